@@ -0,0 +1,141 @@
+package analysis
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/traefik/traefik/v2/pkg/config/dynamic"
+)
+
+const (
+	// FindingConflict means two routers match the same requests with equal priority, traefik picks one at random
+	FindingConflict = "conflict"
+	// FindingShadowed means a router never receives a request because a router with a higher priority matches first
+	FindingShadowed = "shadowed"
+	// FindingInvalid means the rule of a router can not be parsed
+	FindingInvalid = "invalid"
+)
+
+// Finding describes a problem between one or more routers
+type Finding struct {
+	Kind string `json:"kind"`
+	// Routers involved, for shadowed findings the first router shadows the second one
+	Routers     []string `json:"routers"`
+	EntryPoints []string `json:"entryPoints,omitempty"`
+	Priority    int      `json:"priority,omitempty"`
+	Message     string   `json:"message"`
+}
+
+// Involves reports whether the router with the given name is part of the finding
+func (f Finding) Involves(name string) bool {
+	for _, router := range f.Routers {
+		if router == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Conflicts analyzes the routers and reports overlapping, shadowed and invalid routers
+func Conflicts(routers map[string]*dynamic.Router) []Finding {
+	names := make([]string, 0, len(routers))
+	for name := range routers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	findings := make([]Finding, 0)
+	rules := map[string]Rule{}
+	for _, name := range names {
+		rule, err := ParseRule(routers[name].Rule)
+		if err != nil {
+			findings = append(findings, Finding{
+				Kind:    FindingInvalid,
+				Routers: []string{name},
+				Message: err.Error(),
+			})
+			continue
+		}
+		rules[name] = rule
+	}
+
+	for i, a := range names {
+		for _, b := range names[i+1:] {
+			ruleA, okA := rules[a]
+			ruleB, okB := rules[b]
+			if !okA || !okB {
+				continue
+			}
+			// traefik routes tls and plain requests with separate muxers, so only routers of the same kind compete
+			if (routers[a].TLS != nil) != (routers[b].TLS != nil) {
+				continue
+			}
+			entryPoints, ok := sharedEntryPoints(routers[a].EntryPoints, routers[b].EntryPoints)
+			if !ok || !ruleA.Overlaps(ruleB) {
+				continue
+			}
+
+			priorityA, priorityB := Priority(routers[a]), Priority(routers[b])
+			switch {
+			case priorityA == priorityB:
+				findings = append(findings, Finding{
+					Kind:        FindingConflict,
+					Routers:     []string{a, b},
+					EntryPoints: entryPoints,
+					Priority:    priorityA,
+					Message:     fmt.Sprintf("%v and %v match the same requests with priority %v", a, b, priorityA),
+				})
+			case priorityA > priorityB && ruleA.Covers(ruleB):
+				findings = append(findings, shadowed(a, b, entryPoints, priorityA))
+			case priorityB > priorityA && ruleB.Covers(ruleA):
+				findings = append(findings, shadowed(b, a, entryPoints, priorityB))
+			}
+		}
+	}
+
+	return findings
+}
+
+// ConflictsOf returns only the findings involving one of the given routers
+func ConflictsOf(routers map[string]*dynamic.Router, names ...string) []Finding {
+	findings := make([]Finding, 0)
+	for _, finding := range Conflicts(routers) {
+		for _, name := range names {
+			if finding.Involves(name) {
+				findings = append(findings, finding)
+				break
+			}
+		}
+	}
+	return findings
+}
+
+func shadowed(winner, loser string, entryPoints []string, priority int) Finding {
+	return Finding{
+		Kind:        FindingShadowed,
+		Routers:     []string{winner, loser},
+		EntryPoints: entryPoints,
+		Priority:    priority,
+		Message:     fmt.Sprintf("%v shadows %v with priority %v", winner, loser, priority),
+	}
+}
+
+// sharedEntryPoints returns the entrypoints both routers listen on, a router without entrypoints listens on all of them
+// and an empty result together with true means all entrypoints are shared
+func sharedEntryPoints(a, b []string) ([]string, bool) {
+	if len(a) == 0 {
+		return b, true
+	}
+	if len(b) == 0 {
+		return a, true
+	}
+	shared := make([]string, 0)
+	for _, x := range a {
+		for _, y := range b {
+			if x == y {
+				shared = append(shared, x)
+			}
+		}
+	}
+	return shared, len(shared) > 0
+}
@@ -0,0 +1,139 @@
+package analysis
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/traefik/traefik/v2/pkg/config/dynamic"
+)
+
+func TestConflicts(t *testing.T) {
+	tests := []struct {
+		name     string
+		routers  map[string]*dynamic.Router
+		findings []Finding
+	}{
+		{
+			name: "disjoint hosts",
+			routers: map[string]*dynamic.Router{
+				"a": {Rule: "Host(`a.example.com`)"},
+				"b": {Rule: "Host(`b.example.com`)"},
+			},
+			findings: []Finding{},
+		},
+		{
+			name: "priority tie",
+			routers: map[string]*dynamic.Router{
+				"a": {Rule: "Host(`a.example.com`)"},
+				"b": {Rule: "Host(`A.example.com`)"},
+			},
+			findings: []Finding{{Kind: FindingConflict, Routers: []string{"a", "b"}, Priority: 21}},
+		},
+		{
+			name: "explicit priority tie",
+			routers: map[string]*dynamic.Router{
+				"a": {Rule: "Host(`a.example.com`)", Priority: 10},
+				"b": {Rule: "PathPrefix(`/api`)", Priority: 10},
+			},
+			findings: []Finding{{Kind: FindingConflict, Routers: []string{"a", "b"}, Priority: 10}},
+		},
+		{
+			name: "shadowed by a higher priority",
+			routers: map[string]*dynamic.Router{
+				"a": {Rule: "Host(`a.example.com`)", Priority: 100},
+				"b": {Rule: "Host(`a.example.com`) && PathPrefix(`/api`)"},
+			},
+			findings: []Finding{{Kind: FindingShadowed, Routers: []string{"a", "b"}, Priority: 100}},
+		},
+		{
+			name: "longer rule wins",
+			routers: map[string]*dynamic.Router{
+				"a": {Rule: "Host(`a.example.com`)"},
+				"b": {Rule: "Host(`a.example.com`) && PathPrefix(`/api`)"},
+			},
+			findings: []Finding{},
+		},
+		{
+			name: "shadowed by the lower router name",
+			routers: map[string]*dynamic.Router{
+				"a": {Rule: "Host(`a.example.com`) && PathPrefix(`/api`)"},
+				"b": {Rule: "Host(`a.example.com`)", Priority: 100},
+			},
+			findings: []Finding{{Kind: FindingShadowed, Routers: []string{"b", "a"}, Priority: 100}},
+		},
+		{
+			name: "partially overlapping with other priorities",
+			routers: map[string]*dynamic.Router{
+				"a": {Rule: "Host(`a.example.com`)", Priority: 100},
+				"b": {Rule: "Host(`a.example.com`) || Host(`b.example.com`)"},
+			},
+			findings: []Finding{},
+		},
+		{
+			name: "tls and plain routers",
+			routers: map[string]*dynamic.Router{
+				"a": {Rule: "Host(`a.example.com`)"},
+				"b": {Rule: "Host(`a.example.com`)", TLS: &dynamic.RouterTLSConfig{}},
+			},
+			findings: []Finding{},
+		},
+		{
+			name: "other entrypoints",
+			routers: map[string]*dynamic.Router{
+				"a": {Rule: "Host(`a.example.com`)", EntryPoints: []string{"web"}},
+				"b": {Rule: "Host(`a.example.com`)", EntryPoints: []string{"websecure"}},
+			},
+			findings: []Finding{},
+		},
+		{
+			name: "shared entrypoint",
+			routers: map[string]*dynamic.Router{
+				"a": {Rule: "Host(`a.example.com`)", EntryPoints: []string{"web", "internal"}},
+				"b": {Rule: "Host(`a.example.com`)", EntryPoints: []string{"internal"}},
+			},
+			findings: []Finding{{Kind: FindingConflict, Routers: []string{"a", "b"}, EntryPoints: []string{"internal"}, Priority: 21}},
+		},
+		{
+			name: "all entrypoints",
+			routers: map[string]*dynamic.Router{
+				"a": {Rule: "Host(`a.example.com`)"},
+				"b": {Rule: "Host(`a.example.com`)", EntryPoints: []string{"internal"}},
+			},
+			findings: []Finding{{Kind: FindingConflict, Routers: []string{"a", "b"}, EntryPoints: []string{"internal"}, Priority: 21}},
+		},
+		{
+			name: "invalid rule",
+			routers: map[string]*dynamic.Router{
+				"a": {Rule: "Host(`a.example.com`"},
+				"b": {Rule: "Host(`a.example.com`)"},
+			},
+			findings: []Finding{{Kind: FindingInvalid, Routers: []string{"a"}}},
+		},
+	}
+	for _, test := range tests {
+		findings := Conflicts(test.routers)
+		// the messages are for humans, only compare the rest
+		for i := range findings {
+			findings[i].Message = ""
+		}
+		if !reflect.DeepEqual(findings, test.findings) {
+			t.Errorf("%v: Conflicts = %+v, want %+v", test.name, findings, test.findings)
+		}
+	}
+}
+
+func TestConflictsOf(t *testing.T) {
+	routers := map[string]*dynamic.Router{
+		"a": {Rule: "Host(`a.example.com`)"},
+		"b": {Rule: "Host(`a.example.com`)"},
+		"c": {Rule: "Host(`c.example.com`)"},
+		"d": {Rule: "Host(`c.example.com`)"},
+	}
+	findings := ConflictsOf(routers, "b")
+	if len(findings) != 1 || !reflect.DeepEqual(findings[0].Routers, []string{"a", "b"}) {
+		t.Errorf("ConflictsOf(b) = %+v, want the conflict of a and b", findings)
+	}
+	if findings := ConflictsOf(routers, "e"); len(findings) != 0 {
+		t.Errorf("ConflictsOf(e) = %+v, want none", findings)
+	}
+}
@@ -0,0 +1,266 @@
+package analysis
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/traefik/traefik/v2/pkg/config/dynamic"
+	"github.com/vulcand/predicate"
+)
+
+// matchers are the http matchers traefik understands, see traefik/v2/pkg/rules
+var matchers = []string{
+	"Host",
+	"HostHeader",
+	"HostRegexp",
+	"Path",
+	"PathPrefix",
+	"Method",
+	"Headers",
+	"HeadersRegexp",
+	"Query",
+}
+
+// Matcher is a single matcher of a rule, e.g. Host(`a.example.com`, `b.example.com`)
+type Matcher struct {
+	Name   string
+	Values []string
+}
+
+// Clause is a conjunction of matchers, all of them have to match
+type Clause []Matcher
+
+// Rule is a parsed router rule in disjunctive normal form, one of the clauses has to match
+type Rule []Clause
+
+type ruleBuilder func() Rule
+
+// ParseRule parses a traefik router rule and returns it in disjunctive normal form
+func ParseRule(rule string) (Rule, error) {
+	functions := map[string]interface{}{}
+	for _, name := range matchers {
+		name := name
+		fn := func(values ...string) ruleBuilder {
+			return func() Rule {
+				return Rule{Clause{Matcher{Name: name, Values: values}}}
+			}
+		}
+		// traefik accepts the same spellings
+		functions[name] = fn
+		functions[strings.ToLower(name)] = fn
+		functions[strings.ToUpper(name)] = fn
+		functions[strings.Title(strings.ToLower(name))] = fn
+	}
+
+	parser, err := predicate.NewParser(predicate.Def{
+		Operators: predicate.Operators{
+			AND: func(left, right ruleBuilder) ruleBuilder {
+				return func() Rule {
+					// distribute the conjunction over both disjunctions
+					l, r := left(), right()
+					rule := make(Rule, 0, len(l)*len(r))
+					for _, lc := range l {
+						for _, rc := range r {
+							clause := make(Clause, 0, len(lc)+len(rc))
+							clause = append(clause, lc...)
+							rule = append(rule, append(clause, rc...))
+						}
+					}
+					return rule
+				}
+			},
+			OR: func(left, right ruleBuilder) ruleBuilder {
+				return func() Rule {
+					return append(left(), right()...)
+				}
+			},
+		},
+		Functions: functions,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the rule parser: %v", err)
+	}
+
+	parsed, err := parser.Parse(rule)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse rule %v: %v", rule, err)
+	}
+	build, ok := parsed.(ruleBuilder)
+	if !ok {
+		return nil, fmt.Errorf("failed to parse rule %v", rule)
+	}
+
+	return build(), nil
+}
+
+// Priority returns the priority traefik uses for the router, which is the length of the rule if none is set
+func Priority(router *dynamic.Router) int {
+	if router.Priority == 0 {
+		return len(router.Rule)
+	}
+	return router.Priority
+}
+
+// Overlaps reports whether a request exists that could match both rules
+func (r Rule) Overlaps(other Rule) bool {
+	for _, c := range r {
+		for _, o := range other {
+			if c.overlaps(o) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Covers reports whether every request matching other also matches r
+func (r Rule) Covers(other Rule) bool {
+	for _, o := range other {
+		covered := false
+		for _, c := range r {
+			if c.covers(o) {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			return false
+		}
+	}
+	return true
+}
+
+// overlaps is conservative, two clauses are only considered disjoint if they constrain the same property
+// with values that can never match the same request
+func (c Clause) overlaps(other Clause) bool {
+	for _, m := range c {
+		for _, o := range other {
+			if m.disjoint(o) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// covers reports whether every matcher of c is implied by the matchers of other
+func (c Clause) covers(other Clause) bool {
+	for _, m := range c {
+		implied := false
+		for _, o := range other {
+			if o.implies(m) {
+				implied = true
+				break
+			}
+		}
+		if !implied {
+			return false
+		}
+	}
+	return true
+}
+
+func (m Matcher) kind() string {
+	name := strings.ToLower(m.Name)
+	if name == "hostheader" {
+		return "host"
+	}
+	return name
+}
+
+// literal reports whether the values of the matcher can be compared as plain strings
+func (m Matcher) literal() bool {
+	for _, v := range m.Values {
+		if strings.ContainsAny(v, "{}") {
+			return false
+		}
+	}
+	return true
+}
+
+func (m Matcher) normalized() []string {
+	values := make([]string, 0, len(m.Values))
+	for _, v := range m.Values {
+		switch m.kind() {
+		case "host":
+			v = strings.TrimSuffix(strings.ToLower(v), ".")
+		case "method":
+			v = strings.ToUpper(v)
+		}
+		values = append(values, v)
+	}
+	return values
+}
+
+func (m Matcher) disjoint(o Matcher) bool {
+	if !m.literal() || !o.literal() {
+		return false
+	}
+	switch {
+	case m.kind() == o.kind() && (m.kind() == "host" || m.kind() == "method" || m.kind() == "path"):
+		return !intersects(m.normalized(), o.normalized())
+	case m.kind() == "path" && o.kind() == "pathprefix":
+		return !anyHasPrefix(m.Values, o.Values)
+	case m.kind() == "pathprefix" && o.kind() == "path":
+		return !anyHasPrefix(o.Values, m.Values)
+	case m.kind() == "pathprefix" && o.kind() == "pathprefix":
+		return !anyHasPrefix(m.Values, o.Values) && !anyHasPrefix(o.Values, m.Values)
+	}
+	return false
+}
+
+// implies reports whether every request matching m also matches o
+func (m Matcher) implies(o Matcher) bool {
+	if !m.literal() || !o.literal() {
+		return m.kind() == o.kind() && subset(m.Values, o.Values) && subset(o.Values, m.Values)
+	}
+	switch {
+	case m.kind() == o.kind() && m.kind() != "pathprefix":
+		return subset(m.normalized(), o.normalized())
+	case (m.kind() == "path" || m.kind() == "pathprefix") && o.kind() == "pathprefix":
+		return allHavePrefix(m.Values, o.Values)
+	}
+	return false
+}
+
+func intersects(a, b []string) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if x == y {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func subset(a, b []string) bool {
+	for _, x := range a {
+		if !intersects([]string{x}, b) {
+			return false
+		}
+	}
+	return true
+}
+
+// anyHasPrefix reports whether one of the values starts with one of the prefixes
+func anyHasPrefix(values, prefixes []string) bool {
+	for _, v := range values {
+		for _, p := range prefixes {
+			if strings.HasPrefix(v, p) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// allHavePrefix reports whether every value starts with one of the prefixes
+func allHavePrefix(values, prefixes []string) bool {
+	for _, v := range values {
+		if !anyHasPrefix([]string{v}, prefixes) {
+			return false
+		}
+	}
+	return true
+}
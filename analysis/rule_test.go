@@ -0,0 +1,150 @@
+package analysis
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/traefik/traefik/v2/pkg/config/dynamic"
+)
+
+func TestParseRule(t *testing.T) {
+	host := func(values ...string) Matcher { return Matcher{Name: "Host", Values: values} }
+	prefix := func(values ...string) Matcher { return Matcher{Name: "PathPrefix", Values: values} }
+	method := func(values ...string) Matcher { return Matcher{Name: "Method", Values: values} }
+
+	tests := []struct {
+		rule string
+		want Rule
+	}{
+		{rule: "Host(`a.example.com`)", want: Rule{{host("a.example.com")}}},
+		{rule: "Host(`a.example.com`, `b.example.com`)", want: Rule{{host("a.example.com", "b.example.com")}}},
+		{rule: "host(`a.example.com`)", want: Rule{{host("a.example.com")}}},
+		{rule: "Host(`a.example.com`) && PathPrefix(`/api`)", want: Rule{{host("a.example.com"), prefix("/api")}}},
+		{rule: "Host(`a.example.com`) || Host(`b.example.com`)", want: Rule{{host("a.example.com")}, {host("b.example.com")}}},
+		{
+			rule: "Host(`a.example.com`) && (PathPrefix(`/api`) || Method(`POST`))",
+			want: Rule{{host("a.example.com"), prefix("/api")}, {host("a.example.com"), method("POST")}},
+		},
+		{
+			rule: "(Host(`a.example.com`) || Host(`b.example.com`)) && (PathPrefix(`/api`) || Method(`POST`))",
+			want: Rule{
+				{host("a.example.com"), prefix("/api")},
+				{host("a.example.com"), method("POST")},
+				{host("b.example.com"), prefix("/api")},
+				{host("b.example.com"), method("POST")},
+			},
+		},
+		{
+			rule: "Host(`a.example.com`) || PathPrefix(`/api`) && Method(`POST`)",
+			want: Rule{{host("a.example.com")}, {prefix("/api"), method("POST")}},
+		},
+	}
+	for _, test := range tests {
+		rule, err := ParseRule(test.rule)
+		if err != nil {
+			t.Errorf("ParseRule(%v) = %v", test.rule, err)
+			continue
+		}
+		if !reflect.DeepEqual(rule, test.want) {
+			t.Errorf("ParseRule(%v) = %+v, want %+v", test.rule, rule, test.want)
+		}
+	}
+}
+
+func TestParseRuleInvalid(t *testing.T) {
+	rules := []string{
+		"",
+		"Host(`a.example.com`",
+		"Host(`a.example.com`) &&",
+		"Unknown(`a`)",
+		"ClientIP(`10.0.0.0/8`)",
+		// traefik 2.3 has no negation operator, the rules are rejected by traefik as well
+		"!Host(`a.example.com`)",
+		"Host(`a.example.com`) && !PathPrefix(`/api`)",
+	}
+	for _, rule := range rules {
+		if parsed, err := ParseRule(rule); err == nil {
+			t.Errorf("ParseRule(%v) = %+v, want an error", rule, parsed)
+		}
+	}
+}
+
+func TestRuleOverlapsAndCovers(t *testing.T) {
+	tests := []struct {
+		name     string
+		a, b     string
+		overlaps bool
+		// covers reports whether a covers b
+		covers bool
+	}{
+		{name: "same host", a: "Host(`a.example.com`)", b: "Host(`a.example.com`)", overlaps: true, covers: true},
+		{name: "host case and trailing dot", a: "Host(`A.example.com.`)", b: "HOST(`a.example.com`)", overlaps: true, covers: true},
+		{name: "host and host header", a: "HostHeader(`a.example.com`)", b: "Host(`a.example.com`)", overlaps: true, covers: true},
+		{name: "other host", a: "Host(`a.example.com`)", b: "Host(`b.example.com`)"},
+		{name: "host list", a: "Host(`a.example.com`, `b.example.com`)", b: "Host(`b.example.com`)", overlaps: true, covers: true},
+		{name: "host of a list", a: "Host(`b.example.com`)", b: "Host(`a.example.com`, `b.example.com`)", overlaps: true},
+		{name: "host regexp", a: "HostRegexp(`{sub:[a-z]+}.example.com`)", b: "Host(`b.example.com`)", overlaps: true},
+		{name: "host covers path", a: "Host(`a.example.com`)", b: "Host(`a.example.com`) && PathPrefix(`/api`)", overlaps: true, covers: true},
+		{name: "path does not cover host", a: "Host(`a.example.com`) && PathPrefix(`/api`)", b: "Host(`a.example.com`)", overlaps: true},
+		{name: "nested prefixes", a: "PathPrefix(`/api`)", b: "PathPrefix(`/api/v1`)", overlaps: true, covers: true},
+		{name: "disjoint prefixes", a: "PathPrefix(`/api`)", b: "PathPrefix(`/web`)"},
+		{name: "path within prefix", a: "PathPrefix(`/api`)", b: "Path(`/api/users`)", overlaps: true, covers: true},
+		{name: "path outside prefix", a: "PathPrefix(`/api`)", b: "Path(`/web`)"},
+		{name: "paths", a: "Path(`/a`)", b: "Path(`/b`)"},
+		{name: "method case", a: "Method(`post`)", b: "Method(`POST`)", overlaps: true, covers: true},
+		{name: "other method", a: "Method(`GET`)", b: "Method(`POST`)"},
+		{name: "method list", a: "Method(`GET`, `POST`)", b: "Method(`POST`)", overlaps: true, covers: true},
+		{name: "method and host", a: "Method(`GET`)", b: "Host(`a.example.com`)", overlaps: true},
+		{name: "headers are never disjoint", a: "Headers(`X-A`, `1`)", b: "Headers(`X-A`, `2`)", overlaps: true},
+		{name: "or covers each clause", a: "Host(`a.example.com`) || Host(`b.example.com`)", b: "Host(`b.example.com`)", overlaps: true, covers: true},
+		{name: "or is not covered by one clause", a: "Host(`a.example.com`)", b: "Host(`a.example.com`) || Host(`b.example.com`)", overlaps: true},
+		{
+			name:     "nested disjoint",
+			a:        "Host(`a.example.com`) && (PathPrefix(`/api`) || Method(`POST`))",
+			b:        "Host(`b.example.com`) && (PathPrefix(`/api`) || Method(`POST`))",
+			overlaps: false,
+		},
+		{
+			name:     "nested overlapping clause",
+			a:        "Host(`a.example.com`) && (PathPrefix(`/api`) || Method(`POST`))",
+			b:        "(Host(`a.example.com`) && Method(`GET`)) || PathPrefix(`/web`)",
+			overlaps: true,
+		},
+		{
+			name:     "nested covered",
+			a:        "Host(`a.example.com`) || Host(`b.example.com`)",
+			b:        "(Host(`a.example.com`) || Host(`b.example.com`)) && PathPrefix(`/api`)",
+			overlaps: true,
+			covers:   true,
+		},
+	}
+	for _, test := range tests {
+		a, err := ParseRule(test.a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ParseRule(test.b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if overlaps := a.Overlaps(b); overlaps != test.overlaps {
+			t.Errorf("%v: %v overlaps %v = %v, want %v", test.name, test.a, test.b, overlaps, test.overlaps)
+		}
+		if overlaps := b.Overlaps(a); overlaps != test.overlaps {
+			t.Errorf("%v: %v overlaps %v = %v, want %v", test.name, test.b, test.a, overlaps, test.overlaps)
+		}
+		if covers := a.Covers(b); covers != test.covers {
+			t.Errorf("%v: %v covers %v = %v, want %v", test.name, test.a, test.b, covers, test.covers)
+		}
+	}
+}
+
+func TestPriority(t *testing.T) {
+	rule := "Host(`a.example.com`)"
+	if priority := Priority(&dynamic.Router{Rule: rule}); priority != len(rule) {
+		t.Errorf("priority = %v, want the length of the rule %v", priority, len(rule))
+	}
+	if priority := Priority(&dynamic.Router{Rule: rule, Priority: 5}); priority != 5 {
+		t.Errorf("priority = %v, want 5", priority)
+	}
+}
@@ -0,0 +1,162 @@
+package analysis
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+
+	"github.com/traefik/traefik/v2/pkg/config/dynamic"
+	"github.com/traefik/traefik/v2/pkg/middlewares/requestdecorator"
+	"github.com/traefik/traefik/v2/pkg/rules"
+)
+
+// Request is a synthetic request evaluated against the routers
+type Request struct {
+	Method     string              `json:"method"`
+	URL        string              `json:"url"`
+	Headers    map[string][]string `json:"headers,omitempty"`
+	EntryPoint string              `json:"entryPoint,omitempty"`
+	ClientIP   string              `json:"clientIP,omitempty"`
+}
+
+// Match is a router matching the synthetic request
+type Match struct {
+	Router      string   `json:"router"`
+	Rule        string   `json:"rule"`
+	Priority    int      `json:"priority"`
+	Middlewares []string `json:"middlewares"`
+	Service     string   `json:"service"`
+}
+
+// Simulation is the result of a simulated request, Router is nil if no router matches
+type Simulation struct {
+	Router *Match `json:"router"`
+	// Candidates are all matching routers ordered by priority, the first one wins
+	Candidates []Match `json:"candidates"`
+	// Ambiguous is set if more than one router matches with the winning priority
+	Ambiguous bool `json:"ambiguous"`
+}
+
+// Simulate evaluates the request against the routers the same way traefik does
+func Simulate(routers map[string]*dynamic.Router, request Request) (*Simulation, error) {
+	req, err := request.httpRequest()
+	if err != nil {
+		return nil, err
+	}
+
+	candidates := make([]Match, 0)
+	for name, router := range routers {
+		if !listensOn(router, request.EntryPoint) {
+			continue
+		}
+		// traefik only uses routers with a tls section for https requests and vice versa
+		if (router.TLS != nil) != (req.URL.Scheme == "https") {
+			continue
+		}
+
+		ok, err := matches(router, req)
+		if err != nil {
+			return nil, fmt.Errorf("failed to evaluate router %v: %v", name, err)
+		}
+		if !ok {
+			continue
+		}
+
+		middlewares := make([]string, 0, len(router.Middlewares))
+		candidates = append(candidates, Match{
+			Router:      name,
+			Rule:        router.Rule,
+			Priority:    Priority(router),
+			Middlewares: append(middlewares, router.Middlewares...),
+			Service:     router.Service,
+		})
+	}
+
+	// traefik does not define an order for routers with the same priority, sort them by name to be deterministic
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].Priority != candidates[j].Priority {
+			return candidates[i].Priority > candidates[j].Priority
+		}
+		return candidates[i].Router < candidates[j].Router
+	})
+
+	simulation := &Simulation{Candidates: candidates}
+	if len(candidates) > 0 {
+		simulation.Router = &candidates[0]
+		simulation.Ambiguous = len(candidates) > 1 && candidates[1].Priority == candidates[0].Priority
+	}
+
+	return simulation, nil
+}
+
+func (r Request) httpRequest() (*http.Request, error) {
+	u, err := url.Parse(r.URL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse url %v: %v", r.URL, err)
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("url %v has to be absolute", r.URL)
+	}
+	method := r.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+
+	req, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid request: %v", err)
+	}
+	// the address httptest uses, it is replaced by the client ip if one is given
+	req.RemoteAddr = "192.0.2.1:1234"
+	for key, values := range r.Headers {
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
+	if host := req.Header.Get("Host"); host != "" {
+		req.Host = host
+	}
+	if r.ClientIP != "" {
+		if net.ParseIP(r.ClientIP) == nil {
+			return nil, fmt.Errorf("client ip %v is not a valid ip", r.ClientIP)
+		}
+		req.RemoteAddr = net.JoinHostPort(r.ClientIP, "0")
+	}
+
+	return req, nil
+}
+
+func listensOn(router *dynamic.Router, entryPoint string) bool {
+	if entryPoint == "" || len(router.EntryPoints) == 0 {
+		return true
+	}
+	for _, e := range router.EntryPoints {
+		if e == entryPoint {
+			return true
+		}
+	}
+	return false
+}
+
+// matches builds a traefik rules.Router for a single router and checks the request against it
+func matches(router *dynamic.Router, req *http.Request) (bool, error) {
+	muxer, err := rules.NewRouter()
+	if err != nil {
+		return false, err
+	}
+	matched := false
+	err = muxer.AddRoute(router.Rule, Priority(router), http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		matched = true
+	}))
+	if err != nil {
+		return false, err
+	}
+
+	// the request decorator stores the canonical host used by the Host matcher
+	requestdecorator.New(nil).ServeHTTP(httptest.NewRecorder(), req, muxer.ServeHTTP)
+
+	return matched, nil
+}
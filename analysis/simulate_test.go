@@ -0,0 +1,100 @@
+package analysis
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/traefik/traefik/v2/pkg/config/dynamic"
+)
+
+func TestSimulate(t *testing.T) {
+	routers := map[string]*dynamic.Router{
+		"web":    {Rule: "Host(`example.com`)", Service: "web", Middlewares: []string{"auth"}},
+		"api":    {Rule: "Host(`example.com`) && PathPrefix(`/api`)", Service: "api"},
+		"admin":  {Rule: "Host(`example.com`) && PathPrefix(`/admin`)", Service: "admin", EntryPoints: []string{"internal"}},
+		"post":   {Rule: "Host(`example.com`) && Method(`POST`)", Service: "post", Priority: 100},
+		"secure": {Rule: "Host(`example.com`)", Service: "secure", TLS: &dynamic.RouterTLSConfig{}},
+		"a-tie":  {Rule: "Host(`tie.example.com`)", Service: "a"},
+		"b-tie":  {Rule: "Host(`tie.example.com`)", Service: "b"},
+		"header": {Rule: "Host(`example.com`) && Headers(`X-Version`, `2`)", Service: "v2", Priority: 200},
+	}
+
+	tests := []struct {
+		name       string
+		request    Request
+		router     string
+		candidates []string
+		ambiguous  bool
+	}{
+		{name: "host", request: Request{URL: "http://example.com/"}, router: "web", candidates: []string{"web"}},
+		{name: "host with port and case", request: Request{URL: "http://EXAMPLE.com:8080/"}, router: "web", candidates: []string{"web"}},
+		{name: "longer rule wins", request: Request{URL: "http://example.com/api/users"}, router: "api", candidates: []string{"api", "web"}},
+		{name: "explicit priority wins", request: Request{Method: "POST", URL: "http://example.com/api"}, router: "post", candidates: []string{"post", "api", "web"}},
+		{name: "header", request: Request{URL: "http://example.com/", Headers: map[string][]string{"X-Version": {"2"}}}, router: "header", candidates: []string{"header", "web"}},
+		{name: "host header", request: Request{URL: "http://other.example.com/", Headers: map[string][]string{"Host": {"example.com"}}}, router: "web", candidates: []string{"web"}},
+		{name: "other entrypoint", request: Request{URL: "http://example.com/admin", EntryPoint: "web"}, router: "web", candidates: []string{"web"}},
+		{name: "matching entrypoint", request: Request{URL: "http://example.com/admin", EntryPoint: "internal"}, router: "admin", candidates: []string{"admin", "web"}},
+		{name: "any entrypoint", request: Request{URL: "http://example.com/admin"}, router: "admin", candidates: []string{"admin", "web"}},
+		{name: "https", request: Request{URL: "https://example.com/api"}, router: "secure", candidates: []string{"secure"}},
+		{name: "priority tie", request: Request{URL: "http://tie.example.com/"}, router: "a-tie", candidates: []string{"a-tie", "b-tie"}, ambiguous: true},
+		{name: "no match", request: Request{URL: "http://unknown.example.com/"}, candidates: []string{}},
+		{name: "client ip", request: Request{URL: "http://example.com/", ClientIP: "10.1.2.3"}, router: "web", candidates: []string{"web"}},
+	}
+	for _, test := range tests {
+		simulation, err := Simulate(routers, test.request)
+		if err != nil {
+			t.Errorf("%v: Simulate = %v", test.name, err)
+			continue
+		}
+		router := ""
+		if simulation.Router != nil {
+			router = simulation.Router.Router
+		}
+		candidates := make([]string, 0, len(simulation.Candidates))
+		for _, candidate := range simulation.Candidates {
+			candidates = append(candidates, candidate.Router)
+		}
+		if router != test.router || !reflect.DeepEqual(candidates, test.candidates) || simulation.Ambiguous != test.ambiguous {
+			t.Errorf("%v: Simulate = %v %v ambiguous %v, want %v %v ambiguous %v",
+				test.name, router, candidates, simulation.Ambiguous, test.router, test.candidates, test.ambiguous)
+		}
+	}
+
+	simulation, err := Simulate(routers, Request{URL: "http://example.com/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Match{Router: "web", Rule: "Host(`example.com`)", Priority: len("Host(`example.com`)"), Middlewares: []string{"auth"}, Service: "web"}
+	if !reflect.DeepEqual(*simulation.Router, want) {
+		t.Errorf("router = %+v, want %+v", *simulation.Router, want)
+	}
+}
+
+func TestSimulateInvalid(t *testing.T) {
+	routers := map[string]*dynamic.Router{
+		"web": {Rule: "Host(`example.com`)", Service: "web"},
+	}
+	tests := []struct {
+		name    string
+		routers map[string]*dynamic.Router
+		request Request
+	}{
+		{name: "method with a space", request: Request{Method: "G T", URL: "http://example.com/"}},
+		{name: "method with a line break", request: Request{Method: "GET\r\n", URL: "http://example.com/"}},
+		{name: "relative url", request: Request{URL: "/api"}},
+		{name: "url without host", request: Request{URL: "http:///api"}},
+		{name: "malformed url", request: Request{URL: "http://example.com/%zz"}},
+		{name: "invalid client ip", request: Request{URL: "http://example.com/", ClientIP: "10.1.2"}},
+		{name: "invalid rule", routers: map[string]*dynamic.Router{"web": {Rule: "Host(`example.com`"}}, request: Request{URL: "http://example.com/"}},
+		{name: "unknown matcher", routers: map[string]*dynamic.Router{"web": {Rule: "ClientIP(`10.0.0.0/8`)"}}, request: Request{URL: "http://example.com/"}},
+	}
+	for _, test := range tests {
+		if test.routers == nil {
+			test.routers = routers
+		}
+		simulation, err := Simulate(test.routers, test.request)
+		if err == nil {
+			t.Errorf("%v: Simulate = %+v, want an error", test.name, simulation)
+		}
+	}
+}
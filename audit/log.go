@@ -0,0 +1,311 @@
+package audit
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxLineSize is the longest entry Query reads, longer lines are skipped
+const maxLineSize = 4 << 20
+
+// Entry records a single request to the api
+type Entry struct {
+	ID        string    `json:"id"`
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"requestId"`
+	// Actor is the name of the identity, AuthMethod the way it authenticated
+	Actor      string `json:"actor"`
+	AuthMethod string `json:"authMethod,omitempty"`
+	RemoteAddr string `json:"remoteAddr"`
+	Method     string `json:"method"`
+	Path       string `json:"path"`
+	// Operation is read or write
+	Operation string `json:"operation"`
+	Status    int    `json:"status"`
+	Duration  string `json:"duration"`
+	// Body is the request body if it is json and not too long, BodyHash is the sha256 of the whole body
+	Body     json.RawMessage `json:"body,omitempty"`
+	BodyHash string          `json:"bodyHash,omitempty"`
+	Changes  []Change        `json:"changes,omitempty"`
+}
+
+// Change is a resource the request created, updated or deleted, Before and After are the sha256 of the stored
+// resource, they are empty if it did not exist
+type Change struct {
+	Op     string `json:"op"`
+	Kind   string `json:"kind"`
+	Name   string `json:"name"`
+	Before string `json:"before,omitempty"`
+	After  string `json:"after,omitempty"`
+}
+
+// Hash is the sha256 of content, it is empty for empty content
+func Hash(content []byte) string {
+	if len(content) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// Filter selects entries, empty fields match everything
+type Filter struct {
+	Actor     string
+	Operation string
+	Method    string
+	// Kind and Name match entries which changed the resource
+	Kind   string
+	Name   string
+	Status int
+	Since  time.Time
+	Until  time.Time
+	// Limit is the highest number of entries returned, the newest are kept
+	Limit int
+}
+
+// Matches reports whether the entry is selected by the filter
+func (f Filter) Matches(e *Entry) bool {
+	if f.Actor != "" && e.Actor != f.Actor {
+		return false
+	}
+	if f.Operation != "" && e.Operation != f.Operation {
+		return false
+	}
+	if f.Method != "" && e.Method != f.Method {
+		return false
+	}
+	if f.Status != 0 && e.Status != f.Status {
+		return false
+	}
+	if !f.Since.IsZero() && e.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !e.Time.Before(f.Until) {
+		return false
+	}
+	if f.Kind == "" && f.Name == "" {
+		return true
+	}
+	for _, change := range e.Changes {
+		if (f.Kind == "" || change.Kind == f.Kind) && (f.Name == "" || change.Name == f.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Log appends entries as json lines to a file, which is rotated to <path>.1, <path>.2, ... when it
+// exceeds maxSize, only maxFiles rotated files are kept
+type Log struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+
+	mutex sync.Mutex
+	file  *os.File
+	size  int64
+}
+
+func NewLog(path string, maxSize int64, maxFiles int) (*Log, error) {
+	if maxSize <= 0 {
+		return nil, fmt.Errorf("the maximum size of the audit log has to be positive")
+	}
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the directory of the audit log: %v", err)
+	}
+	l := &Log{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	err = l.open()
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *Log) open() error {
+	file, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open the audit log: %v", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to open the audit log: %v", err)
+	}
+	l.file = file
+	l.size = info.Size()
+	return nil
+}
+
+// Write appends the entry, the file is synced so entries survive a crash
+func (l *Log) Write(entry *Entry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to encode the audit entry: %v", err)
+	}
+	line = append(line, '\n')
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.size > 0 && l.size+int64(len(line)) > l.maxSize {
+		err = l.rotate()
+		if err != nil {
+			return err
+		}
+	}
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("failed to write the audit entry: %v", err)
+	}
+	return l.file.Sync()
+}
+
+// rotate shifts the rotated files by one, the oldest is removed
+func (l *Log) rotate() error {
+	err := l.file.Close()
+	if err != nil {
+		return fmt.Errorf("failed to close the audit log: %v", err)
+	}
+	if l.maxFiles < 1 {
+		err = os.Remove(l.path)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to rotate the audit log: %v", err)
+		}
+		return l.open()
+	}
+	err = os.Remove(l.rotated(l.maxFiles))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to rotate the audit log: %v", err)
+	}
+	for i := l.maxFiles - 1; i >= 1; i-- {
+		err = os.Rename(l.rotated(i), l.rotated(i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to rotate the audit log: %v", err)
+		}
+	}
+	err = os.Rename(l.path, l.rotated(1))
+	if err != nil {
+		return fmt.Errorf("failed to rotate the audit log: %v", err)
+	}
+	return l.open()
+}
+
+func (l *Log) rotated(i int) string {
+	return fmt.Sprintf("%v.%d", l.path, i)
+}
+
+// Query returns the entries matching the filter from the current and the rotated files, oldest first. The files
+// are opened while the log is locked and read without blocking writes, a rotation does not affect open files.
+// The files are read newest first and older ones are not read once Limit entries matched.
+func (l *Log) Query(filter Filter) ([]*Entry, error) {
+	segments, err := l.snapshot()
+	if err != nil {
+		return nil, err
+	}
+	defer closeSegments(segments)
+
+	entries := make([]*Entry, 0)
+	for i := len(segments) - 1; i >= 0; i-- {
+		matching, err := read(segments[i], filter)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(matching, entries...)
+		if filter.Limit > 0 && len(entries) >= filter.Limit {
+			break
+		}
+	}
+	// the newest are the last written, the clock may have been adjusted between writes
+	if filter.Limit > 0 && len(entries) > filter.Limit {
+		entries = entries[len(entries)-filter.Limit:]
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Time.Before(entries[j].Time)
+	})
+	return entries, nil
+}
+
+// segment is an open file of the log, only its first size bytes are read so entries written after the
+// snapshot are left out
+type segment struct {
+	path string
+	file *os.File
+	size int64
+}
+
+// snapshot opens the rotated files and the current one, oldest first
+func (l *Log) snapshot() ([]segment, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	segments := make([]segment, 0, l.maxFiles+1)
+	for i := l.maxFiles; i >= 0; i-- {
+		path := l.path
+		if i > 0 {
+			path = l.rotated(i)
+		}
+		file, err := os.Open(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			closeSegments(segments)
+			return nil, fmt.Errorf("failed to read the audit log: %v", err)
+		}
+		// the rotated files are no longer written to
+		size := l.size
+		if i > 0 {
+			info, err := file.Stat()
+			if err != nil {
+				file.Close()
+				closeSegments(segments)
+				return nil, fmt.Errorf("failed to read the audit log: %v", err)
+			}
+			size = info.Size()
+		}
+		segments = append(segments, segment{path: path, file: file, size: size})
+	}
+	return segments, nil
+}
+
+func closeSegments(segments []segment) {
+	for _, s := range segments {
+		s.file.Close()
+	}
+}
+
+func read(s segment, filter Filter) ([]*Entry, error) {
+	entries := make([]*Entry, 0)
+	scanner := bufio.NewScanner(io.LimitReader(s.file, s.size))
+	scanner.Buffer(make([]byte, 64*1024), maxLineSize)
+	for scanner.Scan() {
+		entry := &Entry{}
+		// a line cut off by a crash is skipped
+		if json.Unmarshal(scanner.Bytes(), entry) != nil {
+			continue
+		}
+		if !filter.Matches(entry) {
+			continue
+		}
+		entries = append(entries, entry)
+		// only the last Limit entries are kept, older ones are dropped in batches
+		if filter.Limit > 0 && len(entries) >= 2*filter.Limit {
+			entries = append(entries[:0], entries[len(entries)-filter.Limit:]...)
+		}
+	}
+	err := scanner.Err()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the audit log %v: %v", s.path, err)
+	}
+	return entries, nil
+}
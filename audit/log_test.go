@@ -0,0 +1,71 @@
+package audit
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestQuery(t *testing.T) {
+	// every entry is rotated into its own file
+	log, err := NewLog(filepath.Join(t.TempDir(), "audit.jsonl"), 1, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 10; i++ {
+		actor := "alice"
+		if i%2 == 1 {
+			actor = "bob"
+		}
+		err = log.Write(&Entry{ID: fmt.Sprint(i), Time: start.Add(time.Duration(i) * time.Minute), Actor: actor})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		filter Filter
+		ids    []string
+	}{
+		{name: "all", filter: Filter{}, ids: []string{"0", "1", "2", "3", "4", "5", "6", "7", "8", "9"}},
+		{name: "newest", filter: Filter{Limit: 3}, ids: []string{"7", "8", "9"}},
+		{name: "newest matching", filter: Filter{Actor: "alice", Limit: 2}, ids: []string{"6", "8"}},
+		{name: "fewer than the limit", filter: Filter{Actor: "bob", Until: start.Add(4 * time.Minute), Limit: 5}, ids: []string{"1", "3"}},
+	}
+	for _, test := range tests {
+		entries, err := log.Query(test.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := make([]string, len(entries))
+		for i, entry := range entries {
+			ids[i] = entry.ID
+		}
+		if fmt.Sprint(ids) != fmt.Sprint(test.ids) {
+			t.Errorf("%v: Query = %v, want %v", test.name, ids, test.ids)
+		}
+	}
+}
+
+func TestQueryLimitWithinFile(t *testing.T) {
+	log, err := NewLog(filepath.Join(t.TempDir(), "audit.jsonl"), 1<<20, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 25; i++ {
+		err = log.Write(&Entry{ID: fmt.Sprint(i), Time: time.Unix(int64(i), 0)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, err := log.Query(Filter{Limit: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 4 || entries[0].ID != "21" || entries[3].ID != "24" {
+		t.Errorf("Query = %v entries starting with %v, want 21 to 24", len(entries), entries[0].ID)
+	}
+}
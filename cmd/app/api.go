@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"kommandeur/rbac"
+	"kommandeur/store"
+)
+
+// heartbeatInterval keeps idle event streams from being closed by proxies
+const heartbeatInterval = 15 * time.Second
+
+// parseWait reads the long-poll timeout from the wait query parameter, either as a duration like 30s
+// or as a number of seconds
+func parseWait(value string, max time.Duration) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	wait, err := time.ParseDuration(value)
+	if err != nil {
+		seconds, convErr := strconv.Atoi(value)
+		if convErr != nil {
+			return 0, fmt.Errorf("invalid wait %v: %v", value, err)
+		}
+		wait = time.Duration(seconds) * time.Second
+	}
+	if wait < 0 {
+		return 0, fmt.Errorf("wait has to be positive")
+	}
+	if wait > max {
+		wait = max
+	}
+	return wait, nil
+}
+
+// apiHandler serves the configuration to traefik's http provider. Pollers which send the ETag of their last
+// response in If-None-Match together with a wait parameter are held until the configuration changes or the
+// wait is over, then they get the new configuration or a 304.
+func apiHandler(configCache *store.ConfigCache, maxWait time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		v := r.URL.Query()
+		contentType := v.Get("type")
+		if contentType == "" {
+			contentType = "json"
+		}
+		wait, err := parseWait(v.Get("wait"), maxWait)
+		if err != nil {
+			writeProblem(w, r, http.StatusBadRequest, err)
+			return
+		}
+		deadline := time.After(wait)
+
+		for {
+			// the channel is taken before the snapshot, so a change in between ends the wait right away
+			changed := configCache.Changed()
+			ctx, cancel := context.WithTimeout(r.Context(), time.Second*10)
+			snapshot, err := configCache.Get(ctx)
+			cancel()
+			if err != nil {
+				fmt.Printf("failed to get the configuration: %v", err)
+				writeStoreProblem(w, r, err)
+				return
+			}
+
+			rendered := snapshot.JSON
+			if contentType == "toml" {
+				rendered = snapshot.TOML
+			}
+			status := checkPreconditions(r, rendered.Version, etag(rendered.Version), true)
+			if status == http.StatusNotModified && wait > 0 {
+				select {
+				case <-changed:
+					continue
+				case <-deadline:
+				case <-r.Context().Done():
+					return
+				}
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			if contentType == "toml" {
+				w.Header().Set("Content-Type", "application/toml")
+			}
+			// pollers send the ETag of their last response and get a 304 as long as nothing changed
+			w.Header().Set("ETag", etag(rendered.Version))
+			for _, unresolved := range snapshot.Unresolved {
+				w.Header().Add("Warning", fmt.Sprintf("299 kommandeur %q", fmt.Sprintf("the %v %v is left out: %v", unresolved.Kind, unresolved.Name, unresolved.Error)))
+			}
+			if status != 0 {
+				writePreconditionProblem(w, r, status)
+				return
+			}
+			w.Write(rendered.Body)
+			return
+		}
+	}
+}
+
+// eventsHandler streams the changes of the resources the client may get as server-sent events. With ?reveal=true
+// the sensitive values of the middlewares the client may reveal are decrypted with the encrypted store, if it is
+// set, the values of the others are redacted.
+func eventsHandler(routers store.HTTPRouterStore, services store.HTTPServiceStore, middlewares store.HTTPMiddlewareStore, encrypted *store.HTTPMiddlewareStoreEncrypted, a *access) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			writeProblem(w, r, http.StatusInternalServerError, fmt.Errorf("streaming is not supported"))
+			return
+		}
+		reveal, ok := revealRequested(w, r, store.KindMiddleware)
+		if !ok {
+			return
+		}
+
+		id := identityFrom(r.Context())
+
+		// subscribers are called within the writes, so they must never block, a client which does not keep up
+		// is disconnected and has to reconnect
+		events := make(chan store.Event, 64)
+		overflow := make(chan struct{})
+		once := sync.Once{}
+		subscriber := func(event store.Event) {
+			select {
+			case events <- event:
+			default:
+				once.Do(func() {
+					close(overflow)
+				})
+			}
+		}
+		for _, subscribe := range []func(func(store.Event)) func(){routers.Subscribe, services.Subscribe, middlewares.Subscribe} {
+			defer subscribe(subscriber)()
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		heartbeat := time.NewTicker(heartbeatInterval)
+		defer heartbeat.Stop()
+		for {
+			select {
+			case event := <-events:
+				// deleted resources have lost their labels, they are only sent to identities allowed by name
+				allowed, err := a.allowed(r.Context(), id, rbac.VerbGet, event.Kind, event.Name, nil)
+				if err != nil {
+					fmt.Printf("failed to check access: %v", err)
+					continue
+				}
+				if !allowed {
+					continue
+				}
+				if event.Kind == store.KindMiddleware {
+					// the reveal verb is checked for every middleware, so a rule limited by name only reveals those
+					revealable := false
+					if reveal {
+						revealable, err = a.allowed(r.Context(), id, rbac.VerbReveal, event.Kind, event.Name, nil)
+						if err != nil {
+							fmt.Printf("failed to check access: %v", err)
+							continue
+						}
+					}
+					if revealable {
+						event, err = revealEvent(event, encrypted)
+						if err != nil {
+							fmt.Printf("failed to reveal the event: %v", err)
+							continue
+						}
+					} else {
+						event = redactEvent(event)
+					}
+				}
+				data, err := json.Marshal(event)
+				if err != nil {
+					fmt.Printf("failed to encode the event: %v", err)
+					continue
+				}
+				fmt.Fprintf(w, "event: %v\ndata: %s\n\n", event.Op, data)
+			case <-heartbeat.C:
+				fmt.Fprint(w, ": heartbeat\n\n")
+			case <-overflow:
+				return
+			case <-r.Context().Done():
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/traefik/traefik/v2/pkg/config/dynamic"
+	"kommandeur/store"
+)
+
+// newAPIServer serves the configuration of the stores of a resource server at /api
+func newAPIServer(t *testing.T, maxWait time.Duration) *resourceServer {
+	s := newResourceServer(t)
+	configCache := store.NewConfigCache(s.stores.Routers, s.stores.Services, s.stores.Middlewares, nil, 0)
+	s.router.Handle("/api", apiHandler(configCache, maxWait)).Methods(http.MethodGet, http.MethodHead)
+	return s
+}
+
+func TestAPIHandler(t *testing.T) {
+	s := newAPIServer(t, time.Second)
+	resp, _ := s.do(t, http.MethodPut, "/v1/http/router/web", `{"rule":"Host(`+"`example.com`"+`)","service":"web"}`)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("create = %v, want 201", resp.StatusCode)
+	}
+
+	resp, body := s.do(t, http.MethodGet, "/api", "")
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, "example.com") {
+		t.Fatalf("api = %v %v, want the configuration", resp.StatusCode, body)
+	}
+	tag := resp.Header.Get("ETag")
+	if tag == "" || resp.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("ETag = %q, Content-Type = %q", tag, resp.Header.Get("Content-Type"))
+	}
+
+	resp, body = s.do(t, http.MethodGet, "/api", "", "If-None-Match", tag)
+	if resp.StatusCode != http.StatusNotModified || body != "" {
+		t.Errorf("unchanged api = %v %v, want 304", resp.StatusCode, body)
+	}
+	if resp.Header.Get("ETag") != tag {
+		t.Errorf("ETag of the 304 = %v, want %v", resp.Header.Get("ETag"), tag)
+	}
+
+	// every serialization has its own tag
+	resp, body = s.do(t, http.MethodGet, "/api?type=toml", "", "If-None-Match", tag)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/toml" {
+		t.Errorf("toml with the json tag = %v %v, want 200", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	if resp.Header.Get("ETag") == tag || !strings.Contains(body, "[http.routers.web]") {
+		t.Errorf("toml = %v %v, want its own tag", resp.Header.Get("ETag"), body)
+	}
+
+	resp, _ = s.do(t, http.MethodPut, "/v1/http/router/web", `{"rule":"Host(`+"`example.org`"+`)","service":"web"}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("replace = %v, want 200", resp.StatusCode)
+	}
+	resp, body = s.do(t, http.MethodGet, "/api", "", "If-None-Match", tag)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, "example.org") {
+		t.Errorf("changed api = %v %v, want the new configuration", resp.StatusCode, body)
+	}
+	if resp.Header.Get("ETag") == tag {
+		t.Error("the ETag did not change with the configuration")
+	}
+}
+
+func TestAPIHandlerLongPoll(t *testing.T) {
+	s := newAPIServer(t, 500*time.Millisecond)
+	router := `{"rule":"Host(` + "`example.com`" + `)","service":"web"}`
+	resp, _ := s.do(t, http.MethodPut, "/v1/http/router/web", router)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("create = %v, want 201", resp.StatusCode)
+	}
+	resp, _ = s.do(t, http.MethodGet, "/api", "")
+	tag := resp.Header.Get("ETag")
+
+	start := time.Now()
+	resp, _ = s.do(t, http.MethodGet, "/api?wait=100ms", "", "If-None-Match", tag)
+	if elapsed := time.Since(start); resp.StatusCode != http.StatusNotModified || elapsed < 100*time.Millisecond {
+		t.Errorf("unchanged poll = %v after %v, want 304 after the wait", resp.StatusCode, elapsed)
+	}
+
+	// the wait is capped at the maximum
+	start = time.Now()
+	resp, _ = s.do(t, http.MethodGet, "/api?wait=3600", "", "If-None-Match", tag)
+	if elapsed := time.Since(start); resp.StatusCode != http.StatusNotModified || elapsed > 5*time.Second {
+		t.Errorf("poll longer than the maximum = %v after %v, want 304 after 500ms", resp.StatusCode, elapsed)
+	}
+
+	// without a matching tag there is nothing to wait for
+	start = time.Now()
+	resp, _ = s.do(t, http.MethodGet, "/api?wait=10s", "", "If-None-Match", `"other"`)
+	if elapsed := time.Since(start); resp.StatusCode != http.StatusOK || elapsed > 400*time.Millisecond {
+		t.Errorf("poll with an old tag = %v after %v, want 200 right away", resp.StatusCode, elapsed)
+	}
+
+	for _, wait := range []string{"soon", "-1s"} {
+		resp, _ = s.do(t, http.MethodGet, "/api?wait="+wait, "")
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("wait=%v = %v, want 400", wait, resp.StatusCode)
+		}
+	}
+}
+
+func TestAPIHandlerLongPollChange(t *testing.T) {
+	s := newAPIServer(t, time.Minute)
+	resp, _ := s.do(t, http.MethodGet, "/api", "")
+	tag := resp.Header.Get("ETag")
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		s.stores.Routers.Set(context.Background(), "web", &dynamic.Router{Rule: "Host(`example.com`)", Service: "web"})
+	}()
+	start := time.Now()
+	resp, body := s.do(t, http.MethodGet, "/api?wait=30s", "", "If-None-Match", tag)
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("the poll was answered after %v, want right after the change", elapsed)
+	}
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, "example.com") || resp.Header.Get("ETag") == tag {
+		t.Errorf("poll = %v %v, want the changed configuration", resp.StatusCode, body)
+	}
+}
+
+func TestEventsHandler(t *testing.T) {
+	s := newResourceServer(t)
+	s.router.HandleFunc("/v1/events", eventsHandler(s.stores.Routers, s.stores.Services, s.stores.Middlewares, nil, &access{stores: s.stores})).Methods(http.MethodGet)
+
+	resp, _ := s.do(t, http.MethodGet, "/v1/events?reveal=maybe", "")
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("invalid reveal = %v, want 400", resp.StatusCode)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.URL+"/v1/events", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = s.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("events = %v %v, want a stream", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	// the headers are flushed after subscribing, so the writes are not missed
+	router := `{"rule":"Host(` + "`example.com`" + `)","service":"web"}`
+	s.do(t, http.MethodPut, "/v1/http/router/web", router)
+	s.do(t, http.MethodPut, "/v1/http/middleware/auth", `{"basicAuth":{"users":["admin:$apr1$hash"]}}`)
+	s.do(t, http.MethodDelete, "/v1/http/router/web", "")
+
+	reader := bufio.NewReader(resp.Body)
+	for _, want := range []struct{ op, kind, name string }{
+		{op: store.OperationCreate, kind: store.KindRouter, name: "web"},
+		{op: store.OperationCreate, kind: store.KindMiddleware, name: "auth"},
+		{op: store.OperationDelete, kind: store.KindRouter, name: "web"},
+	} {
+		eventLine, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		dataLine, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader.ReadString('\n')
+
+		if eventLine != "event: "+want.op+"\n" || !strings.HasPrefix(dataLine, "data: ") {
+			t.Fatalf("event = %q %q, want a %v event", eventLine, dataLine, want.op)
+		}
+		event := store.Event{}
+		err = json.Unmarshal([]byte(strings.TrimPrefix(dataLine, "data: ")), &event)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if event.Op != want.op || event.Kind != want.kind || event.Name != want.name {
+			t.Errorf("event = %v %v %v, want %v %v %v", event.Op, event.Kind, event.Name, want.op, want.kind, want.name)
+		}
+		if event.Kind == store.KindMiddleware && (strings.Contains(string(event.After), "$apr1$") || !strings.Contains(string(event.After), store.Redacted)) {
+			t.Errorf("the middleware is not redacted: %s", event.After)
+		}
+		if event.Op == store.OperationDelete && (event.Version != "" || len(event.Before) == 0) {
+			t.Errorf("deletion = %+v, want the router before and no version", event)
+		}
+	}
+}
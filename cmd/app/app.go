@@ -2,17 +2,56 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"github.com/BurntSushi/toml"
 	"github.com/gorilla/mux"
 	"github.com/traefik/traefik/v2/pkg/config/dynamic"
+	"gopkg.in/yaml.v2"
+	"kommandeur/analysis"
+	"kommandeur/audit"
+	"kommandeur/oidc"
+	"kommandeur/rbac"
 	"kommandeur/store"
+	"kommandeur/webhook"
 	"net/http"
 	"time"
 )
 
 func main() {
+	idempotencyTTL := flag.Duration("idempotency-ttl", 24 * time.Hour, "how long responses to requests with an Idempotency-Key are kept")
+	webhookAttempts := flag.Int("webhook-attempts", 8, "how often a webhook delivery is attempted")
+	webhookBackoff := flag.Duration("webhook-backoff", 5 * time.Second, "the wait after the first failed webhook delivery, it doubles with every attempt")
+	webhookAllowedNetworks := flag.String("webhook-allowed-networks", "", "comma separated networks webhooks may be delivered to although they are loopback, link-local or private, e.g. 10.1.0.0/16")
+	maxWait := flag.Duration("max-wait", time.Minute, "the longest time a long-polling request to /api is held")
+	htpasswd := flag.String("htpasswd", "", "the htpasswd file with the users of the management api, authentication is disabled without it")
+	rbacPolicy := flag.String("rbac", "", "the yaml or json file with the roles and bindings of the management api users and tokens")
+	apiHtpasswd := flag.String("api-htpasswd", "", "the htpasswd file with the users which may only read the configuration from /api")
+	oidcIssuer := flag.String("oidc-issuer", "", "the issuer of the JWTs accepted as bearer tokens, JWT authentication is disabled without it")
+	oidcAudience := flag.String("oidc-audience", "", "the audience the JWTs have to be issued for, it is required with -oidc-issuer")
+	oidcJWKS := flag.String("oidc-jwks-url", "", "the url of the key set of the issuer, it is discovered through the issuer by default")
+	oidcUsernameClaim := flag.String("oidc-username-claim", "sub", "the claim the JWT users are named by")
+	oidcGroupsClaim := flag.String("oidc-groups-claim", "groups", "the claim with the groups the rbac policy binds as group:<name>")
+	oidcCacheTTL := flag.Duration("oidc-jwks-cache", time.Hour, "how long the key set of the issuer is cached, unknown keys fetch it earlier")
+	listen := flag.String("listen", ":8080", "the address the api is served on")
+	tlsCert := flag.String("tls-cert", "", "the certificate the api is served with, it is served over plain http without it")
+	tlsKey := flag.String("tls-key", "", "the private key of the certificate")
+	tlsClientCA := flag.String("tls-client-ca", "", "the CA bundle client certificates are verified with, clients with a verified certificate are authenticated by it")
+	tlsRequireClientCert := flag.Bool("tls-require-client-cert", false, "reject connections without a verified client certificate")
+	tlsClientIdentity := flag.String("tls-client-identity", certificateSubject, "name clients by the common name of the certificate subject or by its first san")
+	auditPath := flag.String("audit-log", "", "the jsonl file authenticated requests are recorded in, the audit log is disabled without it")
+	auditReads := flag.Bool("audit-reads", false, "record reads in the audit log as well as writes")
+	auditMaxSize := flag.Int64("audit-max-size", 100, "the size in megabytes at which the audit log is rotated")
+	auditMaxFiles := flag.Int("audit-max-files", 10, "how many rotated audit logs are kept")
+	encryptionKeys := flag.String("encryption-keys", "", "the file with the master keys sensitive middleware fields are encrypted with, one <id> <base64 key> per line, the first is used for new values")
+	secretDir := flag.String("secret-dir", "/run/secrets", "the directory ${secret:file:<path>} references have to point into")
+	secretEnvPrefix := flag.String("secret-env-prefix", "", "the prefix of the environment variables ${env:<name>} references may read, none of them may be read without it")
+	secretRefresh := flag.Duration("secret-refresh", time.Minute, "how long resolved secrets are served from /api before they are read again")
+	flag.Parse()
+
 	// httpRouterStore, err := store.NewJsonStore(store.ModeJson)
 	var httpRouterStore store.HTTPRouterStore
 	var err error
@@ -36,107 +75,368 @@ func main() {
 		fmt.Printf("failed to create a new httpmiddlewarestore: %v", err)
 		return
 	}
+	var encryptedMiddlewareStore *store.HTTPMiddlewareStoreEncrypted
+	var keyring *store.Keyring
+	if *encryptionKeys != "" {
+		keyring, err = store.LoadKeyring(*encryptionKeys)
+		if err != nil {
+			fmt.Printf("failed to load the encryption keys: %v", err)
+			return
+		}
+		encryptedMiddlewareStore = store.NewHTTPMiddlewareStoreEncrypted(httpMiddlewareStore, keyring)
+		httpMiddlewareStore = encryptedMiddlewareStore
+	}
+	// middlewares read from the management api have their sensitive values redacted, writing them back keeps
+	// the stored values
+	httpMiddlewareStore = store.NewHTTPMiddlewareStoreRedacted(httpMiddlewareStore)
+
+	var labelStore store.LabelStore
+	labelStore, err = store.NewLabelStoreJSON("labels")
+	if err != nil {
+		fmt.Printf("failed to create a new labelstore: %v", err)
+		return
+	}
+
+	var idempotencyStore store.IdempotencyStore
+	idempotencyStore, err = store.NewIdempotencyStoreJSON("idempotency")
+	if err != nil {
+		fmt.Printf("failed to create a new idempotencystore: %v", err)
+		return
+	}
+	go func() {
+		for range time.Tick(time.Hour) {
+			err := idempotencyStore.DeleteExpired(context.Background())
+			if err != nil {
+				fmt.Printf("failed to delete expired idempotency records: %v", err)
+			}
+		}
+	}()
+
+	stores := &store.Stores{
+		Routers:     httpRouterStore,
+		Services:    httpServiceStore,
+		Middlewares: httpMiddlewareStore,
+		Labels:      labelStore,
+		Journal:     store.NewJournal("transaction.journal", keyring),
+	}
+
+	// a transaction interrupted by a crash is rolled back before anything reads the stores
+	recovered, err := stores.Recover(context.Background())
+	if err != nil {
+		fmt.Printf("failed to roll back the interrupted transaction: %v", err)
+		return
+	}
+	if recovered {
+		fmt.Printf("rolled back an interrupted transaction\n")
+	}
+
+	// files which can not be decoded or have invalid names, e.g. after a crash or a manual edit, are quarantined
+	// before serving them
+	checks := map[string]func(ctx context.Context) ([]store.QuarantinedFile, error){
+		"routers":     httpRouterStore.Check,
+		"services":    httpServiceStore.Check,
+		"middlewares": httpMiddlewareStore.Check,
+	}
+	for kind, check := range checks {
+		quarantined, err := check(context.Background())
+		if err != nil {
+			fmt.Printf("failed to check the %v: %v", kind, err)
+			return
+		}
+		if len(quarantined) > 0 {
+			fmt.Printf("quarantined %v invalid %v\n", len(quarantined), kind)
+		}
+	}
+
+	// values written before encryption was enabled or with a key which is not the primary one anymore are
+	// encrypted with the primary key
+	if encryptedMiddlewareStore != nil {
+		rotated, err := encryptedMiddlewareStore.Rotate(context.Background())
+		if err != nil {
+			fmt.Printf("failed to encrypt the middlewares: %v", err)
+			return
+		}
+		if len(rotated) > 0 {
+			fmt.Printf("encrypted %v middlewares with the primary key\n", len(rotated))
+		}
+	}
+
+	// files changed by hand or by other processes emit the same events as writes through the api
+	watched := map[string]interface{}{
+		"routers":     httpRouterStore,
+		"services":    httpServiceStore,
+		"middlewares": httpMiddlewareStore,
+	}
+	for kind, s := range watched {
+		watcher, ok := s.(store.Watcher)
+		if !ok {
+			continue
+		}
+		go func(kind string) {
+			err := watcher.Watch(context.Background())
+			if err != nil {
+				fmt.Printf("failed to watch the %v: %v", kind, err)
+			}
+		}(kind)
+	}
+	var webhookStore store.WebhookStore
+	webhookStore, err = store.NewWebhookStoreJSON("webhooks")
+	if err != nil {
+		fmt.Printf("failed to create a new webhookstore: %v", err)
+		return
+	}
+	allowedNetworks, err := parseNetworks(*webhookAllowedNetworks)
+	if err != nil {
+		fmt.Printf("failed to parse the allowed webhook networks: %v", err)
+		return
+	}
+	dispatcher := webhook.NewDispatcher(webhookStore, *webhookAttempts, *webhookBackoff, allowedNetworks)
+
+	logEvent := func(event store.Event) {
+		fmt.Printf("%v %v %v\n", event.Op, event.Kind, event.Name)
+	}
+	httpRouterStore.Subscribe(logEvent)
+	httpServiceStore.Subscribe(logEvent)
+	httpMiddlewareStore.Subscribe(logEvent)
+
+	var tokenStore store.TokenStore
+	tokenStore, err = store.NewTokenStoreJSON("tokens")
+	if err != nil {
+		fmt.Printf("failed to create a new tokenstore: %v", err)
+		return
+	}
+
+	// /api serves the configuration with the secrets resolved, only the /api users and tokens with the config:read
+	// scope may read it, the users of the management api get redacted values from the management api. The /api
+	// users may not use the management api.
+	v1Auth := make([]authenticator, 0)
+	apiAuth := make([]authenticator, 0)
+	if *htpasswd != "" {
+		users, err := htpasswdAuthenticator(*htpasswd, scopeAll)
+		if err != nil {
+			fmt.Printf("failed to set up authentication: %v", err)
+			return
+		}
+		v1Auth = append(v1Auth, users)
+	}
+	if *apiHtpasswd != "" {
+		readers, err := htpasswdAuthenticator(*apiHtpasswd, "config:read")
+		if err != nil {
+			fmt.Printf("failed to set up authentication: %v", err)
+			return
+		}
+		apiAuth = append(apiAuth, readers)
+	}
+	if *oidcIssuer != "" {
+		verifier, err := oidc.NewVerifier(oidc.Config{
+			Issuer:        *oidcIssuer,
+			Audience:      *oidcAudience,
+			JWKSURL:       *oidcJWKS,
+			UsernameClaim: *oidcUsernameClaim,
+			GroupsClaim:   *oidcGroupsClaim,
+			CacheTTL:      *oidcCacheTTL,
+		})
+		if err != nil {
+			fmt.Printf("failed to set up authentication: %v", err)
+			return
+		}
+		// what JWT users may do is limited by the rbac policy
+		users := oidcAuthenticator(verifier, scopeAll)
+		v1Auth = append(v1Auth, users)
+	}
+	var tlsConf *tls.Config
+	if *tlsCert != "" || *tlsKey != "" {
+		tlsConf, err = tlsConfig(*tlsCert, *tlsKey, *tlsClientCA, *tlsRequireClientCert)
+		if err != nil {
+			fmt.Printf("failed to set up tls: %v", err)
+			return
+		}
+	} else if *tlsClientCA != "" {
+		fmt.Printf("client certificates can only be verified if tls is configured")
+		return
+	}
+	if *tlsClientCA != "" {
+		// what certificate users may do is limited by the rbac policy
+		clients, err := certificateAuthenticator(*tlsClientIdentity, scopeAll)
+		if err != nil {
+			fmt.Printf("failed to set up authentication: %v", err)
+			return
+		}
+		v1Auth = append(v1Auth, clients)
+	}
+	if len(v1Auth) == 0 {
+		fmt.Printf("no htpasswd file, oidc issuer or client CA is configured, the management api is not protected\n")
+	} else {
+		// tokens can only be issued by authenticated users
+		v1Auth = append(v1Auth, tokenAuthenticator(tokenStore))
+		apiAuth = append(apiAuth, tokenAuthenticator(tokenStore))
+	}
+
+	// identity provider and certificate users get every scope, what they may do is only limited by the policy
+	if (*oidcIssuer != "" || *tlsClientCA != "") && *rbacPolicy == "" {
+		fmt.Printf("-oidc-issuer and -tls-client-ca require an rbac policy, see -rbac")
+		return
+	}
+	accessControl := &access{stores: stores}
+	if *rbacPolicy != "" {
+		accessControl.policy, err = rbac.Load(*rbacPolicy)
+		if err != nil {
+			fmt.Printf("failed to load the rbac policy: %v", err)
+			return
+		}
+	}
+
+	// webhooks only receive the events of the resources their creator may get, the dispatcher is subscribed once
+	// it can decide that
+	dispatcher.Visible = accessControl.webhookVisible
+	httpRouterStore.Subscribe(dispatcher.Notify)
+	httpServiceStore.Subscribe(dispatcher.Notify)
+	httpMiddlewareStore.Subscribe(dispatcher.Notify)
+
+	var auditLog *audit.Log
+	if *auditPath != "" {
+		auditLog, err = audit.NewLog(*auditPath, *auditMaxSize<<20, *auditMaxFiles)
+		if err != nil {
+			fmt.Printf("failed to open the audit log: %v", err)
+			return
+		}
+	}
+
+	// references to secrets are stored verbatim and only resolved for /api
+	secretResolver := &store.SecretResolver{Dir: *secretDir, EnvPrefix: *secretEnvPrefix}
+	configCache := store.NewConfigCache(httpRouterStore, httpServiceStore, httpMiddlewareStore, secretResolver, *secretRefresh)
 
 	r := mux.NewRouter()
-	r.HandleFunc("/api", func(w http.ResponseWriter, r *http.Request) {
+	r.Handle("/api", authenticate(apiAuth...)(audited(auditLog, *auditReads)(authorize(enforce(accessControl)(apiHandler(configCache, *maxWait)))))).Methods(http.MethodGet, http.MethodHead)
+
+	// the /v1 api has its own router, so middlewares can be put in front of it
+	v1 := mux.NewRouter()
+	r.PathPrefix("/v1").Handler(authenticate(v1Auth...)(audited(auditLog, *auditReads)(authorize(enforce(accessControl)(idempotency(idempotencyStore, *idempotencyTTL)(v1))))))
+	v1Router := v1.PathPrefix("/v1").Subrouter()
+	v1Router.HandleFunc("/events", eventsHandler(httpRouterStore, httpServiceStore, httpMiddlewareStore, encryptedMiddlewareStore, accessControl)).Methods(http.MethodGet)
+	v1Router.HandleFunc("/auth/can-i", canIHandler(accessControl)).Methods(http.MethodGet)
+	v1Router.HandleFunc("/audit", auditHandler(auditLog)).Methods(http.MethodGet)
+	v1Router.HandleFunc("/tokens", listTokensHandler(tokenStore)).Methods(http.MethodGet)
+	v1Router.HandleFunc("/tokens", createTokenHandler(tokenStore)).Methods(http.MethodPost)
+	v1Router.HandleFunc("/tokens/{id}", getTokenHandler(tokenStore)).Methods(http.MethodGet)
+	v1Router.HandleFunc("/tokens/{id}", revokeTokenHandler(tokenStore)).Methods(http.MethodDelete)
+	v1Router.HandleFunc("/webhooks", listWebhooksHandler(webhookStore)).Methods(http.MethodGet)
+	v1Router.HandleFunc("/webhooks", createWebhookHandler(webhookStore, allowedNetworks)).Methods(http.MethodPost)
+	v1Router.HandleFunc("/webhooks/{id}", getWebhookHandler(webhookStore)).Methods(http.MethodGet)
+	v1Router.HandleFunc("/webhooks/{id}", deleteWebhookHandler(webhookStore)).Methods(http.MethodDelete)
+	v1Router.HandleFunc("/webhooks/{id}/deliveries", deliveriesHandler(webhookStore)).Methods(http.MethodGet)
+	v1Router.HandleFunc("/webhooks/{id}/ping", pingWebhookHandler(webhookStore, dispatcher)).Methods(http.MethodPost)
+	v1Router.HandleFunc("/simulate", func(w http.ResponseWriter, r *http.Request) {
 		ctx, cancel := context.WithTimeout(r.Context(), time.Second * 10)
 		defer cancel()
 
-		v := r.URL.Query()
-		contentType := v.Get("type")
-		if contentType == "" {
-			contentType = "json"
+		request := analysis.Request{}
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			fmt.Printf("failed to simulate a request: failed to decode r.Body: %v", err)
+			writeProblem(w, r, http.StatusBadRequest, err)
+			return
 		}
 
 		routers, err := httpRouterStore.GetAll(ctx, 0, -1)
+		if err == nil {
+			err = accessControl.visibleRouters(ctx, identityFrom(ctx), routers)
+		}
 		if err != nil {
 			fmt.Printf("failed to get routers from store: %v", err)
-			w.WriteHeader(http.StatusInternalServerError)
+			writeStoreProblem(w, r, err)
 			return
 		}
-		services, err := httpServiceStore.GetAll(ctx, 0, -1)
+
+		simulation, err := analysis.Simulate(routers, request)
 		if err != nil {
-			fmt.Printf("failed to get services from store: %v", err)
-			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Printf("failed to simulate the request: %v", err)
+			writeProblem(w, r, http.StatusBadRequest, err)
 			return
 		}
-		middlewares, err := httpMiddlewareStore.GetAll(ctx, 0, -1)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(simulation)
+	}).Methods(http.MethodPost)
+	v1Router.HandleFunc("/transactions", func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), time.Second * 10)
+		defer cancel()
+
+		type Transaction struct {
+			Operations []store.Operation `json:"operations"`
+		}
+
+		transaction := Transaction{}
+		err := json.NewDecoder(r.Body).Decode(&transaction)
 		if err != nil {
-			fmt.Printf("failed to get middlewares from store: %v", err)
-			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Printf("failed to apply a transaction: failed to decode r.Body: %v", err)
+			writeProblem(w, r, http.StatusBadRequest, err)
 			return
 		}
 
-		conf := dynamic.Configuration{
-			HTTP: &dynamic.HTTPConfiguration{
-				Routers:     routers,
-				Services:    services,
-				Middlewares: middlewares,
-				Models:      nil,
-			},
-			TCP:  nil,
-			UDP:  nil,
-			TLS:  nil,
+		// unknown kinds are malformed operations, they are rejected before the scopes which are only defined for
+		// known kinds
+		for i, operation := range transaction.Operations {
+			if !isKind(operation.Kind) {
+				writeOperationProblem(w, r, &store.OperationError{Index: i, Err: fmt.Errorf("unknown kind %v", operation.Kind)})
+				return
+			}
 		}
 
-		switch contentType {
-		case "toml":
-			w.Header().Set("Content-Type", "application/toml")
-			toml.NewEncoder(w).Encode(conf)
-		case "json":
-			fallthrough
-		default:
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(conf)
+		// the scopes are checked per operation, a transaction may only touch the kinds the client may write
+		id := identityFrom(r.Context())
+		for i, operation := range transaction.Operations {
+			if !id.allowed(kindResource(operation.Kind), verbWrite) {
+				p := newProblem(r, http.StatusForbidden, fmt.Errorf("%v may not write %v", id.Name, kindResource(operation.Kind)))
+				p.Index = &i
+				p.write(w)
+				return
+			}
 		}
-	})
 
-	v1Router := r.PathPrefix("/v1").Subrouter()
-	httpRouter := v1Router.PathPrefix("/http").Subrouter()
-	httpRouter.HandleFunc("/routers", func(w http.ResponseWriter, r *http.Request) {
-		ctx, cancel := context.WithTimeout(r.Context(), time.Second * 10)
-		defer cancel()
-		names := httpRouterStore.Names(ctx ,0, 20)
-
-		type HML map[string]struct{
-			Href string `json:"href"`
+		if !accessControl.checkOperations(w, r.WithContext(ctx), transaction.Operations) {
+			return
 		}
 
-		type Name struct{
-			Name string `json:"name"`
-			Links HML `json:"_links"`
+		versions, err := stores.Apply(ctx, transaction.Operations)
+		var operationErr *store.OperationError
+		if errors.As(err, &operationErr) {
+			fmt.Printf("rejected transaction: %v", err)
+			writeOperationProblem(w, r, operationErr)
+			return
 		}
-
-		type Response struct {
-			Names []Name `json:"names"`
-			Links HML `json:"_links"`
+		if err != nil {
+			fmt.Printf("failed to apply a transaction: %v", err)
+			writeStoreProblem(w, r, err)
+			return
 		}
 
-		response := Response{
-			Names: make([]Name, 0),
-			Links: HML{
-				"self": {
-					Href: "/v1/http/routers",
-				},
-			},
+		type Result struct {
+			Op      string `json:"op"`
+			Kind    string `json:"kind"`
+			Name    string `json:"name"`
+			Version string `json:"version,omitempty"`
 		}
 
-		for _, name := range names {
-			response.Names = append(response.Names, Name{
-				Name:  name,
-				Links: HML{
-					"self": {
-						Href: "/v1/http/router/" + name,
-					},
-				},
+		results := make([]Result, 0, len(transaction.Operations))
+		for i, operation := range transaction.Operations {
+			results = append(results, Result{
+				Op:      operation.Op,
+				Kind:    operation.Kind,
+				Name:    operation.Name,
+				Version: versions[i],
 			})
 		}
 
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(response)
-	}).Methods(http.MethodGet)
-	httpRouter.HandleFunc("/router", func(w http.ResponseWriter, r *http.Request) {
-		ctx,cancel := context.WithTimeout(r.Context(), time.Second * 10)
+		json.NewEncoder(w).Encode(struct {
+			Operations []Result `json:"operations"`
+		}{
+			Operations: results,
+		})
+	}).Methods(http.MethodPost)
+	v1Router.HandleFunc("/config", func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), time.Second * 10)
 		defer cancel()
 
 		v := r.URL.Query()
@@ -150,8 +450,15 @@ func main() {
 		case "toml":
 			_, err := toml.DecodeReader(r.Body, &configuration)
 			if err != nil {
-				fmt.Printf("failed to add a new router from toml: failed to decode r.Body: %v", err)
-				w.WriteHeader(http.StatusBadRequest)
+				fmt.Printf("failed to sync the configuration from toml: failed to decode r.Body: %v", err)
+				writeProblem(w, r, http.StatusBadRequest, err)
+				return
+			}
+		case "yaml":
+			err := yaml.NewDecoder(r.Body).Decode(&configuration)
+			if err != nil {
+				fmt.Printf("failed to sync the configuration from yaml: failed to decode r.Body: %v", err)
+				writeProblem(w, r, http.StatusBadRequest, err)
 				return
 			}
 		case "json":
@@ -159,117 +466,117 @@ func main() {
 		default:
 			err := json.NewDecoder(r.Body).Decode(&configuration)
 			if err != nil {
-				fmt.Printf("failed to add a new router from json: failed to decode r.Body: %v", err)
-				w.WriteHeader(http.StatusBadRequest)
+				fmt.Printf("failed to sync the configuration from json: failed to decode r.Body: %v", err)
+				writeProblem(w, r, http.StatusBadRequest, err)
 				return
 			}
 		}
-		for name, router := range configuration.HTTP.Routers {
-			err = httpRouterStore.Set(ctx, name, router)
+
+		var prune *store.PruneScope
+		if v.Get("prune") == "true" {
+			selector, err := store.ParseSelector(v.Get("label"))
 			if err != nil {
-				fmt.Printf("failed store the router in httpRouterStore: %v", err)
-				w.WriteHeader(http.StatusInternalServerError)
+				fmt.Printf("failed to sync the configuration: %v", err)
+				writeProblem(w, r, http.StatusBadRequest, err)
 				return
 			}
+			prune = &store.PruneScope{
+				Prefix:   v.Get("prefix"),
+				Selector: selector,
+			}
 		}
 
-		w.WriteHeader(http.StatusCreated)
-	}).Methods(http.MethodPost)
-	httpRouter.HandleFunc("/router/{name:[a-zA-Z0-9=\\-\\/]+}", func(w http.ResponseWriter, r *http.Request) {
-		ctx,cancel := context.WithTimeout(r.Context(), time.Second * 10)
-		defer cancel()
-		name, ok := mux.Vars(r)["name"]
-		if !ok {
-			fmt.Printf("did not find name")
-			w.WriteHeader(http.StatusInternalServerError)
+		plan, err := stores.Plan(ctx, &configuration, prune)
+		if err != nil {
+			fmt.Printf("failed to plan the configuration sync: %v", err)
+			writeStoreProblem(w, r, err)
 			return
 		}
 
-		v := r.URL.Query()
-		contentType := v.Get("type")
-		if contentType == "" {
-			contentType = "json"
-		}
-
-		router, err := httpRouterStore.Get(ctx, name)
-		if err != nil {
-			fmt.Printf("failed to get router for %v from store: %v\n", name, err)
-			w.WriteHeader(http.StatusNotFound)
+		if !accessControl.checkOperations(w, r.WithContext(ctx), plan.Operations) {
 			return
 		}
-		switch contentType {
-		case "toml":
-			w.Header().Set("Content-Type", "application/toml")
-			toml.NewEncoder(w).Encode(router)
-		case "json":
-			fallthrough
-		default:
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(router)
-		}
-	}).Methods(http.MethodGet)
-	httpRouter.HandleFunc("/router/{name:[a-zA-Z0-9=\\-\\/]+}", func(w http.ResponseWriter, r *http.Request) {
-		ctx,cancel := context.WithTimeout(r.Context(), time.Second * 10)
-		defer cancel()
 
-		name, ok := mux.Vars(r)["name"]
-		if !ok {
-			fmt.Printf("did not find name")
-			w.WriteHeader(http.StatusInternalServerError)
+		// a dry run validates the plan the same way as it is validated before it is applied
+		dryRun := v.Get("dryRun") == "true"
+		if dryRun {
+			err = stores.Validate(ctx, plan.Operations)
+		} else {
+			_, err = stores.Apply(ctx, plan.Operations)
+		}
+		var operationErr *store.OperationError
+		if errors.As(err, &operationErr) {
+			fmt.Printf("rejected configuration sync: %v", err)
+			writeOperationProblem(w, r, operationErr)
 			return
 		}
-		err := httpRouterStore.Delete(ctx, name)
 		if err != nil {
-			fmt.Printf("could not delete %v: %v", name, err)
-			w.WriteHeader(http.StatusBadRequest)
+			fmt.Printf("failed to sync the configuration: %v", err)
+			writeStoreProblem(w, r, err)
 			return
 		}
-		w.WriteHeader(http.StatusOK)
-	}).Methods(http.MethodDelete)
-
-	httpRouter.HandleFunc("/services", func(w http.ResponseWriter, r *http.Request) {
-		ctx, cancel := context.WithTimeout(r.Context(), time.Second * 10)
-		defer cancel()
-		names := httpServiceStore.Names(ctx, 0, -1)
-
-		type HML map[string]struct{
-			Href string `json:"href"`
-		}
 
-		type Name struct{
+		type Change struct {
+			Kind string `json:"kind"`
 			Name string `json:"name"`
-			Links HML `json:"_links"`
 		}
 
 		type Response struct {
-			Names []Name `json:"names"`
-			Links HML `json:"_links"`
+			Created   []Change `json:"created"`
+			Updated   []Change `json:"updated"`
+			Deleted   []Change `json:"deleted"`
+			Unchanged int      `json:"unchanged"`
+			DryRun    bool     `json:"dryRun"`
 		}
 
 		response := Response{
-			Names: make([]Name, 0),
-			Links: HML{
-				"self": {
-					Href: "/v1/http/services",
-				},
-			},
+			Created:   make([]Change, 0),
+			Updated:   make([]Change, 0),
+			Deleted:   make([]Change, 0),
+			Unchanged: plan.Unchanged,
+			DryRun:    dryRun,
+		}
+		for _, operation := range plan.Operations {
+			change := Change{Kind: operation.Kind, Name: operation.Name}
+			switch operation.Op {
+			case store.OperationCreate:
+				response.Created = append(response.Created, change)
+			case store.OperationUpdate:
+				response.Updated = append(response.Updated, change)
+			case store.OperationDelete:
+				response.Deleted = append(response.Deleted, change)
+			}
 		}
 
-		for _, name := range names {
-			response.Names = append(response.Names, Name{
-				Name:  name,
-				Links: HML{
-					"self": {
-						Href: "/v1/http/service/" + name,
-					},
-				},
-			})
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}).Methods(http.MethodPut)
+	v1Router.HandleFunc("/quarantine", func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), time.Second * 10)
+		defer cancel()
+
+		listings := map[string]func(ctx context.Context) ([]store.QuarantinedFile, error){
+			"routers":     httpRouterStore.Quarantined,
+			"services":    httpServiceStore.Quarantined,
+			"middlewares": httpMiddlewareStore.Quarantined,
+		}
+		response := map[string][]store.QuarantinedFile{}
+		for kind, list := range listings {
+			files, err := list(ctx)
+			if err != nil {
+				fmt.Printf("failed to list the quarantined %v: %v", kind, err)
+				writeStoreProblem(w, r, err)
+				return
+			}
+			response[kind] = files
 		}
 
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(response)
 	}).Methods(http.MethodGet)
-	httpRouter.HandleFunc("/service", func(w http.ResponseWriter, r *http.Request) {
+
+	httpRouter := v1Router.PathPrefix("/http").Subrouter()
+	httpRouter.HandleFunc("/router", func(w http.ResponseWriter, r *http.Request) {
 		ctx,cancel := context.WithTimeout(r.Context(), time.Second * 10)
 		defer cancel()
 
@@ -284,8 +591,8 @@ func main() {
 		case "toml":
 			_, err := toml.DecodeReader(r.Body, &configuration)
 			if err != nil {
-				fmt.Printf("failed to add a new service from toml: failed to decode r.Body: %v", err)
-				w.WriteHeader(http.StatusBadRequest)
+				fmt.Printf("failed to add a new router from toml: failed to decode r.Body: %v", err)
+				writeProblem(w, r, http.StatusBadRequest, err)
 				return
 			}
 		case "json":
@@ -293,117 +600,102 @@ func main() {
 		default:
 			err := json.NewDecoder(r.Body).Decode(&configuration)
 			if err != nil {
-				fmt.Printf("failed to add a new service from json: failed to decode r.Body: %v", err)
-				w.WriteHeader(http.StatusBadRequest)
+				fmt.Printf("failed to add a new router from json: failed to decode r.Body: %v", err)
+				writeProblem(w, r, http.StatusBadRequest, err)
 				return
 			}
 		}
-		for name, service := range configuration.HTTP.Services {
-			err = httpServiceStore.Set(ctx, name, service)
-			if err != nil {
-				fmt.Printf("failed store the service in httpServiceStore: %v", err)
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
+		routerNames := make([]string, 0, len(configuration.HTTP.Routers))
+		for name := range configuration.HTTP.Routers {
+			routerNames = append(routerNames, name)
 		}
-
-		w.WriteHeader(http.StatusCreated)
-	}).Methods(http.MethodPost)
-	httpRouter.HandleFunc("/service/{name:[a-zA-Z0-9=\\-\\/]+}", func(w http.ResponseWriter, r *http.Request) {
-		ctx,cancel := context.WithTimeout(r.Context(), time.Second * 10)
-		defer cancel()
-		name, ok := mux.Vars(r)["name"]
-		if !ok {
-			fmt.Printf("did not find name")
-			w.WriteHeader(http.StatusInternalServerError)
+		if !accessControl.checkWrites(w, r.WithContext(ctx), store.KindRouter, routerNames) ||
+			!accessControl.checkReferences(w, r.WithContext(ctx), configuration.HTTP.Routers) {
 			return
 		}
-
-		v := r.URL.Query()
-		contentType := v.Get("type")
-		if contentType == "" {
-			contentType = "json"
+		values := make(map[string]interface{}, len(configuration.HTTP.Routers))
+		for name, router := range configuration.HTTP.Routers {
+			values[name] = router
+		}
+		// the routers are stored in a single transaction, either all of them or none are stored
+		err = stores.Put(ctx, store.KindRouter, values)
+		var operationErr *store.OperationError
+		if errors.As(err, &operationErr) {
+			fmt.Printf("rejected routers: %v", err)
+			writeOperationProblem(w, r, operationErr)
+			return
 		}
-
-		service, err := httpServiceStore.Get(ctx, name)
 		if err != nil {
-			fmt.Printf("failed to get service for %v from store: %v\n", name, err)
-			w.WriteHeader(http.StatusNotFound)
+			fmt.Printf("failed store the routers in httpRouterStore: %v", err)
+			writeStoreProblem(w, r, err)
 			return
 		}
-		switch contentType {
-		case "toml":
-			w.Header().Set("Content-Type", "application/toml")
-			toml.NewEncoder(w).Encode(service)
-		case "json":
-			fallthrough
-		default:
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(service)
-		}
-	}).Methods(http.MethodGet)
-	httpRouter.HandleFunc("/service/{name:[a-zA-Z0-9=\\-\\/]+}", func(w http.ResponseWriter, r *http.Request) {
-		ctx,cancel := context.WithTimeout(r.Context(), time.Second * 10)
-		defer cancel()
 
-		name, ok := mux.Vars(r)["name"]
-		if !ok {
-			fmt.Printf("did not find name")
-			w.WriteHeader(http.StatusInternalServerError)
+		// the routers are stored, conflicts are only reported as warnings
+		routers, err := httpRouterStore.GetAll(ctx, 0, -1)
+		if err != nil {
+			fmt.Printf("failed to get routers from store: %v", err)
+			w.WriteHeader(http.StatusCreated)
 			return
 		}
-		err := httpServiceStore.Delete(ctx, name)
+		findings, err := accessControl.visibleFindings(ctx, identityFrom(ctx), analysis.ConflictsOf(routers, routerNames...))
 		if err != nil {
-			fmt.Printf("could not delete %v: %v", name, err)
-			w.WriteHeader(http.StatusBadRequest)
+			fmt.Printf("failed to analyze the routers: %v", err)
+			w.WriteHeader(http.StatusCreated)
 			return
 		}
-		w.WriteHeader(http.StatusOK)
-	}).Methods(http.MethodDelete)
-
-	httpRouter.HandleFunc("/middlewares", func(w http.ResponseWriter, r *http.Request) {
+		if len(findings) == 0 {
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		for _, finding := range findings {
+			w.Header().Add("Warning", fmt.Sprintf("299 kommandeur %q", finding.Message))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(struct {
+			Warnings []analysis.Finding `json:"warnings"`
+		}{
+			Warnings: findings,
+		})
+	}).Methods(http.MethodPost)
+	httpRouter.HandleFunc("/routers/conflicts", func(w http.ResponseWriter, r *http.Request) {
 		ctx, cancel := context.WithTimeout(r.Context(), time.Second * 10)
 		defer cancel()
-		names := httpMiddlewareStore.Names(ctx, 0, -1)
 
-		type HML map[string]struct{
-			Href string `json:"href"`
+		routers, err := httpRouterStore.GetAll(ctx, 0, -1)
+		if err == nil {
+			err = accessControl.visibleRouters(ctx, identityFrom(ctx), routers)
+		}
+		if err != nil {
+			fmt.Printf("failed to get routers from store: %v", err)
+			writeStoreProblem(w, r, err)
+			return
 		}
 
-		type Name struct{
-			Name string `json:"name"`
-			Links HML `json:"_links"`
+		type HML map[string]struct{
+			Href string `json:"href"`
 		}
 
 		type Response struct {
-			Names []Name `json:"names"`
+			Conflicts []analysis.Finding `json:"conflicts"`
 			Links HML `json:"_links"`
 		}
 
 		response := Response{
-			Names: make([]Name, 0),
+			Conflicts: analysis.Conflicts(routers),
 			Links: HML{
 				"self": {
-					Href: "/v1/http/middlewares",
+					Href: "/v1/http/routers/conflicts",
 				},
 			},
 		}
 
-		for _, name := range names {
-			response.Names = append(response.Names, Name{
-				Name:  name,
-				Links: HML{
-					"self": {
-						Href: "/v1/http/middleware/" + name,
-					},
-				},
-			})
-		}
-
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(response)
 	}).Methods(http.MethodGet)
-	httpRouter.HandleFunc("/middleware", func(w http.ResponseWriter, r *http.Request) {
+
+	httpRouter.HandleFunc("/service", func(w http.ResponseWriter, r *http.Request) {
 		ctx,cancel := context.WithTimeout(r.Context(), time.Second * 10)
 		defer cancel()
 
@@ -418,8 +710,8 @@ func main() {
 		case "toml":
 			_, err := toml.DecodeReader(r.Body, &configuration)
 			if err != nil {
-				fmt.Printf("failed to add a new middleware from toml: failed to decode r.Body: %v", err)
-				w.WriteHeader(http.StatusBadRequest)
+				fmt.Printf("failed to add a new service from toml: failed to decode r.Body: %v", err)
+				writeProblem(w, r, http.StatusBadRequest, err)
 				return
 			}
 		case "json":
@@ -427,31 +719,43 @@ func main() {
 		default:
 			err := json.NewDecoder(r.Body).Decode(&configuration)
 			if err != nil {
-				fmt.Printf("failed to add a new middleware from json: failed to decode r.Body: %v", err)
-				w.WriteHeader(http.StatusBadRequest)
+				fmt.Printf("failed to add a new service from json: failed to decode r.Body: %v", err)
+				writeProblem(w, r, http.StatusBadRequest, err)
 				return
 			}
 		}
-		for name, middleware := range configuration.HTTP.Middlewares {
-			err = httpMiddlewareStore.Set(ctx, name, middleware)
-			if err != nil {
-				fmt.Printf("failed store the middleware in httpMiddlewareStore: %v", err)
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
+		serviceNames := make([]string, 0, len(configuration.HTTP.Services))
+		for name := range configuration.HTTP.Services {
+			serviceNames = append(serviceNames, name)
+		}
+		if !accessControl.checkWrites(w, r.WithContext(ctx), store.KindService, serviceNames) ||
+			!accessControl.checkReferences(w, r.WithContext(ctx), configuration.HTTP.Services) {
+			return
+		}
+		values := make(map[string]interface{}, len(configuration.HTTP.Services))
+		for name, service := range configuration.HTTP.Services {
+			values[name] = service
+		}
+		// the services are stored in a single transaction, either all of them or none are stored
+		err = stores.Put(ctx, store.KindService, values)
+		var operationErr *store.OperationError
+		if errors.As(err, &operationErr) {
+			fmt.Printf("rejected services: %v", err)
+			writeOperationProblem(w, r, operationErr)
+			return
+		}
+		if err != nil {
+			fmt.Printf("failed store the services in httpServiceStore: %v", err)
+			writeStoreProblem(w, r, err)
+			return
 		}
 
 		w.WriteHeader(http.StatusCreated)
 	}).Methods(http.MethodPost)
-	httpRouter.HandleFunc("/middleware/{name:[a-zA-Z0-9=\\-\\/]+}", func(w http.ResponseWriter, r *http.Request) {
+
+	httpRouter.HandleFunc("/middleware", func(w http.ResponseWriter, r *http.Request) {
 		ctx,cancel := context.WithTimeout(r.Context(), time.Second * 10)
 		defer cancel()
-		name, ok := mux.Vars(r)["name"]
-		if !ok {
-			fmt.Printf("did not find name")
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
 
 		v := r.URL.Query()
 		contentType := v.Get("type")
@@ -459,41 +763,75 @@ func main() {
 			contentType = "json"
 		}
 
-		middleware, err := httpMiddlewareStore.Get(ctx, name)
-		if err != nil {
-			fmt.Printf("failed to get middleware for %v from store: %v\n", name, err)
-			w.WriteHeader(http.StatusNotFound)
-			return
-		}
+		configuration := dynamic.Configuration{}
 		switch contentType {
 		case "toml":
-			w.Header().Set("Content-Type", "application/toml")
-			toml.NewEncoder(w).Encode(middleware)
+			_, err := toml.DecodeReader(r.Body, &configuration)
+			if err != nil {
+				fmt.Printf("failed to add a new middleware from toml: failed to decode r.Body: %v", err)
+				writeProblem(w, r, http.StatusBadRequest, err)
+				return
+			}
 		case "json":
 			fallthrough
 		default:
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(middleware)
+			err := json.NewDecoder(r.Body).Decode(&configuration)
+			if err != nil {
+				fmt.Printf("failed to add a new middleware from json: failed to decode r.Body: %v", err)
+				writeProblem(w, r, http.StatusBadRequest, err)
+				return
+			}
 		}
-	}).Methods(http.MethodGet)
-	httpRouter.HandleFunc("/middleware/{name:[a-zA-Z0-9=\\-\\/]+}", func(w http.ResponseWriter, r *http.Request) {
-		ctx,cancel := context.WithTimeout(r.Context(), time.Second * 10)
-		defer cancel()
-
-		name, ok := mux.Vars(r)["name"]
-		if !ok {
-			fmt.Printf("did not find name")
-			w.WriteHeader(http.StatusInternalServerError)
+		middlewareNames := make([]string, 0, len(configuration.HTTP.Middlewares))
+		for name := range configuration.HTTP.Middlewares {
+			middlewareNames = append(middlewareNames, name)
+		}
+		if !accessControl.checkWrites(w, r.WithContext(ctx), store.KindMiddleware, middlewareNames) ||
+			!accessControl.checkReferences(w, r.WithContext(ctx), configuration.HTTP.Middlewares) {
+			return
+		}
+		values := make(map[string]interface{}, len(configuration.HTTP.Middlewares))
+		for name, middleware := range configuration.HTTP.Middlewares {
+			values[name] = middleware
+		}
+		// the middlewares are stored in a single transaction, either all of them or none are stored
+		err = stores.Put(ctx, store.KindMiddleware, values)
+		var operationErr *store.OperationError
+		if errors.As(err, &operationErr) {
+			fmt.Printf("rejected middlewares: %v", err)
+			writeOperationProblem(w, r, operationErr)
 			return
 		}
-		err := httpMiddlewareStore.Delete(ctx, name)
 		if err != nil {
-			fmt.Printf("could not delete %v: %v", name, err)
-			w.WriteHeader(http.StatusBadRequest)
+			fmt.Printf("failed store the middlewares in httpMiddlewareStore: %v", err)
+			writeStoreProblem(w, r, err)
 			return
 		}
-		w.WriteHeader(http.StatusOK)
-	}).Methods(http.MethodDelete)
 
-	http.ListenAndServe(":8080", r)
+		w.WriteHeader(http.StatusCreated)
+	}).Methods(http.MethodPost)
+
+	for _, res := range []resource{
+		routerResource(httpRouterStore, labelStore),
+		serviceResource(httpServiceStore, labelStore),
+		middlewareResource(httpMiddlewareStore, labelStore),
+	} {
+		httpRouter.HandleFunc("/" + res.kind + "/{name}/labels", getLabelsHandler(res)).Methods(http.MethodGet)
+		httpRouter.HandleFunc("/" + res.kind + "/{name}/labels", putLabelsHandler(res)).Methods(http.MethodPut)
+		httpRouter.HandleFunc("/" + res.kind + "s", listHandler(res, accessControl)).Methods(http.MethodGet)
+		httpRouter.HandleFunc("/" + res.kind + "/{name}", getHandler(res, accessControl)).Methods(http.MethodGet)
+		httpRouter.HandleFunc("/" + res.kind + "/{name}", deleteHandler(res)).Methods(http.MethodDelete)
+		httpRouter.HandleFunc("/" + res.kind + "/{name}", putHandler(res, accessControl)).Methods(http.MethodPut)
+		httpRouter.HandleFunc("/" + res.kind + "/{name}", patchHandler(res, accessControl)).Methods(http.MethodPatch)
+	}
+
+	server := &http.Server{Addr: *listen, Handler: r, TLSConfig: tlsConf}
+	if tlsConf != nil {
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err != nil {
+		fmt.Printf("failed to serve: %v", err)
+	}
 }
\ No newline at end of file
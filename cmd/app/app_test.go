@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mainHelperEnv runs TestMainHelperProcess as the server, its value is the arguments separated by newlines
+const mainHelperEnv = "KOMMANDEUR_MAIN_HELPER"
+
+// TestMainHelperProcess runs main with the arguments of the parent test, it does nothing unless it is started by
+// runMain
+func TestMainHelperProcess(t *testing.T) {
+	args := os.Getenv(mainHelperEnv)
+	if args == "" {
+		return
+	}
+	os.Args = append([]string{"kommandeur"}, strings.Split(args, "\n")...)
+	main()
+}
+
+// runMain starts the server in dir with the arguments and returns its output, it fails if the server is still
+// running after a few seconds
+func runMain(t *testing.T, dir string, args ...string) string {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, os.Args[0], "-test.run=^TestMainHelperProcess$")
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), mainHelperEnv+"="+strings.Join(append(args, "-listen", "127.0.0.1:0"), "\n"))
+	output := bytes.Buffer{}
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	cmd.Run()
+	if ctx.Err() != nil {
+		t.Fatalf("the server started with %v:\n%s", args, output.String())
+	}
+	return output.String()
+}
+
+func TestMainRefusesToStart(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, _ := testCertificate(t, dir)
+	tests := []struct {
+		name   string
+		args   []string
+		output string
+	}{
+		{
+			name:   "oidc without a policy",
+			args:   []string{"-oidc-issuer", "https://issuer.example.com", "-oidc-audience", "kommandeur"},
+			output: "-oidc-issuer and -tls-client-ca require an rbac policy",
+		},
+		{
+			name:   "client certificates without a policy",
+			args:   []string{"-tls-cert", certFile, "-tls-key", keyFile, "-tls-client-ca", certFile},
+			output: "-oidc-issuer and -tls-client-ca require an rbac policy",
+		},
+		{
+			name:   "client CA without tls",
+			args:   []string{"-tls-client-ca", certFile},
+			output: "client certificates can only be verified if tls is configured",
+		},
+		{
+			name:   "required client certificates without a client CA",
+			args:   []string{"-tls-cert", certFile, "-tls-key", keyFile, "-tls-require-client-cert"},
+			output: "client certificates can only be required with a client CA bundle",
+		},
+		{
+			name:   "missing htpasswd file",
+			args:   []string{"-htpasswd", "missing.htpasswd"},
+			output: "failed to set up authentication",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			output := runMain(t, t.TempDir(), test.args...)
+			if !strings.Contains(output, test.output) {
+				t.Errorf("output = %v, want %v", output, test.output)
+			}
+		})
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"kommandeur/audit"
+	"kommandeur/store"
+)
+
+const (
+	requestIDHeader = "X-Request-Id"
+	// maxAuditBody is the longest request body kept in the audit log, longer bodies are only hashed
+	maxAuditBody = 64 * 1024
+)
+
+// auditSecrets are the fields masked in the logged request bodies in addition to the sensitive middleware values,
+// e.g. the secret of a webhook
+var auditSecrets = []string{"secret", "token", "password", "clientSecret", "apiKey", "privateKey"}
+
+// statusWriter keeps the status of the response, it passes flushes through for the event stream
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *statusWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// audited records the requests of authenticated identities with the resources they changed, reads are only
+// recorded if reads is set. Every request gets a request id, which is taken from the X-Request-Id header if
+// the client sent one.
+func audited(log *audit.Log, reads bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if log == nil {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			operation := verbWrite
+			if r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions {
+				operation = verbRead
+			}
+			id := identityFrom(r.Context())
+			if id == nil || (operation == verbRead && !reads) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			entry := &audit.Entry{
+				Time:       time.Now().UTC(),
+				RequestID:  r.Header.Get(requestIDHeader),
+				Actor:      id.Name,
+				AuthMethod: id.Method,
+				RemoteAddr: r.RemoteAddr,
+				Method:     r.Method,
+				Path:       r.URL.RequestURI(),
+				Operation:  operation,
+			}
+			var err error
+			entry.ID, err = randomHex(8)
+			if err != nil {
+				writeProblem(w, r, http.StatusInternalServerError, err)
+				return
+			}
+			if entry.RequestID == "" {
+				entry.RequestID = entry.ID
+			}
+			w.Header().Set(requestIDHeader, entry.RequestID)
+
+			if operation == verbWrite {
+				body, err := ioutil.ReadAll(r.Body)
+				if err != nil {
+					writeProblem(w, r, http.StatusBadRequest, err)
+					return
+				}
+				r.Body = ioutil.NopCloser(bytes.NewReader(body))
+				entry.BodyHash = audit.Hash(body)
+				// sensitive middleware values and secrets are not kept in the log
+				if len(body) <= maxAuditBody && json.Valid(body) {
+					redacted, err := store.RedactJSON(body)
+					if err == nil {
+						redacted, err = store.RedactFields(redacted, auditSecrets...)
+					}
+					if err == nil {
+						entry.Body = redacted
+					}
+				}
+			}
+
+			// the changes are collected from the stores, a transaction can change many resources
+			mutex := sync.Mutex{}
+			ctx := store.WithObserver(r.Context(), func(event store.Event) {
+				mutex.Lock()
+				defer mutex.Unlock()
+				entry.Changes = append(entry.Changes, audit.Change{
+					Op:     event.Op,
+					Kind:   event.Kind,
+					Name:   event.Name,
+					Before: audit.Hash(event.Before),
+					After:  audit.Hash(event.After),
+				})
+			})
+			sw := &statusWriter{ResponseWriter: w}
+			next.ServeHTTP(sw, r.WithContext(ctx))
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			entry.Status = sw.status
+			if entry.Status == 0 {
+				entry.Status = http.StatusOK
+			}
+			entry.Duration = time.Since(entry.Time).String()
+			err = log.Write(entry)
+			if err != nil {
+				fmt.Printf("failed to write the audit log: %v\n", err)
+			}
+		})
+	}
+}
+
+const (
+	// defaultAuditLimit is used if the limit query parameter is missing
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+// auditHandler queries the audit log, e.g. ?actor=admin&kind=router&name=a&since=2021-01-01T00:00:00Z&limit=50
+func auditHandler(log *audit.Log) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if log == nil {
+			writeProblem(w, r, http.StatusNotFound, errors.New("the audit log is disabled"))
+			return
+		}
+
+		v := r.URL.Query()
+		filter := audit.Filter{
+			Actor:     v.Get("actor"),
+			Operation: v.Get("operation"),
+			Method:    v.Get("method"),
+			Kind:      v.Get("kind"),
+			Name:      v.Get("name"),
+			Limit:     defaultAuditLimit,
+		}
+		var err error
+		for param, target := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+			if v.Get(param) == "" {
+				continue
+			}
+			*target, err = time.Parse(time.RFC3339, v.Get(param))
+			if err != nil {
+				writeProblem(w, r, http.StatusBadRequest, fmt.Errorf("invalid %v: %v", param, err))
+				return
+			}
+		}
+		for param, target := range map[string]*int{"status": &filter.Status, "limit": &filter.Limit} {
+			if v.Get(param) == "" {
+				continue
+			}
+			*target, err = strconv.Atoi(v.Get(param))
+			if err != nil || *target < 0 {
+				writeProblem(w, r, http.StatusBadRequest, fmt.Errorf("invalid %v %v", param, v.Get(param)))
+				return
+			}
+		}
+		// the whole log is never returned at once
+		if filter.Limit < 1 || filter.Limit > maxAuditLimit {
+			writeProblem(w, r, http.StatusBadRequest, fmt.Errorf("invalid limit %v, it has to be between 1 and %v", filter.Limit, maxAuditLimit))
+			return
+		}
+
+		entries, err := log.Query(filter)
+		if err != nil {
+			fmt.Printf("failed to query the audit log: %v", err)
+			writeProblem(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"entries": entries})
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+
+	auth "github.com/abbot/go-http-auth"
+)
+
+const realm = "kommandeur"
+
+// errUnauthenticated is returned if the request carries no or invalid credentials
+var errUnauthenticated = errors.New("authentication required")
+
+// identity is the authenticated client of a request
+type identity struct {
+	Name string `json:"name"`
+	// Method is the way the client authenticated, e.g. basic
+	Method string `json:"method"`
+	// Scopes limit what the client may do, see scope.go
+	Scopes []string `json:"scopes"`
+	// Groups are the groups the identity provider put the client in
+	Groups []string `json:"groups,omitempty"`
+	// Creators are the subjects of the identity which issued the token the client authenticated with
+	Creators []string `json:"creators,omitempty"`
+}
+
+type identityKey struct{}
+
+// identityFrom returns the identity of an authenticated request, it is nil if authentication is disabled
+func identityFrom(ctx context.Context) *identity {
+	id, _ := ctx.Value(identityKey{}).(*identity)
+	return id
+}
+
+// authenticator checks the credentials of a request, it returns nil without an error if the request
+// does not carry credentials it understands, so the next authenticator can be tried
+type authenticator func(r *http.Request) (*identity, error)
+
+// authenticate rejects requests which no authenticator accepts and adds the identity to the request context,
+// without authenticators every request is let through
+func authenticate(authenticators ...authenticator) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if len(authenticators) == 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for _, authenticator := range authenticators {
+				id, err := authenticator(r)
+				if err != nil {
+					fmt.Printf("failed to authenticate a request to %v: %v\n", r.URL.Path, err)
+					break
+				}
+				if id != nil {
+					next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), identityKey{}, id)))
+					return
+				}
+			}
+			w.Header().Add("WWW-Authenticate", `Basic realm="`+realm+`"`)
+			w.Header().Add("WWW-Authenticate", `Bearer realm="`+realm+`"`)
+			writeProblem(w, r, http.StatusUnauthorized, errUnauthenticated)
+		})
+	}
+}
+
+// htpasswdAuthenticator checks basic auth credentials against an htpasswd file, which may contain bcrypt,
+// SHA and MD5 hashes and is reloaded when it changes, all users of the file get the given scopes
+func htpasswdAuthenticator(path string, scopes ...string) (authenticator, error) {
+	_, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the htpasswd file: %v", err)
+	}
+	secrets := auth.HtpasswdFileProvider(path)
+	// the provider panics on syntax errors, the file is loaded once so they surface at startup
+	_, err = secret(secrets, "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the htpasswd file %v: %v", path, err)
+	}
+
+	return func(r *http.Request) (*identity, error) {
+		user, password, ok := r.BasicAuth()
+		if !ok {
+			return nil, nil
+		}
+		hash, err := secret(secrets, user)
+		if err != nil {
+			return nil, err
+		}
+		// unknown users may be known to another authenticator
+		if hash == "" {
+			return nil, nil
+		}
+		if !auth.CheckSecret(password, hash) {
+			return nil, fmt.Errorf("invalid credentials for %v", user)
+		}
+		return &identity{Name: user, Method: "basic", Scopes: scopes}, nil
+	}, nil
+}
+
+// secret looks up the hash of a user and turns a panic while reloading the file into an error
+func secret(secrets auth.SecretProvider, user string) (hash string, err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = fmt.Errorf("%v", recovered)
+		}
+	}()
+	return secrets(user, realm), nil
+}
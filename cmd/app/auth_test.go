@@ -0,0 +1,154 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// the hashes were generated by htpasswd, the passwords are the names of the hash functions
+const testHtpasswd = `bcrypt:$2y$10$Q6GeMFPd0dAxhQULPDdAn.DFy6NDmLaU0A7e2XoJz7PFYAEADFKbC
+sha:{SHA}vFznddje0Ht4+pmO0FaxwrUKN/M=
+md5:$apr1$FVVioVP7$ZdIWPG1p4E/ErujO7kA2n0
+`
+
+func writeHtpasswd(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "users.htpasswd")
+	err := ioutil.WriteFile(path, []byte(content), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestHtpasswdAuthenticator(t *testing.T) {
+	path := writeHtpasswd(t, testHtpasswd)
+	users, err := htpasswdAuthenticator(path, scopeAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		user     string
+		password string
+		basic    bool
+		identity *identity
+		err      bool
+	}{
+		{name: "bcrypt", user: "bcrypt", password: "htpasswd-bcrypt", basic: true, identity: &identity{Name: "bcrypt", Method: "basic", Scopes: []string{scopeAll}}},
+		{name: "sha", user: "sha", password: "htpasswd-sha", basic: true, identity: &identity{Name: "sha", Method: "basic", Scopes: []string{scopeAll}}},
+		{name: "md5", user: "md5", password: "htpasswd-md5", basic: true, identity: &identity{Name: "md5", Method: "basic", Scopes: []string{scopeAll}}},
+		{name: "wrong password", user: "bcrypt", password: "htpasswd-sha", basic: true, err: true},
+		{name: "empty password", user: "md5", basic: true, err: true},
+		{name: "unknown user", user: "mallory", password: "htpasswd-md5", basic: true},
+		{name: "no credentials"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/v1/http/routers", nil)
+		if test.basic {
+			r.SetBasicAuth(test.user, test.password)
+		}
+		id, err := users(r)
+		if (err != nil) != test.err {
+			t.Errorf("%v: err = %v, want an error: %v", test.name, err, test.err)
+		}
+		if !reflect.DeepEqual(id, test.identity) {
+			t.Errorf("%v: identity = %+v, want %+v", test.name, id, test.identity)
+		}
+	}
+
+	// the file is reloaded when it changes
+	err = ioutil.WriteFile(path, []byte("sha:{SHA}vFznddje0Ht4+pmO0FaxwrUKN/M=\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	err = os.Chtimes(path, later, later)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodGet, "/v1/http/routers", nil)
+	r.SetBasicAuth("bcrypt", "htpasswd-bcrypt")
+	if id, _ := users(r); id != nil {
+		t.Errorf("the removed user is still authenticated as %+v", id)
+	}
+}
+
+func TestHtpasswdAuthenticatorInvalidFile(t *testing.T) {
+	_, err := htpasswdAuthenticator(filepath.Join(t.TempDir(), "missing.htpasswd"))
+	if err == nil {
+		t.Error("a missing htpasswd file is accepted")
+	}
+	_, err = htpasswdAuthenticator(writeHtpasswd(t, "admin:hash:with:\"quote\n\"broken"))
+	if err == nil {
+		t.Error("a malformed htpasswd file is accepted")
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	users, err := htpasswdAuthenticator(writeHtpasswd(t, testHtpasswd), scopeAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readers, err := htpasswdAuthenticator(writeHtpasswd(t, "reader:{SHA}vFznddje0Ht4+pmO0FaxwrUKN/M=\n"), "config:read")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the credentials of /api and /v1 are separate like in main
+	identityHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(identityFrom(r.Context()).Name))
+	})
+	r := mux.NewRouter()
+	r.Handle("/api", authenticate(readers)(identityHandler))
+	r.PathPrefix("/v1").Handler(authenticate(users)(identityHandler))
+	s := httptest.NewServer(r)
+	defer s.Close()
+
+	tests := []struct {
+		name     string
+		path     string
+		user     string
+		password string
+		status   int
+	}{
+		{name: "user", path: "/v1/http/routers", user: "md5", password: "htpasswd-md5", status: http.StatusOK},
+		{name: "reader", path: "/api", user: "reader", password: "htpasswd-sha", status: http.StatusOK},
+		{name: "no credentials", path: "/v1/http/routers", status: http.StatusUnauthorized},
+		{name: "wrong password", path: "/v1/http/routers", user: "md5", password: "htpasswd-bcrypt", status: http.StatusUnauthorized},
+		{name: "reader on v1", path: "/v1/http/routers", user: "reader", password: "htpasswd-sha", status: http.StatusUnauthorized},
+		{name: "user on api", path: "/api", user: "sha", password: "htpasswd-sha", status: http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest(http.MethodGet, s.URL+test.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.user != "" {
+			req.SetBasicAuth(test.user, test.password)
+		}
+		resp, err := s.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != test.status {
+			t.Errorf("%v: status = %v, want %v", test.name, resp.StatusCode, test.status)
+			continue
+		}
+		if test.status == http.StatusOK && string(body) != test.user {
+			t.Errorf("%v: identity = %v, want %v", test.name, string(body), test.user)
+		}
+		if test.status == http.StatusUnauthorized && len(resp.Header.Values("WWW-Authenticate")) != 2 {
+			t.Errorf("%v: WWW-Authenticate = %v, want basic and bearer", test.name, resp.Header.Values("WWW-Authenticate"))
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"kommandeur/store"
+)
+
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// replayedHeaders are the response headers stored together with the status and body
+var replayedHeaders = []string{"Content-Type", "ETag", "Location", "Warning"}
+
+// onceSecrets are the fields of responses which contain secrets that are only shown once, they are not stored
+// and replays have them redacted
+var onceSecrets = map[string][]string{
+	http.MethodPost + " /v1/tokens":   {"token"},
+	http.MethodPost + " /v1/webhooks": {"secret"},
+}
+
+// recorder passes the response through and keeps a copy of it
+type recorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *recorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *recorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+// idempotency replays the stored response for write requests with an Idempotency-Key that was already used
+func idempotency(idempotencyStore store.IdempotencyStore, ttl time.Duration) func(http.Handler) http.Handler {
+	inFlight := map[string]bool{}
+	mutex := sync.Mutex{}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := r.Header.Get(idempotencyKeyHeader)
+			if key == "" || r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			body, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				fmt.Printf("failed to read r.Body: %v", err)
+				writeProblem(w, r, http.StatusBadRequest, err)
+				return
+			}
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+			// keys are scoped to the identity, a response is never replayed to another client
+			actor := ""
+			if id := identityFrom(r.Context()); id != nil {
+				actor = id.Method + ":" + id.Name
+			}
+			recordKey := actor + "\n" + key
+			sum := sha256.Sum256(append([]byte(actor+"\n"+r.Method+" "+r.URL.String()+"\n"), body...))
+			requestHash := hex.EncodeToString(sum[:])
+
+			mutex.Lock()
+			if inFlight[recordKey] {
+				mutex.Unlock()
+				writeProblem(w, r, http.StatusConflict, fmt.Errorf("a request with the idempotency key %v is in progress", key))
+				return
+			}
+			inFlight[recordKey] = true
+			mutex.Unlock()
+			defer func() {
+				mutex.Lock()
+				delete(inFlight, recordKey)
+				mutex.Unlock()
+			}()
+
+			ctx, cancel := context.WithTimeout(r.Context(), time.Second*10)
+			defer cancel()
+
+			record, err := idempotencyStore.Get(ctx, recordKey)
+			if err != nil {
+				fmt.Printf("failed to get the idempotency record for %v: %v", key, err)
+				writeProblem(w, r, http.StatusInternalServerError, err)
+				return
+			}
+			if record != nil {
+				if record.RequestHash != requestHash {
+					fmt.Printf("idempotency key %v was used for a different request", key)
+					writeProblem(w, r, http.StatusUnprocessableEntity, fmt.Errorf("the idempotency key %v was used for a different request", key))
+					return
+				}
+				for name, values := range record.Header {
+					w.Header()[name] = values
+				}
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(record.Status)
+				w.Write(record.Body)
+				return
+			}
+
+			rec := &recorder{ResponseWriter: w}
+			next.ServeHTTP(rec, r)
+			if rec.status == 0 {
+				rec.status = http.StatusOK
+			}
+			// server errors are not stored, the client should be able to retry them
+			if rec.status >= http.StatusInternalServerError {
+				return
+			}
+
+			body = rec.body.Bytes()
+			if fields, ok := onceSecrets[r.Method+" "+r.URL.Path]; ok && len(body) > 0 {
+				body, err = store.RedactFields(body, fields...)
+				if err != nil {
+					fmt.Printf("failed to redact the response for %v, it is not stored: %v", key, err)
+					return
+				}
+			}
+			// revealed sensitive values are not stored either, replays have them redacted
+			if reveal, _ := strconv.ParseBool(r.URL.Query().Get("reveal")); reveal && len(body) > 0 {
+				body, err = store.RedactJSON(body)
+				if err != nil {
+					fmt.Printf("failed to redact the response for %v, it is not stored: %v", key, err)
+					return
+				}
+			}
+
+			header := http.Header{}
+			for _, name := range replayedHeaders {
+				if values, ok := w.Header()[http.CanonicalHeaderKey(name)]; ok {
+					header[http.CanonicalHeaderKey(name)] = values
+				}
+			}
+			err = idempotencyStore.Set(ctx, &store.IdempotencyRecord{
+				Key:         recordKey,
+				Method:      r.Method,
+				Path:        r.URL.Path,
+				RequestHash: requestHash,
+				Status:      rec.status,
+				Header:      header,
+				Body:        body,
+				Expires:     time.Now().Add(ttl),
+			})
+			if err != nil {
+				fmt.Printf("failed to store the idempotency record for %v: %v", key, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"kommandeur/oidc"
+)
+
+// oidcAuthenticator checks bearer JWTs issued by an OpenID Connect provider, the groups of the token become
+// group:<name> subjects the rbac policy can bind roles to
+func oidcAuthenticator(verifier *oidc.Verifier, scopes ...string) authenticator {
+	return func(r *http.Request) (*identity, error) {
+		header := r.Header.Get("Authorization")
+		if !strings.HasPrefix(header, "Bearer ") {
+			return nil, nil
+		}
+		token := strings.TrimPrefix(header, "Bearer ")
+		// api tokens are checked by the token authenticator, anything else is not a JWT
+		if strings.HasPrefix(token, tokenPrefix) || strings.Count(token, ".") != 2 {
+			return nil, nil
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), time.Second*10)
+		defer cancel()
+		verified, err := verifier.Verify(ctx, token)
+		if err != nil {
+			return nil, err
+		}
+		return &identity{Name: verified.Username, Method: "oidc", Scopes: scopes, Groups: verified.Groups}, nil
+	}
+}
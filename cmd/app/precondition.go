@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// etag formats a store version as a strong entity tag
+func etag(version string) string {
+	return `"` + version + `"`
+}
+
+// representationETag is the entity tag of a representation of a resource version. Other formats and revealed
+// values are different representations of the same version with their own tags, the json representation with
+// redacted values is tagged with the bare version.
+func representationETag(version, format string, reveal bool) string {
+	if format == "toml" {
+		version += "-toml"
+	}
+	if reveal {
+		version += "-revealed"
+	}
+	return etag(version)
+}
+
+// tagVersion returns the version an entity tag of a representation was derived from, the versions are hex encoded
+// hashes and never contain a dash
+func tagVersion(tag string) string {
+	version := strings.Trim(tag, `"`)
+	if i := strings.Index(version, "-"); i >= 0 {
+		version = version[:i]
+	}
+	return version
+}
+
+// checkPreconditions evaluates If-Match and If-None-Match (RFC 7232) against the current version of a resource
+// and returns the status to respond with, or 0 if the request may proceed. The tag is the entity tag of the
+// representation a read responds with, If-None-Match of reads compares it and all other preconditions compare
+// the version, so a write can be conditioned on the tag of any representation.
+func checkPreconditions(r *http.Request, version, tag string, exists bool) int {
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" {
+		if !exists || !matchesETag(ifMatch, func(t string) bool { return tagVersion(t) == version }) {
+			return http.StatusPreconditionFailed
+		}
+	}
+
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" && exists {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			if matchesETag(ifNoneMatch, func(t string) bool { return t == tag }) {
+				return http.StatusNotModified
+			}
+		} else if matchesETag(ifNoneMatch, func(t string) bool { return tagVersion(t) == version }) {
+			return http.StatusPreconditionFailed
+		}
+	}
+
+	return 0
+}
+
+// matchesETag reports whether the header value is * or lists a matching entity tag, weak tags never match because
+// only strong comparison is used
+func matchesETag(header string, matches func(tag string) bool) bool {
+	if strings.TrimSpace(header) == "*" {
+		return true
+	}
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if strings.HasPrefix(tag, `"`) && matches(tag) {
+			return true
+		}
+	}
+	return false
+}
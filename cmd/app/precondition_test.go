@@ -0,0 +1,163 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCheckPreconditions(t *testing.T) {
+	version := "abc"
+	toml := representationETag(version, "toml", false)
+	tests := []struct {
+		name    string
+		method  string
+		header  string
+		value   string
+		tag     string
+		missing bool
+		status  int
+	}{
+		{name: "no preconditions", method: http.MethodGet, tag: etag(version)},
+		{name: "if-match", method: http.MethodPut, header: "If-Match", value: `"abc"`, tag: etag(version)},
+		{name: "if-match of a list", method: http.MethodPut, header: "If-Match", value: `"x", "abc"`, tag: etag(version)},
+		{name: "if-match of another representation", method: http.MethodPut, header: "If-Match", value: `"abc-toml-revealed"`, tag: etag(version)},
+		{name: "if-match of another version", method: http.MethodPut, header: "If-Match", value: `"abd"`, tag: etag(version), status: http.StatusPreconditionFailed},
+		{name: "weak if-match", method: http.MethodPut, header: "If-Match", value: `W/"abc"`, tag: etag(version), status: http.StatusPreconditionFailed},
+		{name: "if-match any", method: http.MethodPut, header: "If-Match", value: "*", tag: etag(version)},
+		{name: "if-match of a missing resource", method: http.MethodPut, header: "If-Match", value: "*", tag: etag(version), missing: true, status: http.StatusPreconditionFailed},
+		{name: "not modified", method: http.MethodGet, header: "If-None-Match", value: `"abc-toml"`, tag: toml, status: http.StatusNotModified},
+		{name: "head not modified", method: http.MethodHead, header: "If-None-Match", value: `"abc-toml"`, tag: toml, status: http.StatusNotModified},
+		{name: "other representation modified", method: http.MethodGet, header: "If-None-Match", value: `"abc"`, tag: toml},
+		{name: "revealed representation modified", method: http.MethodGet, header: "If-None-Match", value: `"abc"`, tag: representationETag(version, "json", true)},
+		{name: "create only", method: http.MethodPut, header: "If-None-Match", value: "*", tag: etag(version), status: http.StatusPreconditionFailed},
+		{name: "create only of a missing resource", method: http.MethodPut, header: "If-None-Match", value: "*", tag: etag(version), missing: true},
+		{name: "write unless representation", method: http.MethodPut, header: "If-None-Match", value: `"abc-toml"`, tag: etag(version), status: http.StatusPreconditionFailed},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, "/v1/http/router/web", nil)
+		if test.header != "" {
+			r.Header.Set(test.header, test.value)
+		}
+		if status := checkPreconditions(r, version, test.tag, !test.missing); status != test.status {
+			t.Errorf("%v: checkPreconditions = %v, want %v", test.name, status, test.status)
+		}
+	}
+}
+
+func TestRepresentationETag(t *testing.T) {
+	tags := map[string]bool{}
+	for _, format := range []string{"json", "toml"} {
+		for _, reveal := range []bool{false, true} {
+			tag := representationETag("abc", format, reveal)
+			if tags[tag] {
+				t.Errorf("%v is the tag of more than one representation", tag)
+			}
+			tags[tag] = true
+			if tagVersion(tag) != "abc" {
+				t.Errorf("tagVersion(%v) = %v, want abc", tag, tagVersion(tag))
+			}
+		}
+	}
+	if representationETag("abc", "json", false) != etag("abc") {
+		t.Errorf("the json representation is tagged %v, want %v", representationETag("abc", "json", false), etag("abc"))
+	}
+}
+
+func TestConditionalRequests(t *testing.T) {
+	s := newResourceServer(t)
+	router := `{"rule":"Host(` + "`example.com`" + `)","service":"web"}`
+	resp, _ := s.do(t, http.MethodPut, "/v1/http/router/web", router)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("create = %v, want 201", resp.StatusCode)
+	}
+	created := resp.Header.Get("ETag")
+
+	resp, _ = s.do(t, http.MethodGet, "/v1/http/router/web", "")
+	if tag := resp.Header.Get("ETag"); tag != created {
+		t.Fatalf("ETag = %v, want the one of the write %v", tag, created)
+	}
+	resp, body := s.do(t, http.MethodGet, "/v1/http/router/web", "", "If-None-Match", created)
+	if resp.StatusCode != http.StatusNotModified || body != "" {
+		t.Errorf("conditional get = %v %q, want 304 without a body", resp.StatusCode, body)
+	}
+	// the toml representation has its own tag
+	resp, body = s.do(t, http.MethodGet, "/v1/http/router/web?type=toml", "", "If-None-Match", created)
+	if resp.StatusCode != http.StatusOK || body == "" {
+		t.Errorf("conditional get of toml with the json tag = %v, want 200", resp.StatusCode)
+	}
+	toml := resp.Header.Get("ETag")
+	if toml == created {
+		t.Errorf("json and toml are both tagged %v", toml)
+	}
+	resp, _ = s.do(t, http.MethodGet, "/v1/http/router/web?type=toml", "", "If-None-Match", toml)
+	if resp.StatusCode != http.StatusNotModified {
+		t.Errorf("conditional get of toml = %v, want 304", resp.StatusCode)
+	}
+
+	// writes are conditioned on the version, the tag of any representation of it matches
+	updated := `{"rule":"Host(` + "`example.org`" + `)","service":"web"}`
+	resp, _ = s.do(t, http.MethodPut, "/v1/http/router/web", updated, "If-Match", `"outdated"`)
+	if resp.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("put with an outdated tag = %v, want 412", resp.StatusCode)
+	}
+	resp, _ = s.do(t, http.MethodPut, "/v1/http/router/web", router, "If-None-Match", "*")
+	if resp.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("create only of an existing router = %v, want 412", resp.StatusCode)
+	}
+	resp, _ = s.do(t, http.MethodPut, "/v1/http/router/web", updated, "If-Match", toml)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("put with the current toml tag = %v, want 200", resp.StatusCode)
+	}
+	current := resp.Header.Get("ETag")
+
+	// the first tag is outdated now
+	resp, _ = s.do(t, http.MethodGet, "/v1/http/router/web", "", "If-None-Match", created)
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("conditional get with an outdated tag = %v, want 200", resp.StatusCode)
+	}
+	resp, _ = s.do(t, http.MethodPatch, "/v1/http/router/web", `{"service":"api"}`, "Content-Type", contentTypeMergePatch, "If-Match", created)
+	if resp.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("patch with an outdated tag = %v, want 412", resp.StatusCode)
+	}
+	resp, _ = s.do(t, http.MethodDelete, "/v1/http/router/web", "", "If-Match", created)
+	if resp.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("delete with an outdated tag = %v, want 412", resp.StatusCode)
+	}
+	resp, _ = s.do(t, http.MethodPatch, "/v1/http/router/web", `{"service":"api"}`, "Content-Type", contentTypeMergePatch, "If-Match", current)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("patch with the current tag = %v, want 200", resp.StatusCode)
+	}
+	resp, _ = s.do(t, http.MethodDelete, "/v1/http/router/web", "", "If-Match", resp.Header.Get("ETag"))
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("delete with the current tag = %v, want 200", resp.StatusCode)
+	}
+
+	// nothing matches a missing router
+	resp, _ = s.do(t, http.MethodPut, "/v1/http/router/web", router, "If-Match", "*")
+	if resp.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("put with If-Match of a missing router = %v, want 412", resp.StatusCode)
+	}
+	resp, _ = s.do(t, http.MethodPut, "/v1/http/router/web", router, "If-None-Match", "*")
+	if resp.StatusCode != http.StatusCreated {
+		t.Errorf("create only of a missing router = %v, want 201", resp.StatusCode)
+	}
+}
+
+func TestConditionalRequestsRevealed(t *testing.T) {
+	s := newResourceServer(t)
+	resp, _ := s.do(t, http.MethodPut, "/v1/http/middleware/auth", `{"basicAuth":{"users":["admin:$apr1$hash"]}}`)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("create = %v, want 201", resp.StatusCode)
+	}
+	resp, _ = s.do(t, http.MethodGet, "/v1/http/middleware/auth", "")
+	redacted := resp.Header.Get("ETag")
+	resp, body := s.do(t, http.MethodGet, "/v1/http/middleware/auth?reveal=true", "", "If-None-Match", redacted)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, "$apr1$hash") {
+		t.Errorf("revealed get with the tag of the redacted middleware = %v %v, want 200 with the values", resp.StatusCode, body)
+	}
+	if resp.Header.Get("ETag") == redacted {
+		t.Errorf("the redacted and the revealed middleware are both tagged %v", redacted)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"kommandeur/store"
+)
+
+const contentTypeProblem = "application/problem+json"
+
+// problem is a problem details object as defined by RFC 7807
+type problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+	// Index is the failed operation of a transaction
+	Index *int `json:"index,omitempty"`
+}
+
+func newProblem(r *http.Request, status int, err error) problem {
+	p := problem{
+		Type:     "about:blank",
+		Title:    http.StatusText(status),
+		Status:   status,
+		Instance: r.URL.Path,
+	}
+	// details of server errors stay in the log, they may leak paths of the backend
+	if err != nil && status < http.StatusInternalServerError {
+		p.Detail = err.Error()
+	}
+	return p
+}
+
+func (p problem) write(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", contentTypeProblem)
+	w.WriteHeader(p.Status)
+	json.NewEncoder(w).Encode(p)
+}
+
+// writeProblem responds with a problem details body, err is used as detail
+func writeProblem(w http.ResponseWriter, r *http.Request, status int, err error) {
+	newProblem(r, status, err).write(w)
+}
+
+// writeStoreProblem responds with the status matching the store error, the detail is only the store error
+// because the wrapped errors contain backend details like file paths
+func writeStoreProblem(w http.ResponseWriter, r *http.Request, err error) {
+	// invalid input is described without backend details
+	if errors.Is(err, store.ErrInvalidName) || errors.Is(err, store.ErrInvalidListOptions) || errors.Is(err, store.ErrInvalidValue) {
+		writeProblem(w, r, storeStatus(err), err)
+		return
+	}
+	for _, sentinel := range []error{store.ErrNotFound, store.ErrAlreadyExists, store.ErrConflict, store.ErrUnavailable} {
+		if errors.Is(err, sentinel) {
+			writeProblem(w, r, storeStatus(err), sentinel)
+			return
+		}
+	}
+	writeProblem(w, r, http.StatusInternalServerError, err)
+}
+
+// writeOperationProblem responds to a rejected operation of a transaction, the problem has the index of the operation
+func writeOperationProblem(w http.ResponseWriter, r *http.Request, operationErr *store.OperationError) {
+	status := storeStatus(operationErr.Err)
+	if status == http.StatusInternalServerError {
+		// operations which are not store errors are malformed
+		status = http.StatusUnprocessableEntity
+	}
+	p := newProblem(r, status, operationErr.Err)
+	p.Index = &operationErr.Index
+	p.write(w)
+}
+
+// writePreconditionProblem responds to a failed precondition, 304 responses must not have a body
+func writePreconditionProblem(w http.ResponseWriter, r *http.Request, status int) {
+	if status == http.StatusNotModified {
+		w.WriteHeader(status)
+		return
+	}
+	writeProblem(w, r, status, nil)
+}
+
+// storeStatus maps the store errors to http statuses
+func storeStatus(err error) int {
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, store.ErrAlreadyExists), errors.Is(err, store.ErrConflict):
+		return http.StatusConflict
+	case errors.Is(err, store.ErrInvalidName), errors.Is(err, store.ErrInvalidListOptions):
+		return http.StatusBadRequest
+	case errors.Is(err, store.ErrInvalidValue):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, store.ErrUnavailable):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
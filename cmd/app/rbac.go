@@ -0,0 +1,435 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/traefik/traefik/v2/pkg/config/dynamic"
+	"kommandeur/analysis"
+	"kommandeur/rbac"
+	"kommandeur/store"
+)
+
+// access decides with the rbac policy what an identity may do, without a policy everything is allowed
+type access struct {
+	policy *rbac.Policy
+	stores *store.Stores
+}
+
+// personalSubjects are the subjects of the identity without its groups. A token is bound as token:<id> and as the
+// personal subjects of the identity which issued it, what it may do is still limited by its scopes. The groups of
+// the issuer are not carried over, they are only known while the identity provider vouches for them.
+func (id *identity) personalSubjects() []string {
+	name := id.Name
+	switch id.Method {
+	case "oidc":
+		name = "oidc:" + name
+	case "certificate":
+		name = "cert:" + name
+	}
+	return append([]string{name}, id.Creators...)
+}
+
+// subjects are the names the identity can be bound to roles with. Users of an identity provider or with a client
+// certificate are bound as oidc:<name> and cert:<name>, so they can not take over the bindings of other subjects
+// by their name, e.g. a user named group:admins. Their groups are bound as group:<name>.
+func (id *identity) subjects() []string {
+	subjects := id.personalSubjects()
+	for _, group := range id.Groups {
+		subjects = append(subjects, "group:"+group)
+	}
+	return subjects
+}
+
+// allowed decides on a request of the identity, the labels of named store resources are looked up if
+// they are not given
+func (a *access) allowed(ctx context.Context, id *identity, verb, kind, name string, labels map[string]string) (bool, error) {
+	if a == nil || a.policy == nil || id == nil {
+		return true, nil
+	}
+	if labels == nil && name != "" && isKind(kind) && a.stores.Labels != nil {
+		var err error
+		labels, err = a.stores.Labels.Get(ctx, kind, name)
+		if err != nil && !errors.Is(err, store.ErrInvalidName) {
+			return false, fmt.Errorf("failed to get labels of %v %v: %w", kind, name, err)
+		}
+	}
+	return a.policy.Allowed(rbac.Request{Subjects: id.subjects(), Verb: verb, Kind: kind, Name: name, Labels: labels}), nil
+}
+
+// allowedResource decides on a request on a single store resource. A resource which is created has no labels yet,
+// only the new ones are checked. Other requests have to be allowed with the current labels and with the new ones
+// if they are given, so a resource can not be moved into or out of a selector. Other requests are decided by
+// allowed.
+func (a *access) allowedResource(ctx context.Context, id *identity, verb, kind, name string, labels map[string]string) (bool, error) {
+	if !isKind(kind) || name == "" {
+		return a.allowed(ctx, id, verb, kind, name, labels)
+	}
+	if verb == rbac.VerbCreate {
+		if labels == nil {
+			labels = map[string]string{}
+		}
+		return a.allowed(ctx, id, verb, kind, name, labels)
+	}
+	ok, err := a.allowed(ctx, id, verb, kind, name, nil)
+	if err != nil || !ok || labels == nil {
+		return ok, err
+	}
+	return a.allowed(ctx, id, verb, kind, name, labels)
+}
+
+// check writes a problem and returns false if the identity of the request may not do it
+func (a *access) check(w http.ResponseWriter, r *http.Request, verb, kind, name string, labels map[string]string) bool {
+	id := identityFrom(r.Context())
+	ok, err := a.allowedResource(r.Context(), id, verb, kind, name, labels)
+	if err != nil {
+		fmt.Printf("failed to check access: %v", err)
+		writeStoreProblem(w, r, err)
+		return false
+	}
+	if !ok {
+		writeProblem(w, r, http.StatusForbidden, forbidden(id, verb, kind, name))
+		return false
+	}
+	return true
+}
+
+// deniedReference returns the first secret the resource references which the identity may not use, it is empty if
+// all of them may be used. Every reference of a written resource is checked, not only the new ones, so a reference
+// can not be moved into another field, e.g. into the address of a forward auth middleware.
+func (a *access) deniedReference(ctx context.Context, id *identity, resource interface{}) (string, error) {
+	if a == nil || a.policy == nil || id == nil {
+		return "", nil
+	}
+	references, err := store.References(resource)
+	if err != nil {
+		return "", err
+	}
+	for _, reference := range references {
+		ok, err := a.allowed(ctx, id, rbac.VerbUse, rbac.KindSecret, reference, nil)
+		if err != nil || !ok {
+			return reference, err
+		}
+	}
+	return "", nil
+}
+
+// checkReferences writes a problem and returns false if the resource references a secret the identity of the
+// request may not use
+func (a *access) checkReferences(w http.ResponseWriter, r *http.Request, resource interface{}) bool {
+	id := identityFrom(r.Context())
+	reference, err := a.deniedReference(r.Context(), id, resource)
+	if err != nil {
+		fmt.Printf("failed to check access: %v", err)
+		writeStoreProblem(w, r, err)
+		return false
+	}
+	if reference != "" {
+		writeProblem(w, r, http.StatusForbidden, forbidden(id, rbac.VerbUse, rbac.KindSecret, reference))
+		return false
+	}
+	return true
+}
+
+func forbidden(id *identity, verb, kind, name string) error {
+	if name == "" {
+		return fmt.Errorf("%v may not %v %vs", id.Name, verb, kind)
+	}
+	return fmt.Errorf("%v may not %v %v %v", id.Name, verb, kind, name)
+}
+
+// filter restricts a list to the resources the identity may list, it is nil if nothing is restricted
+func (a *access) filter(id *identity, kind string) func(ctx context.Context, name string) (bool, error) {
+	if a == nil || a.policy == nil || id == nil {
+		return nil
+	}
+	return func(ctx context.Context, name string) (bool, error) {
+		return a.allowed(ctx, id, rbac.VerbList, kind, name, nil)
+	}
+}
+
+// visibleRouters removes the routers the identity may not list, so analyses of the routers do not reveal the
+// routers of others
+func (a *access) visibleRouters(ctx context.Context, id *identity, routers map[string]*dynamic.Router) error {
+	filter := a.filter(id, store.KindRouter)
+	if filter == nil {
+		return nil
+	}
+	for name := range routers {
+		ok, err := filter(ctx, name)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			delete(routers, name)
+		}
+	}
+	return nil
+}
+
+// visibleFindings returns the findings whose routers the identity may all list
+func (a *access) visibleFindings(ctx context.Context, id *identity, findings []analysis.Finding) ([]analysis.Finding, error) {
+	filter := a.filter(id, store.KindRouter)
+	if filter == nil {
+		return findings, nil
+	}
+	visible := make([]analysis.Finding, 0, len(findings))
+	for _, finding := range findings {
+		ok := true
+		for _, name := range finding.Routers {
+			var err error
+			ok, err = filter(ctx, name)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				break
+			}
+		}
+		if ok {
+			visible = append(visible, finding)
+		}
+	}
+	return visible, nil
+}
+
+// writeVerb is create if the resource does not exist yet and update otherwise
+func (a *access) writeVerb(ctx context.Context, kind, name string) (string, error) {
+	var err error
+	switch kind {
+	case store.KindRouter:
+		_, err = a.stores.Routers.Version(ctx, name)
+	case store.KindService:
+		_, err = a.stores.Services.Version(ctx, name)
+	case store.KindMiddleware:
+		_, err = a.stores.Middlewares.Version(ctx, name)
+	}
+	if errors.Is(err, store.ErrNotFound) {
+		return rbac.VerbCreate, nil
+	}
+	if err != nil && !errors.Is(err, store.ErrInvalidName) {
+		return "", err
+	}
+	return rbac.VerbUpdate, nil
+}
+
+func isKind(kind string) bool {
+	return kind == store.KindRouter || kind == store.KindService || kind == store.KindMiddleware
+}
+
+// methodVerb maps the method of a request on a collection or a single resource to a verb
+func methodVerb(method string, single bool) string {
+	switch method {
+	case http.MethodGet, http.MethodHead:
+		if single {
+			return rbac.VerbGet
+		}
+		return rbac.VerbList
+	case http.MethodPost:
+		return rbac.VerbCreate
+	case http.MethodDelete:
+		return rbac.VerbDelete
+	default:
+		return rbac.VerbUpdate
+	}
+}
+
+// enforce evaluates the policy for every /v1 request. Requests on a single store resource are decided here,
+// the handlers of lists, bulk writes, transactions and syncs check every resource they touch themselves.
+func enforce(a *access) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if a == nil || a.policy == nil {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := context.WithTimeout(r.Context(), time.Second*10)
+			defer cancel()
+
+			kind, name, verb, labels, err := a.describe(ctx, r)
+			if err != nil {
+				fmt.Printf("failed to check access: %v", err)
+				writeStoreProblem(w, r, err)
+				return
+			}
+			if kind == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if !a.check(w, r.WithContext(ctx), verb, kind, name, labels) {
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// describe maps a request to the kind, name and verb it is checked with and the labels it sets, the kind is
+// empty for requests which are not checked here
+func (a *access) describe(ctx context.Context, r *http.Request) (string, string, string, map[string]string, error) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/v1"), "/"), "/")
+	switch parts[0] {
+	case "auth":
+		return "", "", "", nil, nil
+	case "transactions":
+		return "", "", "", nil, nil
+	case "config":
+		// a sync is checked per operation, reading the configuration is not possible here
+		return "", "", "", nil, nil
+	case "api", "quarantine":
+		// the configuration as a whole can only be read by identities which may read all of it
+		return "config", "", rbac.VerbGet, nil, nil
+	case "events":
+		// the events of the resources the identity may not get are filtered out by the handler
+		return "", "", "", nil, nil
+	case "simulate":
+		// the simulation only considers the routers the identity may list
+		return store.KindRouter, "", rbac.VerbList, nil, nil
+	case "audit":
+		return "audit", "", methodVerb(r.Method, false), nil, nil
+	case "webhooks", "tokens":
+		kind := strings.TrimSuffix(parts[0], "s")
+		if len(parts) == 1 {
+			return kind, "", methodVerb(r.Method, false), nil, nil
+		}
+		return kind, parts[1], methodVerb(r.Method, true), nil, nil
+	case "http":
+	default:
+		return rbac.Any, "", methodVerb(r.Method, false), nil, nil
+	}
+
+	if len(parts) < 2 {
+		return rbac.Any, "", methodVerb(r.Method, false), nil, nil
+	}
+	kind := strings.TrimSuffix(parts[1], "s")
+	if !isKind(kind) {
+		return rbac.Any, "", methodVerb(r.Method, false), nil, nil
+	}
+	switch {
+	case len(parts) == 2 && parts[1] == kind+"s", len(parts) == 3 && parts[1] == kind+"s" && parts[2] == "conflicts":
+		return kind, "", rbac.VerbList, nil, nil
+	case len(parts) == 2:
+		// bulk writes check every resource in their handlers
+		return "", "", "", nil, nil
+	}
+
+	name := parts[2]
+	verb := methodVerb(r.Method, true)
+	if r.Method == http.MethodPut && len(parts) == 3 {
+		var err error
+		verb, err = a.writeVerb(ctx, kind, name)
+		if err != nil {
+			return "", "", "", nil, err
+		}
+	}
+	if len(parts) == 4 && parts[3] == "labels" && r.Method == http.MethodPut {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return "", "", "", nil, err
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		labels := map[string]string{}
+		// a body which can not be decoded is rejected by the handler
+		if json.Unmarshal(body, &labels) == nil {
+			return kind, name, rbac.VerbUpdate, labels, nil
+		}
+		return kind, name, rbac.VerbUpdate, nil, nil
+	}
+	return kind, name, verb, nil, nil
+}
+
+// checkOperations checks every operation of a transaction or sync, creates are checked with the labels they set
+// and updates with the current and the new labels. The secrets the written resources reference have to be usable.
+func (a *access) checkOperations(w http.ResponseWriter, r *http.Request, operations []store.Operation) bool {
+	id := identityFrom(r.Context())
+	for i, operation := range operations {
+		ok, err := a.allowedResource(r.Context(), id, operation.Op, operation.Kind, operation.Name, operation.Labels)
+		if err != nil {
+			fmt.Printf("failed to check access: %v", err)
+			writeStoreProblem(w, r, err)
+			return false
+		}
+		problem := forbidden(id, operation.Op, operation.Kind, operation.Name)
+		if ok {
+			reference, err := a.deniedReference(r.Context(), id, []interface{}{operation.Router, operation.Service, operation.Middleware})
+			if err != nil {
+				fmt.Printf("failed to check access: %v", err)
+				writeStoreProblem(w, r, err)
+				return false
+			}
+			if reference != "" {
+				ok = false
+				problem = forbidden(id, rbac.VerbUse, rbac.KindSecret, reference)
+			}
+		}
+		if !ok {
+			index := i
+			p := newProblem(r, http.StatusForbidden, problem)
+			p.Index = &index
+			p.write(w)
+			return false
+		}
+	}
+	return true
+}
+
+// checkWrites checks writes of whole resources of a kind, e.g. by the bulk handlers
+func (a *access) checkWrites(w http.ResponseWriter, r *http.Request, kind string, names []string) bool {
+	for _, name := range names {
+		verb, err := a.writeVerb(r.Context(), kind, name)
+		if err != nil {
+			fmt.Printf("failed to check access: %v", err)
+			writeStoreProblem(w, r, err)
+			return false
+		}
+		if !a.check(w, r, verb, kind, name, nil) {
+			return false
+		}
+	}
+	return true
+}
+
+// canIHandler tells the client whether it may do something, e.g. ?verb=create&kind=router&name=a&labels=team=a
+func canIHandler(a *access) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), time.Second*10)
+		defer cancel()
+
+		v := r.URL.Query()
+		verb, kind, name := v.Get("verb"), v.Get("kind"), v.Get("name")
+		if verb == "" || kind == "" {
+			writeProblem(w, r, http.StatusBadRequest, fmt.Errorf("verb and kind are required"))
+			return
+		}
+		var labels map[string]string
+		if v.Get("labels") != "" {
+			selector, err := store.ParseSelector(v.Get("labels"))
+			if err != nil {
+				writeProblem(w, r, http.StatusBadRequest, err)
+				return
+			}
+			labels = selector
+		}
+
+		id := identityFrom(ctx)
+		allowed, err := a.allowedResource(ctx, id, verb, kind, name, labels)
+		if err != nil {
+			fmt.Printf("failed to check access: %v", err)
+			writeStoreProblem(w, r, err)
+			return
+		}
+
+		type Response struct {
+			Allowed  bool      `json:"allowed"`
+			Identity *identity `json:"identity,omitempty"`
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(Response{Allowed: allowed, Identity: id})
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"kommandeur/rbac"
+	"kommandeur/store"
+)
+
+// revealed reports whether a response may contain the sensitive values of a resource. They are redacted unless
+// the client asks for them with ?reveal=true, which requires write access to the resource and the reveal verb
+// of the rbac policy. A problem is written and ok is false if the client may not see them.
+func revealed(w http.ResponseWriter, r *http.Request, a *access, kind, name string) (reveal bool, ok bool) {
+	reveal, ok = revealRequested(w, r, kind)
+	if !reveal || !ok {
+		return false, ok
+	}
+	return true, a.check(w, r, rbac.VerbReveal, kind, name, nil)
+}
+
+// revealRequested reports whether the client asks for the sensitive values of resources of the kind and may write
+// them, the reveal verb has to be checked for every resource
+func revealRequested(w http.ResponseWriter, r *http.Request, kind string) (reveal bool, ok bool) {
+	value := r.URL.Query().Get("reveal")
+	if value == "" {
+		return false, true
+	}
+	reveal, err := strconv.ParseBool(value)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, fmt.Errorf("invalid reveal %v", value))
+		return false, false
+	}
+	if !reveal {
+		return false, true
+	}
+
+	id := identityFrom(r.Context())
+	if !id.allowed(kindResource(kind), verbWrite) {
+		writeProblem(w, r, http.StatusForbidden, fmt.Errorf("%v may not reveal the sensitive values of %vs", id.Name, kind))
+		return false, false
+	}
+	return true, true
+}
+
+// revealEvent decrypts the sensitive values of the middleware before and after the change, the contents of the
+// events are the stored ones which are encrypted if encryption is enabled
+func revealEvent(event store.Event, encrypted *store.HTTPMiddlewareStoreEncrypted) (store.Event, error) {
+	if encrypted == nil {
+		return event, nil
+	}
+	for _, content := range []*json.RawMessage{&event.Before, &event.After} {
+		if len(*content) == 0 {
+			continue
+		}
+		decrypted, err := encrypted.DecryptJSON(event.Name, *content)
+		if err != nil {
+			return event, err
+		}
+		*content = decrypted
+	}
+	return event, nil
+}
+
+// redactEvent masks the sensitive values of the resource before and after the change
+func redactEvent(event store.Event) store.Event {
+	for _, content := range []*json.RawMessage{&event.Before, &event.After} {
+		if len(*content) == 0 {
+			continue
+		}
+		redacted, err := store.RedactJSON(*content)
+		if err != nil {
+			// the content has been decoded before it was emitted, so this does not happen
+			*content = nil
+			continue
+		}
+		*content = redacted
+	}
+	return event
+}
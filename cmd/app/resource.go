@@ -0,0 +1,625 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/evanphx/json-patch"
+	"github.com/gorilla/mux"
+	"github.com/traefik/traefik/v2/pkg/config/dynamic"
+	"kommandeur/analysis"
+	"kommandeur/store"
+)
+
+// defaultListLimit is used if the limit query parameter is missing
+const defaultListLimit = 20
+
+const (
+	contentTypeMergePatch = "application/merge-patch+json"
+	contentTypeJSONPatch  = "application/json-patch+json"
+)
+
+// resource wraps one of the typed stores, so handlers working on a single bare resource are only written once
+type resource struct {
+	kind string
+	// create returns a new empty resource to decode into
+	create  func() interface{}
+	get     func(ctx context.Context, name string) (interface{}, error)
+	set     func(ctx context.Context, name string, value interface{}) error
+	delete  func(ctx context.Context, name string) error
+	version func(ctx context.Context, name string) (string, error)
+	names   func(ctx context.Context, options store.ListOptions) (*store.Page, error)
+	// lock holds off other writes to the store, so preconditions are checked against the state that is written
+	lock func(ctx context.Context) (context.Context, func(), error)
+	// filter is optional and creates a filter for the list from the query
+	filter func(query url.Values) func(ctx context.Context, name string) (bool, error)
+	labels store.LabelStore
+	// redact is optional and returns a copy of a resource without its sensitive values
+	redact func(value interface{}) interface{}
+	// conflicts is optional and analyzes a written resource, the findings are returned as warnings
+	conflicts func(ctx context.Context, name string) ([]analysis.Finding, error)
+}
+
+// addWarnings adds a Warning header for every finding of the analysis of a written resource, findings with
+// routers the client may not see are left out
+func addWarnings(ctx context.Context, w http.ResponseWriter, res resource, a *access, name string) {
+	if res.conflicts == nil {
+		return
+	}
+	findings, err := res.conflicts(ctx, name)
+	if err == nil {
+		findings, err = a.visibleFindings(ctx, identityFrom(ctx), findings)
+	}
+	if err != nil {
+		fmt.Printf("failed to analyze %v %v: %v", res.kind, name, err)
+		return
+	}
+	for _, finding := range findings {
+		w.Header().Add("Warning", fmt.Sprintf("299 kommandeur %q", finding.Message))
+	}
+}
+
+func routerResource(s store.HTTPRouterStore, labels store.LabelStore) resource {
+	return resource{
+		kind:   store.KindRouter,
+		create: func() interface{} { return &dynamic.Router{} },
+		get: func(ctx context.Context, name string) (interface{}, error) {
+			return s.Get(ctx, name)
+		},
+		set: func(ctx context.Context, name string, value interface{}) error {
+			return s.Set(ctx, name, value.(*dynamic.Router))
+		},
+		delete:  s.Delete,
+		version: s.Version,
+		lock:    s.Lock,
+		names:   s.Names,
+		filter: func(query url.Values) func(ctx context.Context, name string) (bool, error) {
+			filter := store.RouterFilter{
+				EntryPoint: query.Get("entryPoint"),
+				Service:    query.Get("service"),
+				Middleware: query.Get("middleware"),
+				Rule:       query.Get("rule"),
+			}
+			if filter.Empty() {
+				return nil
+			}
+			return func(ctx context.Context, name string) (bool, error) {
+				router, err := s.Get(ctx, name)
+				if err != nil {
+					return false, err
+				}
+				return filter.Matches(router), nil
+			}
+		},
+		labels: labels,
+		conflicts: func(ctx context.Context, name string) ([]analysis.Finding, error) {
+			routers, err := s.GetAll(ctx, 0, -1)
+			if err != nil {
+				return nil, err
+			}
+			return analysis.ConflictsOf(routers, name), nil
+		},
+	}
+}
+
+func serviceResource(s store.HTTPServiceStore, labels store.LabelStore) resource {
+	return resource{
+		kind:   store.KindService,
+		create: func() interface{} { return &dynamic.Service{} },
+		get: func(ctx context.Context, name string) (interface{}, error) {
+			return s.Get(ctx, name)
+		},
+		set: func(ctx context.Context, name string, value interface{}) error {
+			return s.Set(ctx, name, value.(*dynamic.Service))
+		},
+		delete:  s.Delete,
+		version: s.Version,
+		lock:    s.Lock,
+		names:   s.Names,
+		labels:  labels,
+	}
+}
+
+func middlewareResource(s store.HTTPMiddlewareStore, labels store.LabelStore) resource {
+	return resource{
+		kind:   store.KindMiddleware,
+		create: func() interface{} { return &dynamic.Middleware{} },
+		get: func(ctx context.Context, name string) (interface{}, error) {
+			return s.Get(ctx, name)
+		},
+		set: func(ctx context.Context, name string, value interface{}) error {
+			return s.Set(ctx, name, value.(*dynamic.Middleware))
+		},
+		delete:  s.Delete,
+		version: s.Version,
+		lock:    s.Lock,
+		names:   s.Names,
+		labels:  labels,
+		redact: func(value interface{}) interface{} {
+			return store.RedactMiddleware(value.(*dynamic.Middleware))
+		},
+	}
+}
+
+// listHandler returns a page of names with HAL links to the resources and the pages before and after it
+func listHandler(res resource, accessControl *access) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), time.Second*10)
+		defer cancel()
+
+		v := r.URL.Query()
+		options := store.ListOptions{
+			Cursor: v.Get("cursor"),
+			Limit:  defaultListLimit,
+			Sort:   v.Get("sort"),
+			Order:  v.Get("order"),
+		}
+		if limit := v.Get("limit"); limit != "" {
+			var err error
+			options.Limit, err = strconv.Atoi(limit)
+			if err != nil || options.Limit <= 0 {
+				fmt.Printf("invalid limit %v", limit)
+				writeProblem(w, r, http.StatusBadRequest, fmt.Errorf("invalid limit %v", limit))
+				return
+			}
+		}
+		if res.filter != nil {
+			options.Filter = res.filter(v)
+		}
+		// only the resources the client may see are listed
+		if visible := accessControl.filter(identityFrom(ctx), res.kind); visible != nil {
+			filter := options.Filter
+			options.Filter = func(ctx context.Context, name string) (bool, error) {
+				if filter != nil {
+					ok, err := filter(ctx, name)
+					if err != nil || !ok {
+						return ok, err
+					}
+				}
+				return visible(ctx, name)
+			}
+		}
+
+		page, err := res.names(ctx, options)
+		if err != nil {
+			fmt.Printf("failed to list %vs: %v", res.kind, err)
+			writeStoreProblem(w, r, err)
+			return
+		}
+
+		type Link struct {
+			Href string `json:"href"`
+		}
+
+		type HML map[string]Link
+
+		type Name struct {
+			Name  string `json:"name"`
+			Links HML    `json:"_links"`
+		}
+
+		type Response struct {
+			Names []Name `json:"names"`
+			Links HML    `json:"_links"`
+		}
+
+		// links keep every query parameter and only replace the cursor
+		link := func(cursor string) Link {
+			query := r.URL.Query()
+			query.Del("cursor")
+			if cursor != "" {
+				query.Set("cursor", cursor)
+			}
+			href := "/v1/http/" + res.kind + "s"
+			if encoded := query.Encode(); encoded != "" {
+				href += "?" + encoded
+			}
+			return Link{Href: href}
+		}
+
+		response := Response{
+			Names: make([]Name, 0),
+			Links: HML{
+				"self": link(options.Cursor),
+			},
+		}
+		if page.Next != "" {
+			response.Links["next"] = link(page.Next)
+		}
+		if page.Prev != "" {
+			response.Links["prev"] = link(page.Prev)
+		}
+
+		for _, name := range page.Names {
+			response.Names = append(response.Names, Name{
+				Name: name,
+				Links: HML{
+					"self": {
+						Href: "/v1/http/" + res.kind + "/" + name,
+					},
+				},
+			})
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+// getHandler returns a single resource together with the entity tag of its representation, sensitive values are
+// redacted unless they are revealed
+func getHandler(res resource, accessControl *access) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), time.Second*10)
+		defer cancel()
+
+		name, ok := mux.Vars(r)["name"]
+		if !ok {
+			fmt.Printf("did not find name")
+			writeProblem(w, r, http.StatusInternalServerError, nil)
+			return
+		}
+
+		contentType := r.URL.Query().Get("type")
+		if contentType == "" {
+			contentType = "json"
+		}
+
+		version, err := res.version(ctx, name)
+		if err != nil {
+			fmt.Printf("failed to get %v for %v from store: %v\n", res.kind, name, err)
+			writeStoreProblem(w, r, err)
+			return
+		}
+		reveal, ok := revealed(w, r.WithContext(ctx), accessControl, res.kind, name)
+		if !ok {
+			return
+		}
+		reveal = reveal && res.redact != nil
+		// the version is a hash of the stored content, every representation of it has its own tag
+		tag := representationETag(version, contentType, reveal)
+		w.Header().Set("ETag", tag)
+		if status := checkPreconditions(r, version, tag, true); status != 0 {
+			writePreconditionProblem(w, r, status)
+			return
+		}
+		value, err := res.get(ctx, name)
+		if err != nil {
+			fmt.Printf("failed to get %v for %v from store: %v\n", res.kind, name, err)
+			writeStoreProblem(w, r, err)
+			return
+		}
+		if res.redact != nil && !reveal {
+			value = res.redact(value)
+		}
+		switch contentType {
+		case "toml":
+			w.Header().Set("Content-Type", "application/toml")
+			toml.NewEncoder(w).Encode(value)
+		case "json":
+			fallthrough
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(value)
+		}
+	}
+}
+
+// deleteHandler deletes a single resource
+func deleteHandler(res resource) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), time.Second*10)
+		defer cancel()
+
+		name, ok := mux.Vars(r)["name"]
+		if !ok {
+			fmt.Printf("did not find name")
+			writeProblem(w, r, http.StatusInternalServerError, nil)
+			return
+		}
+
+		ctx, unlock, err := res.lock(ctx)
+		if err != nil {
+			fmt.Printf("failed to lock the %vs: %v\n", res.kind, err)
+			writeStoreProblem(w, r, err)
+			return
+		}
+		defer unlock()
+
+		version, err := res.version(ctx, name)
+		if err != nil && !errors.Is(err, store.ErrNotFound) {
+			fmt.Printf("failed to get %v for %v from store: %v\n", res.kind, name, err)
+			writeStoreProblem(w, r, err)
+			return
+		}
+		if status := checkPreconditions(r, version, etag(version), err == nil); status != 0 {
+			writePreconditionProblem(w, r, status)
+			return
+		}
+
+		err = res.delete(ctx, name)
+		if err != nil {
+			fmt.Printf("could not delete %v: %v", name, err)
+			writeStoreProblem(w, r, err)
+			return
+		}
+		err = res.labels.Delete(ctx, res.kind, name)
+		if err != nil {
+			fmt.Printf("could not delete the labels of %v: %v", name, err)
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// getLabelsHandler returns the labels of a single resource
+func getLabelsHandler(res resource) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), time.Second*10)
+		defer cancel()
+
+		name, ok := mux.Vars(r)["name"]
+		if !ok {
+			fmt.Printf("did not find name")
+			writeProblem(w, r, http.StatusInternalServerError, nil)
+			return
+		}
+
+		_, err := res.version(ctx, name)
+		if err != nil {
+			fmt.Printf("failed to get %v for %v from store: %v\n", res.kind, name, err)
+			writeStoreProblem(w, r, err)
+			return
+		}
+		labels, err := res.labels.Get(ctx, res.kind, name)
+		if err != nil {
+			fmt.Printf("failed to get the labels of %v %v: %v", res.kind, name, err)
+			writeStoreProblem(w, r, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(labels)
+	}
+}
+
+// putLabelsHandler replaces the labels of a single resource
+func putLabelsHandler(res resource) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), time.Second*10)
+		defer cancel()
+
+		name, ok := mux.Vars(r)["name"]
+		if !ok {
+			fmt.Printf("did not find name")
+			writeProblem(w, r, http.StatusInternalServerError, nil)
+			return
+		}
+
+		labels := map[string]string{}
+		err := json.NewDecoder(r.Body).Decode(&labels)
+		if err != nil {
+			fmt.Printf("failed to put the labels of %v %v: failed to decode r.Body: %v", res.kind, name, err)
+			writeProblem(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		_, err = res.version(ctx, name)
+		if err != nil {
+			fmt.Printf("failed to get %v for %v from store: %v\n", res.kind, name, err)
+			writeStoreProblem(w, r, err)
+			return
+		}
+		err = res.labels.Set(ctx, res.kind, name, labels)
+		if err != nil {
+			fmt.Printf("failed to store the labels of %v %v: %v", res.kind, name, err)
+			writeStoreProblem(w, r, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// putHandler creates or replaces a single resource with the bare resource in the body
+func putHandler(res resource, accessControl *access) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), time.Second*10)
+		defer cancel()
+
+		name, ok := mux.Vars(r)["name"]
+		if !ok {
+			fmt.Printf("did not find name")
+			writeProblem(w, r, http.StatusInternalServerError, nil)
+			return
+		}
+
+		contentType := r.URL.Query().Get("type")
+		if contentType == "" {
+			contentType = "json"
+		}
+
+		value := res.create()
+		switch contentType {
+		case "toml":
+			_, err := toml.DecodeReader(r.Body, value)
+			if err != nil {
+				fmt.Printf("failed to put %v %v from toml: failed to decode r.Body: %v", res.kind, name, err)
+				writeProblem(w, r, http.StatusBadRequest, err)
+				return
+			}
+		case "json":
+			fallthrough
+		default:
+			err := json.NewDecoder(r.Body).Decode(value)
+			if err != nil {
+				fmt.Printf("failed to put %v %v from json: failed to decode r.Body: %v", res.kind, name, err)
+				writeProblem(w, r, http.StatusBadRequest, err)
+				return
+			}
+		}
+
+		if !accessControl.checkReferences(w, r.WithContext(ctx), value) {
+			return
+		}
+
+		ctx, unlock, err := res.lock(ctx)
+		if err != nil {
+			fmt.Printf("failed to lock the %vs: %v\n", res.kind, err)
+			writeStoreProblem(w, r, err)
+			return
+		}
+		defer unlock()
+
+		version, err := res.version(ctx, name)
+		if err != nil && !errors.Is(err, store.ErrNotFound) {
+			fmt.Printf("failed to get %v for %v from store: %v\n", res.kind, name, err)
+			writeStoreProblem(w, r, err)
+			return
+		}
+		created := errors.Is(err, store.ErrNotFound)
+		if status := checkPreconditions(r, version, etag(version), !created); status != 0 {
+			writePreconditionProblem(w, r, status)
+			return
+		}
+
+		err = res.set(ctx, name, value)
+		if err != nil {
+			fmt.Printf("failed to store the %v %v: %v", res.kind, name, err)
+			writeStoreProblem(w, r, err)
+			return
+		}
+
+		if version, err := res.version(ctx, name); err == nil {
+			w.Header().Set("ETag", etag(version))
+		}
+		// the resource is stored, conflicts are only reported as warnings
+		addWarnings(ctx, w, res, accessControl, name)
+		if created {
+			w.Header().Set("Location", "/v1/http/"+res.kind+"/"+name)
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// patchHandler applies either a JSON Merge Patch (RFC 7386) or a JSON Patch (RFC 6902) to an existing resource,
+// the format is selected by the Content-Type of the request. The patch applies to the unredacted resource,
+// the response is redacted unless it is revealed.
+func patchHandler(res resource, accessControl *access) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), time.Second*10)
+		defer cancel()
+
+		name, ok := mux.Vars(r)["name"]
+		if !ok {
+			fmt.Printf("did not find name")
+			writeProblem(w, r, http.StatusInternalServerError, nil)
+			return
+		}
+
+		mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil || (mediaType != contentTypeMergePatch && mediaType != contentTypeJSONPatch) {
+			w.Header().Set("Accept-Patch", contentTypeMergePatch+", "+contentTypeJSONPatch)
+			writeProblem(w, r, http.StatusUnsupportedMediaType, fmt.Errorf("patches have to be sent as %v or %v", contentTypeMergePatch, contentTypeJSONPatch))
+			return
+		}
+
+		reveal, ok := revealed(w, r.WithContext(ctx), accessControl, res.kind, name)
+		if !ok {
+			return
+		}
+
+		patch, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			fmt.Printf("failed to patch %v %v: failed to read r.Body: %v", res.kind, name, err)
+			writeProblem(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		ctx, unlock, err := res.lock(ctx)
+		if err != nil {
+			fmt.Printf("failed to lock the %vs: %v\n", res.kind, err)
+			writeStoreProblem(w, r, err)
+			return
+		}
+		defer unlock()
+
+		version, err := res.version(ctx, name)
+		if err != nil && !errors.Is(err, store.ErrNotFound) {
+			fmt.Printf("failed to get %v for %v from store: %v\n", res.kind, name, err)
+			writeStoreProblem(w, r, err)
+			return
+		}
+		if status := checkPreconditions(r, version, etag(version), err == nil); status != 0 {
+			writePreconditionProblem(w, r, status)
+			return
+		}
+		current, err := res.get(ctx, name)
+		if err != nil {
+			fmt.Printf("failed to get %v %v from store: %v\n", res.kind, name, err)
+			writeStoreProblem(w, r, err)
+			return
+		}
+		document, err := json.Marshal(current)
+		if err != nil {
+			fmt.Printf("failed to encode %v %v: %v", res.kind, name, err)
+			writeProblem(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		var patched []byte
+		switch mediaType {
+		case contentTypeMergePatch:
+			patched, err = jsonpatch.MergePatch(document, patch)
+		case contentTypeJSONPatch:
+			var operations jsonpatch.Patch
+			operations, err = jsonpatch.DecodePatch(patch)
+			if err == nil {
+				patched, err = operations.Apply(document)
+			}
+		}
+		if err != nil {
+			fmt.Printf("failed to patch %v %v: %v", res.kind, name, err)
+			writeProblem(w, r, http.StatusUnprocessableEntity, err)
+			return
+		}
+
+		value := res.create()
+		err = json.Unmarshal(patched, value)
+		if err != nil {
+			fmt.Printf("failed to patch %v %v: the result is not a valid %v: %v", res.kind, name, res.kind, err)
+			writeProblem(w, r, http.StatusUnprocessableEntity, err)
+			return
+		}
+		if !accessControl.checkReferences(w, r.WithContext(ctx), value) {
+			return
+		}
+
+		err = res.set(ctx, name, value)
+		if err != nil {
+			fmt.Printf("failed to store the %v %v: %v", res.kind, name, err)
+			writeStoreProblem(w, r, err)
+			return
+		}
+
+		if version, err := res.version(ctx, name); err == nil {
+			w.Header().Set("ETag", representationETag(version, "json", reveal && res.redact != nil))
+		}
+		addWarnings(ctx, w, res, accessControl, name)
+		if res.redact != nil && !reveal {
+			value = res.redact(value)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(value)
+	}
+}
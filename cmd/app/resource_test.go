@@ -0,0 +1,367 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/traefik/traefik/v2/pkg/config/dynamic"
+	"kommandeur/store"
+)
+
+// resourceServer serves the single resource and list handlers of the routers, services and middlewares like main
+// does, the stores are in a temporary directory and there is no policy. Tests of other handlers add them to the
+// router.
+type resourceServer struct {
+	*httptest.Server
+	router *mux.Router
+	stores *store.Stores
+}
+
+func newResourceServer(t *testing.T) *resourceServer {
+	dir := t.TempDir()
+	routers, err := store.NewHTTPRouterStoreJSON(filepath.Join(dir, "routers"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	services, err := store.NewHTTPServiceStoreJSON(filepath.Join(dir, "services"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	middlewares, err := store.NewHTTPMiddlewareStoreJSON(filepath.Join(dir, "middlewares"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	labels, err := store.NewLabelStoreJSON(filepath.Join(dir, "labels"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stores := &store.Stores{Routers: routers, Services: services, Middlewares: middlewares, Labels: labels}
+	accessControl := &access{stores: stores}
+
+	r := mux.NewRouter()
+	httpRouter := r.PathPrefix("/v1/http").Subrouter()
+	for _, res := range []resource{
+		routerResource(routers, labels),
+		serviceResource(services, labels),
+		middlewareResource(middlewares, labels),
+	} {
+		httpRouter.HandleFunc("/"+res.kind+"s", listHandler(res, accessControl)).Methods(http.MethodGet)
+		httpRouter.HandleFunc("/"+res.kind+"/{name}", getHandler(res, accessControl)).Methods(http.MethodGet)
+		httpRouter.HandleFunc("/"+res.kind+"/{name}", deleteHandler(res)).Methods(http.MethodDelete)
+		httpRouter.HandleFunc("/"+res.kind+"/{name}", putHandler(res, accessControl)).Methods(http.MethodPut)
+		httpRouter.HandleFunc("/"+res.kind+"/{name}", patchHandler(res, accessControl)).Methods(http.MethodPatch)
+	}
+	s := &resourceServer{Server: httptest.NewServer(r), router: r, stores: stores}
+	t.Cleanup(s.Close)
+	return s
+}
+
+// do sends a request with the headers given as name, value pairs and returns the response with its body
+func (s *resourceServer) do(t *testing.T, method, path, body string, headers ...string) (*http.Response, string) {
+	t.Helper()
+	var reader io.Reader
+	if body != "" {
+		reader = strings.NewReader(body)
+	}
+	req, err := http.NewRequest(method, s.URL+path, reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	resp, err := s.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(content)
+}
+
+func TestPutHandler(t *testing.T) {
+	s := newResourceServer(t)
+
+	resp, body := s.do(t, http.MethodPut, "/v1/http/router/web", `{"rule":"Host(`+"`example.com`"+`)","service":"web"}`)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("create = %v %v, want 201", resp.StatusCode, body)
+	}
+	if location := resp.Header.Get("Location"); location != "/v1/http/router/web" {
+		t.Errorf("Location = %v, want /v1/http/router/web", location)
+	}
+	created := resp.Header.Get("ETag")
+	if created == "" {
+		t.Error("the created router has no ETag")
+	}
+
+	resp, body = s.do(t, http.MethodPut, "/v1/http/router/web", `{"rule":"Host(`+"`example.org`"+`)","service":"web"}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("replace = %v %v, want 200", resp.StatusCode, body)
+	}
+	if resp.Header.Get("ETag") == created {
+		t.Error("the ETag did not change with the router")
+	}
+	router, err := s.stores.Routers.Get(context.Background(), "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if router.Rule != "Host(`example.org`)" {
+		t.Errorf("rule = %v, want the replaced one", router.Rule)
+	}
+
+	resp, _ = s.do(t, http.MethodPut, "/v1/http/service/web?type=toml", "[loadBalancer]\n[[loadBalancer.servers]]\nurl = \"http://127.0.0.1:8000\"\n")
+	if resp.StatusCode != http.StatusCreated {
+		t.Errorf("create from toml = %v, want 201", resp.StatusCode)
+	}
+	resp, _ = s.do(t, http.MethodPut, "/v1/http/router/web", `{"rule":`)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("malformed body = %v, want 400", resp.StatusCode)
+	}
+	resp, _ = s.do(t, http.MethodPut, "/v1/http/router/..web", `{"rule":"Host(`+"`example.com`"+`)"}`)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("invalid name = %v, want 400", resp.StatusCode)
+	}
+}
+
+func TestPatchHandler(t *testing.T) {
+	router := `{"entryPoints":["web"],"middlewares":["auth"],"service":"web","rule":"Host(` + "`example.com`" + `)","priority":10}`
+	tests := []struct {
+		name        string
+		contentType string
+		patch       string
+		status      int
+		want        *dynamic.Router
+	}{
+		{
+			name:        "merge patch",
+			contentType: contentTypeMergePatch,
+			patch:       `{"service":"api","priority":null}`,
+			status:      http.StatusOK,
+			want:        &dynamic.Router{EntryPoints: []string{"web"}, Middlewares: []string{"auth"}, Service: "api", Rule: "Host(`example.com`)"},
+		},
+		{
+			name:        "merge patch replaces lists",
+			contentType: contentTypeMergePatch + "; charset=utf-8",
+			patch:       `{"middlewares":["auth","compress"]}`,
+			status:      http.StatusOK,
+			want:        &dynamic.Router{EntryPoints: []string{"web"}, Middlewares: []string{"auth", "compress"}, Service: "web", Rule: "Host(`example.com`)", Priority: 10},
+		},
+		{
+			name:        "json patch",
+			contentType: contentTypeJSONPatch,
+			patch:       `[{"op":"test","path":"/service","value":"web"},{"op":"add","path":"/middlewares/-","value":"compress"},{"op":"remove","path":"/entryPoints"}]`,
+			status:      http.StatusOK,
+			want:        &dynamic.Router{Middlewares: []string{"auth", "compress"}, Service: "web", Rule: "Host(`example.com`)", Priority: 10},
+		},
+		{name: "failed test", contentType: contentTypeJSONPatch, patch: `[{"op":"test","path":"/service","value":"api"},{"op":"remove","path":"/rule"}]`, status: http.StatusUnprocessableEntity},
+		{name: "missing path", contentType: contentTypeJSONPatch, patch: `[{"op":"replace","path":"/tls/certResolver","value":"le"}]`, status: http.StatusUnprocessableEntity},
+		{name: "malformed json patch", contentType: contentTypeJSONPatch, patch: `{"op":"remove"}`, status: http.StatusUnprocessableEntity},
+		{name: "result is not a router", contentType: contentTypeMergePatch, patch: `{"priority":"high"}`, status: http.StatusUnprocessableEntity},
+		{name: "unsupported content type", contentType: "application/json", patch: `{"service":"api"}`, status: http.StatusUnsupportedMediaType},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newResourceServer(t)
+			resp, _ := s.do(t, http.MethodPut, "/v1/http/router/web", router)
+			if resp.StatusCode != http.StatusCreated {
+				t.Fatalf("create = %v, want 201", resp.StatusCode)
+			}
+
+			resp, body := s.do(t, http.MethodPatch, "/v1/http/router/web", test.patch, "Content-Type", test.contentType)
+			if resp.StatusCode != test.status {
+				t.Fatalf("patch = %v %v, want %v", resp.StatusCode, body, test.status)
+			}
+			stored, err := s.stores.Routers.Get(context.Background(), "web")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.want == nil {
+				if stored.Service != "web" || stored.Priority != 10 || len(stored.EntryPoints) != 1 {
+					t.Errorf("a rejected patch changed the router to %+v", stored)
+				}
+				if resp.StatusCode == http.StatusUnsupportedMediaType && !strings.Contains(resp.Header.Get("Accept-Patch"), contentTypeJSONPatch) {
+					t.Errorf("Accept-Patch = %v, want both patch formats", resp.Header.Get("Accept-Patch"))
+				}
+				return
+			}
+
+			returned := &dynamic.Router{}
+			err = json.Unmarshal([]byte(body), returned)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, router := range []*dynamic.Router{returned, stored} {
+				encoded, _ := json.Marshal(router)
+				want, _ := json.Marshal(test.want)
+				if string(encoded) != string(want) {
+					t.Errorf("router = %s, want %s", encoded, want)
+				}
+			}
+			if resp.Header.Get("ETag") == "" {
+				t.Error("the patched router has no ETag")
+			}
+		})
+	}
+}
+
+func TestPatchHandlerMissing(t *testing.T) {
+	s := newResourceServer(t)
+	resp, _ := s.do(t, http.MethodPatch, "/v1/http/router/web", `{"service":"api"}`, "Content-Type", contentTypeMergePatch)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("patch of a missing router = %v, want 404", resp.StatusCode)
+	}
+}
+
+func TestPatchHandlerRedacts(t *testing.T) {
+	s := newResourceServer(t)
+	resp, _ := s.do(t, http.MethodPut, "/v1/http/middleware/auth", `{"basicAuth":{"users":["admin:$apr1$hash"]}}`)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("create = %v, want 201", resp.StatusCode)
+	}
+
+	// the patch applies to the stored values, the response is redacted
+	resp, body := s.do(t, http.MethodPatch, "/v1/http/middleware/auth", `{"basicAuth":{"realm":"kommandeur"}}`, "Content-Type", contentTypeMergePatch)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("patch = %v %v, want 200", resp.StatusCode, body)
+	}
+	if strings.Contains(body, "$apr1$") || !strings.Contains(body, store.Redacted) {
+		t.Errorf("the response is not redacted: %v", body)
+	}
+	stored, err := s.stores.Middlewares.Get(context.Background(), "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.BasicAuth.Realm != "kommandeur" || len(stored.BasicAuth.Users) != 1 || stored.BasicAuth.Users[0] != "admin:$apr1$hash" {
+		t.Errorf("stored middleware = %+v, want the users kept and the realm set", stored.BasicAuth)
+	}
+}
+
+// listResponse is the body of the list handler
+type listResponse struct {
+	Names []struct {
+		Name  string `json:"name"`
+		Links map[string]struct {
+			Href string `json:"href"`
+		} `json:"_links"`
+	} `json:"names"`
+	Links map[string]struct {
+		Href string `json:"href"`
+	} `json:"_links"`
+}
+
+func (s *resourceServer) list(t *testing.T, path string) (int, *listResponse) {
+	t.Helper()
+	resp, body := s.do(t, http.MethodGet, path, "")
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, nil
+	}
+	list := &listResponse{}
+	err := json.Unmarshal([]byte(body), list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, list
+}
+
+func (l *listResponse) names() []string {
+	names := make([]string, len(l.Names))
+	for i, name := range l.Names {
+		names[i] = name.Name
+	}
+	return names
+}
+
+func TestListHandler(t *testing.T) {
+	s := newResourceServer(t)
+	for i := 0; i < 25; i++ {
+		service := "web"
+		if i%5 == 0 {
+			service = "api"
+		}
+		resp, body := s.do(t, http.MethodPut, fmt.Sprintf("/v1/http/router/r%02d", i), `{"rule":"Host(`+"`example.com`"+`)","service":"`+service+`"}`)
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("create = %v %v, want 201", resp.StatusCode, body)
+		}
+	}
+
+	status, first := s.list(t, "/v1/http/routers")
+	if status != http.StatusOK {
+		t.Fatalf("list = %v, want 200", status)
+	}
+	if len(first.Names) != defaultListLimit || first.Names[0].Name != "r00" || first.Names[19].Name != "r19" {
+		t.Errorf("first page = %v, want r00 to r19", first.names())
+	}
+	if href := first.Names[0].Links["self"].Href; href != "/v1/http/router/r00" {
+		t.Errorf("self link of r00 = %v", href)
+	}
+	if _, ok := first.Links["prev"]; ok {
+		t.Error("the first page has a prev link")
+	}
+	next, ok := first.Links["next"]
+	if !ok {
+		t.Fatal("the first page has no next link")
+	}
+
+	status, last := s.list(t, next.Href)
+	if status != http.StatusOK {
+		t.Fatalf("next page = %v, want 200", status)
+	}
+	if fmt.Sprint(last.names()) != "[r20 r21 r22 r23 r24]" {
+		t.Errorf("last page = %v, want r20 to r24", last.names())
+	}
+	if _, ok := last.Links["next"]; ok {
+		t.Error("the last page has a next link")
+	}
+	if last.Links["self"].Href != next.Href {
+		t.Errorf("self link = %v, want %v", last.Links["self"].Href, next.Href)
+	}
+	status, prev := s.list(t, last.Links["prev"].Href)
+	if status != http.StatusOK || fmt.Sprint(prev.names()) != fmt.Sprint(first.names()) {
+		t.Errorf("prev page = %v, want the first page", prev)
+	}
+
+	// the links keep the query and only replace the cursor
+	status, filtered := s.list(t, "/v1/http/routers?service=api&sort=name&order=desc&limit=2")
+	if status != http.StatusOK {
+		t.Fatalf("filtered list = %v, want 200", status)
+	}
+	if fmt.Sprint(filtered.names()) != "[r20 r15]" {
+		t.Errorf("filtered page = %v, want r20 r15", filtered.names())
+	}
+	next = filtered.Links["next"]
+	for _, param := range []string{"service=api", "sort=name", "order=desc", "limit=2", "cursor="} {
+		if !strings.Contains(next.Href, param) {
+			t.Errorf("next link %v does not contain %v", next.Href, param)
+		}
+	}
+	status, filtered = s.list(t, next.Href)
+	if status != http.StatusOK || fmt.Sprint(filtered.names()) != "[r10 r05]" {
+		t.Errorf("next filtered page = %v %v, want r10 r05", status, filtered)
+	}
+
+	cursor := strings.SplitN(first.Links["next"].Href, "cursor=", 2)[1]
+	for _, path := range []string{
+		"/v1/http/routers?limit=0",
+		"/v1/http/routers?limit=many",
+		"/v1/http/routers?cursor=garbage",
+		"/v1/http/routers?cursor=" + cursor[:len(cursor)-3],
+		"/v1/http/routers?order=desc&cursor=" + cursor,
+		"/v1/http/routers?sort=size",
+	} {
+		if status, _ := s.list(t, path); status != http.StatusBadRequest {
+			t.Errorf("%v = %v, want 400", path, status)
+		}
+	}
+}
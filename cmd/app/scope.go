@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const (
+	verbRead  = "read"
+	verbWrite = "write"
+	// scopeReadOnly is a shorthand for reading every resource
+	scopeReadOnly = "read-only"
+	// scopeAll allows everything, it is the scope of the htpasswd users
+	scopeAll = "*:write"
+)
+
+// resources are the names used in scopes, * matches all of them
+var resources = []string{"config", "http.routers", "http.services", "http.middlewares", "webhooks", "tokens", "audit"}
+
+// kindResource is the scope resource of a store kind, e.g. http.routers for router
+func kindResource(kind string) string {
+	return "http." + kind + "s"
+}
+
+// parseScope splits a scope like http.routers:write into its resource and verb
+func parseScope(scope string) (string, string, error) {
+	if scope == scopeReadOnly {
+		return "*", verbRead, nil
+	}
+	i := strings.LastIndex(scope, ":")
+	if i < 0 {
+		return "", "", fmt.Errorf("invalid scope %v, expected <resource>:<read|write>", scope)
+	}
+	resource, verb := scope[:i], scope[i+1:]
+	if verb != verbRead && verb != verbWrite {
+		return "", "", fmt.Errorf("invalid scope %v, the verb has to be read or write", scope)
+	}
+	if resource != "*" && !contains(resources, resource) {
+		return "", "", fmt.Errorf("invalid scope %v, unknown resource %v", scope, resource)
+	}
+	return resource, verb, nil
+}
+
+// scopeAllows reports whether a scope grants the verb on the resource, write includes read
+func scopeAllows(scope, resource, verb string) bool {
+	r, v, err := parseScope(scope)
+	if err != nil {
+		return false
+	}
+	return (r == "*" || r == resource) && (v == verb || v == verbWrite)
+}
+
+// allowed reports whether the identity may use the verb on the resource, without authentication everything
+// is allowed
+func (id *identity) allowed(resource, verb string) bool {
+	if id == nil {
+		return true
+	}
+	for _, scope := range id.Scopes {
+		if scopeAllows(scope, resource, verb) {
+			return true
+		}
+	}
+	return false
+}
+
+// covers reports whether the identity holds every given scope, e.g. to issue a token with them
+func (id *identity) covers(scopes []string) bool {
+	for _, scope := range scopes {
+		resource, verb, err := parseScope(scope)
+		if err != nil {
+			return false
+		}
+		if resource == "*" {
+			for _, r := range resources {
+				if !id.allowed(r, verb) {
+					return false
+				}
+			}
+			continue
+		}
+		if !id.allowed(resource, verb) {
+			return false
+		}
+	}
+	return true
+}
+
+// requiredScopes maps a request to the resources it reads or writes, transactions are checked per operation
+// by their handler
+func requiredScopes(r *http.Request) ([]string, string) {
+	verb := verbWrite
+	if r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions {
+		verb = verbRead
+	}
+	path := strings.TrimSuffix(r.URL.Path, "/")
+	kinds := []string{kindResource("router"), kindResource("service"), kindResource("middleware")}
+
+	switch {
+	case path == "/api", path == "/v1/events", path == "/v1/quarantine":
+		return []string{"config"}, verbRead
+	case path == "/v1/simulate":
+		return []string{kindResource("router")}, verbRead
+	case path == "/v1/transactions":
+		return nil, verb
+	case path == "/v1/auth/can-i":
+		// every identity may ask what it may do
+		return nil, verbRead
+	case path == "/v1/config":
+		// a sync can create, update and prune every kind
+		return kinds, verb
+	case strings.HasPrefix(path, "/v1/webhooks"):
+		return []string{"webhooks"}, verb
+	case strings.HasPrefix(path, "/v1/tokens"):
+		return []string{"tokens"}, verb
+	case path == "/v1/audit":
+		return []string{"audit"}, verb
+	}
+	for _, kind := range []string{"router", "service", "middleware"} {
+		if strings.HasPrefix(path, "/v1/http/"+kind) {
+			return []string{kindResource(kind)}, verb
+		}
+	}
+	// unknown paths are only open to identities which may do everything
+	return []string{"*"}, verb
+}
+
+// authorize rejects requests the scopes of the identity do not allow
+func authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := identityFrom(r.Context())
+		resources, verb := requiredScopes(r)
+		for _, resource := range resources {
+			allowed := id.allowed(resource, verb)
+			if resource == "*" {
+				allowed = id.covers([]string{"*:" + verb})
+			}
+			if !allowed {
+				writeProblem(w, r, http.StatusForbidden, fmt.Errorf("%v may not %v %v", id.Name, verb, resource))
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
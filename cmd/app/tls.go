@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+const (
+	// certificateSubject names clients by the common name of their certificate subject
+	certificateSubject = "subject"
+	// certificateSAN names clients by the first DNS name, email address or URI of their certificate
+	certificateSAN = "san"
+)
+
+// tlsConfig loads the server certificate and, if a CA bundle is given, verifies client certificates with it.
+// Without requireClientCert clients may still authenticate in other ways.
+func tlsConfig(certFile, keyFile, clientCAFile string, requireClientCert bool) (*tls.Config, error) {
+	certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the certificate: %v", err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if clientCAFile == "" {
+		if requireClientCert {
+			return nil, errors.New("client certificates can only be required with a client CA bundle")
+		}
+		return config, nil
+	}
+
+	bundle, err := ioutil.ReadFile(clientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the client CA bundle: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(bundle) {
+		return nil, fmt.Errorf("no certificates found in the client CA bundle %v", clientCAFile)
+	}
+	config.ClientCAs = pool
+	config.ClientAuth = tls.VerifyClientCertIfGiven
+	if requireClientCert {
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// certificateAuthenticator names clients with a verified certificate by its subject or SAN, the name can be
+// bound to roles in the rbac policy like any other user
+func certificateAuthenticator(field string, scopes ...string) (authenticator, error) {
+	if field != certificateSubject && field != certificateSAN {
+		return nil, fmt.Errorf("invalid client certificate identity %v, expected %v or %v", field, certificateSubject, certificateSAN)
+	}
+	return func(r *http.Request) (*identity, error) {
+		// only chains verified against the client CA bundle are trusted
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+			return nil, nil
+		}
+		certificate := r.TLS.VerifiedChains[0][0]
+		name := certificateName(certificate, field)
+		if name == "" {
+			return nil, fmt.Errorf("the client certificate %v has no %v to name it by", certificate.SerialNumber, field)
+		}
+		return &identity{Name: name, Method: "certificate", Scopes: scopes}, nil
+	}, nil
+}
+
+func certificateName(certificate *x509.Certificate, field string) string {
+	if field == certificateSubject {
+		return certificate.Subject.CommonName
+	}
+	switch {
+	case len(certificate.DNSNames) > 0:
+		return certificate.DNSNames[0]
+	case len(certificate.EmailAddresses) > 0:
+		return certificate.EmailAddresses[0]
+	case len(certificate.URIs) > 0:
+		return certificate.URIs[0].String()
+	}
+	return ""
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCertificate writes a self-signed certificate and its key to dir, the certificate is its own CA bundle
+func testCertificate(t *testing.T, dir string) (certFile, keyFile string, certificate *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "alice"},
+		DNSNames:              []string{"alice.example.com"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err = x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile, certificate
+}
+
+func TestTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, _ := testCertificate(t, dir)
+	empty := filepath.Join(dir, "empty.pem")
+	err := ioutil.WriteFile(empty, []byte("no certificates\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := tlsConfig(certFile, keyFile, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.ClientCAs != nil || config.ClientAuth != tls.NoClientCert || config.MinVersion != tls.VersionTLS12 {
+		t.Errorf("config without a client CA = %+v", config)
+	}
+	config, err = tlsConfig(certFile, keyFile, certFile, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.ClientCAs == nil || config.ClientAuth != tls.VerifyClientCertIfGiven {
+		t.Errorf("client auth = %v, want certificates verified if given", config.ClientAuth)
+	}
+	config, err = tlsConfig(certFile, keyFile, certFile, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.ClientAuth != tls.RequireAndVerifyClientCert {
+		t.Errorf("client auth = %v, want certificates required", config.ClientAuth)
+	}
+
+	// the server refuses to start with these
+	for _, test := range []struct {
+		name                string
+		cert, key, clientCA string
+		requireClientCert   bool
+	}{
+		{name: "missing certificate", cert: filepath.Join(dir, "missing.pem"), key: keyFile},
+		{name: "key of another file", cert: certFile, key: certFile},
+		{name: "missing client CA bundle", cert: certFile, key: keyFile, clientCA: filepath.Join(dir, "missing.pem")},
+		{name: "client CA bundle without certificates", cert: certFile, key: keyFile, clientCA: empty},
+		{name: "required client certificate without a bundle", cert: certFile, key: keyFile, requireClientCert: true},
+	} {
+		if _, err := tlsConfig(test.cert, test.key, test.clientCA, test.requireClientCert); err == nil {
+			t.Errorf("%v: tlsConfig succeeded, want an error", test.name)
+		}
+	}
+}
+
+func TestCertificateAuthenticator(t *testing.T) {
+	_, _, certificate := testCertificate(t, t.TempDir())
+	_, err := certificateAuthenticator("serial")
+	if err == nil {
+		t.Error("an unknown certificate identity is accepted")
+	}
+
+	verified := func() *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/v1/http/routers", nil)
+		r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{certificate}}}
+		return r
+	}
+	for field, name := range map[string]string{certificateSubject: "alice", certificateSAN: "alice.example.com"} {
+		clients, err := certificateAuthenticator(field, scopeAll)
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, err := clients(verified())
+		if err != nil || id == nil || id.Name != name || id.Method != "certificate" {
+			t.Errorf("%v: identity = %+v, %v, want %v", field, id, err, name)
+		}
+
+		// a certificate which was presented but not verified is not trusted
+		r := httptest.NewRequest(http.MethodGet, "/v1/http/routers", nil)
+		r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{certificate}}
+		if id, err := clients(r); id != nil || err != nil {
+			t.Errorf("%v: unverified certificate = %+v, %v, want no identity", field, id, err)
+		}
+		if id, err := clients(httptest.NewRequest(http.MethodGet, "/v1/http/routers", nil)); id != nil || err != nil {
+			t.Errorf("%v: plain http = %+v, %v, want no identity", field, id, err)
+		}
+	}
+
+	// a certificate without the field can not name the client
+	certificate.DNSNames, certificate.EmailAddresses, certificate.URIs = nil, nil, []*url.URL{}
+	clients, err := certificateAuthenticator(certificateSAN, scopeAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, err := clients(verified()); err == nil {
+		t.Errorf("certificate without a san = %+v, want an error", id)
+	}
+}
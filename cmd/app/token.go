@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"kommandeur/store"
+)
+
+const (
+	// tokenPrefix makes tokens recognizable, e.g. for secret scanners
+	tokenPrefix = "kmd_"
+	// lastUsedInterval limits how often the last used timestamp of a token is written
+	lastUsedInterval = time.Minute
+)
+
+// randomHex returns n random bytes encoded as hex
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// parseToken splits a token of the form kmd_<id>_<secret>
+func parseToken(token string) (string, string, bool) {
+	if !strings.HasPrefix(token, tokenPrefix) {
+		return "", "", false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(token, tokenPrefix), "_", 2)
+	if len(parts) != 2 {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// tokenAuthenticator checks bearer tokens against the token store and records when they were used
+func tokenAuthenticator(tokens store.TokenStore) authenticator {
+	return func(r *http.Request) (*identity, error) {
+		header := r.Header.Get("Authorization")
+		if !strings.HasPrefix(header, "Bearer ") {
+			return nil, nil
+		}
+		id, secret, ok := parseToken(strings.TrimPrefix(header, "Bearer "))
+		if !ok {
+			return nil, nil
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), time.Second*10)
+		defer cancel()
+		token, err := tokens.Get(ctx, id)
+		if errors.Is(err, store.ErrNotFound) || errors.Is(err, store.ErrInvalidName) {
+			return nil, fmt.Errorf("unknown token %v", id)
+		}
+		if err != nil {
+			return nil, err
+		}
+		now := time.Now().UTC()
+		if subtle.ConstantTimeCompare([]byte(hashSecret(secret)), []byte(token.Hash)) != 1 {
+			return nil, fmt.Errorf("invalid secret for token %v", id)
+		}
+		if !token.Valid(now) {
+			return nil, fmt.Errorf("token %v is expired or revoked", id)
+		}
+
+		if token.LastUsed == nil || now.Sub(*token.LastUsed) > lastUsedInterval {
+			err = tokens.Touch(ctx, token.ID, now)
+			if err != nil {
+				fmt.Printf("failed to update the last use of token %v: %v\n", id, err)
+			}
+		}
+		return &identity{Name: "token:" + token.ID, Method: "token", Scopes: token.Scopes, Creators: token.Subjects}, nil
+	}
+}
+
+// withoutHash copies the token, the hash is never returned
+func withoutHash(t *store.Token) *store.Token {
+	copied := *t
+	copied.Hash = ""
+	return &copied
+}
+
+func listTokensHandler(tokens store.TokenStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), time.Second*10)
+		defer cancel()
+
+		list, err := tokens.List(ctx)
+		if err != nil {
+			fmt.Printf("failed to list tokens: %v", err)
+			writeStoreProblem(w, r, err)
+			return
+		}
+		for i := range list {
+			list[i] = withoutHash(list[i])
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"tokens": list})
+	}
+}
+
+// createTokenHandler issues a token, the secret is only part of this response. An identity can not issue
+// tokens with scopes it does not hold itself.
+func createTokenHandler(tokens store.TokenStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), time.Second*10)
+		defer cancel()
+
+		type Request struct {
+			Name   string   `json:"name"`
+			Scopes []string `json:"scopes"`
+			// Expires is either a point in time or TTL a duration like 720h
+			Expires time.Time `json:"expires"`
+			TTL     string    `json:"ttl"`
+		}
+		request := Request{}
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			writeProblem(w, r, http.StatusBadRequest, err)
+			return
+		}
+		if len(request.Scopes) == 0 {
+			writeProblem(w, r, http.StatusUnprocessableEntity, fmt.Errorf("a token needs at least one scope"))
+			return
+		}
+		for _, scope := range request.Scopes {
+			if _, _, err := parseScope(scope); err != nil {
+				writeProblem(w, r, http.StatusUnprocessableEntity, err)
+				return
+			}
+		}
+		creator := identityFrom(r.Context())
+		if creator != nil && !creator.covers(request.Scopes) {
+			writeProblem(w, r, http.StatusForbidden, fmt.Errorf("a token can not have scopes %v does not hold", creator.Name))
+			return
+		}
+
+		now := time.Now().UTC()
+		token := &store.Token{Name: request.Name, Scopes: request.Scopes, Created: now}
+		if !request.Expires.IsZero() {
+			token.Expires = &request.Expires
+		}
+		if request.TTL != "" {
+			ttl, err := time.ParseDuration(request.TTL)
+			if err != nil || ttl <= 0 {
+				writeProblem(w, r, http.StatusUnprocessableEntity, fmt.Errorf("invalid ttl %v", request.TTL))
+				return
+			}
+			expires := now.Add(ttl)
+			token.Expires = &expires
+		}
+		if token.Expires != nil && !token.Expires.After(now) {
+			writeProblem(w, r, http.StatusUnprocessableEntity, fmt.Errorf("the token would already be expired"))
+			return
+		}
+		if creator != nil {
+			token.CreatedBy = creator.Name
+			token.Subjects = creator.personalSubjects()
+		}
+		token.ID, err = randomHex(8)
+		secret := ""
+		if err == nil {
+			secret, err = randomHex(32)
+		}
+		if err != nil {
+			writeProblem(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		token.Hash = hashSecret(secret)
+
+		err = tokens.Set(ctx, token)
+		if err != nil {
+			fmt.Printf("failed to store token %v: %v", token.ID, err)
+			writeStoreProblem(w, r, err)
+			return
+		}
+
+		type Response struct {
+			*store.Token
+			Secret string `json:"token"`
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Location", "/v1/tokens/"+token.ID)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(Response{Token: withoutHash(token), Secret: tokenPrefix + token.ID + "_" + secret})
+	}
+}
+
+func getTokenHandler(tokens store.TokenStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), time.Second*10)
+		defer cancel()
+
+		token, err := tokens.Get(ctx, mux.Vars(r)["id"])
+		if err != nil {
+			writeStoreProblem(w, r, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(withoutHash(token))
+	}
+}
+
+// revokeTokenHandler revokes a token, it is kept so its use can still be traced
+func revokeTokenHandler(tokens store.TokenStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), time.Second*10)
+		defer cancel()
+
+		id := mux.Vars(r)["id"]
+		err := tokens.Revoke(ctx, id, time.Now().UTC())
+		if err != nil {
+			fmt.Printf("failed to revoke token %v: %v", id, err)
+			writeStoreProblem(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"kommandeur/rbac"
+	"kommandeur/store"
+	"kommandeur/webhook"
+)
+
+// parseNetworks parses a comma separated list of networks in CIDR notation
+func parseNetworks(value string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0)
+	for _, cidr := range strings.Split(value, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// validateWebhook checks the url and the filters of a webhook. Host names are resolved by the dispatcher for
+// every delivery, their addresses are checked then.
+func validateWebhook(w *store.Webhook, allowed []*net.IPNet) error {
+	u, err := url.Parse(w.URL)
+	if err != nil {
+		return fmt.Errorf("invalid url: %v", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("the url has to be an absolute http or https url")
+	}
+	ip := net.ParseIP(u.Hostname())
+	host := strings.ToLower(u.Hostname())
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		ip = net.IPv4(127, 0, 0, 1)
+	}
+	if ip != nil {
+		err = webhook.CheckAddress(ip, allowed)
+		if err != nil {
+			return err
+		}
+	}
+	for _, kind := range w.Kinds {
+		if kind != store.KindRouter && kind != store.KindService && kind != store.KindMiddleware {
+			return fmt.Errorf("unknown kind %v", kind)
+		}
+	}
+	for _, op := range w.Operations {
+		if op != store.OperationCreate && op != store.OperationUpdate && op != store.OperationDelete {
+			return fmt.Errorf("unknown operation %v", op)
+		}
+	}
+	return nil
+}
+
+// webhookVisible decides whether a webhook receives an event, its creator has to be allowed to get the resource by
+// its scopes and by the policy. Like tokens, webhooks are bound to the personal subjects of their creator without
+// its groups. Webhooks created without authentication have no creator, they only receive events without a policy.
+func (a *access) webhookVisible(ctx context.Context, hook *store.Webhook, event store.Event) (bool, error) {
+	creator := hook.Creator
+	if creator == nil {
+		return a == nil || a.policy == nil, nil
+	}
+	if !(&identity{Name: creator.Name, Scopes: creator.Scopes}).allowed(kindResource(event.Kind), verbRead) {
+		return false, nil
+	}
+	if a == nil || a.policy == nil {
+		return true, nil
+	}
+	// the labels of a deleted resource are deleted with it, only rules without a selector match its events
+	labels := map[string]string{}
+	if a.stores.Labels != nil {
+		var err error
+		labels, err = a.stores.Labels.Get(ctx, event.Kind, event.Name)
+		if err != nil {
+			return false, fmt.Errorf("failed to get labels of %v %v: %w", event.Kind, event.Name, err)
+		}
+	}
+	return a.policy.Allowed(rbac.Request{Subjects: creator.Subjects, Verb: rbac.VerbGet, Kind: event.Kind, Name: event.Name, Labels: labels}), nil
+}
+
+// withoutSecret copies the webhook, the secret is only returned when the webhook is created
+func withoutSecret(w *store.Webhook) *store.Webhook {
+	copied := *w
+	copied.Secret = ""
+	return &copied
+}
+
+func listWebhooksHandler(webhooks store.WebhookStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), time.Second*10)
+		defer cancel()
+
+		list, err := webhooks.List(ctx)
+		if err != nil {
+			fmt.Printf("failed to list webhooks: %v", err)
+			writeStoreProblem(w, r, err)
+			return
+		}
+		for i := range list {
+			list[i] = withoutSecret(list[i])
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"webhooks": list})
+	}
+}
+
+func createWebhookHandler(webhooks store.WebhookStore, allowed []*net.IPNet) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), time.Second*10)
+		defer cancel()
+
+		hook := store.Webhook{}
+		err := json.NewDecoder(r.Body).Decode(&hook)
+		if err != nil {
+			writeProblem(w, r, http.StatusBadRequest, err)
+			return
+		}
+		err = validateWebhook(&hook, allowed)
+		if err != nil {
+			writeProblem(w, r, http.StatusUnprocessableEntity, err)
+			return
+		}
+		hook.ID, err = webhook.NewID()
+		if err == nil && hook.Secret == "" {
+			hook.Secret, err = webhook.NewID()
+		}
+		if err != nil {
+			writeProblem(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		hook.Created = time.Now().UTC()
+		// the creator is taken from the request, never from the body
+		hook.Creator = nil
+		if id := identityFrom(r.Context()); id != nil {
+			hook.Creator = &store.Creator{Name: id.Name, Subjects: id.personalSubjects(), Scopes: id.Scopes}
+		}
+
+		err = webhooks.Set(ctx, &hook)
+		if err != nil {
+			fmt.Printf("failed to store webhook %v: %v", hook.ID, err)
+			writeStoreProblem(w, r, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Location", "/v1/webhooks/"+hook.ID)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(hook)
+	}
+}
+
+func getWebhookHandler(webhooks store.WebhookStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), time.Second*10)
+		defer cancel()
+
+		hook, err := webhooks.Get(ctx, mux.Vars(r)["id"])
+		if err != nil {
+			writeStoreProblem(w, r, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(withoutSecret(hook))
+	}
+}
+
+func deleteWebhookHandler(webhooks store.WebhookStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), time.Second*10)
+		defer cancel()
+
+		err := webhooks.Delete(ctx, mux.Vars(r)["id"])
+		if err != nil {
+			writeStoreProblem(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func deliveriesHandler(webhooks store.WebhookStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), time.Second*10)
+		defer cancel()
+
+		id := mux.Vars(r)["id"]
+		_, err := webhooks.Get(ctx, id)
+		if err != nil {
+			writeStoreProblem(w, r, err)
+			return
+		}
+		deliveries, err := webhooks.Deliveries(ctx, id)
+		if err != nil {
+			fmt.Printf("failed to get the deliveries of webhook %v: %v", id, err)
+			writeStoreProblem(w, r, err)
+			return
+		}
+		// the payloads are redacted before they are sent, older deliveries may contain sensitive values
+		for _, delivery := range deliveries {
+			if redacted, err := store.RedactJSON(delivery.Payload); err == nil {
+				delivery.Payload = redacted
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"deliveries": deliveries})
+	}
+}
+
+// pingWebhookHandler sends a single ping payload to the webhook and responds with the delivery, so a receiver
+// can be tested without changing the configuration
+func pingWebhookHandler(webhooks store.WebhookStore, dispatcher *webhook.Dispatcher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), time.Second*10)
+		defer cancel()
+
+		hook, err := webhooks.Get(ctx, mux.Vars(r)["id"])
+		if err != nil {
+			writeStoreProblem(w, r, err)
+			return
+		}
+		payload, err := webhook.NewPayload(store.Event{Op: "ping"})
+		if err != nil {
+			writeProblem(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		delivery := dispatcher.Send(ctx, hook, payload, 1)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(delivery)
+	}
+}
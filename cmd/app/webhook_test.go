@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"kommandeur/rbac"
+	"kommandeur/store"
+)
+
+func TestWebhookVisible(t *testing.T) {
+	labels, err := store.NewLabelStoreJSON(filepath.Join(t.TempDir(), "labels"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	err = labels.Set(ctx, store.KindRouter, "web", map[string]string{"team": "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy := &rbac.Policy{
+		Roles: map[string]rbac.Role{
+			"team-a": {Rules: []rbac.Rule{
+				{Kinds: []string{store.KindRouter}, Verbs: []string{rbac.VerbGet}, Names: []string{"team-a-*"}},
+				{Kinds: []string{store.KindRouter}, Verbs: []string{rbac.VerbGet}, Selector: map[string]string{"team": "a"}},
+			}},
+		},
+		Bindings: []rbac.Binding{
+			{Role: "team-a", Subjects: []string{"alice", "group:team-a"}},
+		},
+	}
+	withPolicy := &access{policy: policy, stores: &store.Stores{Labels: labels}}
+	withoutPolicy := &access{stores: &store.Stores{Labels: labels}}
+	alice := &store.Creator{Name: "alice", Subjects: []string{"alice"}, Scopes: []string{scopeAll}}
+	event := func(kind, name string) store.Event {
+		return store.Event{Op: store.OperationUpdate, Kind: kind, Name: name}
+	}
+
+	tests := []struct {
+		name    string
+		access  *access
+		creator *store.Creator
+		event   store.Event
+		visible bool
+	}{
+		{name: "allowed name", access: withPolicy, creator: alice, event: event(store.KindRouter, "team-a-web"), visible: true},
+		{name: "allowed labels", access: withPolicy, creator: alice, event: event(store.KindRouter, "web"), visible: true},
+		{name: "other router", access: withPolicy, creator: alice, event: event(store.KindRouter, "team-b-web")},
+		{name: "other kind", access: withPolicy, creator: alice, event: event(store.KindService, "team-a-web")},
+		{
+			name:    "groups are not carried over",
+			access:  withPolicy,
+			creator: &store.Creator{Name: "oidc:bob", Subjects: []string{"oidc:bob"}, Scopes: []string{scopeAll}},
+			event:   event(store.KindRouter, "team-a-web"),
+		},
+		{
+			name:    "scopes",
+			access:  withoutPolicy,
+			creator: &store.Creator{Name: "token:a", Subjects: []string{"token:a"}, Scopes: []string{"http.services:read"}},
+			event:   event(store.KindRouter, "team-a-web"),
+		},
+		{name: "no policy", access: withoutPolicy, creator: alice, event: event(store.KindService, "web"), visible: true},
+		{name: "no creator", access: withPolicy, event: event(store.KindRouter, "team-a-web")},
+		{name: "no creator without policy", access: withoutPolicy, event: event(store.KindRouter, "team-a-web"), visible: true},
+	}
+	for _, test := range tests {
+		visible, err := test.access.webhookVisible(ctx, &store.Webhook{ID: "a", Creator: test.creator}, test.event)
+		if err != nil {
+			t.Errorf("%v: %v", test.name, err)
+			continue
+		}
+		if visible != test.visible {
+			t.Errorf("%v: visible = %v, want %v", test.name, visible, test.visible)
+		}
+	}
+}
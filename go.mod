@@ -5,10 +5,14 @@ go 1.15
 require (
 	github.com/BurntSushi/toml v0.3.1
 	github.com/abbot/go-http-auth v0.0.0-00010101000000-000000000000
+	github.com/evanphx/json-patch v4.5.0+incompatible
+	github.com/fsnotify/fsnotify v1.4.7
 	github.com/go-check/check v0.0.0-00010101000000-000000000000
 	github.com/gorilla/mux v1.7.3
 	github.com/traefik/traefik/v2 v2.3.6
-
+	github.com/vulcand/predicate v1.1.0
+	gopkg.in/square/go-jose.v2 v2.5.1
+	gopkg.in/yaml.v2 v2.3.0
 )
 
 // Docker v19.03.6
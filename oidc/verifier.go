@@ -0,0 +1,310 @@
+package oidc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+const (
+	// leeway tolerates clock skew between the issuer and kommandeur
+	leeway = time.Minute
+	// refreshInterval limits how often unknown key IDs make the key set be fetched again
+	refreshInterval = 10 * time.Second
+)
+
+// algorithms are the accepted signature algorithms, symmetric ones are never accepted
+var algorithms = []string{
+	string(jose.RS256), string(jose.RS384), string(jose.RS512),
+	string(jose.PS256), string(jose.PS384), string(jose.PS512),
+	string(jose.ES256), string(jose.ES384), string(jose.ES512),
+	string(jose.EdDSA),
+}
+
+// Config describes the issuer tokens are accepted from
+type Config struct {
+	Issuer string
+	// Audience has to be contained in the aud claim, it is required so tokens issued for other clients of the
+	// issuer are not accepted
+	Audience string
+	// JWKSURL is the location of the key set, it is discovered through the issuer if it is empty
+	JWKSURL string
+	// UsernameClaim names the claim the identity is named by, e.g. sub or email
+	UsernameClaim string
+	// GroupsClaim names the claim with the groups of the identity, it may be a list or a single string
+	GroupsClaim string
+	// CacheTTL is how long the key set is used before it is fetched again
+	CacheTTL time.Duration
+}
+
+// Identity is the verified subject of a token
+type Identity struct {
+	Subject  string
+	Username string
+	Groups   []string
+}
+
+// Verifier validates signed JWTs with the key set of the issuer, the key set is cached and fetched again when it
+// expires or a token is signed with an unknown key, so keys can be rotated by the issuer
+type Verifier struct {
+	config Config
+	client *http.Client
+
+	mutex     sync.Mutex
+	jwksURL   string
+	keys      *jose.JSONWebKeySet
+	fetched   time.Time
+	refreshed time.Time
+	// fetching is the fetch in flight, if there is one
+	fetching *fetch
+}
+
+func NewVerifier(config Config) (*Verifier, error) {
+	if config.Issuer == "" {
+		return nil, errors.New("the issuer is required")
+	}
+	if config.Audience == "" {
+		return nil, errors.New("the audience is required")
+	}
+	if config.UsernameClaim == "" {
+		config.UsernameClaim = "sub"
+	}
+	if config.GroupsClaim == "" {
+		config.GroupsClaim = "groups"
+	}
+	if config.CacheTTL <= 0 {
+		config.CacheTTL = time.Hour
+	}
+	return &Verifier{config: config, client: &http.Client{Timeout: 10 * time.Second}, jwksURL: config.JWKSURL}, nil
+}
+
+// Verify checks the signature, issuer, audience and lifetime of a token and returns its identity
+func (v *Verifier) Verify(ctx context.Context, raw string) (*Identity, error) {
+	token, err := jwt.ParseSigned(raw)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the token: %v", err)
+	}
+	if len(token.Headers) != 1 {
+		return nil, errors.New("the token has to have exactly one signature")
+	}
+	header := token.Headers[0]
+	if !contains(algorithms, header.Algorithm) {
+		return nil, fmt.Errorf("unsupported signature algorithm %v", header.Algorithm)
+	}
+
+	key, err := v.key(ctx, header.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	claims := jwt.Claims{}
+	custom := map[string]interface{}{}
+	err = token.Claims(key, &claims, &custom)
+	if err != nil {
+		return nil, fmt.Errorf("invalid token signature: %v", err)
+	}
+	if claims.Expiry == nil {
+		return nil, errors.New("the token does not expire")
+	}
+	expected := jwt.Expected{Issuer: v.config.Issuer, Audience: jwt.Audience{v.config.Audience}, Time: time.Now()}
+	err = claims.ValidateWithLeeway(expected, leeway)
+	if err != nil {
+		return nil, fmt.Errorf("invalid token claims: %v", err)
+	}
+
+	username, _ := custom[v.config.UsernameClaim].(string)
+	if username == "" {
+		return nil, fmt.Errorf("the token has no %v claim", v.config.UsernameClaim)
+	}
+	groups, err := stringList(custom[v.config.GroupsClaim])
+	if err != nil {
+		return nil, fmt.Errorf("invalid %v claim: %v", v.config.GroupsClaim, err)
+	}
+	return &Identity{Subject: claims.Subject, Username: username, Groups: groups}, nil
+}
+
+// key returns the key with the ID, the key set is fetched again if it expired or does not contain the key
+func (v *Verifier) key(ctx context.Context, kid string) (*jose.JSONWebKey, error) {
+	v.mutex.Lock()
+	keys := v.keys
+	expired := keys == nil || time.Since(v.fetched) > v.config.CacheTTL
+	v.mutex.Unlock()
+
+	if expired {
+		var err error
+		keys, err = v.refresh(ctx)
+		if err != nil && keys == nil {
+			return nil, err
+		}
+		if err != nil {
+			fmt.Printf("failed to refresh the key set, using the cached one: %v\n", err)
+		}
+	}
+	key := lookup(keys, kid)
+	if key == nil {
+		// a fetch which is in flight may bring the key as well
+		v.mutex.Lock()
+		due := v.fetching != nil || time.Since(v.refreshed) > refreshInterval
+		v.mutex.Unlock()
+		if due {
+			// the issuer may have rotated its keys
+			var err error
+			keys, err = v.refresh(ctx)
+			if err != nil {
+				return nil, err
+			}
+			key = lookup(keys, kid)
+		}
+	}
+	if key == nil {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	return key, nil
+}
+
+// fetch is a fetch of the key set which concurrent verifications wait for
+type fetch struct {
+	done chan struct{}
+	err  error
+}
+
+// refresh waits for the key set to be fetched and returns the current key set, which is the cached one if the
+// fetch failed. Only one fetch is made at a time, the lock is not held while it is in flight.
+func (v *Verifier) refresh(ctx context.Context) (*jose.JSONWebKeySet, error) {
+	v.mutex.Lock()
+	f := v.fetching
+	if f == nil {
+		f = &fetch{done: make(chan struct{})}
+		v.fetching = f
+		v.refreshed = time.Now()
+		go v.fetch(f, v.jwksURL)
+	}
+	v.mutex.Unlock()
+
+	select {
+	case <-f.done:
+	case <-ctx.Done():
+		v.mutex.Lock()
+		defer v.mutex.Unlock()
+		return v.keys, ctx.Err()
+	}
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	return v.keys, f.err
+}
+
+// fetch fetches the key set and swaps it in, it is not canceled with the request which started it because
+// other requests may wait for it, the client has a timeout instead
+func (v *Verifier) fetch(f *fetch, jwksURL string) {
+	keys, jwksURL, err := v.fetchKeys(context.Background(), jwksURL)
+
+	v.mutex.Lock()
+	if err == nil {
+		v.jwksURL = jwksURL
+		v.keys = keys
+		v.fetched = time.Now()
+	}
+	f.err = err
+	v.fetching = nil
+	v.mutex.Unlock()
+	close(f.done)
+}
+
+// fetchKeys fetches the key set, the URL of it is discovered if it is not known yet
+func (v *Verifier) fetchKeys(ctx context.Context, jwksURL string) (*jose.JSONWebKeySet, string, error) {
+	if jwksURL == "" {
+		discovery := struct {
+			JWKSURI string `json:"jwks_uri"`
+		}{}
+		err := v.get(ctx, strings.TrimSuffix(v.config.Issuer, "/")+"/.well-known/openid-configuration", &discovery)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to discover the key set: %w", err)
+		}
+		if discovery.JWKSURI == "" {
+			return nil, "", errors.New("the discovery document of the issuer has no jwks_uri")
+		}
+		jwksURL = discovery.JWKSURI
+	}
+
+	keys := &jose.JSONWebKeySet{}
+	err := v.get(ctx, jwksURL, keys)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to fetch the key set: %w", err)
+	}
+	return keys, jwksURL, nil
+}
+
+func (v *Verifier) get(ctx context.Context, url string, out interface{}) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	response, err := v.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("%v returned %v", url, response.Status)
+	}
+	return json.NewDecoder(response.Body).Decode(out)
+}
+
+// lookup returns the public signing key with the ID, a token without key ID is only accepted if the set has
+// a single key
+func lookup(keys *jose.JSONWebKeySet, kid string) *jose.JSONWebKey {
+	candidates := keys.Keys
+	if kid != "" {
+		candidates = keys.Key(kid)
+	}
+	if len(candidates) != 1 && kid == "" {
+		return nil
+	}
+	for _, key := range candidates {
+		if key.Use != "" && key.Use != "sig" {
+			continue
+		}
+		if !key.IsPublic() {
+			continue
+		}
+		return &key
+	}
+	return nil
+}
+
+func stringList(value interface{}) ([]string, error) {
+	switch value := value.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{value}, nil
+	case []interface{}:
+		list := make([]string, 0, len(value))
+		for _, v := range value {
+			s, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("expected a list of strings")
+			}
+			list = append(list, s)
+		}
+		return list, nil
+	default:
+		return nil, fmt.Errorf("expected a string or a list of strings")
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,352 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// issuer serves the discovery document and the key set of a test identity provider
+type issuer struct {
+	*httptest.Server
+
+	mutex   sync.Mutex
+	keys    map[string]*rsa.PrivateKey
+	fetches int
+	// gate holds requests for the key set until it is closed, if it is set
+	gate chan struct{}
+}
+
+func newIssuer(t *testing.T, kids ...string) *issuer {
+	i := &issuer{keys: map[string]*rsa.PrivateKey{}}
+	for _, kid := range kids {
+		i.addKey(t, kid)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"issuer": i.URL, "jwks_uri": i.URL + "/keys"})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		i.mutex.Lock()
+		gate := i.gate
+		i.mutex.Unlock()
+		if gate != nil {
+			<-gate
+		}
+		i.mutex.Lock()
+		defer i.mutex.Unlock()
+		i.fetches++
+		keys := jose.JSONWebKeySet{}
+		for kid, key := range i.keys {
+			keys.Keys = append(keys.Keys, jose.JSONWebKey{Key: &key.PublicKey, KeyID: kid, Algorithm: string(jose.RS256), Use: "sig"})
+		}
+		json.NewEncoder(w).Encode(keys)
+	})
+	i.Server = httptest.NewServer(mux)
+	t.Cleanup(i.Close)
+	return i
+}
+
+func (i *issuer) addKey(t *testing.T, kid string) *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	i.keys[kid] = key
+	return key
+}
+
+func (i *issuer) removeKey(kid string) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	delete(i.keys, kid)
+}
+
+func (i *issuer) fetched() int {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	return i.fetches
+}
+
+// sign signs the claims with the key of the issuer with the ID
+func (i *issuer) sign(t *testing.T, kid string, claims map[string]interface{}) string {
+	i.mutex.Lock()
+	key := i.keys[kid]
+	i.mutex.Unlock()
+	return sign(t, jose.SigningKey{Algorithm: jose.RS256, Key: key}, kid, claims)
+}
+
+func sign(t *testing.T, key jose.SigningKey, kid string, claims map[string]interface{}) string {
+	t.Helper()
+	signer, err := jose.NewSigner(key, (&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", kid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := jwt.Signed(signer).Claims(claims).CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+// claims are valid claims for the issuer, the overrides replace them and nil values remove them
+func (i *issuer) claims(overrides map[string]interface{}) map[string]interface{} {
+	now := time.Now()
+	claims := map[string]interface{}{
+		"iss":    i.URL,
+		"aud":    "kommandeur",
+		"sub":    "1234",
+		"email":  "alice@example.com",
+		"iat":    now.Unix(),
+		"exp":    now.Add(time.Hour).Unix(),
+		"groups": []string{"team-a", "team-b"},
+	}
+	for claim, value := range overrides {
+		if value == nil {
+			delete(claims, claim)
+			continue
+		}
+		claims[claim] = value
+	}
+	return claims
+}
+
+func newVerifier(t *testing.T, i *issuer) *Verifier {
+	v, err := NewVerifier(Config{Issuer: i.URL, Audience: "kommandeur", UsernameClaim: "email"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestNewVerifier(t *testing.T) {
+	if _, err := NewVerifier(Config{Audience: "kommandeur"}); err == nil {
+		t.Error("a verifier without issuer was created")
+	}
+	if _, err := NewVerifier(Config{Issuer: "https://issuer.example.com"}); err == nil {
+		t.Error("a verifier without audience was created")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	i := newIssuer(t, "a")
+	v := newVerifier(t, i)
+	tests := []struct {
+		name      string
+		overrides map[string]interface{}
+		valid     bool
+	}{
+		{name: "valid", valid: true},
+		{name: "audience list", overrides: map[string]interface{}{"aud": []string{"other", "kommandeur"}}, valid: true},
+		{name: "wrong issuer", overrides: map[string]interface{}{"iss": "https://other.example.com"}},
+		{name: "no issuer", overrides: map[string]interface{}{"iss": nil}},
+		{name: "wrong audience", overrides: map[string]interface{}{"aud": "other"}},
+		{name: "no audience", overrides: map[string]interface{}{"aud": nil}},
+		{name: "expired", overrides: map[string]interface{}{"exp": time.Now().Add(-2 * time.Minute).Unix()}},
+		{name: "expired within the leeway", overrides: map[string]interface{}{"exp": time.Now().Add(-30 * time.Second).Unix()}, valid: true},
+		{name: "no expiry", overrides: map[string]interface{}{"exp": nil}},
+		{name: "not yet valid", overrides: map[string]interface{}{"nbf": time.Now().Add(time.Hour).Unix()}},
+		{name: "no username", overrides: map[string]interface{}{"email": nil}},
+		{name: "invalid groups", overrides: map[string]interface{}{"groups": []int{1}}},
+	}
+	for _, test := range tests {
+		identity, err := v.Verify(context.Background(), i.sign(t, "a", i.claims(test.overrides)))
+		if test.valid && err != nil {
+			t.Errorf("%v: Verify = %v, want nil", test.name, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%v: Verify = %+v, want an error", test.name, identity)
+		}
+	}
+}
+
+func TestVerifyGroups(t *testing.T) {
+	i := newIssuer(t, "a")
+	v := newVerifier(t, i)
+	tests := []struct {
+		groups interface{}
+		want   []string
+	}{
+		{groups: []string{"team-a", "team-b"}, want: []string{"team-a", "team-b"}},
+		{groups: "team-a", want: []string{"team-a"}},
+		{groups: []string{}, want: []string{}},
+		{groups: nil, want: nil},
+	}
+	for _, test := range tests {
+		identity, err := v.Verify(context.Background(), i.sign(t, "a", i.claims(map[string]interface{}{"groups": test.groups})))
+		if err != nil {
+			t.Errorf("groups %v: %v", test.groups, err)
+			continue
+		}
+		if identity.Username != "alice@example.com" || identity.Subject != "1234" || !reflect.DeepEqual(identity.Groups, test.want) {
+			t.Errorf("groups %v: identity = %+v, want alice@example.com with the groups %v", test.groups, identity, test.want)
+		}
+	}
+}
+
+func TestVerifyRejectsAlgorithms(t *testing.T) {
+	i := newIssuer(t, "a")
+	v := newVerifier(t, i)
+	claims := i.claims(nil)
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encode := base64.RawURLEncoding.EncodeToString
+	tokens := map[string]string{
+		"none":  encode([]byte(`{"alg":"none","kid":"a"}`)) + "." + encode(payload) + ".",
+		"HS256": sign(t, jose.SigningKey{Algorithm: jose.HS256, Key: []byte(strings.Repeat("k", 32))}, "a", claims),
+	}
+	for alg, token := range tokens {
+		identity, err := v.Verify(context.Background(), token)
+		if err == nil {
+			t.Errorf("a token signed with %v was accepted: %+v", alg, identity)
+		}
+	}
+}
+
+func TestVerifyUnknownKey(t *testing.T) {
+	i := newIssuer(t, "a")
+	v := newVerifier(t, i)
+	ctx := context.Background()
+
+	_, err := v.Verify(ctx, i.sign(t, "a", i.claims(nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i.fetched() != 1 {
+		t.Fatalf("the key set was fetched %v times, want 1", i.fetched())
+	}
+
+	// a token signed with a key the issuer does not know is rejected without hammering the issuer
+	other := issuer{keys: map[string]*rsa.PrivateKey{}}
+	other.addKey(t, "b")
+	for n := 0; n < 3; n++ {
+		if _, err := v.Verify(ctx, other.sign(t, "b", i.claims(nil))); err == nil {
+			t.Error("a token signed with an unknown key was accepted")
+		}
+	}
+	if i.fetched() != 1 {
+		t.Errorf("the key set was fetched %v times within the refresh interval, want 1", i.fetched())
+	}
+
+	// once the interval passed an unknown key makes the key set be fetched again
+	v.refreshed = time.Time{}
+	if _, err := v.Verify(ctx, other.sign(t, "b", i.claims(nil))); err == nil {
+		t.Error("a token signed with an unknown key was accepted")
+	}
+	if i.fetched() != 2 {
+		t.Errorf("the key set was fetched %v times, want 2", i.fetched())
+	}
+}
+
+func TestVerifyKeyRotation(t *testing.T) {
+	i := newIssuer(t, "a")
+	v := newVerifier(t, i)
+	ctx := context.Background()
+
+	old := i.sign(t, "a", i.claims(nil))
+	_, err := v.Verify(ctx, old)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the issuer rotates to a new key, tokens signed with it are accepted after the key set is fetched again
+	i.addKey(t, "b")
+	i.removeKey("a")
+	v.refreshed = time.Time{}
+	identity, err := v.Verify(ctx, i.sign(t, "b", i.claims(nil)))
+	if err != nil {
+		t.Fatalf("a token signed with the rotated key was rejected: %v", err)
+	}
+	if identity.Username != "alice@example.com" {
+		t.Errorf("username = %v, want alice@example.com", identity.Username)
+	}
+	if i.fetched() != 2 {
+		t.Errorf("the key set was fetched %v times, want 2", i.fetched())
+	}
+
+	// the key set no longer contains the old key
+	if _, err := v.Verify(ctx, old); err == nil {
+		t.Error("a token signed with the removed key was accepted")
+	}
+}
+
+func TestVerifyCacheTTL(t *testing.T) {
+	i := newIssuer(t, "a")
+	v, err := NewVerifier(Config{Issuer: i.URL, Audience: "kommandeur", CacheTTL: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for n := 0; n < 3; n++ {
+		if _, err := v.Verify(ctx, i.sign(t, "a", i.claims(nil))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if i.fetched() != 1 {
+		t.Errorf("the key set was fetched %v times, want 1", i.fetched())
+	}
+
+	v.fetched = time.Now().Add(-2 * time.Minute)
+	if _, err := v.Verify(ctx, i.sign(t, "a", i.claims(nil))); err != nil {
+		t.Fatal(err)
+	}
+	if i.fetched() != 2 {
+		t.Errorf("the expired key set was fetched %v times, want 2", i.fetched())
+	}
+}
+
+func TestVerifyConcurrentFetch(t *testing.T) {
+	i := newIssuer(t, "a")
+	gate := make(chan struct{})
+	i.mutex.Lock()
+	i.gate = gate
+	i.mutex.Unlock()
+	v := newVerifier(t, i)
+	token := i.sign(t, "a", i.claims(nil))
+
+	errs := make(chan error, 10)
+	for n := 0; n < cap(errs); n++ {
+		go func() {
+			_, err := v.Verify(context.Background(), token)
+			errs <- err
+		}()
+	}
+
+	// a verification which gives up does not wait for the fetch in flight, the lock is not held while fetching
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := v.Verify(ctx, token); err == nil {
+		t.Error("a token was verified without a key set")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("the canceled verification took %v", elapsed)
+	}
+
+	close(gate)
+	for n := 0; n < cap(errs); n++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+	if i.fetched() != 1 {
+		t.Errorf("the key set was fetched %v times by concurrent verifications, want 1", i.fetched())
+	}
+}
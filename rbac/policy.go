@@ -0,0 +1,197 @@
+package rbac
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	VerbGet    = "get"
+	VerbList   = "list"
+	VerbCreate = "create"
+	VerbUpdate = "update"
+	VerbDelete = "delete"
+	// VerbReveal allows to read the sensitive values of a resource, which are redacted otherwise
+	VerbReveal = "reveal"
+	// VerbUse allows to reference a secret in a resource, e.g. ${secret:file:/run/secrets/password}
+	VerbUse = "use"
+	// Any matches every verb or kind
+	Any = "*"
+)
+
+var verbs = []string{VerbGet, VerbList, VerbCreate, VerbUpdate, VerbDelete, VerbReveal, VerbUse, Any}
+
+// Kinds are the kinds rules can refer to, besides the store kinds they cover the configuration as a whole,
+// webhooks, tokens, the audit log and the secrets resources can reference
+var Kinds = []string{"router", "service", "middleware", "config", "webhook", "token", "audit", KindSecret, Any}
+
+// KindSecret is the kind of the secrets resources reference, a secret is named by the reference without ${ and },
+// e.g. secret:file:/run/secrets/password or env:TRAEFIK_PASSWORD
+const KindSecret = "secret"
+
+// storeKinds are the kinds of labeled resources, only their lists are filtered by name. A rule limited by a
+// selector only applies to them, the configuration as a whole, webhooks, tokens and the audit log can only be
+// accessed with unrestricted rules.
+var storeKinds = []string{"router", "service", "middleware"}
+
+// namedKinds are the kinds rules can be limited to by names, secrets have names but no labels
+var namedKinds = []string{"router", "service", "middleware", KindSecret}
+
+// Rule grants verbs on kinds, it is limited to the resources matching one of the name patterns or the selector,
+// without both it applies to all resources of the kinds. A limited rule only applies to routers, services,
+// middlewares and secrets, it allows to list them as the lists are filtered.
+type Rule struct {
+	Kinds []string `json:"kinds" yaml:"kinds"`
+	Verbs []string `json:"verbs" yaml:"verbs"`
+	// Names are patterns in the syntax of path.Match, e.g. team-a-*
+	Names    []string          `json:"names,omitempty" yaml:"names,omitempty"`
+	Selector map[string]string `json:"selector,omitempty" yaml:"selector,omitempty"`
+}
+
+type Role struct {
+	Rules []Rule `json:"rules" yaml:"rules"`
+}
+
+// Binding grants a role to subjects, which are htpasswd user names, token:<id>, oidc:<name>, cert:<name> or
+// group:<name>. Tokens are bound as the subjects of the identity which issued them as well.
+type Binding struct {
+	Role     string   `json:"role" yaml:"role"`
+	Subjects []string `json:"subjects" yaml:"subjects"`
+}
+
+type Policy struct {
+	Roles    map[string]Role `json:"roles" yaml:"roles"`
+	Bindings []Binding       `json:"bindings" yaml:"bindings"`
+}
+
+// Request is an action to decide on, Name is empty for actions on all resources of a kind like listing
+type Request struct {
+	Subjects []string
+	Verb     string
+	Kind     string
+	Name     string
+	Labels   map[string]string
+}
+
+// Load reads a policy from a yaml or json file
+func Load(file string) (*Policy, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	policy := Policy{}
+	err = yaml.UnmarshalStrict(content, &policy)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %v: %v", file, err)
+	}
+	return &policy, policy.Validate()
+}
+
+// Validate checks that all bindings refer to roles and all rules to known verbs, kinds and valid patterns
+func (p *Policy) Validate() error {
+	for name, role := range p.Roles {
+		for i, rule := range role.Rules {
+			for _, verb := range rule.Verbs {
+				if !contains(verbs, verb) {
+					return fmt.Errorf("rule %v of role %v: unknown verb %v", i, name, verb)
+				}
+			}
+			for _, kind := range rule.Kinds {
+				if !contains(Kinds, kind) {
+					return fmt.Errorf("rule %v of role %v: unknown kind %v", i, name, kind)
+				}
+			}
+			for _, kind := range rule.Kinds {
+				if kind == Any {
+					continue
+				}
+				if len(rule.Names) > 0 && !contains(namedKinds, kind) {
+					return fmt.Errorf("rule %v of role %v: names only apply to %v", i, name, namedKinds)
+				}
+				if len(rule.Selector) > 0 && !contains(storeKinds, kind) {
+					return fmt.Errorf("rule %v of role %v: selectors only apply to %v", i, name, storeKinds)
+				}
+			}
+			for _, pattern := range rule.Names {
+				if _, err := path.Match(pattern, ""); err != nil {
+					return fmt.Errorf("rule %v of role %v: invalid name pattern %v", i, name, pattern)
+				}
+			}
+		}
+	}
+	for i, binding := range p.Bindings {
+		if _, ok := p.Roles[binding.Role]; !ok {
+			return fmt.Errorf("binding %v: unknown role %v", i, binding.Role)
+		}
+	}
+	return nil
+}
+
+// Allowed reports whether one of the roles bound to the subjects grants the request
+func (p *Policy) Allowed(request Request) bool {
+	for _, binding := range p.Bindings {
+		if !intersects(binding.Subjects, request.Subjects) {
+			continue
+		}
+		for _, rule := range p.Roles[binding.Role].Rules {
+			if rule.allows(request) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (r Rule) allows(request Request) bool {
+	if !(contains(r.Verbs, Any) || contains(r.Verbs, request.Verb)) {
+		return false
+	}
+	if !(contains(r.Kinds, Any) || contains(r.Kinds, request.Kind)) {
+		return false
+	}
+	if len(r.Names) == 0 && len(r.Selector) == 0 {
+		return true
+	}
+	if !contains(namedKinds, request.Kind) {
+		return false
+	}
+	// a list is allowed if the rule covers some of the resources, the results are filtered by name
+	if request.Name == "" {
+		return request.Verb == VerbList
+	}
+	for _, pattern := range r.Names {
+		if ok, _ := path.Match(pattern, request.Name); ok {
+			return true
+		}
+	}
+	if len(r.Selector) == 0 {
+		return false
+	}
+	for key, value := range r.Selector {
+		if request.Labels[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func intersects(a, b []string) bool {
+	for _, value := range a {
+		if contains(b, value) {
+			return true
+		}
+	}
+	return false
+}
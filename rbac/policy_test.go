@@ -0,0 +1,96 @@
+package rbac
+
+import "testing"
+
+func TestPolicyAllowed(t *testing.T) {
+	policy := &Policy{
+		Roles: map[string]Role{
+			"admin": {Rules: []Rule{{Kinds: []string{Any}, Verbs: []string{Any}}}},
+			"team-a": {Rules: []Rule{
+				{Kinds: []string{Any}, Verbs: []string{Any}, Names: []string{"team-a-*"}},
+				{Kinds: []string{"router"}, Verbs: []string{VerbCreate, VerbUpdate}, Selector: map[string]string{"team": "a"}},
+				{Kinds: []string{"service"}, Verbs: []string{VerbGet, VerbList}},
+				{Kinds: []string{KindSecret}, Verbs: []string{VerbUse}, Names: []string{"secret:file:/run/secrets/team-a-*"}},
+			}},
+		},
+		Bindings: []Binding{
+			{Role: "admin", Subjects: []string{"admin"}},
+			{Role: "team-a", Subjects: []string{"alice", "group:team-a"}},
+		},
+	}
+	err := policy.Validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	team := map[string]string{"team": "a"}
+	tests := []struct {
+		name    string
+		request Request
+		allowed bool
+	}{
+		{name: "admin", request: Request{Subjects: []string{"admin"}, Verb: VerbDelete, Kind: "token", Name: "x"}, allowed: true},
+		{name: "admin reads the configuration", request: Request{Subjects: []string{"admin"}, Verb: VerbGet, Kind: "config"}, allowed: true},
+		{name: "unbound subject", request: Request{Subjects: []string{"bob"}, Verb: VerbGet, Kind: "router", Name: "team-a-web"}},
+		{name: "matching name", request: Request{Subjects: []string{"alice"}, Verb: VerbUpdate, Kind: "router", Name: "team-a-web"}, allowed: true},
+		{name: "matching name by group", request: Request{Subjects: []string{"carol", "group:team-a"}, Verb: VerbDelete, Kind: "middleware", Name: "team-a-auth"}, allowed: true},
+		{name: "other name", request: Request{Subjects: []string{"alice"}, Verb: VerbGet, Kind: "router", Name: "team-b-web"}},
+		{name: "matching selector", request: Request{Subjects: []string{"alice"}, Verb: VerbCreate, Kind: "router", Name: "web", Labels: team}, allowed: true},
+		{name: "other labels", request: Request{Subjects: []string{"alice"}, Verb: VerbCreate, Kind: "router", Name: "web", Labels: map[string]string{"team": "b"}}},
+		{name: "no labels", request: Request{Subjects: []string{"alice"}, Verb: VerbCreate, Kind: "router", Name: "web"}},
+		{name: "selector with another verb", request: Request{Subjects: []string{"alice"}, Verb: VerbDelete, Kind: "router", Name: "web", Labels: team}},
+		{name: "unrestricted rule", request: Request{Subjects: []string{"alice"}, Verb: VerbGet, Kind: "service", Name: "team-b-web"}, allowed: true},
+		{name: "list of a limited kind", request: Request{Subjects: []string{"alice"}, Verb: VerbList, Kind: "router"}, allowed: true},
+		{name: "create without name", request: Request{Subjects: []string{"alice"}, Verb: VerbCreate, Kind: "router"}},
+		{name: "reveal without name", request: Request{Subjects: []string{"alice"}, Verb: VerbReveal, Kind: "middleware"}},
+		{name: "limited rule on the configuration", request: Request{Subjects: []string{"alice"}, Verb: VerbGet, Kind: "config"}},
+		{name: "limited rule on tokens", request: Request{Subjects: []string{"alice"}, Verb: VerbList, Kind: "token"}},
+		{name: "limited rule on a token", request: Request{Subjects: []string{"alice"}, Verb: VerbGet, Kind: "token", Name: "team-a-x"}},
+		{name: "limited rule on webhooks", request: Request{Subjects: []string{"alice"}, Verb: VerbCreate, Kind: "webhook"}},
+		{name: "limited rule on the audit log", request: Request{Subjects: []string{"alice"}, Verb: VerbList, Kind: "audit"}},
+		{name: "limited rule on any kind", request: Request{Subjects: []string{"alice"}, Verb: VerbList, Kind: Any}},
+		{name: "admin uses a secret", request: Request{Subjects: []string{"admin"}, Verb: VerbUse, Kind: KindSecret, Name: "env:TRAEFIK_PASSWORD"}, allowed: true},
+		{name: "matching secret", request: Request{Subjects: []string{"alice"}, Verb: VerbUse, Kind: KindSecret, Name: "secret:file:/run/secrets/team-a-password"}, allowed: true},
+		{name: "other secret", request: Request{Subjects: []string{"alice"}, Verb: VerbUse, Kind: KindSecret, Name: "secret:file:/run/secrets/team-b-password"}},
+		{name: "secret in a subdirectory", request: Request{Subjects: []string{"alice"}, Verb: VerbUse, Kind: KindSecret, Name: "secret:file:/run/secrets/team-a-x/../team-b-password"}},
+		{name: "environment variable", request: Request{Subjects: []string{"alice"}, Verb: VerbUse, Kind: KindSecret, Name: "env:TRAEFIK_PASSWORD"}},
+	}
+	for _, test := range tests {
+		if allowed := policy.Allowed(test.request); allowed != test.allowed {
+			t.Errorf("%v: Allowed(%+v) = %v, want %v", test.name, test.request, allowed, test.allowed)
+		}
+	}
+}
+
+func TestPolicyValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		rule  Rule
+		valid bool
+	}{
+		{name: "unrestricted", rule: Rule{Kinds: []string{"token", "audit"}, Verbs: []string{Any}}, valid: true},
+		{name: "names of store kinds", rule: Rule{Kinds: []string{"router", Any}, Verbs: []string{VerbGet}, Names: []string{"a-*"}}, valid: true},
+		{name: "unknown verb", rule: Rule{Kinds: []string{"router"}, Verbs: []string{"read"}}},
+		{name: "unknown kind", rule: Rule{Kinds: []string{"routers"}, Verbs: []string{VerbGet}}},
+		{name: "invalid pattern", rule: Rule{Kinds: []string{"router"}, Verbs: []string{VerbGet}, Names: []string{"["}}},
+		{name: "names of tokens", rule: Rule{Kinds: []string{"token"}, Verbs: []string{VerbGet}, Names: []string{"a-*"}}},
+		{name: "selector of the configuration", rule: Rule{Kinds: []string{"config"}, Verbs: []string{VerbGet}, Selector: map[string]string{"team": "a"}}},
+		{name: "names of secrets", rule: Rule{Kinds: []string{KindSecret}, Verbs: []string{VerbUse}, Names: []string{"secret:file:/run/secrets/a-*"}}, valid: true},
+		{name: "selector of secrets", rule: Rule{Kinds: []string{KindSecret}, Verbs: []string{VerbUse}, Selector: map[string]string{"team": "a"}}},
+	}
+	for _, test := range tests {
+		policy := &Policy{Roles: map[string]Role{"role": {Rules: []Rule{test.rule}}}, Bindings: []Binding{{Role: "role", Subjects: []string{"a"}}}}
+		err := policy.Validate()
+		if test.valid && err != nil {
+			t.Errorf("%v: Validate = %v, want nil", test.name, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%v: Validate = nil, want an error", test.name)
+		}
+	}
+
+	policy := &Policy{Bindings: []Binding{{Role: "missing", Subjects: []string{"a"}}}}
+	if policy.Validate() == nil {
+		t.Error("a binding of an unknown role was accepted")
+	}
+}
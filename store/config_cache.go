@@ -0,0 +1,181 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/traefik/traefik/v2/pkg/config/dynamic"
+)
+
+// Rendered is a serialized configuration with the version of exactly these bytes
+type Rendered struct {
+	Body    []byte
+	Version string
+}
+
+// Snapshot is the assembled configuration of all stores together with its serializations
+type Snapshot struct {
+	Configuration *dynamic.Configuration
+	JSON          Rendered
+	TOML          Rendered
+	// Unresolved are the resources left out of the configuration because of references which can not be resolved
+	Unresolved []Unresolved
+}
+
+// ConfigCache keeps the assembled configuration in memory, it is dropped whenever one of the stores
+// emits a change, so only the first request after a change reads the stores
+type ConfigCache struct {
+	routers     HTTPRouterStore
+	services    HTTPServiceStore
+	middlewares HTTPMiddlewareStore
+	// resolver resolves the references to secrets, a snapshot containing references is rebuilt after refresh
+	// so changed secrets are picked up
+	resolver *SecretResolver
+	refresh  time.Duration
+
+	// build serializes rebuilding the snapshot, so concurrent requests after a change read the stores once
+	build sync.Mutex
+
+	mutex      sync.Mutex
+	snapshot   *Snapshot
+	expires    time.Time
+	generation uint64
+	// changed is closed and replaced on every change
+	changed chan struct{}
+}
+
+// NewConfigCache creates a cache which resolves references to secrets with the resolver, they are left as they are
+// without one
+func NewConfigCache(routers HTTPRouterStore, services HTTPServiceStore, middlewares HTTPMiddlewareStore, resolver *SecretResolver, refresh time.Duration) *ConfigCache {
+	c := &ConfigCache{
+		routers:     routers,
+		services:    services,
+		middlewares: middlewares,
+		resolver:    resolver,
+		refresh:     refresh,
+		changed:     make(chan struct{}),
+	}
+	routers.Subscribe(c.invalidate)
+	services.Subscribe(c.invalidate)
+	middlewares.Subscribe(c.invalidate)
+	return c
+}
+
+func (c *ConfigCache) invalidate(Event) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.snapshot = nil
+	c.generation++
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// Changed returns a channel which is closed on the next change of one of the stores, it has to be
+// obtained before reading the snapshot to not miss a change in between
+func (c *ConfigCache) Changed() <-chan struct{} {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.changed
+}
+
+// cached returns the snapshot if it did not expire
+func (c *ConfigCache) cached() (*Snapshot, uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.snapshot != nil && !c.expires.IsZero() && time.Now().After(c.expires) {
+		c.snapshot = nil
+	}
+	return c.snapshot, c.generation
+}
+
+// Get returns the cached snapshot or assembles a new one from the stores
+func (c *ConfigCache) Get(ctx context.Context) (*Snapshot, error) {
+	snapshot, _ := c.cached()
+	if snapshot != nil {
+		return snapshot, nil
+	}
+
+	c.build.Lock()
+	defer c.build.Unlock()
+
+	snapshot, generation := c.cached()
+	// another request rebuilt the snapshot while this one was waiting
+	if snapshot != nil {
+		return snapshot, nil
+	}
+
+	snapshot, references, err := c.assemble(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	// a change during the assembly may not be contained, the snapshot is only used for this request then
+	if c.generation == generation {
+		c.snapshot = snapshot
+		c.expires = time.Time{}
+		if references {
+			c.expires = time.Now().Add(c.refresh)
+		}
+	}
+	return snapshot, nil
+}
+
+// assemble builds a snapshot from the stores, it reports whether it resolved references to secrets
+func (c *ConfigCache) assemble(ctx context.Context) (*Snapshot, bool, error) {
+	routers, err := c.routers.GetAll(ctx, 0, -1)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to get routers: %w", err)
+	}
+	services, err := c.services.GetAll(ctx, 0, -1)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to get services: %w", err)
+	}
+	middlewares, err := c.middlewares.GetAll(ctx, 0, -1)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to get middlewares: %w", err)
+	}
+
+	snapshot := &Snapshot{
+		Configuration: &dynamic.Configuration{
+			HTTP: &dynamic.HTTPConfiguration{
+				Routers:     routers,
+				Services:    services,
+				Middlewares: middlewares,
+			},
+		},
+	}
+
+	references := false
+	if c.resolver != nil {
+		snapshot.Configuration, references, snapshot.Unresolved, err = c.resolver.resolveConfiguration(snapshot.Configuration)
+		if err != nil {
+			return nil, references, fmt.Errorf("failed to resolve the secrets: %v", err)
+		}
+		for _, unresolved := range snapshot.Unresolved {
+			fmt.Printf("left %v %v out of the configuration: %v\n", unresolved.Kind, unresolved.Name, unresolved.Error)
+		}
+	}
+
+	body := bytes.Buffer{}
+	err = json.NewEncoder(&body).Encode(snapshot.Configuration)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to encode the configuration as json: %v", err)
+	}
+	snapshot.JSON = Rendered{Body: body.Bytes(), Version: contentVersion(body.Bytes())}
+
+	body = bytes.Buffer{}
+	err = toml.NewEncoder(&body).Encode(snapshot.Configuration)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to encode the configuration as toml: %v", err)
+	}
+	snapshot.TOML = Rendered{Body: body.Bytes(), Version: contentVersion(body.Bytes())}
+
+	return snapshot, references, nil
+}
@@ -0,0 +1,90 @@
+package store
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/traefik/traefik/v2/pkg/config/dynamic"
+)
+
+func newTestConfigCache(t *testing.T) (*ConfigCache, *HTTPRouterStoreJSON) {
+	dir := t.TempDir()
+	routers, err := NewHTTPRouterStoreJSON(filepath.Join(dir, "routers"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	services, err := NewHTTPServiceStoreJSON(filepath.Join(dir, "services"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	middlewares, err := NewHTTPMiddlewareStoreJSON(filepath.Join(dir, "middlewares"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewConfigCache(routers, services, middlewares, nil, 0), routers
+}
+
+func TestConfigCache(t *testing.T) {
+	ctx := context.Background()
+	cache, routers := newTestConfigCache(t)
+	err := routers.Set(ctx, "web", &dynamic.Router{Rule: "Host(`example.com`)", Service: "web"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := cache.Get(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Configuration.HTTP.Routers["web"] == nil {
+		t.Fatalf("the configuration does not contain the router: %s", first.JSON.Body)
+	}
+	if first.JSON.Version == "" || first.JSON.Version == first.TOML.Version {
+		t.Errorf("versions = %v and %v, want one per serialization", first.JSON.Version, first.TOML.Version)
+	}
+	if first.JSON.Version != contentVersion(first.JSON.Body) {
+		t.Error("the version is not the one of the serialized json")
+	}
+	changed := cache.Changed()
+	again, err := cache.Get(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != first {
+		t.Error("the snapshot was assembled again without a change")
+	}
+
+	err = routers.Set(ctx, "web", &dynamic.Router{Rule: "Host(`example.org`)", Service: "web"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-changed:
+	default:
+		t.Error("the changed channel was not closed by the write")
+	}
+	second, err := cache.Get(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second == first || second.JSON.Version == first.JSON.Version {
+		t.Error("the snapshot was not invalidated by the write")
+	}
+	if rule := second.Configuration.HTTP.Routers["web"].Rule; rule != "Host(`example.org`)" {
+		t.Errorf("rule = %v, want the written one", rule)
+	}
+
+	// the version only depends on the configuration, writing the same router again keeps it
+	err = routers.Set(ctx, "web", &dynamic.Router{Rule: "Host(`example.org`)", Service: "web"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	third, err := cache.Get(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if third.JSON.Version != second.JSON.Version {
+		t.Errorf("version = %v, want %v for the same configuration", third.JSON.Version, second.JSON.Version)
+	}
+}
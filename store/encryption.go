@@ -0,0 +1,212 @@
+package store
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/traefik/traefik/v2/pkg/config/dynamic"
+)
+
+const (
+	// encryptedPrefix marks encrypted values, the format is enc:<version>:<key id>:<wrapped data key>:<ciphertext>
+	encryptedPrefix = "enc:"
+	// encryptionVersion is the format values are encrypted in, v2 binds the values to where they are stored with
+	// additional authenticated data, v1 values are only decrypted until they are rotated
+	encryptionVersion = "v2"
+)
+
+var encryptionVersions = []string{"v1", encryptionVersion}
+
+// Keyring holds the master keys sensitive fields are encrypted with. Every value is encrypted with its own data
+// key, which is encrypted with the primary master key. The other keys are only used to decrypt values written
+// before the primary key was rotated.
+type Keyring struct {
+	primary string
+	keys    map[string][]byte
+}
+
+// LoadKeyring reads master keys from a file with a line <id> <base64 encoded 32 byte key> per key, the first key
+// is the primary one, empty lines and lines starting with # are ignored
+func LoadKeyring(path string) (*Keyring, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the key file: %v", err)
+	}
+	defer file.Close()
+
+	k := &Keyring{keys: map[string][]byte{}}
+	scanner := bufio.NewScanner(file)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %v of the key file: expected <id> <base64 key>", line)
+		}
+		id := fields[0]
+		if strings.Contains(id, ":") {
+			return nil, fmt.Errorf("line %v of the key file: the key id %v must not contain a colon", line, id)
+		}
+		if _, ok := k.keys[id]; ok {
+			return nil, fmt.Errorf("line %v of the key file: duplicate key id %v", line, id)
+		}
+		key, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("line %v of the key file: the key %v has to be 32 base64 encoded bytes", line, id)
+		}
+		k.keys[id] = key
+		if k.primary == "" {
+			k.primary = id
+		}
+	}
+	err = scanner.Err()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the key file: %v", err)
+	}
+	if k.primary == "" {
+		return nil, fmt.Errorf("the key file %v contains no keys", path)
+	}
+	return k, nil
+}
+
+// Encrypt encrypts a value with a new data key. The value is bound to the binding, e.g. the field it is stored in,
+// it can only be decrypted with the same binding so it can not be copied elsewhere.
+func (k *Keyring) Encrypt(plaintext, binding string) (string, error) {
+	dataKey := make([]byte, 32)
+	_, err := io.ReadFull(rand.Reader, dataKey)
+	if err != nil {
+		return "", err
+	}
+	wrapped, err := seal(k.keys[k.primary], dataKey, []byte(binding))
+	if err != nil {
+		return "", err
+	}
+	ciphertext, err := seal(dataKey, []byte(plaintext), []byte(binding))
+	if err != nil {
+		return "", err
+	}
+	return encryptedPrefix + encryptionVersion + ":" + k.primary + ":" +
+		base64.RawURLEncoding.EncodeToString(wrapped) + ":" + base64.RawURLEncoding.EncodeToString(ciphertext), nil
+}
+
+// Decrypt decrypts a value with the binding it was encrypted with, values which are not encrypted are returned
+// as they are
+func (k *Keyring) Decrypt(value, binding string) (string, error) {
+	if !IsEncrypted(value) {
+		return value, nil
+	}
+	parts := strings.Split(strings.TrimPrefix(value, encryptedPrefix), ":")
+	if len(parts) != 4 {
+		return "", errors.New("malformed encrypted value")
+	}
+	// v1 values are not bound
+	var additional []byte
+	if parts[0] != "v1" {
+		additional = []byte(binding)
+	}
+	key, ok := k.keys[parts[1]]
+	if !ok {
+		return "", fmt.Errorf("the value is encrypted with the unknown key %v", parts[1])
+	}
+	wrapped, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", fmt.Errorf("malformed encrypted value: %v", err)
+	}
+	ciphertext, err := base64.RawURLEncoding.DecodeString(parts[3])
+	if err != nil {
+		return "", fmt.Errorf("malformed encrypted value: %v", err)
+	}
+	dataKey, err := open(key, wrapped, additional)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt the data key with key %v: %v", parts[1], err)
+	}
+	plaintext, err := open(dataKey, ciphertext, additional)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt the value: %v", err)
+	}
+	return string(plaintext), nil
+}
+
+// current reports whether the value is encrypted in the current format with the primary key
+func (k *Keyring) current(value string) bool {
+	return strings.HasPrefix(value, encryptedPrefix+encryptionVersion+":"+k.primary+":")
+}
+
+// IsEncrypted reports whether the value is encrypted by a keyring
+func IsEncrypted(value string) bool {
+	for _, version := range encryptionVersions {
+		if strings.HasPrefix(value, encryptedPrefix+version+":") {
+			return true
+		}
+	}
+	return false
+}
+
+// seal encrypts with AES-GCM, the nonce is prepended to the ciphertext. The additional data is authenticated but
+// not encrypted, the ciphertext can only be opened with the same additional data.
+func seal(key, plaintext, additional []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, additional), nil
+}
+
+func open(key, sealed, additional []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("the ciphertext is too short")
+	}
+	return gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], additional)
+}
+
+// SensitiveMiddlewareFields returns the sensitive values of a middleware by the path of their field, e.g. the
+// users of basic and digest auth and the private key of the forward auth client certificate
+func SensitiveMiddlewareFields(middleware *dynamic.Middleware) map[string][]*string {
+	fields := map[string][]*string{}
+	if middleware == nil {
+		return fields
+	}
+	if middleware.BasicAuth != nil {
+		for i := range middleware.BasicAuth.Users {
+			fields["basicAuth.users"] = append(fields["basicAuth.users"], &middleware.BasicAuth.Users[i])
+		}
+	}
+	if middleware.DigestAuth != nil {
+		for i := range middleware.DigestAuth.Users {
+			fields["digestAuth.users"] = append(fields["digestAuth.users"], &middleware.DigestAuth.Users[i])
+		}
+	}
+	if middleware.ForwardAuth != nil && middleware.ForwardAuth.TLS != nil && middleware.ForwardAuth.TLS.Key != "" {
+		fields["forwardAuth.tls.key"] = []*string{&middleware.ForwardAuth.TLS.Key}
+	}
+	return fields
+}
@@ -0,0 +1,370 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/traefik/traefik/v2/pkg/config/dynamic"
+)
+
+// newKey returns a line of a key file with a random key
+func newKey(t *testing.T, id string) string {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id + " " + base64.StdEncoding.EncodeToString(key) + "\n"
+}
+
+// newKeyring writes the lines to a key file and loads it
+func newKeyring(t *testing.T, lines ...string) *Keyring {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "keys")
+	err := ioutil.WriteFile(path, []byte(strings.Join(lines, "")), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring, err := LoadKeyring(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keyring
+}
+
+func TestLoadKeyring(t *testing.T) {
+	a, b := newKey(t, "a"), newKey(t, "b")
+	tests := []struct {
+		name    string
+		content string
+		primary string
+	}{
+		{name: "single key", content: a, primary: "a"},
+		{name: "first key is primary", content: b + a, primary: "b"},
+		{name: "comments and empty lines", content: "# keys\n\n" + a + "  \n", primary: "a"},
+		{name: "no keys", content: "# keys\n"},
+		{name: "missing key", content: "a\n"},
+		{name: "too many fields", content: strings.TrimSuffix(a, "\n") + " x\n"},
+		{name: "colon in id", content: newKey(t, "a:b")},
+		{name: "duplicate id", content: a + newKey(t, "a")},
+		{name: "invalid base64", content: "a not-base64!\n"},
+		{name: "short key", content: "a " + base64.StdEncoding.EncodeToString(make([]byte, 16)) + "\n"},
+	}
+	for _, test := range tests {
+		path := filepath.Join(t.TempDir(), "keys")
+		err := ioutil.WriteFile(path, []byte(test.content), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keyring, err := LoadKeyring(path)
+		if test.primary == "" {
+			if err == nil {
+				t.Errorf("%v: LoadKeyring succeeded, want an error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", test.name, err)
+			continue
+		}
+		if keyring.primary != test.primary {
+			t.Errorf("%v: primary = %v, want %v", test.name, keyring.primary, test.primary)
+		}
+	}
+
+	if _, err := LoadKeyring(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("a missing key file was loaded")
+	}
+}
+
+func TestKeyringRoundTrip(t *testing.T) {
+	keyring := newKeyring(t, newKey(t, "a"))
+	for _, plaintext := range []string{"", "admin:$apr1$H6uskkkW$IgXLP6ewTrSuBkTrqE8wj/", strings.Repeat("x", 10000), "ünïcode"} {
+		encrypted, err := keyring.Encrypt(plaintext, "binding")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !IsEncrypted(encrypted) || !keyring.current(encrypted) {
+			t.Errorf("%q is not encrypted with the primary key", encrypted)
+		}
+		if plaintext != "" && strings.Contains(encrypted, plaintext) {
+			t.Errorf("%q contains the plaintext", encrypted)
+		}
+		decrypted, err := keyring.Decrypt(encrypted, "binding")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decrypted != plaintext {
+			t.Errorf("Decrypt = %q, want %q", decrypted, plaintext)
+		}
+	}
+
+	// every value has its own data key and nonce
+	first, _ := keyring.Encrypt("secret", "binding")
+	second, _ := keyring.Encrypt("secret", "binding")
+	if first == second {
+		t.Error("the same plaintext was encrypted to the same value twice")
+	}
+
+	// values which are not encrypted are returned as they are
+	value, err := keyring.Decrypt("admin:plain", "binding")
+	if err != nil || value != "admin:plain" {
+		t.Errorf("Decrypt(plaintext) = %q, %v, want it unchanged", value, err)
+	}
+}
+
+func TestKeyringRejects(t *testing.T) {
+	keyring := newKeyring(t, newKey(t, "a"))
+	encrypted, err := keyring.Encrypt("secret", "middleware:a:basicAuth.users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(encrypted, ":")
+	tamper := func(part int) string {
+		tampered := append([]string{}, parts...)
+		decoded, _ := base64.RawURLEncoding.DecodeString(tampered[part])
+		decoded[len(decoded)-1] ^= 1
+		tampered[part] = base64.RawURLEncoding.EncodeToString(decoded)
+		return strings.Join(tampered, ":")
+	}
+
+	tests := []struct {
+		name    string
+		keyring *Keyring
+		value   string
+		binding string
+	}{
+		{name: "wrong key", keyring: newKeyring(t, newKey(t, "a")), value: encrypted, binding: "middleware:a:basicAuth.users"},
+		{name: "unknown key", keyring: newKeyring(t, newKey(t, "b")), value: encrypted, binding: "middleware:a:basicAuth.users"},
+		{name: "other middleware", keyring: keyring, value: encrypted, binding: "middleware:b:basicAuth.users"},
+		{name: "other field", keyring: keyring, value: encrypted, binding: "middleware:a:digestAuth.users"},
+		{name: "tampered data key", keyring: keyring, value: tamper(3), binding: "middleware:a:basicAuth.users"},
+		{name: "tampered ciphertext", keyring: keyring, value: tamper(4), binding: "middleware:a:basicAuth.users"},
+		{name: "missing part", keyring: keyring, value: strings.Join(parts[:4], ":"), binding: "middleware:a:basicAuth.users"},
+		{name: "extra part", keyring: keyring, value: encrypted + ":x", binding: "middleware:a:basicAuth.users"},
+		{name: "invalid base64", keyring: keyring, value: "enc:v2:a:!!!:!!!", binding: "middleware:a:basicAuth.users"},
+		{name: "short ciphertext", keyring: keyring, value: "enc:v2:a:AA:AA", binding: "middleware:a:basicAuth.users"},
+	}
+	for _, test := range tests {
+		value, err := test.keyring.Decrypt(test.value, test.binding)
+		if err == nil {
+			t.Errorf("%v: Decrypt = %q, want an error", test.name, value)
+		}
+	}
+}
+
+// TestKeyringDecryptsV1 checks that values written before they were bound can still be decrypted
+func TestKeyringDecryptsV1(t *testing.T) {
+	keyring := newKeyring(t, newKey(t, "a"))
+	dataKey := make([]byte, 32)
+	wrapped, err := seal(keyring.keys["a"], dataKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphertext, err := seal(dataKey, []byte("secret"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value := "enc:v1:a:" + base64.RawURLEncoding.EncodeToString(wrapped) + ":" + base64.RawURLEncoding.EncodeToString(ciphertext)
+
+	if !IsEncrypted(value) || keyring.current(value) {
+		t.Errorf("%q is not an encrypted value which has to be rotated", value)
+	}
+	decrypted, err := keyring.Decrypt(value, "anything")
+	if err != nil || decrypted != "secret" {
+		t.Errorf("Decrypt = %q, %v, want secret", decrypted, err)
+	}
+}
+
+func newEncryptedStore(t *testing.T, dir string, keyring *Keyring) *HTTPMiddlewareStoreEncrypted {
+	t.Helper()
+	middlewares, err := NewHTTPMiddlewareStoreJSON(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewHTTPMiddlewareStoreEncrypted(middlewares, keyring)
+}
+
+func sensitiveMiddleware() *dynamic.Middleware {
+	return &dynamic.Middleware{BasicAuth: &dynamic.BasicAuth{Users: dynamic.Users{"admin:$apr1$secret-hash", "other:$apr1$other-hash"}}}
+}
+
+// checkNoPlaintext fails the test if a file in the directory contains one of the values
+func checkNoPlaintext(t *testing.T, dir string, values ...string) {
+	t.Helper()
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		for _, value := range values {
+			if bytes.Contains(content, []byte(value)) {
+				t.Errorf("%v contains %v in plain text", path, value)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEncryptedStore(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	s := newEncryptedStore(t, dir, newKeyring(t, newKey(t, "a")))
+
+	err := s.Set(ctx, "auth", sensitiveMiddleware())
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkNoPlaintext(t, dir, "secret-hash", "other-hash")
+
+	middleware, err := s.Get(ctx, "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := middleware.BasicAuth.Users, sensitiveMiddleware().BasicAuth.Users; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("users = %v, want %v", got, want)
+	}
+	all, err := s.GetAll(ctx, 0, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if all["auth"].BasicAuth.Users[0] != "admin:$apr1$secret-hash" {
+		t.Errorf("GetAll users = %v, want them decrypted", all["auth"].BasicAuth.Users)
+	}
+
+	// writing the same middleware again keeps the file
+	before, err := ioutil.ReadFile(filepath.Join(dir, "middleware_auth.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Set(ctx, "auth", sensitiveMiddleware())
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, err := ioutil.ReadFile(filepath.Join(dir, "middleware_auth.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(before, after) {
+		t.Error("writing the same middleware again changed the ciphertext")
+	}
+
+	// a changed value is encrypted again and the old one is gone
+	changed := sensitiveMiddleware()
+	changed.BasicAuth.Users[1] = "other:$apr1$changed-hash"
+	err = s.Set(ctx, "auth", changed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkNoPlaintext(t, dir, "secret-hash", "other-hash", "changed-hash")
+}
+
+// TestEncryptedStoreRejectsCiphertext checks that ciphertext copied from another middleware can not be written
+// and read back
+func TestEncryptedStoreRejectsCiphertext(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	keyring := newKeyring(t, newKey(t, "a"))
+	s := newEncryptedStore(t, dir, keyring)
+	err := s.Set(ctx, "team-b", sensitiveMiddleware())
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := s.HTTPMiddlewareStore.Get(ctx, "team-b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	copied := &dynamic.Middleware{BasicAuth: &dynamic.BasicAuth{Users: dynamic.Users{stored.BasicAuth.Users[0]}}}
+	err = s.Set(ctx, "team-a", copied)
+	if !errors.Is(err, ErrInvalidValue) {
+		t.Errorf("Set with ciphertext = %v, want ErrInvalidValue", err)
+	}
+	if _, err := s.Get(ctx, "team-a"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get after the rejected write = %v, want ErrNotFound", err)
+	}
+
+	// ciphertext moved to another middleware on disk can not be decrypted either
+	err = s.HTTPMiddlewareStore.Set(ctx, "team-a", copied)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if middleware, err := s.Get(ctx, "team-a"); err == nil {
+		t.Errorf("the moved ciphertext was decrypted to %v", middleware.BasicAuth.Users)
+	}
+}
+
+func TestEncryptedStoreRotate(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	a, b := newKey(t, "a"), newKey(t, "b")
+
+	// a middleware written before encryption was enabled
+	plain, err := NewHTTPMiddlewareStoreJSON(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = plain.Set(ctx, "plain", sensitiveMiddleware())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newEncryptedStore(t, dir, newKeyring(t, a))
+	err = s.Set(ctx, "old", sensitiveMiddleware())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Set(ctx, "none", &dynamic.Middleware{StripPrefix: &dynamic.StripPrefix{Prefixes: []string{"/api"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rotated, err := s.Rotate(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(rotated, ",") != "plain" {
+		t.Errorf("rotated = %v, want the plain middleware", rotated)
+	}
+	checkNoPlaintext(t, dir, "secret-hash", "other-hash")
+
+	// b becomes the primary key, a is kept to decrypt the old values
+	s = newEncryptedStore(t, dir, newKeyring(t, b, a))
+	rotated, err = s.Rotate(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rotated) != 2 {
+		t.Errorf("rotated = %v, want plain and old", rotated)
+	}
+	rotated, err = s.Rotate(ctx)
+	if err != nil || len(rotated) != 0 {
+		t.Errorf("second rotation = %v, %v, want nothing to rotate", rotated, err)
+	}
+
+	// a can be removed once everything is rotated
+	s = newEncryptedStore(t, dir, newKeyring(t, b))
+	for _, name := range []string{"plain", "old"} {
+		middleware, err := s.Get(ctx, name)
+		if err != nil {
+			t.Fatalf("failed to get %v after the rotation: %v", name, err)
+		}
+		if middleware.BasicAuth.Users[0] != "admin:$apr1$secret-hash" {
+			t.Errorf("%v users = %v, want them decrypted", name, middleware.BasicAuth.Users)
+		}
+	}
+	checkNoPlaintext(t, dir, "secret-hash", "other-hash")
+}
@@ -0,0 +1,40 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+var (
+	// ErrNotFound is returned if the resource does not exist
+	ErrNotFound = errors.New("not found")
+	// ErrAlreadyExists is returned if a resource should be created but already exists
+	ErrAlreadyExists = errors.New("already exists")
+	// ErrConflict is returned if the resource changed, e.g. it does not have the expected version anymore
+	ErrConflict = errors.New("conflict")
+	// ErrInvalidName is returned if a name can not be used for a resource
+	ErrInvalidName = errors.New("invalid name")
+	// ErrUnavailable is returned if the backend of a store can not be reached or used
+	ErrUnavailable = errors.New("backend unavailable")
+	// ErrInvalidListOptions is returned if a list can not be created from the given options
+	ErrInvalidListOptions = errors.New("invalid list options")
+	// ErrInvalidValue is returned if a resource contains a value which can not be stored, e.g. a redacted one
+	ErrInvalidValue = errors.New("invalid value")
+)
+
+// fileError wraps errors of file operations with the matching store error
+func fileError(err error, format string, args ...interface{}) error {
+	var pathErr *os.PathError
+	switch {
+	case os.IsNotExist(err):
+		return fmt.Errorf("%v: %w: %v", fmt.Sprintf(format, args...), ErrNotFound, err)
+	case errors.As(err, &pathErr):
+		return fmt.Errorf("%v: %w: %v", fmt.Sprintf(format, args...), ErrUnavailable, err)
+	}
+	return fmt.Errorf("%v: %v", fmt.Sprintf(format, args...), err)
+}
+
+func checkName(name string) error {
+	return ValidateName(name)
+}
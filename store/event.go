@@ -0,0 +1,235 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// Event describes a change of a resource, it is emitted for writes through the store as well as for
+// files changed by other processes
+type Event struct {
+	Op   string `json:"op"`
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+	// Version is empty for deletions
+	Version string `json:"version,omitempty"`
+	// Before and After are the stored resource before and after the change, they are empty if it did not exist
+	Before json.RawMessage `json:"before,omitempty"`
+	After  json.RawMessage `json:"after,omitempty"`
+}
+
+// notifier keeps the version and content of every resource file it has seen and calls the subscribers when it changes,
+// so a write through the store and the watcher noticing it afterwards only emit a single event
+type notifier struct {
+	kind   string
+	decode func(r io.Reader) error
+
+	mutex       sync.Mutex
+	versions    map[string]string
+	contents    map[string][]byte
+	subscribers map[int]func(Event)
+	next        int
+}
+
+func newNotifier(kind string, decode func(r io.Reader) error) *notifier {
+	return &notifier{
+		kind:        kind,
+		decode:      decode,
+		versions:    map[string]string{},
+		contents:    map[string][]byte{},
+		subscribers: map[int]func(Event){},
+	}
+}
+
+// Subscribe registers a function which is called synchronously for every change, until the returned function is called
+func (n *notifier) Subscribe(subscriber func(Event)) func() {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	id := n.next
+	n.next++
+	n.subscribers[id] = subscriber
+	return func() {
+		n.mutex.Lock()
+		defer n.mutex.Unlock()
+		delete(n.subscribers, id)
+	}
+}
+
+type observerKey struct{}
+
+// WithObserver returns a context which makes the stores pass the events of writes done with it to the observer
+// as well, e.g. to attribute the changes to a request
+func WithObserver(ctx context.Context, observer func(Event)) context.Context {
+	return context.WithValue(ctx, observerKey{}, observer)
+}
+
+// refresh compares the file of a resource with the last version seen and emits an event if it changed,
+// files which can not be decoded are not emitted
+func (n *notifier) refresh(ctx context.Context, name, path string) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return fileError(err, "failed to read %v", name)
+	}
+
+	n.mutex.Lock()
+	event := Event{Kind: n.kind, Name: name, Before: n.contents[name]}
+	previous, known := n.versions[name]
+	switch {
+	case os.IsNotExist(err) && !known:
+		n.mutex.Unlock()
+		return nil
+	case os.IsNotExist(err):
+		event.Op = OperationDelete
+		delete(n.versions, name)
+		delete(n.contents, name)
+	default:
+		event.Version = contentVersion(content)
+		if event.Version == previous {
+			n.mutex.Unlock()
+			return nil
+		}
+		decodeErr := n.decode(bytes.NewReader(content))
+		if decodeErr != nil {
+			n.mutex.Unlock()
+			return fmt.Errorf("failed to decode %v %v: %v", n.kind, name, decodeErr)
+		}
+		event.Op = OperationCreate
+		if known {
+			event.Op = OperationUpdate
+		}
+		event.After = bytes.TrimSpace(content)
+		n.versions[name] = event.Version
+		n.contents[name] = event.After
+	}
+	n.mutex.Unlock()
+
+	observer, _ := ctx.Value(observerKey{}).(func(Event))
+	if pending, ok := ctx.Value(pendingKey{}).(*pendingEvents); ok {
+		pending.add(n, event, observer)
+		return nil
+	}
+	n.publish(event, observer)
+	return nil
+}
+
+// publish calls the subscribers and the observer, if there is one
+func (n *notifier) publish(event Event, observer func(Event)) {
+	n.mutex.Lock()
+	subscribers := make([]func(Event), 0, len(n.subscribers))
+	for _, subscriber := range n.subscribers {
+		subscribers = append(subscribers, subscriber)
+	}
+	n.mutex.Unlock()
+
+	for _, subscriber := range subscribers {
+		subscriber(event)
+	}
+	if observer != nil {
+		observer(event)
+	}
+}
+
+type pendingKey struct{}
+
+// pendingEvents holds back the events of the writes of a transaction until it is committed or rolled back
+type pendingEvents struct {
+	mutex  sync.Mutex
+	events []pendingEvent
+}
+
+type pendingEvent struct {
+	notifier *notifier
+	event    Event
+	observer func(Event)
+}
+
+// withPendingEvents returns a context which makes the stores hold back the events of writes done with it
+func withPendingEvents(ctx context.Context) (context.Context, *pendingEvents) {
+	pending := &pendingEvents{}
+	return context.WithValue(ctx, pendingKey{}, pending), pending
+}
+
+func (p *pendingEvents) add(n *notifier, event Event, observer func(Event)) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.events = append(p.events, pendingEvent{notifier: n, event: event, observer: observer})
+}
+
+// flush emits the held back events in order. If the transaction was rolled back only the net change of every
+// resource is emitted, which is none unless the rollback did not restore the file byte for byte.
+func (p *pendingEvents) flush(committed bool) {
+	p.mutex.Lock()
+	events := p.events
+	p.events = nil
+	p.mutex.Unlock()
+
+	if committed {
+		for _, pending := range events {
+			pending.notifier.publish(pending.event, pending.observer)
+		}
+		return
+	}
+
+	type resource struct {
+		notifier *notifier
+		name     string
+	}
+	order := make([]resource, 0)
+	net := map[resource]*pendingEvent{}
+	for _, pending := range events {
+		r := resource{notifier: pending.notifier, name: pending.event.Name}
+		first, ok := net[r]
+		if !ok {
+			pending := pending
+			net[r] = &pending
+			order = append(order, r)
+			continue
+		}
+		first.event.Version = pending.event.Version
+		first.event.After = pending.event.After
+	}
+	for _, r := range order {
+		pending := net[r]
+		if bytes.Equal(pending.event.Before, pending.event.After) {
+			continue
+		}
+		switch {
+		case len(pending.event.Before) == 0:
+			pending.event.Op = OperationCreate
+		case len(pending.event.After) == 0:
+			pending.event.Op = OperationDelete
+		default:
+			pending.event.Op = OperationUpdate
+		}
+		pending.notifier.publish(pending.event, pending.observer)
+	}
+}
+
+// seen records the version of a resource without emitting an event, it is used for the files already
+// in the directory when the store is created
+func (n *notifier) seen(name string, content []byte) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.versions[name] = contentVersion(content)
+	// the content is only kept if it is valid, it is emitted as json
+	if n.decode(bytes.NewReader(content)) == nil {
+		n.contents[name] = bytes.TrimSpace(content)
+	}
+}
+
+// names returns the resources the notifier has seen
+func (n *notifier) names() []string {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	names := make([]string, 0, len(n.versions))
+	for name := range n.versions {
+		names = append(names, name)
+	}
+	return names
+}
@@ -0,0 +1,234 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	quarantineDir    = "quarantine"
+	quarantineLayout = "20060102T150405.000000000Z"
+	tempPrefix       = ".tmp-"
+	// fileMode replaces the 0600 of temporary files for stores whose files are not secret
+	fileMode os.FileMode = 0644
+	// secretFileMode is used for the stores whose files contain secrets, e.g. credentials of middlewares
+	secretFileMode os.FileMode = 0600
+)
+
+// QuarantinedFile is a file which could not be decoded and was moved out of the store
+type QuarantinedFile struct {
+	File        string    `json:"file"`
+	Path        string    `json:"path"`
+	Quarantined time.Time `json:"quarantined"`
+	Reason      string    `json:"reason,omitempty"`
+}
+
+// writeFileAtomic writes to a temporary file in the same directory and renames it, so readers either see
+// the old or the new content but never a partially written file, even after a crash. The file gets the mode
+// once it is written.
+func writeFileAtomic(path string, mode os.FileMode, write func(w io.Writer) error) error {
+	dir := filepath.Dir(path)
+	f, err := ioutil.TempFile(dir, tempPrefix+filepath.Base(path)+"-")
+	if err != nil {
+		return err
+	}
+	// the temporary file is removed if anything fails, after the rename this is a no-op
+	defer os.Remove(f.Name())
+
+	err = write(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = f.Sync()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Chmod(f.Name(), mode)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(f.Name(), path)
+	if err != nil {
+		return err
+	}
+
+	return syncDir(dir)
+}
+
+// removeFile removes the file and makes the removal durable
+func removeFile(path string) error {
+	err := os.Remove(path)
+	if err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir persists renames and removals of the directory entries
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// quarantine moves a corrupt file into the quarantine directory of the store
+func quarantine(dir, path string, reason error) (*QuarantinedFile, error) {
+	qDir := filepath.Join(dir, quarantineDir)
+	err := os.MkdirAll(qDir, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	q := &QuarantinedFile{
+		File:        filepath.Base(path),
+		Path:        filepath.Join(qDir, filepath.Base(path)+"."+now.Format(quarantineLayout)),
+		Quarantined: now,
+		Reason:      reason.Error(),
+	}
+	err = os.Rename(path, q.Path)
+	if err != nil {
+		return nil, err
+	}
+	// the reason is kept next to the file so it can be listed later
+	err = ioutil.WriteFile(q.Path+".reason", []byte(q.Reason), fileMode)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("quarantined %v as %v: %v\n", path, q.Path, reason)
+
+	return q, syncDir(dir)
+}
+
+// quarantined lists the files in the quarantine directory of the store
+func quarantined(dir string) ([]QuarantinedFile, error) {
+	files := make([]QuarantinedFile, 0)
+	qDir := filepath.Join(dir, quarantineDir)
+	infos, err := ioutil.ReadDir(qDir)
+	if os.IsNotExist(err) {
+		return files, nil
+	}
+	if err != nil {
+		return nil, fileError(err, "failed to read %v", qDir)
+	}
+	for _, info := range infos {
+		if info.IsDir() || strings.HasSuffix(info.Name(), ".reason") {
+			continue
+		}
+		// the name ends with a dot and the time of the quarantine which has a fixed length
+		i := len(info.Name()) - len(quarantineLayout) - 1
+		if i <= 0 {
+			continue
+		}
+		q := QuarantinedFile{
+			File: info.Name()[:i],
+			Path: filepath.Join(qDir, info.Name()),
+		}
+		q.Quarantined, _ = time.Parse(quarantineLayout, info.Name()[i+1:])
+		if reason, err := ioutil.ReadFile(q.Path + ".reason"); err == nil {
+			q.Reason = string(reason)
+		}
+		files = append(files, q)
+	}
+
+	return files, nil
+}
+
+// check decodes every resource file of the store, quarantines the ones that fail or have an invalid name and
+// removes temporary files left behind by a crash. Files which are more permissive than the mode are restricted.
+func check(dir, prefix string, mode os.FileMode, decode func(r io.Reader) error) ([]QuarantinedFile, error) {
+	files := make([]QuarantinedFile, 0)
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fileError(err, "failed to read %v", dir)
+	}
+	for _, info := range infos {
+		path := filepath.Join(dir, info.Name())
+		if info.IsDir() {
+			continue
+		}
+		if strings.HasPrefix(info.Name(), tempPrefix) {
+			err = removeFile(path)
+			if err != nil {
+				return nil, fileError(err, "failed to remove the temporary file %v", path)
+			}
+			continue
+		}
+		if !strings.HasPrefix(info.Name(), prefix) || !strings.HasSuffix(info.Name(), jsonExtension) {
+			continue
+		}
+		// files named before the name grammar existed can not be addressed, they are moved out of the way
+		// so they do not silently disappear from the configuration
+		reason := ValidateName(resourceName(info.Name(), prefix))
+		if reason == nil {
+			err = decodeFile(path, decode)
+			if err == nil {
+				// files written with a more permissive mode, e.g. by an older version, are restricted
+				if info.Mode().Perm()&^mode != 0 {
+					err = os.Chmod(path, mode)
+					if err != nil {
+						return nil, fileError(err, "failed to change the mode of %v", path)
+					}
+				}
+				continue
+			}
+			reason = fmt.Errorf("failed to decode %v: %v", info.Name(), err)
+		}
+		q, err := quarantine(dir, path, reason)
+		if err != nil {
+			return nil, fileError(err, "failed to quarantine %v", path)
+		}
+		files = append(files, *q)
+	}
+
+	return files, nil
+}
+
+func decodeFile(path string, decode func(r io.Reader) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return decode(f)
+}
+
+// quarantineCorrupt moves the files a read of the store could not decode into the quarantine directory. Reads only
+// hold the store lock shared, so the files are decoded again under the exclusive lock and only moved if they are
+// still corrupt.
+func (l locker) quarantineCorrupt(ctx context.Context, paths []string, decode func(r io.Reader) error) error {
+	if len(paths) == 0 {
+		return nil
+	}
+	unlock, err := l.lockStore(ctx, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	for _, path := range paths {
+		err := decodeFile(path, decode)
+		if err == nil || os.IsNotExist(err) {
+			continue
+		}
+		_, err = quarantine(l.dir, path, fmt.Errorf("failed to decode %v: %v", filepath.Base(path), err))
+		if err != nil {
+			return fileError(err, "failed to quarantine %v", path)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/traefik/traefik/v2/pkg/config/dynamic"
+)
+
+// HTTPMiddlewareStoreEncrypted encrypts the sensitive fields of middlewares before they are written to the
+// underlying store and decrypts them when they are read, so they are never stored in plain text. Every value is
+// bound to the name of its middleware and the path of its field, so ciphertext can not be moved to another field.
+type HTTPMiddlewareStoreEncrypted struct {
+	HTTPMiddlewareStore
+	keyring *Keyring
+}
+
+func NewHTTPMiddlewareStoreEncrypted(store HTTPMiddlewareStore, keyring *Keyring) *HTTPMiddlewareStoreEncrypted {
+	return &HTTPMiddlewareStoreEncrypted{HTTPMiddlewareStore: store, keyring: keyring}
+}
+
+func (h *HTTPMiddlewareStoreEncrypted) GetAll(ctx context.Context, offset, limit int) (map[string]*dynamic.Middleware, error) {
+	middlewares, err := h.HTTPMiddlewareStore.GetAll(ctx, offset, limit)
+	if err != nil {
+		return nil, err
+	}
+	for name, middleware := range middlewares {
+		err = h.decrypt(name, middleware)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt middleware %v: %v", name, err)
+		}
+	}
+	return middlewares, nil
+}
+
+func (h *HTTPMiddlewareStoreEncrypted) Get(ctx context.Context, name string) (*dynamic.Middleware, error) {
+	middleware, err := h.HTTPMiddlewareStore.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	err = h.decrypt(name, middleware)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt middleware %v: %v", name, err)
+	}
+	return middleware, nil
+}
+
+func (h *HTTPMiddlewareStoreEncrypted) Set(ctx context.Context, name string, middleware *dynamic.Middleware) error {
+	stored, err := h.HTTPMiddlewareStore.Get(ctx, name)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	encrypted, err := h.encrypt(name, middleware, stored)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt middleware %v: %w", name, err)
+	}
+	return h.HTTPMiddlewareStore.Set(ctx, name, encrypted)
+}
+
+// Watch watches the underlying store if it can be watched
+func (h *HTTPMiddlewareStoreEncrypted) Watch(ctx context.Context) error {
+	watcher, ok := h.HTTPMiddlewareStore.(Watcher)
+	if !ok {
+		return nil
+	}
+	return watcher.Watch(ctx)
+}
+
+// Rotate encrypts every value which is not encrypted with the primary key yet, e.g. after a new key was added
+// or values were stored before encryption was enabled. It returns the names of the rewritten middlewares.
+func (h *HTTPMiddlewareStoreEncrypted) Rotate(ctx context.Context) ([]string, error) {
+	ctx, unlock, err := h.Lock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	middlewares, err := h.HTTPMiddlewareStore.GetAll(ctx, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	rotated := make([]string, 0)
+	for name, middleware := range middlewares {
+		current := true
+		for _, values := range SensitiveMiddlewareFields(middleware) {
+			for _, value := range values {
+				current = current && h.keyring.current(*value)
+			}
+		}
+		if current {
+			continue
+		}
+		err = h.decrypt(name, middleware)
+		if err != nil {
+			return rotated, fmt.Errorf("failed to decrypt middleware %v: %v", name, err)
+		}
+		encrypted, err := h.encrypt(name, middleware, nil)
+		if err != nil {
+			return rotated, fmt.Errorf("failed to encrypt middleware %v: %v", name, err)
+		}
+		err = h.HTTPMiddlewareStore.Set(ctx, name, encrypted)
+		if err != nil {
+			return rotated, err
+		}
+		rotated = append(rotated, name)
+	}
+	return rotated, nil
+}
+
+// DecryptJSON decrypts the sensitive fields of a stored middleware encoded as json, e.g. the content of an event
+func (h *HTTPMiddlewareStoreEncrypted) DecryptJSON(name string, content []byte) ([]byte, error) {
+	middleware := &dynamic.Middleware{}
+	err := json.Unmarshal(content, middleware)
+	if err != nil {
+		return nil, err
+	}
+	err = h.decrypt(name, middleware)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt middleware %v: %v", name, err)
+	}
+	return json.Marshal(middleware)
+}
+
+// binding is the additional data the values of a field of a middleware are encrypted with
+func binding(name, path string) string {
+	return KindMiddleware + ":" + name + ":" + path
+}
+
+func (h *HTTPMiddlewareStoreEncrypted) decrypt(name string, middleware *dynamic.Middleware) error {
+	for path, values := range SensitiveMiddlewareFields(middleware) {
+		for _, value := range values {
+			plaintext, err := h.keyring.Decrypt(*value, binding(name, path))
+			if err != nil {
+				return fmt.Errorf("%v: %v", path, err)
+			}
+			*value = plaintext
+		}
+	}
+	return nil
+}
+
+// encrypt returns a copy of the middleware with encrypted sensitive fields. Values which are also part of the
+// stored middleware keep their ciphertext, so writing the same middleware again does not change the file.
+// Encrypted values are rejected, they can only be written by the store itself.
+func (h *HTTPMiddlewareStoreEncrypted) encrypt(name string, middleware, stored *dynamic.Middleware) (*dynamic.Middleware, error) {
+	previous := map[string]map[string]string{}
+	for path, values := range SensitiveMiddlewareFields(stored) {
+		previous[path] = map[string]string{}
+		for _, value := range values {
+			if !h.keyring.current(*value) {
+				continue
+			}
+			plaintext, err := h.keyring.Decrypt(*value, binding(name, path))
+			if err == nil {
+				previous[path][plaintext] = *value
+			}
+		}
+	}
+
+	encrypted := middleware.DeepCopy()
+	for path, values := range SensitiveMiddlewareFields(encrypted) {
+		for _, value := range values {
+			if IsEncrypted(*value) {
+				return nil, fmt.Errorf("%w: %v: encrypted values can not be written", ErrInvalidValue, path)
+			}
+			if ciphertext, ok := previous[path][*value]; ok {
+				*value = ciphertext
+				continue
+			}
+			ciphertext, err := h.keyring.Encrypt(*value, binding(name, path))
+			if err != nil {
+				return nil, fmt.Errorf("%v: %v", path, err)
+			}
+			*value = ciphertext
+		}
+	}
+	return encrypted, nil
+}
@@ -4,6 +4,8 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"github.com/traefik/traefik/v2/pkg/config/dynamic"
 	"os"
 	"path/filepath"
@@ -12,12 +14,22 @@ import (
 
 func NewHTTPMiddlewareStoreJSON(middlewareDir string) (*HTTPMiddlewareStoreJSON, error) {
 	err := os.MkdirAll(middlewareDir, os.ModePerm)
-	return &HTTPMiddlewareStoreJSON{middlewareDir: middlewareDir, prefix: "middleware_"}, err
+	h := &HTTPMiddlewareStoreJSON{middlewareDir: middlewareDir, prefix: "middleware_", locker: locker{dir: middlewareDir}, notifier: newNotifier(KindMiddleware, decodeMiddleware)}
+	if err != nil {
+		return h, err
+	}
+	return h, scan(middlewareDir, h.prefix, h.notifier)
+}
+
+func decodeMiddleware(r io.Reader) error {
+	return json.NewDecoder(r).Decode(&dynamic.Middleware{})
 }
 
 type HTTPMiddlewareStoreJSON struct {
 	middlewareDir string
 	prefix string
+	locker
+	*notifier
 }
 
 func (h *HTTPMiddlewareStoreJSON) filepath(name string) string {
@@ -29,16 +41,57 @@ func (h *HTTPMiddlewareStoreJSON) extractName(path string) string {
 }
 
 func (h *HTTPMiddlewareStoreJSON) Delete(ctx context.Context, name string) error {
-	return os.Remove(h.filepath(name))
+	err := checkName(name)
+	if err != nil {
+		return err
+	}
+	unlock, err := h.lockResource(ctx, filepath.Base(h.filepath(name)), true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	err = removeFile(h.filepath(name))
+	if err != nil {
+		return fileError(err, "failed to delete %v", name)
+	}
+	return h.refresh(ctx, name, h.filepath(name))
 }
 
 func (h *HTTPMiddlewareStoreJSON) GetAll(ctx context.Context, offset, limit int) (map[string]*dynamic.Middleware, error) {
+	middlewares, corrupt, err := h.getAll(ctx, offset, limit)
+	if err != nil {
+		return nil, err
+	}
+	// reads only hold the store lock shared, the corrupt files are moved aside under the exclusive lock
+	err = h.quarantineCorrupt(ctx, corrupt, decodeMiddleware)
+	if err != nil {
+		return nil, err
+	}
+	return middlewares, nil
+}
+
+// getAll reads the middlewares and returns the files which can not be decoded
+func (h *HTTPMiddlewareStoreJSON) getAll(ctx context.Context, offset, limit int) (map[string]*dynamic.Middleware, []string, error) {
+	unlock, err := h.lockStore(ctx, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer unlock()
+
 	ctr := 0
 
 	middlewares := map[string]*dynamic.Middleware{}
+	corrupt := make([]string, 0)
 	// Walk walks the directory in lexical order, so this is fine
-	err := filepath.Walk(h.middlewareDir, func(path string, info os.FileInfo, err error) error {
-		if info.IsDir() || !strings.HasPrefix(info.Name(), h.prefix) {
+	err = filepath.Walk(h.middlewareDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		// resources are only stored in the top level directory
+		if info.IsDir() && path != h.middlewareDir {
+			return filepath.SkipDir
+		}
+		if info.IsDir() || !resourceFile(info.Name(), h.prefix) {
 			return nil
 		}
 		// skip
@@ -53,14 +106,16 @@ func (h *HTTPMiddlewareStoreJSON) GetAll(ctx context.Context, offset, limit int)
 		limit--
 		f, err := os.OpenFile(path, os.O_RDONLY, info.Mode())
 		if err != nil {
-			return fmt.Errorf("failed to open %v: %v", path, err)
+			return err
 		}
 		defer f.Close()
 		// decode the content into a dynamic.Middleware
 		middleware := dynamic.Middleware{}
 		err = json.NewDecoder(f).Decode(&middleware)
 		if err != nil {
-			return fmt.Errorf("failed to decode %v: %v", info.Name(), err)
+			// a corrupt file is left out of the listing
+			corrupt = append(corrupt, path)
+			return nil
 		}
 		// add the middleware to the map
 		middlewares[h.extractName(info.Name())] = &middleware
@@ -69,16 +124,25 @@ func (h *HTTPMiddlewareStoreJSON) GetAll(ctx context.Context, offset, limit int)
 	})
 
 	if err != nil {
-		return nil, fmt.Errorf("failed to scan %v: %v", h.middlewareDir, err)
+		return nil, nil, fileError(err, "failed to scan %v", h.middlewareDir)
 	}
 
-	return middlewares, nil
+	return middlewares, corrupt, nil
 }
 
 func (h *HTTPMiddlewareStoreJSON) Get(ctx context.Context, name string) (*dynamic.Middleware, error) {
+	err := checkName(name)
+	if err != nil {
+		return nil, err
+	}
+	unlock, err := h.lockResource(ctx, filepath.Base(h.filepath(name)), false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
 	f, err := os.OpenFile(h.filepath(name), os.O_RDONLY, os.ModePerm)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open %v: %v", name, err)
+		return nil, fileError(err, "failed to open %v", name)
 	}
 	defer f.Close()
 
@@ -91,30 +155,89 @@ func (h *HTTPMiddlewareStoreJSON) Get(ctx context.Context, name string) (*dynami
 	return &middleware, nil
 }
 
-func (h *HTTPMiddlewareStoreJSON) Set(ctx context.Context, name string, middleware *dynamic.Middleware) error {
-	f, err := os.OpenFile(h.filepath(name), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.ModePerm)
+func (h *HTTPMiddlewareStoreJSON) Version(ctx context.Context, name string) (string, error) {
+	err := checkName(name)
 	if err != nil {
-		return fmt.Errorf("failed to open or create %v: %v", name, err)
+		return "", err
+	}
+	unlock, err := h.lockResource(ctx, filepath.Base(h.filepath(name)), false)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+	content, err := ioutil.ReadFile(h.filepath(name))
+	if err != nil {
+		return "", fileError(err, "failed to read %v", name)
 	}
-	defer f.Close()
 
-	err = json.NewEncoder(f).Encode(middleware)
+	return contentVersion(content), nil
+}
+
+func (h *HTTPMiddlewareStoreJSON) Set(ctx context.Context, name string, middleware *dynamic.Middleware) error {
+	err := checkName(name)
 	if err != nil {
-		return fmt.Errorf("failed to encode %v.%v: %v", name, jsonExtension, err)
+		return err
+	}
+	unlock, err := h.lockResource(ctx, filepath.Base(h.filepath(name)), true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	err = writeFileAtomic(h.filepath(name), secretFileMode, func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(middleware)
+	})
+	if err != nil {
+		return fileError(err, "failed to write %v", name)
 	}
 
-	return nil
+	return h.refresh(ctx, name, h.filepath(name))
 }
 
-func (h *HTTPMiddlewareStoreJSON) Names(ctx context.Context, offset, limit int) []string {
-	names := make([]string, 0)
-	filepath.Walk(h.middlewareDir, func(path string, info os.FileInfo, err error) error {
-		if info.IsDir() || !strings.HasPrefix(info.Name(), h.prefix) {
+func (h *HTTPMiddlewareStoreJSON) Names(ctx context.Context, options ListOptions) (*Page, error) {
+	unlock, err := h.lockStore(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	entries := make([]entry, 0)
+	err = filepath.Walk(h.middlewareDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		// resources are only stored in the top level directory
+		if info.IsDir() && path != h.middlewareDir {
+			return filepath.SkipDir
+		}
+		if info.IsDir() || !resourceFile(info.Name(), h.prefix) {
 			return nil
 		}
-		names = append(names, h.extractName(info.Name()))
+		entries = append(entries, entry{name: h.extractName(info.Name()), modified: info.ModTime()})
 		return nil
 	})
+	if err != nil {
+		return nil, fileError(err, "failed to scan %v", h.middlewareDir)
+	}
+
+	return paginate(ctx, entries, options)
+}
 
-	return names
-}
\ No newline at end of file
+// Check quarantines the middlewares which can not be decoded and removes unfinished writes
+func (h *HTTPMiddlewareStoreJSON) Check(ctx context.Context) ([]QuarantinedFile, error) {
+	unlock, err := h.lockStore(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	return check(h.middlewareDir, h.prefix, secretFileMode, decodeMiddleware)
+}
+
+func (h *HTTPMiddlewareStoreJSON) Quarantined(ctx context.Context) ([]QuarantinedFile, error) {
+	return quarantined(h.middlewareDir)
+}
+
+// Watch emits events for middlewares changed by other processes
+func (h *HTTPMiddlewareStoreJSON) Watch(ctx context.Context) error {
+	return watch(ctx, h.middlewareDir, h.prefix, h.locker, h.notifier)
+}
@@ -4,6 +4,8 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"github.com/traefik/traefik/v2/pkg/config/dynamic"
 	"os"
 	"path/filepath"
@@ -14,12 +16,22 @@ const jsonExtension = ".json"
 
 func NewHTTPRouterStoreJSON(routerDir string) (*HTTPRouterStoreJSON, error) {
 	err := os.MkdirAll(routerDir, os.ModePerm)
-	return &HTTPRouterStoreJSON{routerDir: routerDir, prefix: "router_"}, err
+	h := &HTTPRouterStoreJSON{routerDir: routerDir, prefix: "router_", locker: locker{dir: routerDir}, notifier: newNotifier(KindRouter, decodeRouter)}
+	if err != nil {
+		return h, err
+	}
+	return h, scan(routerDir, h.prefix, h.notifier)
+}
+
+func decodeRouter(r io.Reader) error {
+	return json.NewDecoder(r).Decode(&dynamic.Router{})
 }
 
 type HTTPRouterStoreJSON struct {
 	routerDir string
 	prefix string
+	locker
+	*notifier
 }
 
 func (h *HTTPRouterStoreJSON) filepath(name string) string {
@@ -31,16 +43,57 @@ func (h *HTTPRouterStoreJSON) extractName(path string) string {
 }
 
 func (h *HTTPRouterStoreJSON) Delete(ctx context.Context, name string) error {
-	return os.Remove(h.filepath(name))
+	err := checkName(name)
+	if err != nil {
+		return err
+	}
+	unlock, err := h.lockResource(ctx, filepath.Base(h.filepath(name)), true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	err = removeFile(h.filepath(name))
+	if err != nil {
+		return fileError(err, "failed to delete %v", name)
+	}
+	return h.refresh(ctx, name, h.filepath(name))
 }
 
 func (h *HTTPRouterStoreJSON) GetAll(ctx context.Context, offset, limit int) (map[string]*dynamic.Router, error) {
+	routers, corrupt, err := h.getAll(ctx, offset, limit)
+	if err != nil {
+		return nil, err
+	}
+	// reads only hold the store lock shared, the corrupt files are moved aside under the exclusive lock
+	err = h.quarantineCorrupt(ctx, corrupt, decodeRouter)
+	if err != nil {
+		return nil, err
+	}
+	return routers, nil
+}
+
+// getAll reads the routers and returns the files which can not be decoded
+func (h *HTTPRouterStoreJSON) getAll(ctx context.Context, offset, limit int) (map[string]*dynamic.Router, []string, error) {
+	unlock, err := h.lockStore(ctx, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer unlock()
+
 	ctr := 0
 
 	routers := map[string]*dynamic.Router{}
+	corrupt := make([]string, 0)
 	// Walk walks the directory in lexical order, so this is fine
-	err := filepath.Walk(h.routerDir, func(path string, info os.FileInfo, err error) error {
-		if info.IsDir() || !strings.HasPrefix(info.Name(), h.prefix) {
+	err = filepath.Walk(h.routerDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		// resources are only stored in the top level directory
+		if info.IsDir() && path != h.routerDir {
+			return filepath.SkipDir
+		}
+		if info.IsDir() || !resourceFile(info.Name(), h.prefix) {
 			return nil
 		}
 		// skip
@@ -55,32 +108,43 @@ func (h *HTTPRouterStoreJSON) GetAll(ctx context.Context, offset, limit int) (ma
 		limit--
 		f, err := os.OpenFile(path, os.O_RDONLY, info.Mode())
 		if err != nil {
-			return fmt.Errorf("failed to open %v: %v", path, err)
+			return err
 		}
 		defer f.Close()
 		// decode the content into a dynamic.Router
 		router := dynamic.Router{}
 		err = json.NewDecoder(f).Decode(&router)
 		if err != nil {
-			return fmt.Errorf("failed to decode %v: %v", info.Name(), err)
+			// a corrupt file is left out of the listing
+			corrupt = append(corrupt, path)
+			return nil
 		}
 		// add the router to the map
-		routers[strings.TrimSuffix(info.Name(), jsonExtension)] = &router
+		routers[h.extractName(info.Name())] = &router
 
 		return nil
 	})
 
 	if err != nil {
-		return nil, fmt.Errorf("failed to scan %v: %v", h.routerDir, err)
+		return nil, nil, fileError(err, "failed to scan %v", h.routerDir)
 	}
 
-	return routers, nil
+	return routers, corrupt, nil
 }
 
 func (h *HTTPRouterStoreJSON) Get(ctx context.Context, name string) (*dynamic.Router, error) {
+	err := checkName(name)
+	if err != nil {
+		return nil, err
+	}
+	unlock, err := h.lockResource(ctx, filepath.Base(h.filepath(name)), false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
 	f, err := os.OpenFile(h.filepath(name), os.O_RDONLY, os.ModePerm)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open %v: %v", name, err)
+		return nil, fileError(err, "failed to open %v", name)
 	}
 	defer f.Close()
 
@@ -93,31 +157,89 @@ func (h *HTTPRouterStoreJSON) Get(ctx context.Context, name string) (*dynamic.Ro
 	return &router, nil
 }
 
-func (h *HTTPRouterStoreJSON) Set(ctx context.Context, name string, router *dynamic.Router) error {
-	f, err := os.OpenFile(h.filepath(name), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.ModePerm)
+func (h *HTTPRouterStoreJSON) Version(ctx context.Context, name string) (string, error) {
+	err := checkName(name)
 	if err != nil {
-		return fmt.Errorf("failed to open or create %v: %v", name, err)
+		return "", err
 	}
-	defer f.Close()
+	unlock, err := h.lockResource(ctx, filepath.Base(h.filepath(name)), false)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+	content, err := ioutil.ReadFile(h.filepath(name))
+	if err != nil {
+		return "", fileError(err, "failed to read %v", name)
+	}
+
+	return contentVersion(content), nil
+}
 
-	err = json.NewEncoder(f).Encode(router)
+func (h *HTTPRouterStoreJSON) Set(ctx context.Context, name string, router *dynamic.Router) error {
+	err := checkName(name)
 	if err != nil {
-		return fmt.Errorf("failed to encode %v.%v: %v", name, jsonExtension, err)
+		return err
+	}
+	unlock, err := h.lockResource(ctx, filepath.Base(h.filepath(name)), true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	err = writeFileAtomic(h.filepath(name), fileMode, func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(router)
+	})
+	if err != nil {
+		return fileError(err, "failed to write %v", name)
 	}
 
-	return nil
+	return h.refresh(ctx, name, h.filepath(name))
 }
 
-func (h *HTTPRouterStoreJSON) Names(ctx context.Context, offset, limit int) []string {
-	names := make([]string, 0)
-	filepath.Walk(h.routerDir, func(path string, info os.FileInfo, err error) error {
-		if info.IsDir() || !strings.HasPrefix(info.Name(), h.prefix) {
+func (h *HTTPRouterStoreJSON) Names(ctx context.Context, options ListOptions) (*Page, error) {
+	unlock, err := h.lockStore(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	entries := make([]entry, 0)
+	err = filepath.Walk(h.routerDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		// resources are only stored in the top level directory
+		if info.IsDir() && path != h.routerDir {
+			return filepath.SkipDir
+		}
+		if info.IsDir() || !resourceFile(info.Name(), h.prefix) {
 			return nil
 		}
-		names = append(names, h.extractName(info.Name()))
+		entries = append(entries, entry{name: h.extractName(info.Name()), modified: info.ModTime()})
 		return nil
 	})
+	if err != nil {
+		return nil, fileError(err, "failed to scan %v", h.routerDir)
+	}
+
+	return paginate(ctx, entries, options)
+}
+
+// Check quarantines the routers which can not be decoded and removes unfinished writes
+func (h *HTTPRouterStoreJSON) Check(ctx context.Context) ([]QuarantinedFile, error) {
+	unlock, err := h.lockStore(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
 
-	return names
+	return check(h.routerDir, h.prefix, fileMode, decodeRouter)
 }
 
+func (h *HTTPRouterStoreJSON) Quarantined(ctx context.Context) ([]QuarantinedFile, error) {
+	return quarantined(h.routerDir)
+}
+
+// Watch emits events for routers changed by other processes
+func (h *HTTPRouterStoreJSON) Watch(ctx context.Context) error {
+	return watch(ctx, h.routerDir, h.prefix, h.locker, h.notifier)
+}
@@ -10,6 +10,14 @@ type HTTPServiceStore interface {
 	Get(ctx context.Context, name string) (*dynamic.Service, error)
 	Set(ctx context.Context, name string, service *dynamic.Service) error
 	Delete(ctx context.Context, name string) error
-	Names(ctx context.Context, offset, limit int) []string
+	Names(ctx context.Context, options ListOptions) (*Page, error)
+	Version(ctx context.Context, name string) (string, error)
+	// Check verifies every stored file and quarantines the corrupt ones
+	Check(ctx context.Context) ([]QuarantinedFile, error)
+	Quarantined(ctx context.Context) ([]QuarantinedFile, error)
+	// Lock acquires the store-wide lock, operations using the returned context do not wait for it
+	Lock(ctx context.Context) (context.Context, func(), error)
+	// Subscribe calls the subscriber for every change until the returned function is called
+	Subscribe(subscriber func(Event)) func()
 }
 
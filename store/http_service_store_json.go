@@ -4,6 +4,8 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"github.com/traefik/traefik/v2/pkg/config/dynamic"
 	"os"
 	"path/filepath"
@@ -12,12 +14,22 @@ import (
 
 func NewHTTPServiceStoreJSON(serviceDir string) (*HTTPServiceStoreJSON, error) {
 	err := os.MkdirAll(serviceDir, os.ModePerm)
-	return &HTTPServiceStoreJSON{serviceDir: serviceDir, prefix: "service_"}, err
+	h := &HTTPServiceStoreJSON{serviceDir: serviceDir, prefix: "service_", locker: locker{dir: serviceDir}, notifier: newNotifier(KindService, decodeService)}
+	if err != nil {
+		return h, err
+	}
+	return h, scan(serviceDir, h.prefix, h.notifier)
+}
+
+func decodeService(r io.Reader) error {
+	return json.NewDecoder(r).Decode(&dynamic.Service{})
 }
 
 type HTTPServiceStoreJSON struct {
 	serviceDir string
 	prefix string
+	locker
+	*notifier
 }
 
 func (h *HTTPServiceStoreJSON) filepath(name string) string {
@@ -29,16 +41,57 @@ func (h *HTTPServiceStoreJSON) extractName(path string) string {
 }
 
 func (h *HTTPServiceStoreJSON) Delete(ctx context.Context, name string) error {
-	return os.Remove(h.filepath(name))
+	err := checkName(name)
+	if err != nil {
+		return err
+	}
+	unlock, err := h.lockResource(ctx, filepath.Base(h.filepath(name)), true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	err = removeFile(h.filepath(name))
+	if err != nil {
+		return fileError(err, "failed to delete %v", name)
+	}
+	return h.refresh(ctx, name, h.filepath(name))
 }
 
 func (h *HTTPServiceStoreJSON) GetAll(ctx context.Context, offset, limit int) (map[string]*dynamic.Service, error) {
+	services, corrupt, err := h.getAll(ctx, offset, limit)
+	if err != nil {
+		return nil, err
+	}
+	// reads only hold the store lock shared, the corrupt files are moved aside under the exclusive lock
+	err = h.quarantineCorrupt(ctx, corrupt, decodeService)
+	if err != nil {
+		return nil, err
+	}
+	return services, nil
+}
+
+// getAll reads the services and returns the files which can not be decoded
+func (h *HTTPServiceStoreJSON) getAll(ctx context.Context, offset, limit int) (map[string]*dynamic.Service, []string, error) {
+	unlock, err := h.lockStore(ctx, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer unlock()
+
 	ctr := 0
 
 	services := map[string]*dynamic.Service{}
+	corrupt := make([]string, 0)
 	// Walk walks the directory in lexical order, so this is fine
-	err := filepath.Walk(h.serviceDir, func(path string, info os.FileInfo, err error) error {
-		if info.IsDir() || !strings.HasPrefix(info.Name(), h.prefix) {
+	err = filepath.Walk(h.serviceDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		// resources are only stored in the top level directory
+		if info.IsDir() && path != h.serviceDir {
+			return filepath.SkipDir
+		}
+		if info.IsDir() || !resourceFile(info.Name(), h.prefix) {
 			return nil
 		}
 		// skip
@@ -53,32 +106,43 @@ func (h *HTTPServiceStoreJSON) GetAll(ctx context.Context, offset, limit int) (m
 		limit--
 		f, err := os.OpenFile(path, os.O_RDONLY, info.Mode())
 		if err != nil {
-			return fmt.Errorf("failed to open %v: %v", path, err)
+			return err
 		}
 		defer f.Close()
 		// decode the content into a dynamic.Service
 		service := dynamic.Service{}
 		err = json.NewDecoder(f).Decode(&service)
 		if err != nil {
-			return fmt.Errorf("failed to decode %v: %v", info.Name(), err)
+			// a corrupt file is left out of the listing
+			corrupt = append(corrupt, path)
+			return nil
 		}
 		// add the service to the map
-		services[strings.TrimSuffix(info.Name(), jsonExtension)] = &service
+		services[h.extractName(info.Name())] = &service
 
 		return nil
 	})
 
 	if err != nil {
-		return nil, fmt.Errorf("failed to scan %v: %v", h.serviceDir, err)
+		return nil, nil, fileError(err, "failed to scan %v", h.serviceDir)
 	}
 
-	return services, nil
+	return services, corrupt, nil
 }
 
 func (h *HTTPServiceStoreJSON) Get(ctx context.Context, name string) (*dynamic.Service, error) {
+	err := checkName(name)
+	if err != nil {
+		return nil, err
+	}
+	unlock, err := h.lockResource(ctx, filepath.Base(h.filepath(name)), false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
 	f, err := os.OpenFile(h.filepath(name), os.O_RDONLY, os.ModePerm)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open %v: %v", name, err)
+		return nil, fileError(err, "failed to open %v", name)
 	}
 	defer f.Close()
 
@@ -91,32 +155,89 @@ func (h *HTTPServiceStoreJSON) Get(ctx context.Context, name string) (*dynamic.S
 	return &service, nil
 }
 
-func (h *HTTPServiceStoreJSON) Set(ctx context.Context, name string, service *dynamic.Service) error {
-	f, err := os.OpenFile(h.filepath(name), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.ModePerm)
+func (h *HTTPServiceStoreJSON) Version(ctx context.Context, name string) (string, error) {
+	err := checkName(name)
 	if err != nil {
-		return fmt.Errorf("failed to open or create %v: %v", name, err)
+		return "", err
 	}
-	defer f.Close()
+	unlock, err := h.lockResource(ctx, filepath.Base(h.filepath(name)), false)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+	content, err := ioutil.ReadFile(h.filepath(name))
+	if err != nil {
+		return "", fileError(err, "failed to read %v", name)
+	}
+
+	return contentVersion(content), nil
+}
 
-	err = json.NewEncoder(f).Encode(service)
+func (h *HTTPServiceStoreJSON) Set(ctx context.Context, name string, service *dynamic.Service) error {
+	err := checkName(name)
+	if err != nil {
+		return err
+	}
+	unlock, err := h.lockResource(ctx, filepath.Base(h.filepath(name)), true)
 	if err != nil {
-		return fmt.Errorf("failed to encode %v.%v: %v", name, jsonExtension, err)
+		return err
+	}
+	defer unlock()
+	err = writeFileAtomic(h.filepath(name), fileMode, func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(service)
+	})
+	if err != nil {
+		return fileError(err, "failed to write %v", name)
 	}
 
-	return nil
+	return h.refresh(ctx, name, h.filepath(name))
 }
 
-func (h *HTTPServiceStoreJSON) Names(ctx context.Context, offset, limit int) []string {
-	names := make([]string, 0)
-	filepath.Walk(h.serviceDir, func(path string, info os.FileInfo, err error) error {
-		if info.IsDir() || !strings.HasPrefix(info.Name(), h.prefix) {
+func (h *HTTPServiceStoreJSON) Names(ctx context.Context, options ListOptions) (*Page, error) {
+	unlock, err := h.lockStore(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	entries := make([]entry, 0)
+	err = filepath.Walk(h.serviceDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		// resources are only stored in the top level directory
+		if info.IsDir() && path != h.serviceDir {
+			return filepath.SkipDir
+		}
+		if info.IsDir() || !resourceFile(info.Name(), h.prefix) {
 			return nil
 		}
-		names = append(names, h.extractName(info.Name()))
+		entries = append(entries, entry{name: h.extractName(info.Name()), modified: info.ModTime()})
 		return nil
 	})
+	if err != nil {
+		return nil, fileError(err, "failed to scan %v", h.serviceDir)
+	}
 
-	return names
+	return paginate(ctx, entries, options)
 }
 
+// Check quarantines the services which can not be decoded and removes unfinished writes
+func (h *HTTPServiceStoreJSON) Check(ctx context.Context) ([]QuarantinedFile, error) {
+	unlock, err := h.lockStore(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	return check(h.serviceDir, h.prefix, fileMode, decodeService)
+}
 
+func (h *HTTPServiceStoreJSON) Quarantined(ctx context.Context) ([]QuarantinedFile, error) {
+	return quarantined(h.serviceDir)
+}
+
+// Watch emits events for services changed by other processes
+func (h *HTTPServiceStoreJSON) Watch(ctx context.Context) error {
+	return watch(ctx, h.serviceDir, h.prefix, h.locker, h.notifier)
+}
@@ -0,0 +1,27 @@
+package store
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// IdempotencyRecord is the response of a write request, stored under the Idempotency-Key of the request
+type IdempotencyRecord struct {
+	Key    string `json:"key"`
+	Method string `json:"method"`
+	Path   string `json:"path"`
+	// RequestHash identifies the request body, a key may not be reused for a different request
+	RequestHash string      `json:"requestHash"`
+	Status      int         `json:"status"`
+	Header      http.Header `json:"header,omitempty"`
+	Body        []byte      `json:"body,omitempty"`
+	Expires     time.Time   `json:"expires"`
+}
+
+type IdempotencyStore interface {
+	// Get returns nil if no unexpired record exists for the key
+	Get(ctx context.Context, key string) (*IdempotencyRecord, error)
+	Set(ctx context.Context, record *IdempotencyRecord) error
+	DeleteExpired(ctx context.Context) error
+}
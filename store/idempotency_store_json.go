@@ -0,0 +1,94 @@
+package store
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+func NewIdempotencyStoreJSON(idempotencyDir string) (*IdempotencyStoreJSON, error) {
+	err := os.MkdirAll(idempotencyDir, os.ModePerm)
+	return &IdempotencyStoreJSON{idempotencyDir: idempotencyDir, prefix: "key_"}, err
+}
+
+type IdempotencyStoreJSON struct {
+	idempotencyDir string
+	prefix         string
+}
+
+// filepath hashes the key, it is chosen by the client and can contain anything
+func (i *IdempotencyStoreJSON) filepath(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(i.idempotencyDir, i.prefix+hex.EncodeToString(sum[:])+jsonExtension)
+}
+
+func (i *IdempotencyStoreJSON) Get(ctx context.Context, key string) (*IdempotencyRecord, error) {
+	record, err := i.read(i.filepath(key))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if time.Now().After(record.Expires) {
+		return nil, nil
+	}
+
+	return record, nil
+}
+
+func (i *IdempotencyStoreJSON) Set(ctx context.Context, record *IdempotencyRecord) error {
+	err := writeFileAtomic(i.filepath(record.Key), secretFileMode, func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(record)
+	})
+	if err != nil {
+		return fileError(err, "failed to write the record for %v", record.Key)
+	}
+
+	return nil
+}
+
+func (i *IdempotencyStoreJSON) DeleteExpired(ctx context.Context) error {
+	now := time.Now()
+	return filepath.Walk(i.idempotencyDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !strings.HasPrefix(info.Name(), i.prefix) {
+			return nil
+		}
+		record, err := i.read(path)
+		if err == nil && now.Before(record.Expires) {
+			return nil
+		}
+		// records which can not be decoded are useless as well
+		err = os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return fileError(err, "failed to remove %v", path)
+		}
+		return nil
+	})
+}
+
+func (i *IdempotencyStoreJSON) read(path string) (*IdempotencyRecord, error) {
+	f, err := os.OpenFile(path, os.O_RDONLY, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	record := IdempotencyRecord{}
+	err = json.NewDecoder(f).Decode(&record)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %v: %v", path, err)
+	}
+
+	return &record, nil
+}
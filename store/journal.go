@@ -0,0 +1,153 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/traefik/traefik/v2/pkg/config/dynamic"
+)
+
+// journalBinding binds the encrypted journal to its purpose so it can not be copied into a resource
+const journalBinding = "journal"
+
+// Journal keeps the snapshots of a transaction on disk while it is applied, a transaction interrupted by a crash
+// is rolled back on the next start
+type Journal struct {
+	path string
+	// keyring is optional, the snapshots contain the decrypted values of middlewares so the journal is encrypted
+	// if the stores are
+	keyring *Keyring
+}
+
+// NewJournal returns a journal stored in the file at the path
+func NewJournal(path string, keyring *Keyring) *Journal {
+	return &Journal{path: path, keyring: keyring}
+}
+
+type journalEntry struct {
+	Kind   string            `json:"kind"`
+	Name   string            `json:"name"`
+	Exists bool              `json:"exists"`
+	Value  json.RawMessage   `json:"value,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// write durably stores the snapshots before the first write of a transaction
+func (j *Journal) write(snapshots []snapshot) error {
+	entries := make([]journalEntry, len(snapshots))
+	for i, snap := range snapshots {
+		entries[i] = journalEntry{Kind: snap.kind, Name: snap.name, Exists: snap.exists, Labels: snap.labels}
+		if snap.exists {
+			value, err := json.Marshal(snap.value)
+			if err != nil {
+				return err
+			}
+			entries[i].Value = value
+		}
+	}
+	content, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	if j.keyring != nil {
+		encrypted, err := j.keyring.Encrypt(string(content), journalBinding)
+		if err != nil {
+			return err
+		}
+		content = []byte(encrypted)
+	}
+	return writeFileAtomic(j.path, secretFileMode, func(w io.Writer) error {
+		_, err := w.Write(content)
+		return err
+	})
+}
+
+// read returns the snapshots of an interrupted transaction, or nil if there is none
+func (j *Journal) read() ([]snapshot, error) {
+	content, err := ioutil.ReadFile(j.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if IsEncrypted(strings.TrimSpace(string(content))) {
+		if j.keyring == nil {
+			return nil, fmt.Errorf("the journal is encrypted but no keys are configured")
+		}
+		decrypted, err := j.keyring.Decrypt(strings.TrimSpace(string(content)), journalBinding)
+		if err != nil {
+			return nil, err
+		}
+		content = []byte(decrypted)
+	}
+
+	var entries []journalEntry
+	err = json.Unmarshal(content, &entries)
+	if err != nil {
+		return nil, fmt.Errorf("malformed journal: %v", err)
+	}
+	snapshots := make([]snapshot, len(entries))
+	for i, entry := range entries {
+		snapshots[i] = snapshot{key: key{kind: entry.Kind, name: entry.Name}, exists: entry.Exists, labels: entry.Labels}
+		if !entry.Exists {
+			continue
+		}
+		switch entry.Kind {
+		case KindRouter:
+			snapshots[i].value = &dynamic.Router{}
+		case KindService:
+			snapshots[i].value = &dynamic.Service{}
+		case KindMiddleware:
+			snapshots[i].value = &dynamic.Middleware{}
+		default:
+			return nil, fmt.Errorf("malformed journal: unknown kind %v", entry.Kind)
+		}
+		err = json.Unmarshal(entry.Value, snapshots[i].value)
+		if err != nil {
+			return nil, fmt.Errorf("malformed journal: %v %v: %v", entry.Kind, entry.Name, err)
+		}
+	}
+	return snapshots, nil
+}
+
+// clear removes the journal once its transaction is committed or rolled back
+func (j *Journal) clear() error {
+	err := removeFile(j.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Recover rolls back a transaction which was interrupted by a crash and reports whether there was one, it has
+// to be called before the stores are used
+func (s *Stores) Recover(ctx context.Context) (bool, error) {
+	if s.Journal == nil {
+		return false, nil
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// the journal is only read under the locks, another process may still be applying its transaction
+	ctx, unlock, err := s.lock(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	snapshots, err := s.Journal.read()
+	if err != nil || snapshots == nil {
+		return false, err
+	}
+	err = s.rollback(ctx, snapshots)
+	if err != nil {
+		return true, err
+	}
+	return true, s.Journal.clear()
+}
@@ -0,0 +1,41 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+type LabelStore interface {
+	Get(ctx context.Context, kind, name string) (map[string]string, error)
+	Set(ctx context.Context, kind, name string, labels map[string]string) error
+	Delete(ctx context.Context, kind, name string) error
+}
+
+// Selector selects resources by labels, all labels of the selector have to match
+type Selector map[string]string
+
+// ParseSelector parses a selector in the form key=value,key2=value2
+func ParseSelector(selector string) (Selector, error) {
+	s := Selector{}
+	if strings.TrimSpace(selector) == "" {
+		return s, nil
+	}
+	for _, pair := range strings.Split(selector, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, fmt.Errorf("invalid label selector %v", pair)
+		}
+		s[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	return s, nil
+}
+
+func (s Selector) Matches(labels map[string]string) bool {
+	for key, value := range s {
+		if v, ok := labels[key]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,77 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+func NewLabelStoreJSON(labelDir string) (*LabelStoreJSON, error) {
+	err := os.MkdirAll(labelDir, os.ModePerm)
+	return &LabelStoreJSON{labelDir: labelDir}, err
+}
+
+// LabelStoreJSON keeps the labels of every resource in its own file, e.g. router_name.json
+type LabelStoreJSON struct {
+	labelDir string
+}
+
+func (l *LabelStoreJSON) filepath(kind, name string) string {
+	return filepath.Join(l.labelDir, kind+"_"+name+jsonExtension)
+}
+
+func (l *LabelStoreJSON) Get(ctx context.Context, kind, name string) (map[string]string, error) {
+	err := checkName(name)
+	if err != nil {
+		return nil, err
+	}
+	labels := map[string]string{}
+	f, err := os.OpenFile(l.filepath(kind, name), os.O_RDONLY, os.ModePerm)
+	if os.IsNotExist(err) {
+		return labels, nil
+	}
+	if err != nil {
+		return nil, fileError(err, "failed to open labels of %v %v", kind, name)
+	}
+	defer f.Close()
+
+	err = json.NewDecoder(f).Decode(&labels)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode labels of %v %v: %v", kind, name, err)
+	}
+
+	return labels, nil
+}
+
+func (l *LabelStoreJSON) Set(ctx context.Context, kind, name string, labels map[string]string) error {
+	err := checkName(name)
+	if err != nil {
+		return err
+	}
+	if len(labels) == 0 {
+		return l.Delete(ctx, kind, name)
+	}
+	err = writeFileAtomic(l.filepath(kind, name), fileMode, func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(labels)
+	})
+	if err != nil {
+		return fileError(err, "failed to write labels of %v %v", kind, name)
+	}
+
+	return nil
+}
+
+func (l *LabelStoreJSON) Delete(ctx context.Context, kind, name string) error {
+	err := checkName(name)
+	if err != nil {
+		return err
+	}
+	err = removeFile(l.filepath(kind, name))
+	if err != nil && !os.IsNotExist(err) {
+		return fileError(err, "failed to delete labels of %v %v", kind, name)
+	}
+	return nil
+}
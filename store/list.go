@@ -0,0 +1,218 @@
+package store
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/traefik/traefik/v2/pkg/config/dynamic"
+)
+
+const (
+	SortName     = "name"
+	SortModified = "modified"
+)
+
+const (
+	OrderAscending  = "asc"
+	OrderDescending = "desc"
+)
+
+// ListOptions select a page of names, the zero value lists all names sorted by name
+type ListOptions struct {
+	// Cursor is a token from a previous Page, it has to be used with the same Sort and Order
+	Cursor string
+	// Limit is the maximum number of names, 0 means no limit
+	Limit int
+	Sort  string
+	Order string
+	// Filter is optional and only names it returns true for are listed
+	Filter func(ctx context.Context, name string) (bool, error)
+}
+
+// Page is a page of names with the cursors of the pages before and after it, the cursors are empty
+// if there is no such page
+type Page struct {
+	Names []string
+	Next  string
+	Prev  string
+}
+
+// entry is a listed resource with the properties it can be sorted by
+type entry struct {
+	name     string
+	modified time.Time
+}
+
+// cursor points between two entries, it is serialized as an opaque token
+type cursor struct {
+	Sort     string `json:"s"`
+	Order    string `json:"o"`
+	Name     string `json:"n"`
+	Modified int64  `json:"m,omitempty"`
+	// Before is set if the page ends before the entry, otherwise it starts after it
+	Before bool `json:"b,omitempty"`
+}
+
+func (c cursor) encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCursor(token string) (*cursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid cursor: %v", ErrInvalidListOptions, err)
+	}
+	c := cursor{}
+	err = json.Unmarshal(b, &c)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid cursor: %v", ErrInvalidListOptions, err)
+	}
+	return &c, nil
+}
+
+// less orders the entries, names are unique so ties on the modification time are broken by name. An entry is
+// never less than itself in either order, the cursors rely on it.
+func (o ListOptions) less(a, b entry) bool {
+	if o.Sort == SortModified && !a.modified.Equal(b.modified) {
+		return a.modified.Before(b.modified) != (o.Order == OrderDescending)
+	}
+	if a.name == b.name {
+		return false
+	}
+	return (a.name < b.name) != (o.Order == OrderDescending)
+}
+
+func (o ListOptions) validate() (ListOptions, error) {
+	if o.Sort == "" {
+		o.Sort = SortName
+	}
+	if o.Order == "" {
+		o.Order = OrderAscending
+	}
+	if o.Sort != SortName && o.Sort != SortModified {
+		return o, fmt.Errorf("%w: unknown sort %v", ErrInvalidListOptions, o.Sort)
+	}
+	if o.Order != OrderAscending && o.Order != OrderDescending {
+		return o, fmt.Errorf("%w: unknown order %v", ErrInvalidListOptions, o.Order)
+	}
+	if o.Limit < 0 {
+		return o, fmt.Errorf("%w: limit has to be positive", ErrInvalidListOptions)
+	}
+	return o, nil
+}
+
+// paginate filters, sorts and cuts the entries according to the options
+func paginate(ctx context.Context, entries []entry, options ListOptions) (*Page, error) {
+	options, err := options.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	filtered := make([]entry, 0, len(entries))
+	for _, e := range entries {
+		if options.Filter != nil {
+			ok, err := options.Filter(ctx, e.name)
+			if err != nil {
+				return nil, fmt.Errorf("failed to filter %v: %w", e.name, err)
+			}
+			if !ok {
+				continue
+			}
+		}
+		filtered = append(filtered, e)
+	}
+	sort.Slice(filtered, func(i, j int) bool {
+		return options.less(filtered[i], filtered[j])
+	})
+
+	start, end := 0, len(filtered)
+	if options.Cursor != "" {
+		c, err := decodeCursor(options.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		if c.Sort != options.Sort || c.Order != options.Order {
+			return nil, fmt.Errorf("%w: the cursor was created for sort %v %v", ErrInvalidListOptions, c.Sort, c.Order)
+		}
+		position := entry{name: c.Name, modified: time.Unix(0, c.Modified)}
+		if c.Before {
+			// the page ends with the last entry before the cursor position
+			end = sort.Search(len(filtered), func(i int) bool {
+				return !options.less(filtered[i], position)
+			})
+			if options.Limit > 0 && end-options.Limit > 0 {
+				start = end - options.Limit
+			}
+		} else {
+			// the page starts with the first entry after the cursor position
+			start = sort.Search(len(filtered), func(i int) bool {
+				return options.less(position, filtered[i])
+			})
+		}
+	}
+	if options.Limit > 0 && start+options.Limit < end {
+		end = start + options.Limit
+	}
+
+	page := &Page{Names: make([]string, 0, end-start)}
+	for _, e := range filtered[start:end] {
+		page.Names = append(page.Names, e.name)
+	}
+	if end < len(filtered) && end > 0 {
+		page.Next = options.cursor(filtered[end-1], false).encode()
+	}
+	if start > 0 && start < len(filtered) {
+		page.Prev = options.cursor(filtered[start], true).encode()
+	}
+
+	return page, nil
+}
+
+func (o ListOptions) cursor(e entry, before bool) cursor {
+	c := cursor{Sort: o.Sort, Order: o.Order, Name: e.name, Before: before}
+	if o.Sort == SortModified {
+		c.Modified = e.modified.UnixNano()
+	}
+	return c
+}
+
+// RouterFilter matches routers by their properties, empty fields match every router
+type RouterFilter struct {
+	EntryPoint string
+	Service    string
+	Middleware string
+	// Rule matches routers whose rule contains it
+	Rule string
+}
+
+func (f RouterFilter) Empty() bool {
+	return f == RouterFilter{}
+}
+
+func (f RouterFilter) Matches(router *dynamic.Router) bool {
+	if f.EntryPoint != "" && !contains(router.EntryPoints, f.EntryPoint) {
+		return false
+	}
+	if f.Middleware != "" && !contains(router.Middlewares, f.Middleware) {
+		return false
+	}
+	if f.Service != "" && router.Service != f.Service {
+		return false
+	}
+	return strings.Contains(router.Rule, f.Rule)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,149 @@
+package store
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// listEntries are named a0 to a9, the modification times are in the reverse order of the names
+func listEntries() []entry {
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	entries := make([]entry, 10)
+	for i := range entries {
+		entries[i] = entry{name: fmt.Sprintf("a%d", i), modified: start.Add(time.Duration(9-i) * time.Minute)}
+	}
+	return entries
+}
+
+// pages follows the next cursors from the first page and returns the names of every page
+func pages(t *testing.T, entries []entry, options ListOptions) [][]string {
+	t.Helper()
+	result := make([][]string, 0)
+	for {
+		page, err := paginate(context.Background(), entries, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result = append(result, page.Names)
+		if page.Next == "" {
+			return result
+		}
+		options.Cursor = page.Next
+		if len(result) > len(entries) {
+			t.Fatal("the pages do not end")
+		}
+	}
+}
+
+func TestPaginate(t *testing.T) {
+	tests := []struct {
+		name    string
+		options ListOptions
+		pages   [][]string
+	}{
+		{name: "no limit", pages: [][]string{{"a0", "a1", "a2", "a3", "a4", "a5", "a6", "a7", "a8", "a9"}}},
+		{name: "pages", options: ListOptions{Limit: 4}, pages: [][]string{{"a0", "a1", "a2", "a3"}, {"a4", "a5", "a6", "a7"}, {"a8", "a9"}}},
+		{name: "full last page", options: ListOptions{Limit: 5}, pages: [][]string{{"a0", "a1", "a2", "a3", "a4"}, {"a5", "a6", "a7", "a8", "a9"}}},
+		{name: "limit above the count", options: ListOptions{Limit: 20}, pages: [][]string{{"a0", "a1", "a2", "a3", "a4", "a5", "a6", "a7", "a8", "a9"}}},
+		{name: "descending", options: ListOptions{Limit: 4, Order: OrderDescending}, pages: [][]string{{"a9", "a8", "a7", "a6"}, {"a5", "a4", "a3", "a2"}, {"a1", "a0"}}},
+		{name: "modified", options: ListOptions{Limit: 6, Sort: SortModified}, pages: [][]string{{"a9", "a8", "a7", "a6", "a5", "a4"}, {"a3", "a2", "a1", "a0"}}},
+		{
+			name: "filter",
+			options: ListOptions{Limit: 2, Filter: func(ctx context.Context, name string) (bool, error) {
+				return name != "a1" && name != "a2", nil
+			}},
+			pages: [][]string{{"a0", "a3"}, {"a4", "a5"}, {"a6", "a7"}, {"a8", "a9"}},
+		},
+	}
+	for _, test := range tests {
+		if got := pages(t, listEntries(), test.options); !reflect.DeepEqual(got, test.pages) {
+			t.Errorf("%v: pages = %v, want %v", test.name, got, test.pages)
+		}
+	}
+}
+
+func TestPaginatePrev(t *testing.T) {
+	ctx := context.Background()
+	options := ListOptions{Limit: 4}
+	first, err := paginate(ctx, listEntries(), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Prev != "" {
+		t.Errorf("the first page has a previous page")
+	}
+	options.Cursor = first.Next
+	second, err := paginate(ctx, listEntries(), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	options.Cursor = second.Next
+	last, err := paginate(ctx, listEntries(), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last.Next != "" {
+		t.Errorf("the last page %v has a next page", last.Names)
+	}
+
+	options.Cursor = last.Prev
+	prev, err := paginate(ctx, listEntries(), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(prev.Names, second.Names) {
+		t.Errorf("previous page of %v = %v, want %v", last.Names, prev.Names, second.Names)
+	}
+	options.Cursor = prev.Prev
+	prev, err = paginate(ctx, listEntries(), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(prev.Names, first.Names) || prev.Prev != "" {
+		t.Errorf("previous page of %v = %v, want the first page %v", second.Names, prev.Names, first.Names)
+	}
+
+	// the cursor is a position, the next page starts after it even if the entry was deleted in the meantime
+	entries := listEntries()
+	entries = append(entries[:3], entries[4:]...)
+	options.Cursor = first.Next
+	page, err := paginate(ctx, entries, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(page.Names, []string{"a4", "a5", "a6", "a7"}) {
+		t.Errorf("page after the deleted a3 = %v, want a4 to a7", page.Names)
+	}
+}
+
+func TestPaginateInvalid(t *testing.T) {
+	ctx := context.Background()
+	first, err := paginate(ctx, listEntries(), ListOptions{Limit: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		options ListOptions
+	}{
+		{name: "not base64", options: ListOptions{Cursor: "not a cursor!"}},
+		{name: "truncated", options: ListOptions{Cursor: first.Next[:len(first.Next)-3]}},
+		{name: "not json", options: ListOptions{Cursor: base64.RawURLEncoding.EncodeToString([]byte("a3"))}},
+		{name: "other sort", options: ListOptions{Cursor: first.Next, Sort: SortModified}},
+		{name: "other order", options: ListOptions{Cursor: first.Next, Order: OrderDescending}},
+		{name: "unknown sort", options: ListOptions{Sort: "size"}},
+		{name: "unknown order", options: ListOptions{Order: "up"}},
+		{name: "negative limit", options: ListOptions{Limit: -1}},
+	}
+	for _, test := range tests {
+		page, err := paginate(ctx, listEntries(), test.options)
+		if !errors.Is(err, ErrInvalidListOptions) {
+			t.Errorf("%v: paginate = %+v, %v, want ErrInvalidListOptions", test.name, page, err)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	lockDir       = ".locks"
+	storeLockFile = ".store.lock"
+	lockExtension = ".lock"
+	// lockRetry is the initial and lockRetryMax the longest wait between two attempts to acquire a lock
+	lockRetry    = 5 * time.Millisecond
+	lockRetryMax = 100 * time.Millisecond
+)
+
+// lockedKey marks a context in which the store-wide lock of a directory is held
+type lockedKey string
+
+// locker acquires advisory locks on the files of a store directory, so the api and other processes working
+// on the same directory do not interleave their writes. A write holds the store-wide lock shared and the lock
+// of its resource exclusively, while Lock holds the store-wide lock exclusively.
+type locker struct {
+	dir string
+}
+
+// Lock acquires the store-wide lock exclusively, the returned context has to be used for the operations on the
+// store while the lock is held, otherwise they wait for the lock themselves
+func (l locker) Lock(ctx context.Context) (context.Context, func(), error) {
+	unlock, err := l.lockStore(ctx, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	return context.WithValue(ctx, lockedKey(l.dir), true), unlock, nil
+}
+
+// lockStore acquires the store-wide lock, unless the context already holds it
+func (l locker) lockStore(ctx context.Context, exclusive bool) (func(), error) {
+	if locked, _ := ctx.Value(lockedKey(l.dir)).(bool); locked {
+		return func() {}, nil
+	}
+	return acquire(ctx, filepath.Join(l.dir, lockDir, storeLockFile), exclusive)
+}
+
+// lockResource acquires the lock of a single file of the store
+func (l locker) lockResource(ctx context.Context, file string, exclusive bool) (func(), error) {
+	unlockStore, err := l.lockStore(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	unlock, err := acquire(ctx, filepath.Join(l.dir, lockDir, file+lockExtension), exclusive)
+	if err != nil {
+		unlockStore()
+		return nil, err
+	}
+	return func() {
+		unlock()
+		unlockStore()
+	}, nil
+}
+
+// acquire retries to lock the file until it succeeds or the context is done
+func acquire(ctx context.Context, path string, exclusive bool) (func(), error) {
+	err := os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	if err != nil {
+		return nil, fileError(err, "failed to create the lock directory")
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDONLY, fileMode)
+	if err != nil {
+		return nil, fileError(err, "failed to open the lock %v", filepath.Base(path))
+	}
+
+	retry := lockRetry
+	for {
+		ok, err := tryLock(f, exclusive)
+		if err != nil {
+			f.Close()
+			return nil, fileError(err, "failed to lock %v", filepath.Base(path))
+		}
+		if ok {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			f.Close()
+			return nil, fmt.Errorf("%w: failed to lock %v: %v", ErrUnavailable, filepath.Base(path), ctx.Err())
+		case <-time.After(retry):
+		}
+		if retry *= 2; retry > lockRetryMax {
+			retry = lockRetryMax
+		}
+	}
+
+	return func() {
+		unlock(f)
+		f.Close()
+	}, nil
+}
+
+// detached keeps the values of a context, e.g. the held locks, but is never done
+type detached struct {
+	context.Context
+}
+
+func (detached) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (detached) Done() <-chan struct{} {
+	return nil
+}
+
+func (detached) Err() error {
+	return nil
+}
@@ -0,0 +1,26 @@
+//go:build !windows
+// +build !windows
+
+package store
+
+import (
+	"os"
+	"syscall"
+)
+
+// tryLock acquires a flock without blocking, it returns false if another file description holds a conflicting lock
+func tryLock(f *os.File, exclusive bool) (bool, error) {
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	err := syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func unlock(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
@@ -0,0 +1,140 @@
+//go:build !windows
+// +build !windows
+
+package store
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/traefik/traefik/v2/pkg/config/dynamic"
+)
+
+// lockHelperEnv runs TestLockHelperProcess as the other process, its value is the lock to hold and the directory
+const lockHelperEnv = "KOMMANDEUR_LOCK_HELPER"
+
+// TestLockHelperProcess holds a lock of the router store until its stdin is closed, it does nothing unless it is
+// started by lockedByProcess
+func TestLockHelperProcess(t *testing.T) {
+	lock, dir := os.Getenv(lockHelperEnv), os.Getenv(lockHelperEnv+"_DIR")
+	if lock == "" {
+		return
+	}
+	routers, err := NewHTTPRouterStoreJSON(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var unlock func()
+	if lock == "store" {
+		_, unlock, err = routers.Lock(context.Background())
+	} else {
+		unlock, err = routers.lockResource(context.Background(), filepath.Base(routers.filepath(lock)), true)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlock()
+
+	os.Stdout.WriteString("locked\n")
+	bufio.NewReader(os.Stdin).ReadString('\n')
+}
+
+// lockedByProcess starts another process which holds the lock of the store in dir, or only the lock of the named
+// router, the returned function makes it release the lock and waits for it to exit
+func lockedByProcess(t *testing.T, dir, lock string) func() {
+	cmd := exec.Command(os.Args[0], "-test.run=^TestLockHelperProcess$")
+	cmd.Env = append(os.Environ(), lockHelperEnv+"="+lock, lockHelperEnv+"_DIR="+dir)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cmd.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	release := func() {
+		stdin.Close()
+		cmd.Wait()
+	}
+	line, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil || line != "locked\n" {
+		release()
+		t.Fatalf("the helper process did not lock: %q, %v", line, err)
+	}
+	return release
+}
+
+func TestLockBetweenProcesses(t *testing.T) {
+	dir := t.TempDir()
+	routers, err := NewHTTPRouterStoreJSON(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := &dynamic.Router{Rule: "Host(`example.com`)", Service: "web"}
+	err = routers.Set(context.Background(), "web", router)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the operations give up when the context is done instead of waiting for the other process
+	unavailable := func(name string, operation func(ctx context.Context) error) {
+		t.Helper()
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		err := operation(ctx)
+		if !errors.Is(err, ErrUnavailable) {
+			t.Errorf("%v = %v, want ErrUnavailable", name, err)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("%v gave up after %v, want the deadline of the context", name, elapsed)
+		}
+	}
+	available := func(name string, operation func(ctx context.Context) error) {
+		t.Helper()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		if err := operation(ctx); err != nil {
+			t.Errorf("%v = %v, want no error", name, err)
+		}
+	}
+	set := func(name string) func(ctx context.Context) error {
+		return func(ctx context.Context) error {
+			return routers.Set(ctx, name, router)
+		}
+	}
+	get := func(ctx context.Context) error {
+		_, err := routers.Get(ctx, "web")
+		return err
+	}
+	names := func(ctx context.Context) error {
+		_, err := routers.Names(ctx, ListOptions{})
+		return err
+	}
+
+	release := lockedByProcess(t, dir, "store")
+	unavailable("set while the store is locked", set("web"))
+	unavailable("set of another router while the store is locked", set("api"))
+	unavailable("names while the store is locked", names)
+	release()
+	available("set after the store is unlocked", set("web"))
+
+	release = lockedByProcess(t, dir, "web")
+	unavailable("set while the router is locked", set("web"))
+	unavailable("get while the router is locked", get)
+	available("set of another router", set("api"))
+	available("names while a router is locked", names)
+	release()
+	available("get after the router is unlocked", get)
+}
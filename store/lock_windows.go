@@ -0,0 +1,12 @@
+package store
+
+import "os"
+
+// tryLock always succeeds, flock is not available on windows so the stores are not locked there
+func tryLock(f *os.File, exclusive bool) (bool, error) {
+	return true, nil
+}
+
+func unlock(f *os.File) error {
+	return nil
+}
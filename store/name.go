@@ -0,0 +1,37 @@
+package store
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// maxNameLength keeps the file names of the JSON stores below the 255 bytes most file systems allow,
+// the longest prefix is middleware_ and the extension is .json
+const maxNameLength = 200
+
+// namePattern is the grammar of resource names, traefik reserves @ to separate the provider and every
+// character has to be safe in file names and urls
+var namePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._=-]*$`)
+
+// ValidateName checks that the name can be used for a resource in every store
+func ValidateName(name string) error {
+	if name == "" {
+		return fmt.Errorf("%w: the name is empty", ErrInvalidName)
+	}
+	if len(name) > maxNameLength {
+		return fmt.Errorf("%w: the name is longer than %v characters", ErrInvalidName, maxNameLength)
+	}
+	if !namePattern.MatchString(name) {
+		return fmt.Errorf("%w: %q has to start with a letter or digit and may only contain letters, digits, '.', '_', '=' and '-'", ErrInvalidName, name)
+	}
+	return nil
+}
+
+// resourceFile reports whether the file name belongs to a resource stored with the prefix
+func resourceFile(fileName, prefix string) bool {
+	if !strings.HasPrefix(fileName, prefix) || !strings.HasSuffix(fileName, jsonExtension) {
+		return false
+	}
+	return ValidateName(strings.TrimSuffix(strings.TrimPrefix(fileName, prefix), jsonExtension)) == nil
+}
@@ -0,0 +1,84 @@
+package store
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/quick"
+)
+
+func TestValidateName(t *testing.T) {
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{name: "a", valid: true},
+		{name: "web-router", valid: true},
+		{name: "web_router.v2", valid: true},
+		{name: "key=value", valid: true},
+		{name: "0", valid: true},
+		{name: strings.Repeat("a", maxNameLength), valid: true},
+		{name: "", valid: false},
+		{name: strings.Repeat("a", maxNameLength+1), valid: false},
+		{name: ".", valid: false},
+		{name: "..", valid: false},
+		{name: "../x", valid: false},
+		{name: "a/../../x", valid: false},
+		{name: "a/b", valid: false},
+		{name: `a\b`, valid: false},
+		{name: "/etc/passwd", valid: false},
+		{name: ".hidden", valid: false},
+		{name: "-a", valid: false},
+		{name: "a\x00b", valid: false},
+		{name: "a\nb", valid: false},
+		{name: "a b", valid: false},
+		{name: "a@docker", valid: false},
+		{name: "a%2fb", valid: false},
+		{name: "äpfel", valid: false},
+		{name: "a∕b", valid: false},
+		{name: "日本", valid: false},
+	}
+	for _, test := range tests {
+		err := ValidateName(test.name)
+		if test.valid && err != nil {
+			t.Errorf("ValidateName(%q) = %v, want nil", test.name, err)
+		}
+		if !test.valid && !errors.Is(err, ErrInvalidName) {
+			t.Errorf("ValidateName(%q) = %v, want ErrInvalidName", test.name, err)
+		}
+	}
+}
+
+// TestValidateNameFileNames checks that every valid name maps to a file directly in the store directory
+func TestValidateNameFileNames(t *testing.T) {
+	dir := filepath.Join("stores", "routers")
+	valid := func(name string) bool {
+		if ValidateName(name) != nil {
+			return true
+		}
+		path := filepath.Join(dir, "middleware_"+name+jsonExtension)
+		return filepath.Dir(path) == dir &&
+			len(filepath.Base(path)) < 255 &&
+			resourceFile(filepath.Base(path), "middleware_") &&
+			resourceName(filepath.Base(path), "middleware_") == name
+	}
+	err := quick.Check(valid, &quick.Config{MaxCount: 10000})
+	if err != nil {
+		t.Error(err)
+	}
+
+	// random strings are rarely valid, names built from the allowed characters are
+	alphabet := "abcXYZ019._=-/\\\x00ä"
+	generated := func(indices []uint8) bool {
+		name := make([]byte, 0, len(indices))
+		for _, i := range indices {
+			name = append(name, alphabet[int(i)%len(alphabet)])
+		}
+		return valid(string(name))
+	}
+	err = quick.Check(generated, &quick.Config{MaxCount: 10000})
+	if err != nil {
+		t.Error(err)
+	}
+}
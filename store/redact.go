@@ -0,0 +1,194 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/traefik/traefik/v2/pkg/config/dynamic"
+)
+
+// Redacted replaces sensitive values in the responses of the management api
+const Redacted = "[redacted]"
+
+// redact masks a sensitive value, the user names of basic and digest auth users stay visible. References to
+// secrets are not secret themselves and are kept.
+func redact(path, value string) string {
+	if HasReferences(value) {
+		return value
+	}
+	if strings.HasSuffix(path, ".users") && !IsEncrypted(value) {
+		if i := strings.LastIndex(value, ":"); i >= 0 {
+			return value[:i+1] + Redacted
+		}
+	}
+	return Redacted
+}
+
+func isRedacted(value string) bool {
+	return strings.HasSuffix(value, Redacted)
+}
+
+// RedactMiddleware returns a copy of the middleware with its sensitive fields masked
+func RedactMiddleware(middleware *dynamic.Middleware) *dynamic.Middleware {
+	redacted := middleware.DeepCopy()
+	for path, values := range SensitiveMiddlewareFields(redacted) {
+		for _, value := range values {
+			*value = redact(path, *value)
+		}
+	}
+	return redacted
+}
+
+// RestoreMiddleware replaces the redacted values of a middleware written by a client with the stored values
+// they were redacted from, so a middleware can be read and written back without revealing its secrets
+func RestoreMiddleware(middleware, stored *dynamic.Middleware) error {
+	storedFields := SensitiveMiddlewareFields(stored)
+	for path, values := range SensitiveMiddlewareFields(middleware) {
+		for _, value := range values {
+			if !isRedacted(*value) {
+				continue
+			}
+			restored := false
+			for _, candidate := range storedFields[path] {
+				if redact(path, *candidate) == *value {
+					*value = *candidate
+					restored = true
+					break
+				}
+			}
+			if !restored {
+				return fmt.Errorf("%w: %v: the redacted value %v does not match a stored one", ErrInvalidValue, path, *value)
+			}
+		}
+	}
+	return nil
+}
+
+// HTTPMiddlewareStoreRedacted keeps redacted values out of the underlying store, they are replaced with the
+// stored values when a middleware is written back
+type HTTPMiddlewareStoreRedacted struct {
+	HTTPMiddlewareStore
+}
+
+func NewHTTPMiddlewareStoreRedacted(store HTTPMiddlewareStore) *HTTPMiddlewareStoreRedacted {
+	return &HTTPMiddlewareStoreRedacted{HTTPMiddlewareStore: store}
+}
+
+func (h *HTTPMiddlewareStoreRedacted) Set(ctx context.Context, name string, middleware *dynamic.Middleware) error {
+	restored := middleware.DeepCopy()
+	stored, err := h.HTTPMiddlewareStore.Get(ctx, name)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	err = RestoreMiddleware(restored, stored)
+	if err != nil {
+		return fmt.Errorf("failed to set middleware %v: %w", name, err)
+	}
+	return h.HTTPMiddlewareStore.Set(ctx, name, restored)
+}
+
+// Watch watches the underlying store if it can be watched
+func (h *HTTPMiddlewareStoreRedacted) Watch(ctx context.Context) error {
+	watcher, ok := h.HTTPMiddlewareStore.(Watcher)
+	if !ok {
+		return nil
+	}
+	return watcher.Watch(ctx)
+}
+
+// sensitivePaths are the json paths of the sensitive fields within a middleware
+var sensitivePaths = [][]string{{"basicAuth", "users"}, {"digestAuth", "users"}, {"forwardAuth", "tls", "key"}}
+
+// RedactJSON masks the sensitive middleware fields anywhere in a json document, e.g. in a request body with a
+// single middleware, a map of them or a transaction
+func RedactJSON(document []byte) ([]byte, error) {
+	var value interface{}
+	decoder := json.NewDecoder(bytes.NewReader(document))
+	decoder.UseNumber()
+	err := decoder.Decode(&value)
+	if err != nil {
+		return nil, err
+	}
+	redactValue(value)
+	return json.Marshal(value)
+}
+
+func redactValue(value interface{}) {
+	switch value := value.(type) {
+	case []interface{}:
+		for _, v := range value {
+			redactValue(v)
+		}
+	case map[string]interface{}:
+		for _, path := range sensitivePaths {
+			redactPath(value, path, strings.Join(path, "."))
+		}
+		for _, v := range value {
+			redactValue(v)
+		}
+	}
+}
+
+func redactPath(object map[string]interface{}, path []string, name string) {
+	if len(path) > 1 {
+		child, ok := object[path[0]].(map[string]interface{})
+		if ok {
+			redactPath(child, path[1:], name)
+		}
+		return
+	}
+	switch field := object[path[0]].(type) {
+	case string:
+		object[path[0]] = redact(name, field)
+	case []interface{}:
+		for i, v := range field {
+			if s, ok := v.(string); ok {
+				field[i] = redact(name, s)
+			}
+		}
+	}
+}
+
+// RedactFields masks the string values of the named fields anywhere in a json document, e.g. the secrets of
+// tokens and webhooks
+func RedactFields(document []byte, fields ...string) ([]byte, error) {
+	var value interface{}
+	decoder := json.NewDecoder(bytes.NewReader(document))
+	decoder.UseNumber()
+	err := decoder.Decode(&value)
+	if err != nil {
+		return nil, err
+	}
+	redactFields(value, fields)
+	return json.Marshal(value)
+}
+
+func redactFields(value interface{}, fields []string) {
+	switch value := value.(type) {
+	case []interface{}:
+		for _, v := range value {
+			redactFields(v, fields)
+		}
+	case map[string]interface{}:
+		for key, v := range value {
+			if s, ok := v.(string); ok && s != "" && containsFold(fields, key) {
+				value[key] = Redacted
+				continue
+			}
+			redactFields(v, fields)
+		}
+	}
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,245 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/traefik/traefik/v2/pkg/config/dynamic"
+)
+
+// referencePattern matches references like ${env:NAME} and ${secret:file:/run/secrets/name}
+var referencePattern = regexp.MustCompile(`\$\{(env|secret):([^}]*)\}`)
+
+// HasReferences reports whether a value contains references to secrets
+func HasReferences(value string) bool {
+	return referencePattern.MatchString(value)
+}
+
+// References returns the references in the strings of a resource without ${ and }, e.g.
+// secret:file:/run/secrets/name, sorted and without duplicates
+func References(resource interface{}) ([]string, error) {
+	encoded, err := json.Marshal(resource)
+	if err != nil {
+		return nil, err
+	}
+	var value interface{}
+	err = json.Unmarshal(encoded, &value)
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	collectReferences(value, seen)
+	references := make([]string, 0, len(seen))
+	for reference := range seen {
+		references = append(references, reference)
+	}
+	sort.Strings(references)
+	return references, nil
+}
+
+// collectReferences adds the references in all strings of a decoded json value, the paths of files are cleaned
+// so they name the file the resolver reads
+func collectReferences(value interface{}, seen map[string]bool) {
+	switch value := value.(type) {
+	case string:
+		for _, match := range referencePattern.FindAllStringSubmatch(value, -1) {
+			provider, key := match[1], match[2]
+			if provider == "secret" && strings.HasPrefix(key, "file:") {
+				key = "file:" + filepath.Clean(strings.TrimPrefix(key, "file:"))
+			}
+			seen[provider+":"+key] = true
+		}
+	case []interface{}:
+		for _, v := range value {
+			collectReferences(v, seen)
+		}
+	case map[string]interface{}:
+		for _, v := range value {
+			collectReferences(v, seen)
+		}
+	}
+}
+
+// SecretResolver replaces references to secrets with their values, references are stored verbatim and only
+// resolved when the configuration is rendered for traefik
+type SecretResolver struct {
+	// Dir is the directory secret files have to be in
+	Dir string
+	// EnvPrefix is the prefix of the environment variables which can be referenced, none can be if it is empty so
+	// the variables of kommandeur itself are not revealed by accident
+	EnvPrefix string
+}
+
+// Resolve replaces every reference in the value, it fails if one of them can not be resolved
+func (s *SecretResolver) Resolve(value string) (string, error) {
+	var err error
+	resolved := referencePattern.ReplaceAllStringFunc(value, func(reference string) string {
+		if err != nil {
+			return ""
+		}
+		match := referencePattern.FindStringSubmatch(reference)
+		var v string
+		v, err = s.lookup(match[1], match[2])
+		if err != nil {
+			err = fmt.Errorf("failed to resolve %v: %v", reference, err)
+		}
+		return v
+	})
+	if err != nil {
+		return "", err
+	}
+	return resolved, nil
+}
+
+func (s *SecretResolver) lookup(provider, key string) (string, error) {
+	if provider == "env" {
+		if s.EnvPrefix == "" {
+			return "", fmt.Errorf("environment variables can not be referenced without a prefix")
+		}
+		if !strings.HasPrefix(key, s.EnvPrefix) {
+			return "", fmt.Errorf("only environment variables starting with %v can be referenced", s.EnvPrefix)
+		}
+		value, ok := os.LookupEnv(key)
+		if !ok {
+			return "", fmt.Errorf("the environment variable is not set")
+		}
+		return value, nil
+	}
+
+	if !strings.HasPrefix(key, "file:") {
+		return "", fmt.Errorf("unsupported secret provider, expected ${secret:file:<path>}")
+	}
+	path := filepath.Clean(strings.TrimPrefix(key, "file:"))
+	dir, err := filepath.Abs(s.Dir)
+	if err != nil {
+		return "", err
+	}
+	relative, err := filepath.Rel(dir, path)
+	if !filepath.IsAbs(path) || err != nil || relative == ".." || strings.HasPrefix(relative, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("secret files have to be in %v", dir)
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	// files usually end with a newline which is not part of the secret
+	return strings.TrimRight(string(content), "\r\n"), nil
+}
+
+// Unresolved is a resource which is left out of the rendered configuration, a reference of it can not be resolved
+type Unresolved struct {
+	Kind  string
+	Name  string
+	Error string
+}
+
+// resolveConfiguration returns a copy of the configuration with all references resolved and whether it contained
+// any, the configuration is returned as it is if it does not contain references. Resources with references which
+// can not be resolved are left out and returned, so a single one does not break the whole configuration.
+func (s *SecretResolver) resolveConfiguration(configuration *dynamic.Configuration) (*dynamic.Configuration, bool, []Unresolved, error) {
+	encoded, err := json.Marshal(configuration)
+	if err != nil {
+		return nil, false, nil, err
+	}
+	if !referencePattern.Match(encoded) || configuration.HTTP == nil {
+		return configuration, false, nil, nil
+	}
+
+	http := configuration.HTTP
+	resolved := &dynamic.HTTPConfiguration{
+		Routers:     make(map[string]*dynamic.Router, len(http.Routers)),
+		Services:    make(map[string]*dynamic.Service, len(http.Services)),
+		Middlewares: make(map[string]*dynamic.Middleware, len(http.Middlewares)),
+	}
+	unresolved := make([]Unresolved, 0)
+	resolve := func(kind, name string, resource, out interface{}) bool {
+		err := s.resolveResource(resource, out)
+		if err != nil {
+			unresolved = append(unresolved, Unresolved{Kind: kind, Name: name, Error: err.Error()})
+			return false
+		}
+		return true
+	}
+	for name, router := range http.Routers {
+		out := &dynamic.Router{}
+		if resolve(KindRouter, name, router, out) {
+			resolved.Routers[name] = out
+		}
+	}
+	for name, service := range http.Services {
+		out := &dynamic.Service{}
+		if resolve(KindService, name, service, out) {
+			resolved.Services[name] = out
+		}
+	}
+	for name, middleware := range http.Middlewares {
+		out := &dynamic.Middleware{}
+		if resolve(KindMiddleware, name, middleware, out) {
+			resolved.Middlewares[name] = out
+		}
+	}
+	sort.Slice(unresolved, func(i, j int) bool {
+		if unresolved[i].Kind != unresolved[j].Kind {
+			return unresolved[i].Kind < unresolved[j].Kind
+		}
+		return unresolved[i].Name < unresolved[j].Name
+	})
+	return &dynamic.Configuration{HTTP: resolved}, true, unresolved, nil
+}
+
+// resolveResource decodes a copy of the resource with its references resolved into out
+func (s *SecretResolver) resolveResource(resource, out interface{}) error {
+	encoded, err := json.Marshal(resource)
+	if err != nil {
+		return err
+	}
+	var value interface{}
+	decoder := json.NewDecoder(bytes.NewReader(encoded))
+	// numbers are kept as they are, e.g. large integers
+	decoder.UseNumber()
+	err = decoder.Decode(&value)
+	if err != nil {
+		return err
+	}
+	value, err = s.resolveValue(value)
+	if err != nil {
+		return err
+	}
+	encoded, err = json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(encoded, out)
+}
+
+// resolveValue resolves the references in all strings of a decoded json value
+func (s *SecretResolver) resolveValue(value interface{}) (interface{}, error) {
+	switch value := value.(type) {
+	case string:
+		return s.Resolve(value)
+	case []interface{}:
+		for i := range value {
+			resolved, err := s.resolveValue(value[i])
+			if err != nil {
+				return nil, err
+			}
+			value[i] = resolved
+		}
+	case map[string]interface{}:
+		for key := range value {
+			resolved, err := s.resolveValue(value[key])
+			if err != nil {
+				return nil, err
+			}
+			value[key] = resolved
+		}
+	}
+	return value, nil
+}
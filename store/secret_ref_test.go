@@ -0,0 +1,110 @@
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/traefik/traefik/v2/pkg/config/dynamic"
+)
+
+func TestSecretResolverResolve(t *testing.T) {
+	dir := t.TempDir()
+	err := ioutil.WriteFile(filepath.Join(dir, "password"), []byte("file-secret\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("KOMMANDEUR_TEST_SECRET", "env-secret")
+	defer os.Unsetenv("KOMMANDEUR_TEST_SECRET")
+
+	tests := []struct {
+		name     string
+		prefix   string
+		value    string
+		resolved string
+		invalid  bool
+	}{
+		{name: "no references", value: "a:b", resolved: "a:b"},
+		{name: "file", value: "a:${secret:file:" + filepath.Join(dir, "password") + "}", resolved: "a:file-secret"},
+		{name: "file outside of the directory", value: "${secret:file:" + filepath.Join(dir, "..", "password") + "}", invalid: true},
+		{name: "relative file", value: "${secret:file:password}", invalid: true},
+		{name: "missing file", value: "${secret:file:" + filepath.Join(dir, "missing") + "}", invalid: true},
+		{name: "unknown provider", value: "${secret:vault:password}", invalid: true},
+		{name: "env without prefix", value: "${env:KOMMANDEUR_TEST_SECRET}", invalid: true},
+		{name: "env with prefix", prefix: "KOMMANDEUR_", value: "a:${env:KOMMANDEUR_TEST_SECRET}", resolved: "a:env-secret"},
+		{name: "env with other prefix", prefix: "TRAEFIK_", value: "${env:KOMMANDEUR_TEST_SECRET}", invalid: true},
+		{name: "unset env", prefix: "KOMMANDEUR_", value: "${env:KOMMANDEUR_TEST_UNSET}", invalid: true},
+	}
+	for _, test := range tests {
+		resolver := &SecretResolver{Dir: dir, EnvPrefix: test.prefix}
+		resolved, err := resolver.Resolve(test.value)
+		if test.invalid && err == nil {
+			t.Errorf("%v: Resolve(%q) = %q, want an error", test.name, test.value, resolved)
+		}
+		if !test.invalid && (err != nil || resolved != test.resolved) {
+			t.Errorf("%v: Resolve(%q) = %q, %v, want %q", test.name, test.value, resolved, err, test.resolved)
+		}
+	}
+}
+
+func TestSecretResolverLeavesOutUnresolved(t *testing.T) {
+	dir := t.TempDir()
+	err := ioutil.WriteFile(filepath.Join(dir, "password"), []byte("secret"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolver := &SecretResolver{Dir: dir}
+	configuration := &dynamic.Configuration{HTTP: &dynamic.HTTPConfiguration{
+		Routers: map[string]*dynamic.Router{"web": {Rule: "Host(`example.com`)", Service: "web", Middlewares: []string{"good"}}},
+		Middlewares: map[string]*dynamic.Middleware{
+			"good":    {BasicAuth: &dynamic.BasicAuth{Users: []string{"a:${secret:file:" + filepath.Join(dir, "password") + "}"}}},
+			"env":     {BasicAuth: &dynamic.BasicAuth{Users: []string{"a:${env:HOME}"}}},
+			"missing": {BasicAuth: &dynamic.BasicAuth{Users: []string{"a:${secret:file:" + filepath.Join(dir, "missing") + "}"}}},
+		},
+	}}
+
+	resolved, references, unresolved, err := resolver.resolveConfiguration(configuration)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !references {
+		t.Error("the references were not reported")
+	}
+	if !reflect.DeepEqual(resolved.HTTP.Routers, configuration.HTTP.Routers) {
+		t.Errorf("routers = %+v, want %+v", resolved.HTTP.Routers, configuration.HTTP.Routers)
+	}
+	want := map[string]*dynamic.Middleware{"good": {BasicAuth: &dynamic.BasicAuth{Users: dynamic.Users{"a:secret"}}}}
+	if !reflect.DeepEqual(resolved.HTTP.Middlewares, want) {
+		t.Errorf("middlewares = %+v, want the resolved middleware good", resolved.HTTP.Middlewares)
+	}
+	if len(unresolved) != 2 || unresolved[0].Name != "env" || unresolved[1].Name != "missing" || unresolved[0].Kind != KindMiddleware {
+		t.Errorf("unresolved = %+v, want the middlewares env and missing", unresolved)
+	}
+	// the stored configuration keeps the references
+	if configuration.HTTP.Middlewares["good"].BasicAuth.Users[0] == "a:secret" {
+		t.Error("the references of the configuration were replaced")
+	}
+}
+
+func TestReferences(t *testing.T) {
+	middleware := &dynamic.Middleware{
+		BasicAuth:   &dynamic.BasicAuth{Users: []string{"a:${secret:file:/run/secrets/a}", "b:${env:TRAEFIK_B}", "c:${secret:file:/run/secrets/a}"}},
+		ForwardAuth: &dynamic.ForwardAuth{Address: "https://auth.example.com/${secret:file:/run/secrets/team-a/../b}"},
+		Headers:     &dynamic.Headers{CustomRequestHeaders: map[string]string{"X-Token": "${secret:vault:token}"}},
+	}
+	references, err := References(middleware)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"env:TRAEFIK_B", "secret:file:/run/secrets/a", "secret:file:/run/secrets/b", "secret:vault:token"}
+	if !reflect.DeepEqual(references, want) {
+		t.Errorf("References = %v, want %v", references, want)
+	}
+
+	references, err = References(&dynamic.Router{Rule: "Host(`example.com`)"})
+	if err != nil || len(references) != 0 {
+		t.Errorf("References = %v, %v, want none", references, err)
+	}
+}
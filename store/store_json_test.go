@@ -0,0 +1,335 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"testing/quick"
+
+	"github.com/traefik/traefik/v2/pkg/config/dynamic"
+)
+
+// jsonStore is the part of the resource stores the tests use, the value is the stored resource
+type jsonStore struct {
+	set    func(ctx context.Context, name string) error
+	get    func(ctx context.Context, name string) (interface{}, error)
+	delete func(ctx context.Context, name string) error
+	names  func(ctx context.Context) ([]string, error)
+	want   interface{}
+}
+
+func newJSONStores(t *testing.T, dir string) map[string]jsonStore {
+	routers, err := NewHTTPRouterStoreJSON(filepath.Join(dir, "routers"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	services, err := NewHTTPServiceStoreJSON(filepath.Join(dir, "services"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	middlewares, err := NewHTTPMiddlewareStoreJSON(filepath.Join(dir, "middlewares"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	router := &dynamic.Router{Rule: "Host(`example.com`)", Service: "web"}
+	service := &dynamic.Service{LoadBalancer: &dynamic.ServersLoadBalancer{Servers: []dynamic.Server{{URL: "http://127.0.0.1:8000"}}}}
+	middleware := &dynamic.Middleware{StripPrefix: &dynamic.StripPrefix{Prefixes: []string{"/api"}}}
+	names := func(list func(ctx context.Context, options ListOptions) (*Page, error)) func(ctx context.Context) ([]string, error) {
+		return func(ctx context.Context) ([]string, error) {
+			page, err := list(ctx, ListOptions{})
+			if err != nil {
+				return nil, err
+			}
+			return page.Names, nil
+		}
+	}
+
+	return map[string]jsonStore{
+		"routers": {
+			set:    func(ctx context.Context, name string) error { return routers.Set(ctx, name, router) },
+			get:    func(ctx context.Context, name string) (interface{}, error) { return routers.Get(ctx, name) },
+			delete: routers.Delete,
+			names:  names(routers.Names),
+			want:   router,
+		},
+		"services": {
+			set:    func(ctx context.Context, name string) error { return services.Set(ctx, name, service) },
+			get:    func(ctx context.Context, name string) (interface{}, error) { return services.Get(ctx, name) },
+			delete: services.Delete,
+			names:  names(services.Names),
+			want:   service,
+		},
+		"middlewares": {
+			set:    func(ctx context.Context, name string) error { return middlewares.Set(ctx, name, middleware) },
+			get:    func(ctx context.Context, name string) (interface{}, error) { return middlewares.Get(ctx, name) },
+			delete: middlewares.Delete,
+			names:  names(middlewares.Names),
+			want:   middleware,
+		},
+	}
+}
+
+// checkFiles fails the test if a file exists outside the directories of the stores
+func checkFiles(t *testing.T, dir string) {
+	t.Helper()
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		relative, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		parts := strings.Split(relative, string(filepath.Separator))
+		switch parts[0] {
+		case "routers", "services", "middlewares":
+			// the resources are stored in the directory itself, the locks in a directory within it
+			if len(parts) == 2 || (len(parts) == 3 && parts[1] == ".locks") {
+				return nil
+			}
+		}
+		t.Errorf("%v is outside of the store directories", relative)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestJSONStores(t *testing.T) {
+	names := []string{
+		"a",
+		"web-router",
+		"web_router.v2",
+		"key=value",
+		strings.Repeat("a", maxNameLength),
+		"",
+		strings.Repeat("a", maxNameLength+1),
+		strings.Repeat("a", 300),
+		".",
+		"..",
+		"../x",
+		"../../x",
+		"a/../../x",
+		"a/b",
+		`a\b`,
+		`..\x`,
+		"/tmp/x",
+		".hidden",
+		"a\x00b",
+		"a\nb",
+		"äpfel",
+		"a∕b",
+		"日本",
+	}
+
+	ctx := context.Background()
+	for _, kind := range []string{"routers", "services", "middlewares"} {
+		kind := kind
+		t.Run(kind, func(t *testing.T) {
+			dir := t.TempDir()
+			s := newJSONStores(t, dir)[kind]
+			stored := make([]string, 0)
+			for _, name := range names {
+				valid := ValidateName(name) == nil
+				err := s.set(ctx, name)
+				if valid && err != nil {
+					t.Errorf("failed to set %q: %v", name, err)
+					continue
+				}
+				if !valid {
+					if !errors.Is(err, ErrInvalidName) {
+						t.Errorf("set %q = %v, want ErrInvalidName", name, err)
+					}
+					if _, err := s.get(ctx, name); !errors.Is(err, ErrInvalidName) {
+						t.Errorf("get %q = %v, want ErrInvalidName", name, err)
+					}
+					if err := s.delete(ctx, name); !errors.Is(err, ErrInvalidName) {
+						t.Errorf("delete %q = %v, want ErrInvalidName", name, err)
+					}
+					continue
+				}
+				stored = append(stored, name)
+
+				value, err := s.get(ctx, name)
+				if err != nil {
+					t.Errorf("failed to get %q: %v", name, err)
+				} else if !reflect.DeepEqual(value, s.want) {
+					t.Errorf("get %q = %+v, want %+v", name, value, s.want)
+				}
+			}
+			checkFiles(t, dir)
+
+			listed, err := s.names(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sort.Strings(stored)
+			if !reflect.DeepEqual(listed, stored) {
+				t.Errorf("names = %v, want %v", listed, stored)
+			}
+
+			for _, name := range stored {
+				err := s.delete(ctx, name)
+				if err != nil {
+					t.Errorf("failed to delete %q: %v", name, err)
+				}
+				if _, err := s.get(ctx, name); !errors.Is(err, ErrNotFound) {
+					t.Errorf("get %q after delete = %v, want ErrNotFound", name, err)
+				}
+			}
+			listed, err = s.names(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(listed) != 0 {
+				t.Errorf("names after delete = %v, want none", listed)
+			}
+		})
+	}
+}
+
+// TestJSONStoresRandomNames writes random names, the invalid ones have to be rejected and the valid ones
+// have to end up in the store directory
+func TestJSONStoresRandomNames(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	stores := newJSONStores(t, dir)
+
+	property := func(name string, traversal bool) bool {
+		if traversal {
+			name = "../" + name
+		}
+		for kind, s := range stores {
+			err := s.set(ctx, name)
+			if ValidateName(name) != nil {
+				if !errors.Is(err, ErrInvalidName) {
+					t.Logf("%v: set %q = %v, want ErrInvalidName", kind, name, err)
+					return false
+				}
+				continue
+			}
+			if err != nil {
+				t.Logf("%v: failed to set %q: %v", kind, name, err)
+				return false
+			}
+			err = s.delete(ctx, name)
+			if err != nil {
+				t.Logf("%v: failed to delete %q: %v", kind, name, err)
+				return false
+			}
+		}
+		return true
+	}
+	err := quick.Check(property, &quick.Config{MaxCount: 500})
+	if err != nil {
+		t.Error(err)
+	}
+	checkFiles(t, dir)
+}
+
+// TestCheckQuarantinesInvalidNames checks that files which do not match the name grammar are moved out of the store
+func TestCheckQuarantinesInvalidNames(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	routers, err := NewHTTPRouterStoreJSON(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = routers.Set(ctx, "valid", &dynamic.Router{Rule: "Host(`example.com`)", Service: "web"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "router_in valid.json"), []byte(`{"rule":"Host(`+"`a`"+`)"}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	quarantined, err := routers.Check(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(quarantined) != 1 || quarantined[0].File != "router_in valid.json" {
+		t.Fatalf("quarantined = %+v, want router_in valid.json", quarantined)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "router_in valid.json")); !os.IsNotExist(err) {
+		t.Errorf("router_in valid.json is still in the store: %v", err)
+	}
+	page, err := routers.Names(ctx, ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(page.Names, []string{"valid"}) {
+		t.Errorf("names = %v, want [valid]", page.Names)
+	}
+}
+
+// TestGetAllQuarantinesCorruptFiles checks that a listing leaves corrupt files out and moves them aside, also while
+// the store is locked by the caller
+func TestGetAllQuarantinesCorruptFiles(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	routers, err := NewHTTPRouterStoreJSON(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := &dynamic.Router{Rule: "Host(`example.com`)", Service: "web"}
+	err = routers.Set(ctx, "valid", router)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "router_corrupt.json"), []byte(`{"rule":`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	all, err := routers.GetAll(ctx, 0, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(all, map[string]*dynamic.Router{"valid": router}) {
+		t.Errorf("routers = %+v, want only the valid router", all)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(dir, "router_locked.json"), []byte(`{"rule":`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	locked, unlock, err := routers.Lock(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	all, err = routers.GetAll(locked, 0, -1)
+	unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 1 {
+		t.Errorf("routers = %+v, want only the valid router", all)
+	}
+
+	quarantined, err := routers.Quarantined(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(quarantined) != 2 {
+		t.Fatalf("quarantined = %+v, want the corrupt files", quarantined)
+	}
+	page, err := routers.Names(ctx, ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(page.Names, []string{"valid"}) {
+		t.Errorf("names = %v, want [valid]", page.Names)
+	}
+}
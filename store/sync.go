@@ -0,0 +1,182 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/traefik/traefik/v2/pkg/config/dynamic"
+)
+
+// PruneScope limits which resources missing from the desired configuration are deleted
+type PruneScope struct {
+	// Prefix only prunes resources with names starting with it
+	Prefix string
+	// Selector only prunes resources carrying all of its labels, synced resources are labeled with it
+	Selector Selector
+}
+
+// Plan is the list of operations converging the stores to a desired configuration
+type Plan struct {
+	Operations []Operation
+	Unchanged  int
+}
+
+// Plan compares the desired configuration with the stores, resources not in the configuration are only deleted
+// if a prune scope is given
+func (s *Stores) Plan(ctx context.Context, desired *dynamic.Configuration, prune *PruneScope) (*Plan, error) {
+	if desired.HTTP == nil {
+		desired.HTTP = &dynamic.HTTPConfiguration{}
+	}
+	if prune != nil && len(prune.Selector) > 0 && s.Labels == nil {
+		return nil, fmt.Errorf("pruning by labels requires a label store")
+	}
+
+	routers, err := s.Routers.GetAll(ctx, 0, -1)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get routers: %w", err)
+	}
+	services, err := s.Services.GetAll(ctx, 0, -1)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get services: %w", err)
+	}
+	middlewares, err := s.Middlewares.GetAll(ctx, 0, -1)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get middlewares: %w", err)
+	}
+	// values redacted by the management api stand for the stored ones
+	for name, middleware := range desired.HTTP.Middlewares {
+		err = RestoreMiddleware(middleware, middlewares[name])
+		if err != nil {
+			return nil, fmt.Errorf("middleware %v: %w", name, err)
+		}
+	}
+
+	plan := &Plan{Operations: make([]Operation, 0)}
+	// routers are deleted before and created after the services and middlewares they reference
+	kinds := []struct {
+		kind    string
+		current map[string]interface{}
+		desired map[string]interface{}
+	}{
+		{KindRouter, routerValues(routers), routerValues(desired.HTTP.Routers)},
+		{KindMiddleware, middlewareValues(middlewares), middlewareValues(desired.HTTP.Middlewares)},
+		{KindService, serviceValues(services), serviceValues(desired.HTTP.Services)},
+	}
+	for _, d := range kinds {
+		if prune == nil {
+			break
+		}
+		for _, name := range sortedNames(d.current) {
+			if _, ok := d.desired[name]; ok || !strings.HasPrefix(name, prune.Prefix) {
+				continue
+			}
+			if len(prune.Selector) > 0 {
+				labels, err := s.Labels.Get(ctx, d.kind, name)
+				if err != nil {
+					return nil, fmt.Errorf("failed to get labels of %v %v: %w", d.kind, name, err)
+				}
+				if !prune.Selector.Matches(labels) {
+					continue
+				}
+			}
+			plan.Operations = append(plan.Operations, Operation{Op: OperationDelete, Kind: d.kind, Name: name})
+		}
+	}
+
+	for i := len(kinds) - 1; i >= 0; i-- {
+		d := kinds[i]
+		for _, name := range sortedNames(d.desired) {
+			operation := Operation{Op: OperationCreate, Kind: d.kind, Name: name}
+			if prune != nil && len(prune.Selector) > 0 {
+				operation.Labels = map[string]string{}
+			}
+			if current, ok := d.current[name]; ok {
+				equal, err := equalJSON(current, d.desired[name])
+				if err != nil {
+					return nil, fmt.Errorf("failed to compare %v %v: %v", d.kind, name, err)
+				}
+				labeled := true
+				if operation.Labels != nil {
+					labels, err := s.Labels.Get(ctx, d.kind, name)
+					if err != nil {
+						return nil, fmt.Errorf("failed to get labels of %v %v: %w", d.kind, name, err)
+					}
+					labeled = prune.Selector.Matches(labels)
+					for key, value := range labels {
+						operation.Labels[key] = value
+					}
+				}
+				if equal && labeled {
+					plan.Unchanged++
+					continue
+				}
+				operation.Op = OperationUpdate
+			}
+			if operation.Labels != nil {
+				for key, value := range prune.Selector {
+					operation.Labels[key] = value
+				}
+			}
+			switch d.kind {
+			case KindRouter:
+				operation.Router = desired.HTTP.Routers[name]
+			case KindService:
+				operation.Service = desired.HTTP.Services[name]
+			case KindMiddleware:
+				operation.Middleware = desired.HTTP.Middlewares[name]
+			}
+			plan.Operations = append(plan.Operations, operation)
+		}
+	}
+
+	return plan, nil
+}
+
+func routerValues(routers map[string]*dynamic.Router) map[string]interface{} {
+	values := make(map[string]interface{}, len(routers))
+	for name, router := range routers {
+		values[name] = router
+	}
+	return values
+}
+
+func serviceValues(services map[string]*dynamic.Service) map[string]interface{} {
+	values := make(map[string]interface{}, len(services))
+	for name, service := range services {
+		values[name] = service
+	}
+	return values
+}
+
+func middlewareValues(middlewares map[string]*dynamic.Middleware) map[string]interface{} {
+	values := make(map[string]interface{}, len(middlewares))
+	for name, middleware := range middlewares {
+		values[name] = middleware
+	}
+	return values
+}
+
+func sortedNames(values map[string]interface{}) []string {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// equalJSON compares the json encoding, which is what the stores persist
+func equalJSON(a, b interface{}) (bool, error) {
+	x, err := json.Marshal(a)
+	if err != nil {
+		return false, err
+	}
+	y, err := json.Marshal(b)
+	if err != nil {
+		return false, err
+	}
+	return string(x) == string(y), nil
+}
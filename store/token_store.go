@@ -0,0 +1,40 @@
+package store
+
+import (
+	"context"
+	"time"
+)
+
+// Token is an api token, only the hash of its secret is stored
+type Token struct {
+	ID     string   `json:"id"`
+	Name   string   `json:"name,omitempty"`
+	Hash   string   `json:"hash,omitempty"`
+	Scopes []string `json:"scopes"`
+	// CreatedBy is the identity which issued the token
+	CreatedBy string `json:"createdBy,omitempty"`
+	// Subjects are the rbac subjects of the identity which issued the token without its groups, the token is bound
+	// to their roles besides its own subject token:<id>
+	Subjects []string  `json:"subjects,omitempty"`
+	Created  time.Time `json:"created"`
+	// Expires is nil for tokens which do not expire
+	Expires  *time.Time `json:"expires,omitempty"`
+	LastUsed *time.Time `json:"lastUsed,omitempty"`
+	Revoked  *time.Time `json:"revoked,omitempty"`
+}
+
+// Valid reports whether the token may be used at the given time
+func (t *Token) Valid(now time.Time) bool {
+	return t.Revoked == nil && (t.Expires == nil || now.Before(*t.Expires))
+}
+
+type TokenStore interface {
+	List(ctx context.Context) ([]*Token, error)
+	Get(ctx context.Context, id string) (*Token, error)
+	Set(ctx context.Context, token *Token) error
+	// Touch records the last use of the token, the other fields are kept as they are stored, so a concurrent
+	// revocation is not undone
+	Touch(ctx context.Context, id string, used time.Time) error
+	// Revoke marks the token as revoked at the given time, a token which is already revoked keeps its revocation time
+	Revoke(ctx context.Context, id string, revoked time.Time) error
+}
@@ -0,0 +1,115 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+func NewTokenStoreJSON(tokenDir string) (*TokenStoreJSON, error) {
+	err := os.MkdirAll(tokenDir, os.ModePerm)
+	return &TokenStoreJSON{tokenDir: tokenDir, prefix: "token_"}, err
+}
+
+// TokenStoreJSON keeps every token in its own file, revoked tokens are kept as well
+type TokenStoreJSON struct {
+	tokenDir string
+	prefix   string
+
+	// writes are serialized, so the read-modify-writes of Touch and Revoke do not overwrite each other
+	mutex sync.Mutex
+}
+
+func (s *TokenStoreJSON) filepath(id string) string {
+	return filepath.Join(s.tokenDir, s.prefix+id+jsonExtension)
+}
+
+func (s *TokenStoreJSON) List(ctx context.Context) ([]*Token, error) {
+	infos, err := ioutil.ReadDir(s.tokenDir)
+	if err != nil {
+		return nil, fileError(err, "failed to read %v", s.tokenDir)
+	}
+	tokens := make([]*Token, 0)
+	for _, info := range infos {
+		if info.IsDir() || !resourceFile(info.Name(), s.prefix) {
+			continue
+		}
+		token, err := s.Get(ctx, resourceName(info.Name(), s.prefix))
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, nil
+}
+
+func (s *TokenStoreJSON) Get(ctx context.Context, id string) (*Token, error) {
+	err := checkName(id)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(s.filepath(id), os.O_RDONLY, os.ModePerm)
+	if err != nil {
+		return nil, fileError(err, "failed to open token %v", id)
+	}
+	defer f.Close()
+
+	token := Token{}
+	err = json.NewDecoder(f).Decode(&token)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode token %v: %v", id, err)
+	}
+
+	return &token, nil
+}
+
+func (s *TokenStoreJSON) Set(ctx context.Context, token *Token) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.write(token)
+}
+
+func (s *TokenStoreJSON) Touch(ctx context.Context, id string, used time.Time) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	token, err := s.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	token.LastUsed = &used
+	return s.write(token)
+}
+
+func (s *TokenStoreJSON) Revoke(ctx context.Context, id string, revoked time.Time) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	token, err := s.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	if token.Revoked != nil {
+		return nil
+	}
+	token.Revoked = &revoked
+	return s.write(token)
+}
+
+func (s *TokenStoreJSON) write(token *Token) error {
+	err := checkName(token.ID)
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomic(s.filepath(token.ID), secretFileMode, func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(token)
+	})
+	if err != nil {
+		return fileError(err, "failed to write token %v", token.ID)
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package store
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTokenStoreRevoke(t *testing.T) {
+	ctx := context.Background()
+	tokens, err := NewTokenStoreJSON(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	created := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	err = tokens.Set(ctx, &Token{ID: "a", Scopes: []string{"*:write"}, Created: created})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// uses and the revocation race, the revocation must not be overwritten by a use
+	revoked := created.Add(time.Hour)
+	var wg sync.WaitGroup
+	for n := 0; n < 20; n++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			if n == 10 {
+				if err := tokens.Revoke(ctx, "a", revoked); err != nil {
+					t.Error(err)
+				}
+				return
+			}
+			if err := tokens.Touch(ctx, "a", created.Add(time.Duration(n)*time.Minute)); err != nil {
+				t.Error(err)
+			}
+		}(n)
+	}
+	wg.Wait()
+
+	token, err := tokens.Get(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.Revoked == nil || !token.Revoked.Equal(revoked) || token.Valid(revoked.Add(time.Minute)) {
+		t.Errorf("revoked = %v, want %v", token.Revoked, revoked)
+	}
+
+	// a second revocation keeps the time of the first one
+	err = tokens.Revoke(ctx, "a", revoked.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err = tokens.Get(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !token.Revoked.Equal(revoked) {
+		t.Errorf("revoked = %v, want %v", token.Revoked, revoked)
+	}
+
+	if err := tokens.Revoke(ctx, "missing", revoked); err == nil {
+		t.Error("a missing token was revoked")
+	}
+}
@@ -0,0 +1,387 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/traefik/traefik/v2/pkg/config/dynamic"
+)
+
+const (
+	KindRouter     = "router"
+	KindService    = "service"
+	KindMiddleware = "middleware"
+)
+
+const (
+	OperationCreate = "create"
+	OperationUpdate = "update"
+	OperationDelete = "delete"
+)
+
+// Operation is a single write in a transaction, the resource is taken from the field matching the kind
+type Operation struct {
+	Op   string `json:"op"`
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+	// Version is optional, if it is set the operation only succeeds if the resource has this version
+	Version    string              `json:"version,omitempty"`
+	Router     *dynamic.Router     `json:"router,omitempty"`
+	Service    *dynamic.Service    `json:"service,omitempty"`
+	Middleware *dynamic.Middleware `json:"middleware,omitempty"`
+	// Labels replace the labels of the resource if they are set
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// OperationError is returned if an operation of a transaction can not be applied to the current state
+type OperationError struct {
+	Index int
+	Err   error
+}
+
+func (o *OperationError) Error() string {
+	return fmt.Sprintf("operation %v: %v", o.Index, o.Err)
+}
+
+func (o *OperationError) Unwrap() error {
+	return o.Err
+}
+
+// Stores bundles the http stores and applies transactions across all of them
+type Stores struct {
+	Routers     HTTPRouterStore
+	Services    HTTPServiceStore
+	Middlewares HTTPMiddlewareStore
+	// Labels is optional
+	Labels LabelStore
+	// Journal is optional, without it a transaction interrupted by a crash is left partially applied
+	Journal *Journal
+
+	// transactions are serialized so that validation and commit see the same state
+	mutex sync.Mutex
+}
+
+type key struct {
+	kind string
+	name string
+}
+
+// snapshot is the state of a resource before the transaction touched it
+type snapshot struct {
+	key
+	exists bool
+	value  interface{}
+	labels map[string]string
+}
+
+// Apply validates all operations against the current state and applies them in order,
+// if one of them fails all previous ones are rolled back. The events of the writes are emitted
+// once the transaction is committed.
+func (s *Stores) Apply(ctx context.Context, operations []Operation) ([]string, error) {
+	return s.transaction(ctx, func(ctx context.Context) ([]Operation, error) {
+		return operations, nil
+	})
+}
+
+// Put creates or replaces the resources of one kind in a single transaction, whether a resource is created
+// or updated is decided while the stores are locked
+func (s *Stores) Put(ctx context.Context, kind string, values map[string]interface{}) error {
+	_, err := s.transaction(ctx, func(ctx context.Context) ([]Operation, error) {
+		names := make([]string, 0, len(values))
+		for name := range values {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		operations := make([]Operation, 0, len(names))
+		for _, name := range names {
+			operation := Operation{Op: OperationUpdate, Kind: kind, Name: name}
+			_, err := s.version(ctx, key{kind: kind, name: name})
+			if errors.Is(err, ErrNotFound) || errors.Is(err, ErrInvalidName) {
+				// invalid names are rejected by the validation
+				operation.Op = OperationCreate
+			} else if err != nil {
+				return nil, fmt.Errorf("failed to get the version of %v %v: %w", kind, name, err)
+			}
+			switch value := values[name].(type) {
+			case *dynamic.Router:
+				operation.Router = value
+			case *dynamic.Service:
+				operation.Service = value
+			case *dynamic.Middleware:
+				operation.Middleware = value
+			}
+			operations = append(operations, operation)
+		}
+		return operations, nil
+	})
+	return err
+}
+
+// Validate checks the operations against the current state like Apply without applying them, e.g. for a dry run
+func (s *Stores) Validate(ctx context.Context, operations []Operation) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	ctx, unlock, err := s.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	_, err = s.validate(ctx, operations)
+	return err
+}
+
+// transaction applies the operations returned by plan, which is called once the stores are locked
+func (s *Stores) transaction(ctx context.Context, plan func(ctx context.Context) ([]Operation, error)) ([]string, error) {
+	// the events are held back until the locks are released, the events of a rolled back transaction are dropped
+	ctx, pending := withPendingEvents(ctx)
+	versions, err := s.transactionLocked(ctx, plan)
+	pending.flush(err == nil)
+	return versions, err
+}
+
+func (s *Stores) transactionLocked(ctx context.Context, plan func(ctx context.Context) ([]Operation, error)) ([]string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// other processes working on the same directories are locked out for the whole transaction
+	ctx, unlock, err := s.lock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	operations, err := plan(ctx)
+	if err != nil {
+		return nil, err
+	}
+	snapshots, err := s.validate(ctx, operations)
+	if err != nil {
+		return nil, err
+	}
+	if s.Journal != nil {
+		err = s.Journal.write(snapshots)
+		if err != nil {
+			return nil, fmt.Errorf("failed to write the journal: %w", err)
+		}
+	}
+
+	versions := make([]string, len(operations))
+	for i, operation := range operations {
+		err = s.apply(ctx, operation)
+		if err == nil && operation.Op != OperationDelete {
+			versions[i], err = s.version(ctx, key{kind: operation.Kind, name: operation.Name})
+		}
+		if err != nil {
+			rollbackErr := s.rollback(ctx, snapshots)
+			if rollbackErr != nil {
+				// the journal is kept so the rollback is retried on the next start
+				return nil, fmt.Errorf("failed to apply operation %v: %w, rollback failed: %v", i, err, rollbackErr)
+			}
+			s.clearJournal()
+			return nil, fmt.Errorf("failed to apply operation %v, rolled back: %w", i, err)
+		}
+	}
+
+	s.clearJournal()
+	return versions, nil
+}
+
+// clearJournal removes the journal of a finished transaction, the transaction is finished even if that fails
+func (s *Stores) clearJournal() {
+	if s.Journal == nil {
+		return
+	}
+	err := s.Journal.clear()
+	if err != nil {
+		fmt.Printf("failed to remove the journal, the next start rolls back the last transaction: %v\n", err)
+	}
+}
+
+// lock acquires the store-wide locks of all stores in a fixed order
+func (s *Stores) lock(ctx context.Context) (context.Context, func(), error) {
+	unlocks := make([]func(), 0, 3)
+	unlock := func() {
+		for i := len(unlocks) - 1; i >= 0; i-- {
+			unlocks[i]()
+		}
+	}
+	for _, locker := range []func(ctx context.Context) (context.Context, func(), error){s.Routers.Lock, s.Services.Lock, s.Middlewares.Lock} {
+		locked, u, err := locker(ctx)
+		if err != nil {
+			unlock()
+			return nil, nil, err
+		}
+		ctx = locked
+		unlocks = append(unlocks, u)
+	}
+	return ctx, unlock, nil
+}
+
+// validate checks every operation against the state the previous operations would leave behind
+// and returns the snapshots of all touched resources in the order they were touched
+func (s *Stores) validate(ctx context.Context, operations []Operation) ([]snapshot, error) {
+	snapshots := make([]snapshot, 0)
+	exists := map[key]bool{}
+
+	for i, operation := range operations {
+		k := key{kind: operation.Kind, name: operation.Name}
+		if err := checkName(operation.Name); err != nil {
+			return nil, &OperationError{Index: i, Err: err}
+		}
+		if operation.Kind != KindRouter && operation.Kind != KindService && operation.Kind != KindMiddleware {
+			return nil, &OperationError{Index: i, Err: fmt.Errorf("unknown kind %v", operation.Kind)}
+		}
+
+		current, touched := exists[k]
+		if !touched {
+			version, err := s.version(ctx, k)
+			if err != nil && !errors.Is(err, ErrNotFound) {
+				return nil, fmt.Errorf("failed to get the version of %v %v: %w", k.kind, k.name, err)
+			}
+			current = err == nil
+			snap := snapshot{key: k, exists: current}
+			if current {
+				if operation.Version != "" && operation.Version != version {
+					return nil, &OperationError{Index: i, Err: fmt.Errorf("%w: %v %v has version %v", ErrConflict, k.kind, k.name, version)}
+				}
+				snap.value, err = s.get(ctx, k)
+				if err != nil {
+					return nil, fmt.Errorf("failed to get %v %v: %w", k.kind, k.name, err)
+				}
+				if s.Labels != nil {
+					snap.labels, err = s.Labels.Get(ctx, k.kind, k.name)
+					if err != nil {
+						return nil, fmt.Errorf("failed to get labels of %v %v: %w", k.kind, k.name, err)
+					}
+				}
+			}
+			snapshots = append(snapshots, snap)
+		} else if operation.Version != "" {
+			return nil, &OperationError{Index: i, Err: fmt.Errorf("%w: version can only be checked by the first operation on %v %v", ErrConflict, k.kind, k.name)}
+		}
+
+		switch operation.Op {
+		case OperationCreate:
+			if current {
+				return nil, &OperationError{Index: i, Err: fmt.Errorf("%v %v %w", k.kind, k.name, ErrAlreadyExists)}
+			}
+		case OperationUpdate, OperationDelete:
+			if !current {
+				return nil, &OperationError{Index: i, Err: fmt.Errorf("%v %v %w", k.kind, k.name, ErrNotFound)}
+			}
+		default:
+			return nil, &OperationError{Index: i, Err: fmt.Errorf("unknown operation %v", operation.Op)}
+		}
+		if operation.Op != OperationDelete && operation.value() == nil {
+			return nil, &OperationError{Index: i, Err: fmt.Errorf("%v is missing", k.kind)}
+		}
+		exists[k] = operation.Op != OperationDelete
+	}
+
+	return snapshots, nil
+}
+
+// rollback restores the snapshots in reverse order
+func (s *Stores) rollback(ctx context.Context, snapshots []snapshot) error {
+	// the request context may already be done, the rollback has to finish anyway but keeps the locks
+	ctx = detached{ctx}
+	failed := make([]string, 0)
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		snap := snapshots[i]
+		var err error
+		if snap.exists {
+			err = s.set(ctx, snap.key, snap.value)
+			if err == nil && s.Labels != nil {
+				err = s.Labels.Set(ctx, snap.kind, snap.name, snap.labels)
+			}
+		} else if _, versionErr := s.version(ctx, snap.key); versionErr == nil {
+			err = s.delete(ctx, snap.key)
+		}
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%v %v: %v", snap.kind, snap.name, err))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to restore %v", failed)
+	}
+	return nil
+}
+
+func (s *Stores) apply(ctx context.Context, operation Operation) error {
+	k := key{kind: operation.Kind, name: operation.Name}
+	if operation.Op == OperationDelete {
+		return s.delete(ctx, k)
+	}
+	err := s.set(ctx, k, operation.value())
+	if err != nil || s.Labels == nil || operation.Labels == nil {
+		return err
+	}
+	return s.Labels.Set(ctx, k.kind, k.name, operation.Labels)
+}
+
+func (o Operation) value() interface{} {
+	switch {
+	case o.Kind == KindRouter && o.Router != nil:
+		return o.Router
+	case o.Kind == KindService && o.Service != nil:
+		return o.Service
+	case o.Kind == KindMiddleware && o.Middleware != nil:
+		return o.Middleware
+	}
+	return nil
+}
+
+func (s *Stores) get(ctx context.Context, k key) (interface{}, error) {
+	switch k.kind {
+	case KindRouter:
+		return s.Routers.Get(ctx, k.name)
+	case KindService:
+		return s.Services.Get(ctx, k.name)
+	default:
+		return s.Middlewares.Get(ctx, k.name)
+	}
+}
+
+func (s *Stores) set(ctx context.Context, k key, value interface{}) error {
+	switch k.kind {
+	case KindRouter:
+		return s.Routers.Set(ctx, k.name, value.(*dynamic.Router))
+	case KindService:
+		return s.Services.Set(ctx, k.name, value.(*dynamic.Service))
+	default:
+		return s.Middlewares.Set(ctx, k.name, value.(*dynamic.Middleware))
+	}
+}
+
+func (s *Stores) delete(ctx context.Context, k key) error {
+	var err error
+	switch k.kind {
+	case KindRouter:
+		err = s.Routers.Delete(ctx, k.name)
+	case KindService:
+		err = s.Services.Delete(ctx, k.name)
+	default:
+		err = s.Middlewares.Delete(ctx, k.name)
+	}
+	if err != nil || s.Labels == nil {
+		return err
+	}
+	return s.Labels.Delete(ctx, k.kind, k.name)
+}
+
+func (s *Stores) version(ctx context.Context, k key) (string, error) {
+	switch k.kind {
+	case KindRouter:
+		return s.Routers.Version(ctx, k.name)
+	case KindService:
+		return s.Services.Version(ctx, k.name)
+	default:
+		return s.Middlewares.Version(ctx, k.name)
+	}
+}
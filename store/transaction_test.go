@@ -0,0 +1,149 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/traefik/traefik/v2/pkg/config/dynamic"
+)
+
+func newStores(t *testing.T, dir string) *Stores {
+	routers, err := NewHTTPRouterStoreJSON(filepath.Join(dir, "routers"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	services, err := NewHTTPServiceStoreJSON(filepath.Join(dir, "services"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	middlewares, err := NewHTTPMiddlewareStoreJSON(filepath.Join(dir, "middlewares"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Stores{Routers: routers, Services: services, Middlewares: middlewares}
+}
+
+func TestStoresValidate(t *testing.T) {
+	ctx := context.Background()
+	stores := newStores(t, t.TempDir())
+	router := &dynamic.Router{Rule: "Host(`example.com`)", Service: "web"}
+	_, err := stores.Apply(ctx, []Operation{{Op: OperationCreate, Kind: KindRouter, Name: "web", Router: router}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		operations []Operation
+		index      int
+		err        error
+	}{
+		{name: "valid", operations: []Operation{
+			{Op: OperationUpdate, Kind: KindRouter, Name: "web", Router: router},
+			{Op: OperationCreate, Kind: KindRouter, Name: "api", Router: router},
+		}, index: -1},
+		{name: "create of an existing resource", operations: []Operation{
+			{Op: OperationCreate, Kind: KindRouter, Name: "api", Router: router},
+			{Op: OperationCreate, Kind: KindRouter, Name: "web", Router: router},
+		}, index: 1, err: ErrAlreadyExists},
+		{name: "update of a missing resource", operations: []Operation{{Op: OperationUpdate, Kind: KindRouter, Name: "api", Router: router}}, err: ErrNotFound},
+		{name: "create after delete", operations: []Operation{
+			{Op: OperationDelete, Kind: KindRouter, Name: "web"},
+			{Op: OperationCreate, Kind: KindRouter, Name: "web", Router: router},
+		}, index: -1},
+		{name: "outdated version", operations: []Operation{{Op: OperationUpdate, Kind: KindRouter, Name: "web", Version: "1", Router: router}}, err: ErrConflict},
+		{name: "invalid name", operations: []Operation{{Op: OperationCreate, Kind: KindRouter, Name: "../web", Router: router}}, err: ErrInvalidName},
+		{name: "unknown kind", operations: []Operation{{Op: OperationCreate, Kind: "tcp", Name: "web", Router: router}}},
+		{name: "missing value", operations: []Operation{{Op: OperationCreate, Kind: KindService, Name: "web", Router: router}}},
+	}
+	for _, test := range tests {
+		err := stores.Validate(ctx, test.operations)
+		if test.index < 0 {
+			if err != nil {
+				t.Errorf("%v: Validate = %v, want nil", test.name, err)
+			}
+			continue
+		}
+		var operationErr *OperationError
+		if !errors.As(err, &operationErr) || operationErr.Index != test.index || (test.err != nil && !errors.Is(err, test.err)) {
+			t.Errorf("%v: Validate = %v, want an error of operation %v", test.name, err, test.index)
+		}
+	}
+
+	// nothing was written
+	page, err := stores.Routers.Names(ctx, ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Names) != 1 || page.Names[0] != "web" {
+		t.Errorf("routers = %v, want web", page.Names)
+	}
+}
+
+func TestStoresRecover(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	keyring := newKeyring(t, newKey(t, "a"))
+	journal := filepath.Join(dir, "transaction.journal")
+	stores := newStores(t, dir)
+	stores.Journal = NewJournal(journal, keyring)
+
+	router := &dynamic.Router{Rule: "Host(`example.com`)", Service: "web"}
+	_, err := stores.Apply(ctx, []Operation{{Op: OperationCreate, Kind: KindRouter, Name: "web", Router: router}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(journal); !os.IsNotExist(err) {
+		t.Fatalf("the journal of a committed transaction was kept: %v", err)
+	}
+
+	// a crash after the first operation leaves the journal and a partially applied transaction behind
+	operations := []Operation{
+		{Op: OperationUpdate, Kind: KindRouter, Name: "web", Router: &dynamic.Router{Rule: "Host(`other.example.com`)", Service: "web"}},
+		{Op: OperationCreate, Kind: KindRouter, Name: "api", Router: router},
+	}
+	snapshots, err := stores.validate(ctx, operations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = stores.Journal.write(snapshots)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = stores.apply(ctx, operations[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(journal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(content), "example.com") {
+		t.Errorf("the journal is not encrypted: %s", content)
+	}
+
+	restarted := newStores(t, dir)
+	restarted.Journal = NewJournal(journal, keyring)
+	recovered, err := restarted.Recover(ctx)
+	if err != nil || !recovered {
+		t.Fatalf("Recover = %v, %v, want true", recovered, err)
+	}
+	restored, err := restarted.Routers.Get(ctx, "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.Rule != router.Rule {
+		t.Errorf("rule = %v, want %v", restored.Rule, router.Rule)
+	}
+	if _, err := os.Stat(journal); !os.IsNotExist(err) {
+		t.Errorf("the journal was kept after the recovery: %v", err)
+	}
+	if recovered, err := restarted.Recover(ctx); err != nil || recovered {
+		t.Errorf("second Recover = %v, %v, want false", recovered, err)
+	}
+}
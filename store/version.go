@@ -0,0 +1,12 @@
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// contentVersion returns a version identifying the stored content of a resource, it changes with every modification
+func contentVersion(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
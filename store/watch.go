@@ -0,0 +1,110 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Watcher is implemented by stores which notice changes made by other processes
+type Watcher interface {
+	// Watch emits events for changed files until the context is done
+	Watch(ctx context.Context) error
+}
+
+// resourceName is the name of the resource stored in the file
+func resourceName(fileName, prefix string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(fileName, prefix), jsonExtension)
+}
+
+// scan records the versions of the resource files in the directory
+func scan(dir, prefix string, n *notifier) error {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		if info.IsDir() || !resourceFile(info.Name(), prefix) {
+			continue
+		}
+		content, err := ioutil.ReadFile(filepath.Join(dir, info.Name()))
+		if err != nil {
+			return err
+		}
+		n.seen(resourceName(info.Name(), prefix), content)
+	}
+	return nil
+}
+
+// watch refreshes the notifier for every resource file created, written, renamed or removed in the directory
+func watch(ctx context.Context, dir, prefix string, l locker, n *notifier) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to create a watcher for %v: %v", dir, err)
+	}
+	defer watcher.Close()
+	err = watcher.Add(dir)
+	if err != nil {
+		return fmt.Errorf("failed to watch %v: %v", dir, err)
+	}
+
+	refresh := func(fileName string) {
+		ctx, cancel := context.WithTimeout(ctx, time.Second*10)
+		defer cancel()
+		name := resourceName(fileName, prefix)
+		unlock, err := l.lockResource(ctx, fileName, false)
+		if err != nil {
+			fmt.Printf("failed to lock %v: %v\n", fileName, err)
+			return
+		}
+		defer unlock()
+		err = n.refresh(ctx, name, filepath.Join(dir, fileName))
+		if err != nil {
+			fmt.Printf("ignoring the change of %v: %v\n", fileName, err)
+		}
+	}
+
+	// changes between creating the store and starting the watch are picked up as well
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return fileError(err, "failed to read %v", dir)
+	}
+	for _, info := range infos {
+		if !info.IsDir() && resourceFile(info.Name(), prefix) {
+			refresh(info.Name())
+		}
+	}
+	for _, name := range n.names() {
+		if _, err := os.Stat(filepath.Join(dir, prefix+name+jsonExtension)); os.IsNotExist(err) {
+			refresh(prefix + name + jsonExtension)
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			// temporary files, locks and quarantined files are not resources
+			fileName := filepath.Base(event.Name)
+			if filepath.Dir(event.Name) != filepath.Clean(dir) || !resourceFile(fileName, prefix) {
+				continue
+			}
+			refresh(fileName)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			fmt.Printf("failed to watch %v: %v\n", dir, err)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+// Webhook is a subscription to the changes of the stores, empty filters match everything
+type Webhook struct {
+	ID  string `json:"id"`
+	URL string `json:"url"`
+	// Secret is the key of the HMAC signature of the payloads
+	Secret     string    `json:"secret,omitempty"`
+	Kinds      []string  `json:"kinds,omitempty"`
+	Operations []string  `json:"operations,omitempty"`
+	Created    time.Time `json:"created"`
+	// Creator is the identity which created the webhook, only the events of resources it may get are delivered
+	Creator *Creator `json:"creator,omitempty"`
+}
+
+// Creator is what the webhook is authorized by, the subjects are the rbac subjects of the identity without its
+// groups and the scopes the scopes it had
+type Creator struct {
+	Name     string   `json:"name"`
+	Subjects []string `json:"subjects,omitempty"`
+	Scopes   []string `json:"scopes,omitempty"`
+}
+
+// Matches reports whether the webhook is subscribed to the event
+func (w *Webhook) Matches(event Event) bool {
+	if len(w.Kinds) > 0 && !contains(w.Kinds, event.Kind) {
+		return false
+	}
+	return len(w.Operations) == 0 || contains(w.Operations, event.Op)
+}
+
+// Delivery is a single attempt to send a payload to a webhook
+type Delivery struct {
+	ID      string          `json:"id"`
+	Webhook string          `json:"webhook"`
+	Attempt int             `json:"attempt"`
+	Time    time.Time       `json:"time"`
+	Payload json.RawMessage `json:"payload"`
+	// Status is the status of the response, it is 0 if no response was received
+	Status int    `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+	// Duration is the time the request took in milliseconds
+	Duration int64 `json:"duration"`
+}
+
+// PendingDelivery is a payload which is retried, it is kept until it is delivered or all attempts failed so
+// retries survive a restart
+type PendingDelivery struct {
+	ID      string `json:"id"`
+	Webhook string `json:"webhook"`
+	// Attempt is the number of the next attempt, Next the time it is made at
+	Attempt int             `json:"attempt"`
+	Next    time.Time       `json:"next"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+type WebhookStore interface {
+	List(ctx context.Context) ([]*Webhook, error)
+	Get(ctx context.Context, id string) (*Webhook, error)
+	Set(ctx context.Context, webhook *Webhook) error
+	Delete(ctx context.Context, id string) error
+	// AddDelivery appends to the delivery log of the webhook, only the latest deliveries are kept
+	AddDelivery(ctx context.Context, delivery *Delivery) error
+	// Deliveries returns the delivery log of the webhook, the latest delivery first
+	Deliveries(ctx context.Context, id string) ([]*Delivery, error)
+	// SetPending stores a delivery which is retried, it replaces the one with the same id
+	SetPending(ctx context.Context, pending *PendingDelivery) error
+	// DeletePending removes a pending delivery, it is not an error if it does not exist
+	DeletePending(ctx context.Context, webhook, id string) error
+	// Pending returns the pending deliveries of all webhooks, the next one first
+	Pending(ctx context.Context) ([]*PendingDelivery, error)
+}
@@ -0,0 +1,242 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// maxDeliveries is the number of deliveries kept per webhook
+const maxDeliveries = 100
+
+func NewWebhookStoreJSON(webhookDir string) (*WebhookStoreJSON, error) {
+	err := os.MkdirAll(filepath.Join(webhookDir, "deliveries"), os.ModePerm)
+	if err == nil {
+		err = os.MkdirAll(filepath.Join(webhookDir, "pending"), os.ModePerm)
+	}
+	return &WebhookStoreJSON{webhookDir: webhookDir, prefix: "webhook_"}, err
+}
+
+// WebhookStoreJSON keeps every webhook in its own file, the delivery log of a webhook in deliveries/<id>.json and
+// its pending deliveries in pending/<id>/<delivery id>.json
+type WebhookStoreJSON struct {
+	webhookDir string
+	prefix     string
+
+	// deliveries are appended by concurrent retries
+	mutex sync.Mutex
+}
+
+func (s *WebhookStoreJSON) filepath(id string) string {
+	return filepath.Join(s.webhookDir, s.prefix+id+jsonExtension)
+}
+
+func (s *WebhookStoreJSON) deliveriesPath(id string) string {
+	return filepath.Join(s.webhookDir, "deliveries", id+jsonExtension)
+}
+
+func (s *WebhookStoreJSON) pendingDir(id string) string {
+	return filepath.Join(s.webhookDir, "pending", id)
+}
+
+func (s *WebhookStoreJSON) List(ctx context.Context) ([]*Webhook, error) {
+	infos, err := ioutil.ReadDir(s.webhookDir)
+	if err != nil {
+		return nil, fileError(err, "failed to read %v", s.webhookDir)
+	}
+	webhooks := make([]*Webhook, 0)
+	for _, info := range infos {
+		if info.IsDir() || !resourceFile(info.Name(), s.prefix) {
+			continue
+		}
+		webhook, err := s.Get(ctx, resourceName(info.Name(), s.prefix))
+		if err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, webhook)
+	}
+	return webhooks, nil
+}
+
+func (s *WebhookStoreJSON) Get(ctx context.Context, id string) (*Webhook, error) {
+	err := checkName(id)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(s.filepath(id), os.O_RDONLY, os.ModePerm)
+	if err != nil {
+		return nil, fileError(err, "failed to open webhook %v", id)
+	}
+	defer f.Close()
+
+	webhook := Webhook{}
+	err = json.NewDecoder(f).Decode(&webhook)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode webhook %v: %v", id, err)
+	}
+
+	return &webhook, nil
+}
+
+func (s *WebhookStoreJSON) Set(ctx context.Context, webhook *Webhook) error {
+	err := checkName(webhook.ID)
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomic(s.filepath(webhook.ID), secretFileMode, func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(webhook)
+	})
+	if err != nil {
+		return fileError(err, "failed to write webhook %v", webhook.ID)
+	}
+	return nil
+}
+
+func (s *WebhookStoreJSON) Delete(ctx context.Context, id string) error {
+	err := checkName(id)
+	if err != nil {
+		return err
+	}
+	err = removeFile(s.filepath(id))
+	if err != nil {
+		return fileError(err, "failed to delete webhook %v", id)
+	}
+	err = os.Remove(s.deliveriesPath(id))
+	if err != nil && !os.IsNotExist(err) {
+		return fileError(err, "failed to delete the deliveries of webhook %v", id)
+	}
+	err = os.RemoveAll(s.pendingDir(id))
+	if err != nil {
+		return fileError(err, "failed to delete the pending deliveries of webhook %v", id)
+	}
+	return nil
+}
+
+func (s *WebhookStoreJSON) AddDelivery(ctx context.Context, delivery *Delivery) error {
+	err := checkName(delivery.Webhook)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	deliveries, err := s.Deliveries(ctx, delivery.Webhook)
+	if err != nil {
+		return err
+	}
+	deliveries = append([]*Delivery{delivery}, deliveries...)
+	if len(deliveries) > maxDeliveries {
+		deliveries = deliveries[:maxDeliveries]
+	}
+	err = writeFileAtomic(s.deliveriesPath(delivery.Webhook), secretFileMode, func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(deliveries)
+	})
+	if err != nil {
+		return fileError(err, "failed to write the deliveries of webhook %v", delivery.Webhook)
+	}
+	return nil
+}
+
+func (s *WebhookStoreJSON) Deliveries(ctx context.Context, id string) ([]*Delivery, error) {
+	err := checkName(id)
+	if err != nil {
+		return nil, err
+	}
+	deliveries := make([]*Delivery, 0)
+	content, err := ioutil.ReadFile(s.deliveriesPath(id))
+	if os.IsNotExist(err) {
+		return deliveries, nil
+	}
+	if err != nil {
+		return nil, fileError(err, "failed to read the deliveries of webhook %v", id)
+	}
+	err = json.Unmarshal(content, &deliveries)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode the deliveries of webhook %v: %v", id, err)
+	}
+	sort.SliceStable(deliveries, func(i, j int) bool {
+		return deliveries[i].Time.After(deliveries[j].Time)
+	})
+	return deliveries, nil
+}
+
+func (s *WebhookStoreJSON) SetPending(ctx context.Context, pending *PendingDelivery) error {
+	err := checkName(pending.Webhook)
+	if err == nil {
+		err = checkName(pending.ID)
+	}
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(s.pendingDir(pending.Webhook), os.ModePerm)
+	if err == nil {
+		path := filepath.Join(s.pendingDir(pending.Webhook), pending.ID+jsonExtension)
+		err = writeFileAtomic(path, secretFileMode, func(w io.Writer) error {
+			return json.NewEncoder(w).Encode(pending)
+		})
+	}
+	if err != nil {
+		return fileError(err, "failed to write pending delivery %v of webhook %v", pending.ID, pending.Webhook)
+	}
+	return nil
+}
+
+func (s *WebhookStoreJSON) DeletePending(ctx context.Context, webhook, id string) error {
+	err := checkName(webhook)
+	if err == nil {
+		err = checkName(id)
+	}
+	if err != nil {
+		return err
+	}
+	err = removeFile(filepath.Join(s.pendingDir(webhook), id+jsonExtension))
+	if err != nil && !os.IsNotExist(err) {
+		return fileError(err, "failed to delete pending delivery %v of webhook %v", id, webhook)
+	}
+	return nil
+}
+
+func (s *WebhookStoreJSON) Pending(ctx context.Context) ([]*PendingDelivery, error) {
+	pending := make([]*PendingDelivery, 0)
+	webhooks, err := ioutil.ReadDir(filepath.Join(s.webhookDir, "pending"))
+	if err != nil {
+		return nil, fileError(err, "failed to read the pending deliveries")
+	}
+	for _, webhook := range webhooks {
+		if !webhook.IsDir() {
+			continue
+		}
+		infos, err := ioutil.ReadDir(s.pendingDir(webhook.Name()))
+		if err != nil {
+			return nil, fileError(err, "failed to read the pending deliveries of webhook %v", webhook.Name())
+		}
+		for _, info := range infos {
+			if info.IsDir() || !resourceFile(info.Name(), "") {
+				continue
+			}
+			path := filepath.Join(s.pendingDir(webhook.Name()), info.Name())
+			content, err := ioutil.ReadFile(path)
+			if err != nil {
+				return nil, fileError(err, "failed to read pending delivery %v", path)
+			}
+			delivery := &PendingDelivery{}
+			err = json.Unmarshal(content, delivery)
+			if err != nil {
+				// a delivery which can not be decoded can not be retried either
+				fmt.Printf("skipping pending delivery %v: %v\n", path, err)
+				continue
+			}
+			pending = append(pending, delivery)
+		}
+	}
+	sort.SliceStable(pending, func(i, j int) bool {
+		return pending[i].Next.Before(pending[j].Next)
+	})
+	return pending, nil
+}
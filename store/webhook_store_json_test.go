@@ -0,0 +1,67 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestWebhookStorePending(t *testing.T) {
+	ctx := context.Background()
+	s, err := NewWebhookStoreJSON(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"a", "b"} {
+		err = s.Set(ctx, &Webhook{ID: id, URL: "https://example.com"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Now().UTC()
+	for _, pending := range []*PendingDelivery{
+		{ID: "1", Webhook: "a", Attempt: 2, Next: now.Add(time.Minute), Payload: json.RawMessage(`{"id":"1"}`)},
+		{ID: "2", Webhook: "b", Attempt: 2, Next: now, Payload: json.RawMessage(`{"id":"2"}`)},
+		{ID: "3", Webhook: "a", Attempt: 2, Next: now.Add(time.Second), Payload: json.RawMessage(`{"id":"3"}`)},
+		// the next attempt replaces the pending one
+		{ID: "1", Webhook: "a", Attempt: 3, Next: now.Add(time.Hour), Payload: json.RawMessage(`{"id":"1"}`)},
+	} {
+		err = s.SetPending(ctx, pending)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.SetPending(ctx, &PendingDelivery{ID: "../1", Webhook: "a"}); err == nil {
+		t.Error("a pending delivery with an invalid id was stored")
+	}
+
+	pending, err := s.Pending(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 3 || pending[0].ID != "2" || pending[1].ID != "3" || pending[2].ID != "1" || pending[2].Attempt != 3 {
+		t.Fatalf("pending = %+v, want 2, 3 and the third attempt of 1", pending)
+	}
+
+	err = s.DeletePending(ctx, "b", "2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.DeletePending(ctx, "b", "2")
+	if err != nil {
+		t.Errorf("deleting a missing pending delivery = %v, want nil", err)
+	}
+	// the pending deliveries of a deleted webhook are deleted with it
+	err = s.Delete(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending, err = s.Pending(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 0 {
+		t.Errorf("pending = %+v, want none", pending)
+	}
+}
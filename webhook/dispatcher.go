@@ -0,0 +1,382 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+
+	"kommandeur/store"
+)
+
+const (
+	SignatureHeader = "X-Kommandeur-Signature"
+	EventHeader     = "X-Kommandeur-Event"
+	DeliveryHeader  = "X-Kommandeur-Delivery"
+	// maxBackoff caps the exponential backoff between two attempts
+	maxBackoff = time.Hour
+	// queueSize is the number of events and retries waiting for a worker, events are dropped if it is full so
+	// writes are never blocked by slow webhooks
+	queueSize = 1000
+	workers   = 4
+)
+
+// ErrForbiddenAddress is returned for webhooks pointing to the host itself or into the internal network
+var ErrForbiddenAddress = errors.New("forbidden address")
+
+// forbiddenNetworks can only be reached through an allowed network, they include the private networks so
+// webhooks can not be used to probe the internal network
+var forbiddenNetworks = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+}
+
+// CheckAddress rejects loopback, link-local, e.g. cloud metadata services, private, unspecified and multicast
+// addresses unless they are part of one of the allowed networks
+func CheckAddress(ip net.IP, allowed []*net.IPNet) error {
+	for _, network := range allowed {
+		if network.Contains(ip) {
+			return nil
+		}
+	}
+	if ip.IsMulticast() {
+		return fmt.Errorf("%w: %v is a multicast address", ErrForbiddenAddress, ip)
+	}
+	for _, cidr := range forbiddenNetworks {
+		_, network, _ := net.ParseCIDR(cidr)
+		if network.Contains(ip) {
+			return fmt.Errorf("%w: %v is in %v", ErrForbiddenAddress, ip, network)
+		}
+	}
+	return nil
+}
+
+// Payload is the body sent to the webhooks, a retry sends the same payload with the same id
+type Payload struct {
+	ID      string          `json:"id"`
+	Op      string          `json:"op"`
+	Kind    string          `json:"kind"`
+	Name    string          `json:"name"`
+	Version string          `json:"version,omitempty"`
+	Before  json.RawMessage `json:"before,omitempty"`
+	After   json.RawMessage `json:"after,omitempty"`
+	Time    time.Time       `json:"time"`
+}
+
+// Sign returns the signature of the body as it is sent in the signature header, receivers compute it with the
+// secret of their webhook and compare it to the header
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// NewID returns a random hex id for webhooks, deliveries and secrets
+func NewID() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Dispatcher sends the events of the stores to the webhooks subscribed to them, a fixed number of workers
+// delivers them from a bounded queue
+type Dispatcher struct {
+	webhooks store.WebhookStore
+	client   *http.Client
+	// attempts is the maximum number of attempts per payload, backoff the wait after the first failed one
+	attempts int
+	backoff  time.Duration
+	// Visible is optional, it decides whether a webhook may receive an event, e.g. whether its creator may get
+	// the resource. It has to be set before the first event is dispatched.
+	Visible func(ctx context.Context, webhook *store.Webhook, event store.Event) (bool, error)
+
+	jobs chan job
+}
+
+// job is an event to dispatch or a pending delivery to retry
+type job struct {
+	event   *store.Event
+	pending *store.PendingDelivery
+}
+
+// NewDispatcher creates a dispatcher which only connects to the addresses CheckAddress accepts with the allowed
+// networks, the addresses are checked when connecting, so host names and redirects can not bypass it. The workers
+// are started and the pending deliveries of the store are retried.
+func NewDispatcher(webhooks store.WebhookStore, attempts int, backoff time.Duration, allowed []*net.IPNet) *Dispatcher {
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil {
+				return fmt.Errorf("%w: %v is not an ip address", ErrForbiddenAddress, host)
+			}
+			return CheckAddress(ip, allowed)
+		},
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	d := &Dispatcher{
+		webhooks: webhooks,
+		client:   &http.Client{Timeout: 10 * time.Second, Transport: transport},
+		attempts: attempts,
+		backoff:  backoff,
+		jobs:     make(chan job, queueSize),
+	}
+	for i := 0; i < workers; i++ {
+		go d.work()
+	}
+	go d.resume()
+	return d
+}
+
+// Notify is subscribed to the stores, it returns immediately and delivers in the background
+func (d *Dispatcher) Notify(event store.Event) {
+	select {
+	case d.jobs <- job{event: &event}:
+	default:
+		fmt.Printf("dropping the event of %v %v %v, the webhook queue is full\n", event.Op, event.Kind, event.Name)
+	}
+}
+
+func (d *Dispatcher) work() {
+	for j := range d.jobs {
+		if j.event != nil {
+			d.dispatch(*j.event)
+		} else {
+			d.retry(j.pending)
+		}
+	}
+}
+
+// resume schedules the deliveries which were pending when the process stopped
+func (d *Dispatcher) resume() {
+	pending, err := d.webhooks.Pending(context.Background())
+	if err != nil {
+		fmt.Printf("failed to read the pending webhook deliveries: %v\n", err)
+		return
+	}
+	for _, p := range pending {
+		d.schedule(p)
+	}
+}
+
+func (d *Dispatcher) dispatch(event store.Event) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	webhooks, err := d.webhooks.List(ctx)
+	if err != nil {
+		fmt.Printf("failed to list the webhooks for %v %v %v: %v\n", event.Op, event.Kind, event.Name, err)
+		return
+	}
+	for _, webhook := range webhooks {
+		if !webhook.Matches(event) {
+			continue
+		}
+		if d.Visible != nil {
+			visible, err := d.Visible(ctx, webhook, event)
+			if err != nil {
+				fmt.Printf("failed to authorize webhook %v for %v %v: %v\n", webhook.ID, event.Kind, event.Name, err)
+				continue
+			}
+			if !visible {
+				continue
+			}
+		}
+		payload, err := NewPayload(event)
+		if err != nil {
+			fmt.Printf("failed to create the payload for webhook %v: %v\n", webhook.ID, err)
+			continue
+		}
+		d.deliver(webhook, payload, 1)
+	}
+}
+
+// NewPayload creates the payload of an event with a new id, the sensitive values of middlewares are redacted
+func NewPayload(event store.Event) (*Payload, error) {
+	id, err := NewID()
+	if err != nil {
+		return nil, err
+	}
+	before, err := redact(event.Before)
+	if err != nil {
+		return nil, fmt.Errorf("failed to redact %v %v: %v", event.Kind, event.Name, err)
+	}
+	after, err := redact(event.After)
+	if err != nil {
+		return nil, fmt.Errorf("failed to redact %v %v: %v", event.Kind, event.Name, err)
+	}
+	return &Payload{
+		ID:      id,
+		Op:      event.Op,
+		Kind:    event.Kind,
+		Name:    event.Name,
+		Version: event.Version,
+		Before:  before,
+		After:   after,
+		Time:    time.Now().UTC(),
+	}, nil
+}
+
+func redact(content json.RawMessage) (json.RawMessage, error) {
+	if len(content) == 0 {
+		return nil, nil
+	}
+	return store.RedactJSON(content)
+}
+
+// deliver makes an attempt, a failed one is stored as pending and retried with exponential backoff until the
+// webhook accepts the payload or all attempts failed
+func (d *Dispatcher) deliver(webhook *store.Webhook, payload *Payload, attempt int) {
+	delivery := d.Send(context.Background(), webhook, payload, attempt)
+	if delivery.Error == "" || attempt >= d.attempts {
+		if delivery.Error != "" {
+			fmt.Printf("giving up on delivery %v to webhook %v after %v attempts: %v\n", payload.ID, webhook.ID, attempt, delivery.Error)
+		}
+		if attempt > 1 {
+			err := d.webhooks.DeletePending(context.Background(), webhook.ID, payload.ID)
+			if err != nil {
+				fmt.Printf("failed to delete pending delivery %v of webhook %v: %v\n", payload.ID, webhook.ID, err)
+			}
+		}
+		return
+	}
+
+	backoff := d.backoff
+	for i := 1; i < attempt && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxBackoff {
+		backoff = maxBackoff
+	}
+	pending := &store.PendingDelivery{
+		ID:      payload.ID,
+		Webhook: webhook.ID,
+		Attempt: attempt + 1,
+		Next:    time.Now().UTC().Add(backoff),
+		Payload: delivery.Payload,
+	}
+	// the retry is made even if it can not be stored, it is only lost on a restart then
+	err := d.webhooks.SetPending(context.Background(), pending)
+	if err != nil {
+		fmt.Printf("failed to store pending delivery %v of webhook %v: %v\n", payload.ID, webhook.ID, err)
+	}
+	d.schedule(pending)
+}
+
+// schedule queues the pending delivery when it is due, it is tried again later if the queue is full
+func (d *Dispatcher) schedule(pending *store.PendingDelivery) {
+	time.AfterFunc(time.Until(pending.Next), func() {
+		select {
+		case d.jobs <- job{pending: pending}:
+		default:
+			pending.Next = time.Now().UTC().Add(d.backoff)
+			d.schedule(pending)
+		}
+	})
+}
+
+// retry makes the next attempt of a pending delivery
+func (d *Dispatcher) retry(pending *store.PendingDelivery) {
+	// the webhook may have been deleted in the meantime
+	webhook, err := d.webhooks.Get(context.Background(), pending.Webhook)
+	if errors.Is(err, store.ErrNotFound) {
+		d.webhooks.DeletePending(context.Background(), pending.Webhook, pending.ID)
+		return
+	}
+	if err != nil {
+		fmt.Printf("failed to get webhook %v, retrying delivery %v later: %v\n", pending.Webhook, pending.ID, err)
+		pending.Next = time.Now().UTC().Add(d.backoff)
+		d.schedule(pending)
+		return
+	}
+	payload := &Payload{}
+	err = json.Unmarshal(pending.Payload, payload)
+	if err != nil {
+		fmt.Printf("dropping pending delivery %v of webhook %v: %v\n", pending.ID, pending.Webhook, err)
+		d.webhooks.DeletePending(context.Background(), pending.Webhook, pending.ID)
+		return
+	}
+	d.deliver(webhook, payload, pending.Attempt)
+}
+
+// Send makes a single attempt to deliver the payload and records it in the delivery log
+func (d *Dispatcher) Send(ctx context.Context, webhook *store.Webhook, payload *Payload, attempt int) *store.Delivery {
+	body, _ := json.Marshal(payload)
+	delivery := &store.Delivery{
+		ID:      payload.ID,
+		Webhook: webhook.ID,
+		Attempt: attempt,
+		Time:    time.Now().UTC(),
+		Payload: body,
+	}
+
+	err := d.post(ctx, webhook, payload, body, delivery)
+	delivery.Duration = time.Since(delivery.Time).Milliseconds()
+	if err != nil {
+		delivery.Error = err.Error()
+	}
+
+	err = d.webhooks.AddDelivery(context.Background(), delivery)
+	if err != nil {
+		fmt.Printf("failed to log delivery %v to webhook %v: %v\n", payload.ID, webhook.ID, err)
+	}
+	return delivery
+}
+
+func (d *Dispatcher) post(ctx context.Context, webhook *store.Webhook, payload *Payload, body []byte, delivery *store.Delivery) error {
+	req, err := http.NewRequest(http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "kommandeur-webhook")
+	event := payload.Op
+	if payload.Kind != "" {
+		event = payload.Kind + "." + payload.Op
+	}
+	req.Header.Set(EventHeader, event)
+	req.Header.Set(DeliveryHeader, payload.ID)
+	req.Header.Set(SignatureHeader, Sign(webhook.Secret, body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 1<<20))
+
+	delivery.Status = resp.StatusCode
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("the webhook responded with %v", resp.Status)
+	}
+	return nil
+}
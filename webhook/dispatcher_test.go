@@ -0,0 +1,392 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"kommandeur/store"
+)
+
+// request is a delivery received by the test receiver
+type request struct {
+	header http.Header
+	body   []byte
+}
+
+// receiver records the deliveries and responds with the statuses in order, the last one is repeated
+type receiver struct {
+	*httptest.Server
+	requests chan request
+
+	mutex    sync.Mutex
+	statuses []int
+}
+
+func newReceiver(t *testing.T, statuses ...int) *receiver {
+	r := &receiver{requests: make(chan request, 100), statuses: statuses}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		r.requests <- request{header: req.Header, body: body}
+
+		r.mutex.Lock()
+		status := http.StatusOK
+		if len(r.statuses) > 0 {
+			status = r.statuses[0]
+		}
+		if len(r.statuses) > 1 {
+			r.statuses = r.statuses[1:]
+		}
+		r.mutex.Unlock()
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+// next waits for the next delivery
+func (r *receiver) next(t *testing.T) request {
+	t.Helper()
+	select {
+	case req := <-r.requests:
+		return req
+	case <-time.After(5 * time.Second):
+		t.Fatal("no delivery was received")
+	}
+	return request{}
+}
+
+// none fails the test if a delivery is received within a short time
+func (r *receiver) none(t *testing.T) {
+	t.Helper()
+	select {
+	case req := <-r.requests:
+		t.Fatalf("unexpected delivery %s", req.body)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+var loopback = []*net.IPNet{{IP: net.IPv4(127, 0, 0, 0), Mask: net.CIDRMask(8, 32)}}
+
+func newDispatcher(t *testing.T, attempts int, allowed []*net.IPNet, webhooks ...*store.Webhook) (*Dispatcher, store.WebhookStore) {
+	s, err := store.NewWebhookStoreJSON(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, webhook := range webhooks {
+		err = s.Set(context.Background(), webhook)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return NewDispatcher(s, attempts, 10*time.Millisecond, allowed), s
+}
+
+func routerEvent(op string) store.Event {
+	return store.Event{
+		Op:      op,
+		Kind:    store.KindRouter,
+		Name:    "web",
+		Version: "1",
+		After:   json.RawMessage(`{"rule":"Host(` + "`example.com`" + `)","service":"web"}`),
+	}
+}
+
+func TestDispatcherSignsPayloads(t *testing.T) {
+	r := newReceiver(t)
+	webhook := &store.Webhook{ID: "a", URL: r.URL, Secret: "secret"}
+	d, _ := newDispatcher(t, 1, loopback, webhook)
+
+	d.Notify(routerEvent(store.OperationCreate))
+	req := r.next(t)
+
+	if got, want := req.header.Get(SignatureHeader), Sign("secret", req.body); got != want {
+		t.Errorf("signature = %v, want %v", got, want)
+	}
+	if req.header.Get(SignatureHeader) == Sign("other", req.body) {
+		t.Error("the signature does not depend on the secret")
+	}
+	if got := req.header.Get(EventHeader); got != "router.create" {
+		t.Errorf("event = %v, want router.create", got)
+	}
+	payload := Payload{}
+	err := json.Unmarshal(req.body, &payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := req.header.Get(DeliveryHeader); got != payload.ID {
+		t.Errorf("delivery = %v, want the payload id %v", got, payload.ID)
+	}
+	if payload.Op != store.OperationCreate || payload.Kind != store.KindRouter || payload.Name != "web" || payload.Version != "1" {
+		t.Errorf("payload = %+v, want the created router web", payload)
+	}
+}
+
+func TestDispatcherFilters(t *testing.T) {
+	tests := []struct {
+		name       string
+		kinds      []string
+		operations []string
+		event      store.Event
+		delivered  bool
+	}{
+		{name: "no filters", event: routerEvent(store.OperationCreate), delivered: true},
+		{name: "matching kind", kinds: []string{store.KindService, store.KindRouter}, event: routerEvent(store.OperationCreate), delivered: true},
+		{name: "other kind", kinds: []string{store.KindService}, event: routerEvent(store.OperationCreate), delivered: false},
+		{name: "matching operation", operations: []string{store.OperationDelete}, event: routerEvent(store.OperationDelete), delivered: true},
+		{name: "other operation", operations: []string{store.OperationDelete}, event: routerEvent(store.OperationUpdate), delivered: false},
+		{name: "matching kind and other operation", kinds: []string{store.KindRouter}, operations: []string{store.OperationCreate}, event: routerEvent(store.OperationDelete), delivered: false},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			r := newReceiver(t)
+			d, _ := newDispatcher(t, 1, loopback, &store.Webhook{ID: "a", URL: r.URL, Secret: "secret", Kinds: test.kinds, Operations: test.operations})
+
+			d.Notify(test.event)
+			if test.delivered {
+				r.next(t)
+			} else {
+				r.none(t)
+			}
+		})
+	}
+}
+
+func TestDispatcherRetries(t *testing.T) {
+	r := newReceiver(t, http.StatusInternalServerError, http.StatusBadGateway, http.StatusNoContent)
+	d, s := newDispatcher(t, 5, loopback, &store.Webhook{ID: "a", URL: r.URL, Secret: "secret"})
+
+	start := time.Now()
+	d.Notify(routerEvent(store.OperationCreate))
+	ids := make([]string, 0, 3)
+	for i := 0; i < 3; i++ {
+		ids = append(ids, r.next(t).header.Get(DeliveryHeader))
+	}
+	r.none(t)
+	// the backoff doubles, 10ms after the first attempt and 20ms after the second one
+	if elapsed := time.Since(start); elapsed < 30*time.Millisecond {
+		t.Errorf("three attempts took %v, want at least 30ms of backoff", elapsed)
+	}
+	if ids[0] != ids[1] || ids[1] != ids[2] {
+		t.Errorf("retries have the ids %v, want the same id", ids)
+	}
+
+	deliveries, err := s.Deliveries(context.Background(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 3 {
+		t.Fatalf("%v deliveries were logged, want 3", len(deliveries))
+	}
+	// the latest delivery is first
+	for i, want := range []struct {
+		attempt int
+		status  int
+		failed  bool
+	}{{3, http.StatusNoContent, false}, {2, http.StatusBadGateway, true}, {1, http.StatusInternalServerError, true}} {
+		delivery := deliveries[i]
+		if delivery.ID != ids[0] || delivery.Webhook != "a" || delivery.Attempt != want.attempt || delivery.Status != want.status || (delivery.Error != "") != want.failed {
+			t.Errorf("delivery %v = %+v, want attempt %v with status %v", i, delivery, want.attempt, want.status)
+		}
+		if len(delivery.Payload) == 0 {
+			t.Errorf("delivery %v has no payload", i)
+		}
+	}
+}
+
+func TestDispatcherVisible(t *testing.T) {
+	r := newReceiver(t)
+	d, _ := newDispatcher(t, 1, loopback, &store.Webhook{ID: "a", URL: r.URL, Secret: "secret"})
+	d.Visible = func(ctx context.Context, webhook *store.Webhook, event store.Event) (bool, error) {
+		return event.Name == "web", nil
+	}
+
+	other := routerEvent(store.OperationCreate)
+	other.Name = "api"
+	d.Notify(other)
+	d.Notify(routerEvent(store.OperationCreate))
+	payload := Payload{}
+	err := json.Unmarshal(r.next(t).body, &payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payload.Name != "web" {
+		t.Errorf("the event of %v was delivered, want only web", payload.Name)
+	}
+	r.none(t)
+}
+
+func TestDispatcherKeepsPendingDeliveries(t *testing.T) {
+	r := newReceiver(t, http.StatusInternalServerError)
+	d, s := newDispatcher(t, 3, loopback, &store.Webhook{ID: "a", URL: r.URL, Secret: "secret"})
+	ctx := context.Background()
+
+	d.Notify(routerEvent(store.OperationCreate))
+	id := r.next(t).header.Get(DeliveryHeader)
+	// the retry is stored before it is scheduled
+	var pending []*store.PendingDelivery
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(time.Millisecond) {
+		var err error
+		pending, err = s.Pending(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pending) > 0 {
+			break
+		}
+	}
+	if len(pending) != 1 || pending[0].ID != id || pending[0].Webhook != "a" || pending[0].Attempt != 2 {
+		t.Fatalf("pending = %+v, want the second attempt of %v", pending, id)
+	}
+	r.next(t)
+	r.next(t)
+	r.none(t)
+	if pending, err := s.Pending(ctx); err != nil || len(pending) != 0 {
+		t.Errorf("pending = %v, %v after the last attempt, want none", pending, err)
+	}
+}
+
+func TestDispatcherResumesPendingDeliveries(t *testing.T) {
+	r := newReceiver(t)
+	s, err := store.NewWebhookStoreJSON(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	err = s.Set(ctx, &store.Webhook{ID: "a", URL: r.URL, Secret: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := NewPayload(routerEvent(store.OperationCreate))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a retry which was pending when the previous process stopped
+	err = s.SetPending(ctx, &store.PendingDelivery{ID: payload.ID, Webhook: "a", Attempt: 3, Next: time.Now().Add(-time.Minute), Payload: body})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	NewDispatcher(s, 5, 10*time.Millisecond, loopback)
+	req := r.next(t)
+	if req.header.Get(DeliveryHeader) != payload.ID || string(req.body) != string(body) {
+		t.Errorf("delivery %v = %s, want the pending payload %v", req.header.Get(DeliveryHeader), req.body, payload.ID)
+	}
+	r.none(t)
+	deliveries, err := s.Deliveries(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 1 || deliveries[0].Attempt != 3 {
+		t.Errorf("deliveries = %+v, want the third attempt", deliveries)
+	}
+	if pending, err := s.Pending(ctx); err != nil || len(pending) != 0 {
+		t.Errorf("pending = %v, %v after the delivery, want none", pending, err)
+	}
+}
+
+func TestDispatcherGivesUp(t *testing.T) {
+	r := newReceiver(t, http.StatusInternalServerError)
+	d, s := newDispatcher(t, 2, loopback, &store.Webhook{ID: "a", URL: r.URL, Secret: "secret"})
+
+	d.Notify(routerEvent(store.OperationCreate))
+	r.next(t)
+	r.next(t)
+	r.none(t)
+
+	deliveries, err := s.Deliveries(context.Background(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 2 || deliveries[0].Error == "" || deliveries[1].Error == "" {
+		t.Errorf("deliveries = %+v, want 2 failed ones", deliveries)
+	}
+}
+
+func TestDispatcherRedactsPayloads(t *testing.T) {
+	r := newReceiver(t)
+	d, _ := newDispatcher(t, 1, loopback, &store.Webhook{ID: "a", URL: r.URL, Secret: "secret"})
+
+	d.Notify(store.Event{
+		Op:     store.OperationUpdate,
+		Kind:   store.KindMiddleware,
+		Name:   "auth",
+		Before: json.RawMessage(`{"basicAuth":{"users":["admin:$apr1$before"]}}`),
+		After:  json.RawMessage(`{"basicAuth":{"users":["admin:$apr1$after"]}}`),
+	})
+	req := r.next(t)
+
+	if strings.Contains(string(req.body), "$apr1$") {
+		t.Errorf("the payload contains the password hashes: %s", req.body)
+	}
+	if !strings.Contains(string(req.body), "admin:"+store.Redacted) {
+		t.Errorf("the payload does not contain the redacted users: %s", req.body)
+	}
+}
+
+func TestDispatcherRejectsForbiddenAddresses(t *testing.T) {
+	r := newReceiver(t)
+	webhook := &store.Webhook{ID: "a", URL: r.URL, Secret: "secret"}
+	d, _ := newDispatcher(t, 1, nil, webhook)
+
+	payload, err := NewPayload(routerEvent(store.OperationCreate))
+	if err != nil {
+		t.Fatal(err)
+	}
+	delivery := d.Send(context.Background(), webhook, payload, 1)
+	if !strings.Contains(delivery.Error, ErrForbiddenAddress.Error()) {
+		t.Errorf("delivery error = %q, want a forbidden address", delivery.Error)
+	}
+	r.none(t)
+}
+
+func TestCheckAddress(t *testing.T) {
+	allowed := []*net.IPNet{{IP: net.IPv4(10, 1, 0, 0), Mask: net.CIDRMask(16, 32)}}
+	tests := []struct {
+		ip        string
+		forbidden bool
+	}{
+		{ip: "93.184.216.34", forbidden: false},
+		{ip: "2606:2800:220:1:248:1893:25c8:1946", forbidden: false},
+		{ip: "127.0.0.1", forbidden: true},
+		{ip: "127.1.2.3", forbidden: true},
+		{ip: "::1", forbidden: true},
+		{ip: "::ffff:127.0.0.1", forbidden: true},
+		{ip: "0.0.0.0", forbidden: true},
+		{ip: "::", forbidden: true},
+		{ip: "169.254.169.254", forbidden: true},
+		{ip: "fe80::1", forbidden: true},
+		{ip: "fd00:ec2::254", forbidden: true},
+		{ip: "10.0.0.1", forbidden: true},
+		{ip: "172.16.0.1", forbidden: true},
+		{ip: "192.168.1.1", forbidden: true},
+		{ip: "100.64.0.1", forbidden: true},
+		{ip: "224.0.0.1", forbidden: true},
+		{ip: "10.1.2.3", forbidden: false},
+	}
+	for _, test := range tests {
+		err := CheckAddress(net.ParseIP(test.ip), allowed)
+		if test.forbidden && !errors.Is(err, ErrForbiddenAddress) {
+			t.Errorf("CheckAddress(%v) = %v, want ErrForbiddenAddress", test.ip, err)
+		}
+		if !test.forbidden && err != nil {
+			t.Errorf("CheckAddress(%v) = %v, want nil", test.ip, err)
+		}
+	}
+}